@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Mount point of the unified cgroup hierarchy, only cgroup v2 is supported to limit the mounters
+	CgroupRoot = "/sys/fs/cgroup"
+	// Child cgroup the connector moves itself into, since the cgroup enabling the controllers for its children can't have processes of its own
+	ConnectorCgroupName = "connector"
+	// Prefix of the child cgroups of the mounters, each of which is limited separately
+	MounterCgroupPrefix = "mounter-"
+	// Period of cpu.max in microseconds
+	CgroupCpuPeriod = 100000
+)
+
+// cgroupLimits are written to memory.max, cpu.max, cpu.weight and io.weight of the cgroup of a mounter, empty if not limited
+type cgroupLimits struct {
+	memoryMax, cpuMax   string
+	cpuWeight, ioWeight string
+}
+
+// mounterCgroups places each mounter into its own cgroup under the cgroup of the connector service, which must be delegated by systemd
+type mounterCgroups struct {
+	dir string
+	// Limits of all mounters given to the connector
+	cgroupLimits
+	// Both controllers are enabled to apply the limits of the volumes, even if the connector limits neither of them
+	overridable bool
+	// The io controller is also enabled for the weights of the volumes if it's available
+	ioEnabled bool
+
+	lock sync.Mutex
+	// Limits of the volumes overriding the ones of the connector by the mount paths of their mounters
+	overrides map[string]cgroupLimits
+}
+
+// mounterLimits limits the resources of the mounters, nil if none of -mounter-cgroups, -mounter-memory-limit and -mounter-cpu-limit is given
+var mounterLimits *mounterCgroups
+
+// newMounterCgroups validates the limits of the mounters, returns nil if there is no limit and the cgroups are not enabled for the volumes
+func newMounterCgroups(enabled bool, memoryLimit string, cpuLimit float64) (*mounterCgroups, error) {
+	if !enabled && memoryLimit == "" && cpuLimit == 0 {
+		return nil, nil
+	}
+	cg := &mounterCgroups{overridable: enabled, overrides: make(map[string]cgroupLimits)}
+	if memoryLimit != "" {
+		bytes, err := parseByteSize(memoryLimit)
+		if err != nil || bytes == 0 {
+			return nil, fmt.Errorf("invalid memory limit %s, expect bytes with an optional suffix of K, M, G or T", memoryLimit)
+		}
+		cg.memoryMax = formatMemoryMax(bytes)
+	}
+	if cpuLimit < 0 {
+		return nil, fmt.Errorf("invalid cpu limit %g", cpuLimit)
+	} else if cpuLimit > 0 {
+		cg.cpuMax = formatCpuMax(cpuLimit)
+	}
+	return cg, nil
+}
+
+func formatMemoryMax(bytes uint64) string {
+	return strconv.FormatUint(bytes, 10)
+}
+
+func formatCpuMax(cores float64) string {
+	return fmt.Sprintf("%d %d", int64(cores*CgroupCpuPeriod), CgroupCpuPeriod)
+}
+
+// setup moves the connector into its own child cgroup and enables the controllers of the limits for the mounters
+func (cg *mounterCgroups) setup() error {
+	var controllers []string
+	if cg.memoryMax != "" || cg.overridable {
+		controllers = append(controllers, "+memory")
+	}
+	if cg.cpuMax != "" || cg.overridable {
+		controllers = append(controllers, "+cpu")
+	}
+	if _, err := os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("cgroup v2 is required to limit the mounters: %w", err)
+	}
+	current, err := currentCgroup()
+	if err != nil {
+		return err
+	}
+	cg.dir = filepath.Join(CgroupRoot, current)
+	if filepath.Base(current) == ConnectorCgroupName {
+		// Moved already
+		cg.dir = filepath.Dir(cg.dir)
+	}
+	if cg.overridable {
+		// Not delegated to the service by every systemd, so the io weights of the volumes are ignored without it
+		if available, err := os.ReadFile(filepath.Join(cg.dir, "cgroup.controllers")); err == nil {
+			for _, controller := range strings.Fields(string(available)) {
+				if controller == "io" {
+					controllers = append(controllers, "+io")
+					cg.ioEnabled = true
+				}
+			}
+		}
+	}
+
+	connectorDir := filepath.Join(cg.dir, ConnectorCgroupName)
+	if err = ensureDirectoryExists(connectorDir); err != nil {
+		return fmt.Errorf("failed to create cgroup %s, is Delegate=yes set for the connector service: %w", connectorDir, err)
+	}
+	if err = os.WriteFile(filepath.Join(connectorDir, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return fmt.Errorf("failed to move connector into cgroup %s: %w", connectorDir, err)
+	}
+	// The others left in the cgroup of the service, e.g. the parent of the daemon not exited yet, are moved together
+	if procs, err := os.ReadFile(filepath.Join(cg.dir, "cgroup.procs")); err == nil {
+		for _, pid := range strings.Fields(string(procs)) {
+			os.WriteFile(filepath.Join(connectorDir, "cgroup.procs"), []byte(pid), 0644)
+		}
+	}
+	if err = os.WriteFile(filepath.Join(cg.dir, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644); err != nil {
+		return fmt.Errorf("failed to enable %s for the cgroups under %s: %w", strings.Join(controllers, " "), cg.dir, err)
+	}
+	// Left by the mounters killed together with the previous connector
+	if entries, err := os.ReadDir(cg.dir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasPrefix(entry.Name(), MounterCgroupPrefix) {
+				os.Remove(filepath.Join(cg.dir, entry.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+// currentCgroup returns the path of the cgroup v2 of the connector relative to CgroupRoot
+func currentCgroup() (string, error) {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path := strings.TrimPrefix(scanner.Text(), "0::"); path != scanner.Text() {
+			return path, nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no cgroup v2 found in /proc/self/cgroup")
+}
+
+func (cg *mounterCgroups) cgroupDir(mountPath string) string {
+	return filepath.Join(cg.dir, MounterCgroupPrefix+rcloneCacheId(mountPath))
+}
+
+// hasMounterOverrides returns true if the volume overrides any of the limits or the weights of its mounter
+func hasMounterOverrides(c *protocol.InitKodoMountCmd) bool {
+	return c.MounterMemoryLimit > 0 || c.MounterCpuLimit > 0 || c.MounterCpuWeight > 0 || c.MounterIoWeight > 0
+}
+
+// override limits the mounter of the mount point by the limits and the weights of its volume instead of the ones of the connector.
+// The ones whose controllers are not enabled are ignored and returned, e.g. the connector only limits the memory without -mounter-cgroups.
+func (cg *mounterCgroups) override(c *protocol.InitKodoMountCmd) (ignored []string) {
+	memoryEnabled, cpuEnabled := cg.memoryMax != "" || cg.overridable, cg.cpuMax != "" || cg.overridable
+	limits := cg.cgroupLimits
+	if c.MounterMemoryLimit > 0 {
+		if memoryEnabled {
+			limits.memoryMax = formatMemoryMax(c.MounterMemoryLimit)
+		} else {
+			ignored = append(ignored, "memory limit")
+		}
+	}
+	if c.MounterCpuLimit > 0 {
+		if cpuEnabled {
+			limits.cpuMax = formatCpuMax(c.MounterCpuLimit)
+		} else {
+			ignored = append(ignored, "cpu limit")
+		}
+	}
+	if c.MounterCpuWeight > 0 {
+		if cpuEnabled {
+			limits.cpuWeight = strconv.FormatUint(c.MounterCpuWeight, 10)
+		} else {
+			ignored = append(ignored, "cpu weight")
+		}
+	}
+	if c.MounterIoWeight > 0 {
+		if cg.ioEnabled {
+			limits.ioWeight = "default " + strconv.FormatUint(c.MounterIoWeight, 10)
+		} else {
+			ignored = append(ignored, "io weight")
+		}
+	}
+
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	cg.overrides[c.MountPath] = limits
+	return ignored
+}
+
+func (cg *mounterCgroups) limitsOf(mountPath string) cgroupLimits {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+
+	if limits, ok := cg.overrides[mountPath]; ok {
+		return limits
+	}
+	return cg.cgroupLimits
+}
+
+// place moves the mounter into the cgroup of its mount point, kept across the restarts of the mounter.
+// The processes forked by the mounter before it's moved are left in the cgroup of the connector.
+func (cg *mounterCgroups) place(mountPath string, pid int) error {
+	dir := cg.cgroupDir(mountPath)
+	if err := ensureDirectoryExists(dir); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %w", dir, err)
+	}
+	limits := cg.limitsOf(mountPath)
+	if limits.memoryMax != "" {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(limits.memoryMax), 0644); err != nil {
+			return fmt.Errorf("failed to limit memory of cgroup %s: %w", dir, err)
+		}
+	}
+	if limits.cpuMax != "" {
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(limits.cpuMax), 0644); err != nil {
+			return fmt.Errorf("failed to limit cpu of cgroup %s: %w", dir, err)
+		}
+	}
+	if limits.cpuWeight != "" {
+		if err := os.WriteFile(filepath.Join(dir, "cpu.weight"), []byte(limits.cpuWeight), 0644); err != nil {
+			return fmt.Errorf("failed to weight cpu of cgroup %s: %w", dir, err)
+		}
+	}
+	if limits.ioWeight != "" {
+		if err := os.WriteFile(filepath.Join(dir, "io.weight"), []byte(limits.ioWeight), 0644); err != nil {
+			return fmt.Errorf("failed to weight io of cgroup %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("failed to move pid %d into cgroup %s: %w", pid, dir, err)
+	}
+	return nil
+}
+
+// remove removes the cgroup of the mount point once its mounter is stopped for good
+func (cg *mounterCgroups) remove(mountPath string) {
+	cg.lock.Lock()
+	delete(cg.overrides, mountPath)
+	cg.lock.Unlock()
+
+	if err := os.Remove(cg.cgroupDir(mountPath)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove cgroup of mounter of %s: %s", mountPath, err)
+	}
+}
+
+// parseByteSize parses the bytes with an optional binary suffix, e.g. 512M or 2G
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	shift := 0
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value << shift, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+const (
+	// CleanupCommand is the subcommand force-cleaning the mounts of a stuck volume on the node
+	CleanupCommand = "cleanup"
+	// Longest time to wait for the connector daemon to stop a supervised mounter, which is killed after MounterStopTimeout
+	CleanupStopTimeout = MounterStopTimeout + 20*time.Second
+	// Longest time to wait for a killed mounter to exit
+	CleanupKillTimeout = 5 * time.Second
+	// Stacked mount points on the same path are unmounted one by one, at most so many times
+	CleanupMaxUnmounts = 10
+)
+
+// cleanupTarget is a mount path of the volume to clean up
+type cleanupTarget struct {
+	mountPath  string
+	volumeId   string
+	supervised bool
+	mounters   []mounterProcess
+}
+
+// mounterProcess is a rclone or kodofs process found in /proc, which may be left by the previous connector
+type mounterProcess struct {
+	pid       int
+	command   string
+	volumeId  string
+	mountPath string
+}
+
+// cleanupReport prints what's done, or what would be done in a dry run, and remembers whether any step failed
+type cleanupReport struct {
+	dryRun bool
+	failed bool
+}
+
+func (report *cleanupReport) done(format string, args ...interface{}) {
+	if report.dryRun {
+		format = "would " + format
+	}
+	fmt.Printf("  "+format+"\n", args...)
+}
+
+func (report *cleanupReport) fail(format string, args ...interface{}) {
+	report.failed = true
+	fmt.Printf("  failed to "+format+"\n", args...)
+}
+
+// runCleanup stops the mounters, lazily unmounts the mount points and removes the stale files of a stuck volume, returns the exit code
+func runCleanup(args []string) int {
+	flagSet := flag.NewFlagSet(CleanupCommand, flag.ContinueOnError)
+	volumeId := flagSet.String("volume-id", "", "ID of the volume, all its mount paths on the node are cleaned up")
+	targetPath := flagSet.String("target-path", "", "Mount path to clean up, e.g. the target path of a Pod")
+	force := flagSet.Bool("force", false, "Also remove the cache with the files not uploaded yet, which are lost")
+	dryRun := flagSet.Bool("dry-run", false, "Only report what would be done")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	} else if (*volumeId == "") == (*targetPath == "") || flagSet.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Exactly one of -volume-id and -target-path is required\n")
+		flagSet.Usage()
+		return 2
+	}
+	if *targetPath != "" {
+		*targetPath = filepath.Clean(*targetPath)
+	}
+	resolveRcloneDirs()
+
+	// The connector daemon may be stuck as well, the mounters found in /proc are killed anyway
+	var state struct {
+		Mounters []MounterStatus `json:"mounters"`
+	}
+	reachable := true
+	if data, err := requestDebugState(); err != nil {
+		reachable = false
+		fmt.Printf("Connector daemon is not reachable, its mounters may be restarted once killed: %s\n", err)
+	} else if err = json.Unmarshal(data, &state); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse state of connector: %s\n", err)
+		return 1
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", MountInfoPath, err)
+		return 1
+	}
+	mounters, err := findMounterProcesses()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find mounters: %s\n", err)
+		return 1
+	}
+
+	targets := findCleanupTargets(*volumeId, *targetPath, state.Mounters, mounts, mounters)
+	if len(targets) == 0 {
+		fmt.Printf("Nothing to clean up for %s%s\n", *volumeId, *targetPath)
+		return 0
+	}
+	report := &cleanupReport{dryRun: *dryRun}
+	for _, target := range targets {
+		if target.volumeId != "" {
+			fmt.Printf("Cleaning up %s of volume %s\n", target.mountPath, target.volumeId)
+		} else {
+			fmt.Printf("Cleaning up %s\n", target.mountPath)
+		}
+		cleanupMountPath(report, target, reachable, *force)
+	}
+	if report.failed {
+		return 1
+	}
+	return 0
+}
+
+// findCleanupTargets returns the mount paths of the volume id or the target path, known by the connector daemon, the mounter processes or the mount table
+func findCleanupTargets(volumeId, targetPath string, statuses []MounterStatus, mounts []mountInfo, mounters []mounterProcess) []*cleanupTarget {
+	var targets []*cleanupTarget
+	targetsByPath := make(map[string]*cleanupTarget)
+	add := func(mountPath, mountVolumeId string) *cleanupTarget {
+		target, exists := targetsByPath[mountPath]
+		if !exists {
+			target = &cleanupTarget{mountPath: mountPath}
+			targetsByPath[mountPath] = target
+			targets = append(targets, target)
+		}
+		if target.volumeId == "" {
+			target.volumeId = mountVolumeId
+		}
+		return target
+	}
+	matches := func(mountPath, mountVolumeId string) bool {
+		if targetPath != "" {
+			return mountPath == targetPath
+		}
+		return mountVolumeId == volumeId
+	}
+
+	for _, status := range statuses {
+		if matches(status.MountPath, status.VolumeId) {
+			add(status.MountPath, status.VolumeId).supervised = true
+		}
+	}
+	for _, mounter := range mounters {
+		if matches(mounter.mountPath, mounter.volumeId) {
+			target := add(mounter.mountPath, mounter.volumeId)
+			target.mounters = append(target.mounters, mounter)
+		}
+	}
+	for _, mount := range mounts {
+		if !isMounterFsType(mount.fsType) {
+			continue
+		}
+		if mount.mountPoint == targetPath || (volumeId != "" && isVolumeTargetPath(mount.mountPoint, volumeId)) {
+			add(mount.mountPoint, volumeId)
+		}
+	}
+	if targetPath != "" && len(targets) == 0 {
+		// Still cleans up the stale files left by the mounter already exited
+		if files, _ := findStaleRcloneFiles("", targetPath, false); len(files) > 0 {
+			add(targetPath, "")
+		}
+	}
+	return targets
+}
+
+// isVolumeTargetPath reports whether the path is a target path of the volume published by kubelet or Nomad, which are
+// /var/lib/kubelet/pods/<pod uid>/volumes/kubernetes.io~csi/<pv>/mount and <csi dir>/per-alloc/<alloc id>/<volume>/<rw|ro>-<mode>
+func isVolumeTargetPath(path, volumeId string) bool {
+	dir, base := filepath.Split(path)
+	if filepath.Base(dir) != volumeId {
+		return false
+	}
+	return base == "mount" || strings.HasPrefix(base, "rw-") || strings.HasPrefix(base, "ro-")
+}
+
+// cleanupMountPath cleans up the mount path in the order of the manual runbook:
+// stop the supervised mounter, kill the mounters left, lazily unmount the mount point, then remove the stale files
+func cleanupMountPath(report *cleanupReport, target *cleanupTarget, reachable, force bool) {
+	if target.supervised && reachable {
+		if report.dryRun {
+			report.done("ask the connector daemon to stop the supervised mounter")
+		} else if _, err := requestConnector(protocol.KodoUmountCmdName, &protocol.KodoUmountCmd{
+			VolumeId: target.volumeId, MountPath: target.mountPath,
+		}, CleanupStopTimeout); err != nil {
+			report.fail("stop the supervised mounter by the connector daemon: %s", err)
+		} else {
+			report.done("stopped the supervised mounter by the connector daemon")
+		}
+	}
+
+	mounters := target.mounters
+	if !report.dryRun && target.supervised && reachable {
+		// Only the mounters not stopped by the connector daemon are left
+		if all, err := findMounterProcesses(); err != nil {
+			report.fail("find mounters: %s", err)
+		} else {
+			mounters = nil
+			for _, mounter := range all {
+				if mounter.mountPath == target.mountPath {
+					mounters = append(mounters, mounter)
+				}
+			}
+		}
+	}
+	for _, mounter := range mounters {
+		if report.dryRun {
+			report.done("kill mounter %d: %s", mounter.pid, mounter.command)
+		} else if err := killMounter(mounter.pid); err != nil {
+			report.fail("kill mounter %d: %s", mounter.pid, err)
+		} else {
+			report.done("killed mounter %d: %s", mounter.pid, mounter.command)
+		}
+	}
+
+	paths := []string{target.mountPath}
+	if target.volumeId != "" {
+		// Bound by the detach command to keep the mounter alive until the cache is uploaded
+		paths = append(paths, filepath.Join(DrainingKodoMountsDir, rcloneCacheId(target.mountPath)))
+	}
+	for _, path := range paths {
+		for i := 0; i < CleanupMaxUnmounts; i++ {
+			info, err := findMountInfo(path)
+			if err != nil {
+				report.fail("detect mount point %s: %s", path, err)
+				break
+			} else if info == nil {
+				break
+			}
+			if report.dryRun {
+				report.done("unmount %s of %s lazily", info.fsType, path)
+				break
+			} else if err = syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+				report.fail("unmount %s of %s lazily: %s", info.fsType, path, err)
+				break
+			}
+			report.done("unmounted %s of %s lazily", info.fsType, path)
+		}
+	}
+
+	files, err := findStaleRcloneFiles(target.volumeId, target.mountPath, force)
+	if err != nil {
+		report.fail("find stale files: %s", err)
+	}
+	for _, file := range files {
+		if file.kept != "" {
+			report.done("keep %s: %s, rerun with -force to remove it", file.path, file.kept)
+			continue
+		} else if report.dryRun {
+			report.done("remove %s", file.path)
+			continue
+		}
+		if err = os.RemoveAll(file.path); err != nil {
+			report.fail("remove %s: %s", file.path, err)
+		} else {
+			report.done("removed %s", file.path)
+			if dir := filepath.Dir(file.path); dir != rcloneConfigDir {
+				// The cache or log directory of the volume is removed once empty
+				os.Remove(dir)
+			}
+		}
+	}
+}
+
+// killMounter kills the mounter and waits for it to exit, the mount point stuck by it is unmounted next
+func killMounter(pid int) error {
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return err
+	}
+	for deadline := time.Now().Add(CleanupKillTimeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+	}
+	return fmt.Errorf("still running after %s, it may be in uninterruptible sleep", CleanupKillTimeout)
+}
+
+// findMounterProcesses returns the mount processes of the registered mounters on the node, with the mount paths parsed from the arguments
+func findMounterProcesses() ([]mounterProcess, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var mounters []mounterProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		volumeId, mountPath, ok := parseMounterProcess(args)
+		if !ok {
+			continue
+		}
+		mounters = append(mounters, mounterProcess{pid: pid, command: strings.Join(args, " "), volumeId: volumeId, mountPath: filepath.Clean(mountPath)})
+	}
+	return mounters, nil
+}
+
+func isRcloneMount(args []string) bool {
+	for _, arg := range args[1:] {
+		if arg == "mount" {
+			return true
+		}
+	}
+	return false
+}
+
+// staleRcloneFile is a config file, a CA bundle, a cache directory or a log file written for a mount path
+type staleRcloneFile struct {
+	path string
+	// Why the file is kept, empty if it's removed
+	kept string
+}
+
+// findStaleRcloneFiles returns the files written by the connector for the mount path, of any volume if volumeId is empty.
+// The cache with the files not uploaded yet is kept unless forced, rclone uploads them once the volume is mounted on the path again.
+func findStaleRcloneFiles(volumeId, mountPath string, force bool) ([]staleRcloneFile, error) {
+	uuid := rcloneCacheId(mountPath)
+	if volumeId == "" {
+		volumeId = "*"
+	}
+	patterns := []string{
+		filepath.Join(rcloneConfigDir, volumeId+"-"+uuid+".conf"),
+		filepath.Join(rcloneConfigDir, volumeId+"-"+uuid+".ca.pem"),
+		filepath.Join(rcloneCacheDir, volumeId, uuid),
+		filepath.Join(rcloneLogDir, volumeId, uuid+".log"),
+	}
+	var files []staleRcloneFile
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return files, err
+		}
+		for _, path := range paths {
+			file := staleRcloneFile{path: path}
+			if strings.HasPrefix(path, rcloneCacheDir+string(filepath.Separator)) && !force {
+				if dirtyFiles, err := countVfsCacheDirtyFiles(path); err != nil {
+					file.kept = fmt.Sprintf("failed to inspect vfs cache: %s", err)
+				} else if dirtyFiles > 0 {
+					file.kept = fmt.Sprintf("%d files are not uploaded yet", dirtyFiles)
+				}
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
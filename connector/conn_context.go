@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// connContext is shared by the goroutines of a session, started by the session with the request of its command
+// before any of them starts, so no lock is needed.
+type connContext struct {
+	requestId string
+	ctx       context.Context
+	span      trace.Span
+	// The connection is kept alive for the next command, so every command must terminate explicitly
+	keepAlive bool
+}
+
+func (c *connContext) start(request *protocol.Request) {
+	if c.span != nil {
+		return
+	}
+	c.requestId, c.keepAlive = request.RequestId, request.KeepAlive
+	c.ctx, c.span = tracer.Start(protocol.ExtractTraceContext(context.Background(), request), "connector "+request.Cmd,
+		trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// context returns the context of the span to start the spans of the mounter
+func (c *connContext) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c *connContext) end() {
+	if c.span != nil {
+		c.span.End()
+	}
+}
+
+// logger returns the logger with the request id of the connection and the volume of the command
+func (c *connContext) logger(cmd protocol.Cmd) *log.Entry {
+	fields := make(log.Fields)
+	if c.requestId != "" {
+		fields["requestID"] = c.requestId
+	}
+	switch cmd := cmd.(type) {
+	case *protocol.InitKodoFSMountCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.GatewayID, cmd.MountPath
+	case *protocol.InitKodoMountCmd:
+		fields["volumeID"], fields["mountPath"], fields["bucket"] = cmd.VolumeId, cmd.MountPath, cmd.BucketId
+	case *protocol.KodoUmountCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	case *protocol.KodoFlushCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	case *protocol.KodoDetachCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	case *protocol.KodoVfsStatsCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	case *protocol.KodoVfsForgetCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	case *protocol.KodoMountLogsCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	case *protocol.UmountCmd:
+		fields["volumeID"], fields["mountPath"] = cmd.VolumeId, cmd.MountPath
+	}
+	return log.WithFields(fields)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Directory of the crash reports of the mounters, each of which is a directory named <time>-<volume id>-<pid>
+	CrashReportDir = "/var/lib/qiniu/storage/csi-plugin/crashes"
+	// Only the latest crash reports are kept
+	CrashReportMaxCount = 20
+	// Lines of stderr of the mounter kept for its crash report
+	CrashReportStderrLines = 200
+	// Path of the pattern of the core dumps of the kernel
+	CorePatternPath = "/proc/sys/kernel/core_pattern"
+)
+
+var mounterCrashTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Subsystem: "mounter",
+	Name:      "crashes_total",
+	Help:      "Total number of mounters killed by the signals of the crashes, e.g. SIGSEGV or SIGABRT, by volume and signal",
+}, []string{"volume_id", "signal"})
+
+func init() {
+	metricsRegistry.MustRegister(mounterCrashTotal)
+}
+
+// crashSignals names the signals killing a mounter by its own fault, SIGTERM and SIGKILL sent by the connector are not crashes
+var crashSignals = map[syscall.Signal]string{
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGSYS:  "SIGSYS",
+	syscall.SIGQUIT: "SIGQUIT",
+}
+
+// environSecretRegexp matches the names of the environment variables carrying secrets, e.g. RCLONE_CONFIG_PASS
+var environSecretRegexp = regexp.MustCompile(`(?i)(pass|token|secret|key|credential)`)
+
+// stderrTail keeps the last lines written to stderr of a mounter
+type stderrTail struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (t *stderrTail) add(line string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.lines = append(t.lines, line); len(t.lines) > CrashReportStderrLines {
+		t.lines = t.lines[len(t.lines)-CrashReportStderrLines:]
+	}
+}
+
+func (t *stderrTail) bytes() []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, line := range t.lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// crashSignal returns the signal killing the process if it's a crash
+func crashSignal(state *os.ProcessState) (syscall.Signal, bool) {
+	if state == nil {
+		return 0, false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || crashSignals[status.Signal()] == "" {
+		return 0, false
+	}
+	return status.Signal(), true
+}
+
+// reportCrash saves the last stderr, the core dump location and the environment of the crashed mounter into a new crash report,
+// and returns its directory
+func (r *mounterRecord) reportCrash(cmd *exec.Cmd, signal syscall.Signal, stderr *stderrTail) (string, error) {
+	now := time.Now()
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	dir := filepath.Join(CrashReportDir, fmt.Sprintf("%s-%s-%d", now.UTC().Format("20060102-150405"), r.volumeId, cmd.Process.Pid))
+	if err := ensureDirectoryExists(dir); err != nil {
+		return "", err
+	}
+
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "Volume ID:    %s\n", r.volumeId)
+	fmt.Fprintf(&report, "Mount Path:   %s\n", r.mountPath)
+	fmt.Fprintf(&report, "Pid:          %d\n", cmd.Process.Pid)
+	fmt.Fprintf(&report, "Signal:       %s (%d)\n", crashSignals[signal], signal)
+	fmt.Fprintf(&report, "Started At:   %s\n", r.status().StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&report, "Crashed At:   %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&report, "Command:      %s\n", strings.Join(cmd.Args, " "))
+	fmt.Fprintf(&report, "Core Dump:    %s\n", coreDumpLocation(cmd.Process.Pid, status.CoreDump()))
+	fmt.Fprintf(&report, "Connector:    %s, CommitID: %s, rclone %s\n", VERSION, COMMITID, rcloneVersion)
+
+	environ := cmd.Env
+	if environ == nil {
+		environ = os.Environ()
+	}
+	files := map[string][]byte{
+		"report.txt": report.Bytes(),
+		// The arguments never contain secrets, see protocol.CheckArgs, but the logs may
+		"stderr.log":  redactLog(stderr.bytes()),
+		"environ.txt": redactEnviron(environ),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return dir, err
+		}
+	}
+	pruneCrashReports()
+	return dir, nil
+}
+
+// coreDumpLocation describes where the core dump of the process could be found by the core pattern of the kernel
+func coreDumpLocation(pid int, dumped bool) string {
+	if !dumped {
+		var limit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); err == nil && limit.Cur == 0 {
+			return "not dumped, since RLIMIT_CORE of the connector is 0, set LimitCORE=infinity in the connector service to dump it"
+		}
+		return "not dumped"
+	}
+	pattern, err := os.ReadFile(CorePatternPath)
+	if err != nil {
+		return fmt.Sprintf("dumped, but failed to read %s: %s", CorePatternPath, err)
+	}
+	corePattern := strings.TrimSpace(string(pattern))
+	switch {
+	case strings.Contains(corePattern, "systemd-coredump"):
+		return fmt.Sprintf("dumped to systemd-coredump, see coredumpctl info %d", pid)
+	case strings.HasPrefix(corePattern, "|"):
+		return fmt.Sprintf("dumped to the handler %s", strings.TrimPrefix(corePattern, "|"))
+	case filepath.IsAbs(corePattern):
+		return fmt.Sprintf("dumped to %s", corePattern)
+	}
+	// Relative to the working directory of the mounter, which is inherited from the connector
+	cwd, _ := os.Getwd()
+	return fmt.Sprintf("dumped to %s under %s", corePattern, cwd)
+}
+
+// redactEnviron masks the values of the environment variables carrying secrets, and the passwords of the proxies
+func redactEnviron(environ []string) []byte {
+	sorted := append([]string(nil), environ...)
+	sort.Strings(sorted)
+	var buf bytes.Buffer
+	for _, env := range sorted {
+		key, value, _ := strings.Cut(env, "=")
+		if environSecretRegexp.MatchString(key) && value != "" {
+			value = "******"
+		} else if u, err := url.Parse(value); err == nil && u.User != nil {
+			value = u.Redacted()
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", key, value)
+	}
+	return buf.Bytes()
+}
+
+// pruneCrashReports removes the oldest crash reports beyond CrashReportMaxCount
+func pruneCrashReports() {
+	entries, err := os.ReadDir(CrashReportDir)
+	if err != nil {
+		return
+	}
+	// Named by the time first, so sorted from the oldest
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	for len(dirs) > CrashReportMaxCount {
+		if err = os.RemoveAll(filepath.Join(CrashReportDir, dirs[0])); err != nil {
+			log.Warnf("Failed to remove crash report %s: %s", dirs[0], err)
+		}
+		dirs = dirs[1:]
+	}
+}
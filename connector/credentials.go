@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Temporary credentials are renewed once their remaining lifetime is shorter than this, or a third of their lifetime if shorter
+	CredentialsRenewBefore = 10 * time.Minute
+	// Interval to retry renewing the temporary credentials after a failure
+	CredentialsRetryInterval = 30 * time.Second
+	// Timeout of a single request to the credential source
+	CredentialsRequestTimeout = 10 * time.Second
+	// Path prefix of the loopback credentials endpoint
+	CredentialsPathPrefix = "/credentials/"
+	// Path of the instance metadata service to retrieve the temporary credentials of an instance role
+	InstanceCredentialsPath = "/latest/meta-data/ram/security-credentials/"
+	// How often the credential files are read again, the keys read from them are served as if they expire after this
+	CredentialFilesRefreshInterval = time.Minute
+	// Max size of a credential file
+	CredentialFileMaxSize = 64 << 10
+)
+
+// temporaryCredentials is a set of short-lived credentials, encoded in the format of the AWS container credentials endpoint
+type temporaryCredentials struct {
+	AccessKeyId     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token,omitempty"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// credentialsProvider retrieves temporary credentials from a credential source
+type credentialsProvider interface {
+	retrieve(ctx context.Context) (*temporaryCredentials, error)
+}
+
+func newCredentialsProvider(cmd *protocol.InitKodoMountCmd) (credentialsProvider, error) {
+	source := cmd.CredentialSource
+	switch source.Type {
+	case protocol.CredentialSourceTypeSTS:
+		endpoint, err := url.Parse(source.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sts endpoint %s: %w", source.Endpoint, err)
+		}
+		return &stsCredentialsProvider{endpoint: endpoint, token: source.Token, volumeId: cmd.VolumeId, bucketId: cmd.BucketId, client: newKodoHttpClient(cmd)}, nil
+	case protocol.CredentialSourceTypeInstance:
+		endpoint := *instanceMetadataEndpoint
+		if source.Endpoint != "" {
+			endpoint = source.Endpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance metadata endpoint %s: %w", endpoint, err)
+		}
+		return &instanceCredentialsProvider{endpoint: u, role: source.Role}, nil
+	case protocol.CredentialSourceTypeFile:
+		if source.AccessKeyFile == "" || source.SecretKeyFile == "" {
+			return nil, errors.New("both access key file and secret key file are required")
+		}
+		return &fileCredentialsProvider{accessKeyFile: source.AccessKeyFile, secretKeyFile: source.SecretKeyFile, sessionTokenFile: source.SessionTokenFile}, nil
+	default:
+		return nil, fmt.Errorf("unsupported credential source type %q", source.Type)
+	}
+}
+
+// stsCredentialsProvider retrieves temporary credentials from an STS endpoint by GET <endpoint>?volume=<volume>&bucket=<bucket>,
+// the endpoint is expected to respond in the format of the AWS container credentials endpoint
+type stsCredentialsProvider struct {
+	endpoint                  *url.URL
+	token, volumeId, bucketId string
+	// Resolves the endpoint like the Kodo endpoints of the volume
+	client *http.Client
+}
+
+func (p *stsCredentialsProvider) retrieve(ctx context.Context) (*temporaryCredentials, error) {
+	u := *p.endpoint
+	query := u.Query()
+	query.Set("volume", p.volumeId)
+	query.Set("bucket", p.bucketId)
+	u.RawQuery = query.Encode()
+	header := make(http.Header)
+	if p.token != "" {
+		header.Set("Authorization", "Bearer "+p.token)
+	}
+	body, err := requestCredentials(ctx, p.client, u.String(), header)
+	if err != nil {
+		return nil, fmt.Errorf("sts endpoint: %w", err)
+	}
+	credentials, err := parseTemporaryCredentials(body)
+	if err != nil {
+		return nil, fmt.Errorf("sts endpoint: %w", err)
+	}
+	return credentials, nil
+}
+
+// instanceCredentialsProvider retrieves temporary credentials of the instance role from the instance metadata service,
+// by GET <endpoint>/latest/meta-data/ram/security-credentials/<role>
+type instanceCredentialsProvider struct {
+	endpoint *url.URL
+	role     string
+}
+
+// instanceMetadataClient never goes through proxies, the instance metadata service is only reachable from the node itself
+var instanceMetadataClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+func (p *instanceCredentialsProvider) retrieve(ctx context.Context) (*temporaryCredentials, error) {
+	u := *p.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + InstanceCredentialsPath + url.PathEscape(p.role)
+	body, err := requestCredentials(ctx, instanceMetadataClient, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata of role %s: %w", p.role, err)
+	}
+	credentials, err := parseTemporaryCredentials(body)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata of role %s: %w", p.role, err)
+	}
+	return credentials, nil
+}
+
+// kodoPluginPid is the pid of the Kodo CSI plugin which sent the last mount command, the credential files are read in its root directory
+var kodoPluginPid int32
+
+// recordKodoPluginPid remembers the Kodo CSI plugin on the other side of the connection by SO_PEERCRED
+func recordKodoPluginPid(conn net.Conn) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *unix.Ucred
+	rawConn.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil && cred.Pid > 0 {
+		atomic.StoreInt32(&kodoPluginPid, cred.Pid)
+	}
+}
+
+// fileCredentialsProvider reads the keys from the files in the container of the Kodo CSI plugin, e.g. rendered by Vault agent
+// or issued by a SPIFFE helper, every CredentialFilesRefreshInterval, so that the rotated keys are picked up by the mounter.
+// The keys in the files never expire by themselves, so the last ones are kept if the files can't be read, e.g. while the plugin restarts.
+type fileCredentialsProvider struct {
+	accessKeyFile, secretKeyFile, sessionTokenFile string
+	last                                           *temporaryCredentials
+}
+
+func (p *fileCredentialsProvider) retrieve(ctx context.Context) (*temporaryCredentials, error) {
+	credentials, err := p.read()
+	if err != nil {
+		if p.last == nil {
+			return nil, err
+		}
+		log.Warnf("Failed to read credential files, the last keys read from %s are kept: %s", p.accessKeyFile, err)
+		credentials = p.last
+	} else if p.last != nil && (credentials.AccessKeyId != p.last.AccessKeyId || credentials.SecretAccessKey != p.last.SecretAccessKey || credentials.Token != p.last.Token) {
+		log.Infof("Keys in %s are changed, serve the new ones", p.accessKeyFile)
+	}
+	credentials.Expiration = time.Now().Add(CredentialFilesRefreshInterval)
+	p.last = credentials
+	return credentials, nil
+}
+
+func (p *fileCredentialsProvider) read() (*temporaryCredentials, error) {
+	pid := atomic.LoadInt32(&kodoPluginPid)
+	if pid == 0 {
+		return nil, errors.New("no Kodo CSI plugin is connected")
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	var credentials temporaryCredentials
+	for _, file := range []struct {
+		path     string
+		value    *string
+		optional bool
+	}{{p.accessKeyFile, &credentials.AccessKeyId, false}, {p.secretKeyFile, &credentials.SecretAccessKey, false}, {p.sessionTokenFile, &credentials.Token, true}} {
+		if file.path == "" {
+			continue
+		}
+		data, err := readFileInRoot(root, file.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in the Kodo CSI plugin: %w", file.path, err)
+		}
+		if *file.value = strings.TrimSpace(string(data)); *file.value == "" && !file.optional {
+			return nil, fmt.Errorf("%s in the Kodo CSI plugin is empty", file.path)
+		}
+	}
+	return &credentials, nil
+}
+
+// readFileInRoot reads the file as if root is the root directory, even the absolute symlinks are resolved in root, so the files of the node
+// out of the container could never be read. The symlinks of the projected volumes of Kubernetes are also resolved in this way.
+func readFileInRoot(root, path string) ([]byte, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+	fd, err := unix.Openat2(rootFd, path, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		return nil, errors.New("openat2 is not supported by the kernel, which requires Linux 5.6 or later")
+	} else if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	return ioutil.ReadAll(io.LimitReader(file, CredentialFileMaxSize))
+}
+
+// requestCredentials requests the credential source and returns the response body
+func requestCredentials(ctx context.Context, client *http.Client, u string, header http.Header) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, CredentialsRequestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responds status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// parseTemporaryCredentials parses temporary credentials in the format of the AWS container credentials endpoint,
+// the field names used by other metadata services are accepted as well
+func parseTemporaryCredentials(body []byte) (*temporaryCredentials, error) {
+	var result struct {
+		temporaryCredentials
+		AccessKeySecret string `json:"AccessKeySecret"`
+		SessionToken    string `json:"SessionToken"`
+		SecurityToken   string `json:"SecurityToken"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	credentials := result.temporaryCredentials
+	if credentials.SecretAccessKey == "" {
+		credentials.SecretAccessKey = result.AccessKeySecret
+	}
+	if credentials.Token == "" {
+		credentials.Token = result.SessionToken
+	}
+	if credentials.Token == "" {
+		credentials.Token = result.SecurityToken
+	}
+	if credentials.AccessKeyId == "" || credentials.SecretAccessKey == "" {
+		return nil, errors.New("responds no access key")
+	}
+	if credentials.Expiration.IsZero() {
+		return nil, errors.New("responds no expiration")
+	}
+	return &credentials, nil
+}
+
+// credentialsManager keeps the temporary credentials of a mount point fresh and serves them to the mounter.
+// rclone retrieves the credentials from the loopback endpoint of the connector, so it never sees the token of the credential source.
+type credentialsManager struct {
+	id, token string
+	provider  credentialsProvider
+
+	lock        sync.RWMutex
+	current     *temporaryCredentials
+	renewMargin time.Duration
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// credentialsManagers saves *credentialsManager by id
+var credentialsManagers sync.Map
+
+var (
+	credentialsServerOnce sync.Once
+	credentialsServerAddr string
+	credentialsServerErr  error
+)
+
+// startCredentialsManager retrieves the first credentials in the foreground and renews them in the background until stop is called
+func startCredentialsManager(cmd *protocol.InitKodoMountCmd) (*credentialsManager, error) {
+	if err := startCredentialsServer(); err != nil {
+		return nil, err
+	}
+	provider, err := newCredentialsProvider(cmd)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	current, err := provider.retrieve(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve temporary credentials: %w", err)
+	}
+	m := &credentialsManager{
+		id:       cmd.VolumeId + "-" + rcloneCacheId(cmd.MountPath),
+		token:    token,
+		provider: provider,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	m.set(current)
+	credentialsManagers.Store(m.id, m)
+	go m.renew()
+	return m, nil
+}
+
+// uri returns the url of the loopback endpoint serving the credentials
+func (m *credentialsManager) uri() string {
+	return "http://" + credentialsServerAddr + CredentialsPathPrefix + m.id
+}
+
+// get returns the current credentials and how long before the expiration they are renewed
+func (m *credentialsManager) get() (*temporaryCredentials, time.Duration) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.current, m.renewMargin
+}
+
+func (m *credentialsManager) set(credentials *temporaryCredentials) {
+	renewMargin := CredentialsRenewBefore
+	if lifetime := time.Until(credentials.Expiration); renewMargin > lifetime/3 {
+		renewMargin = lifetime / 3
+	}
+	if renewMargin < 0 {
+		renewMargin = 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.current = credentials
+	m.renewMargin = renewMargin
+}
+
+func (m *credentialsManager) renew() {
+	defer close(m.doneCh)
+	for {
+		current, renewMargin := m.get()
+		wait := time.Until(current.Expiration.Add(-renewMargin))
+		if wait < CredentialsRetryInterval {
+			wait = CredentialsRetryInterval
+		}
+		select {
+		case <-m.stopCh:
+			return
+		case <-time.After(wait):
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-m.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		credentials, err := m.provider.retrieve(ctx)
+		cancel()
+		if err != nil {
+			log.Warnf("Failed to renew temporary credentials of %s, which expire at %s: %s", m.id, current.Expiration, err)
+			continue
+		}
+		m.set(credentials)
+		if _, ok := m.provider.(*fileCredentialsProvider); ok {
+			// Read again every CredentialFilesRefreshInterval, which is logged only if the keys change
+			continue
+		}
+		log.Infof("Renewed temporary credentials of %s, which expire at %s", m.id, credentials.Expiration)
+	}
+}
+
+func (m *credentialsManager) stop() {
+	credentialsManagers.Delete(m.id)
+	close(m.stopCh)
+	<-m.doneCh
+}
+
+// startCredentialsServer serves the credentials endpoint on a random loopback port, shared by all mounters
+func startCredentialsServer() error {
+	credentialsServerOnce.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			credentialsServerErr = fmt.Errorf("failed to listen for credentials endpoint: %w", err)
+			return
+		}
+		credentialsServerAddr = listener.Addr().String()
+		mux := http.NewServeMux()
+		mux.HandleFunc(CredentialsPathPrefix, serveCredentials)
+		go func() {
+			if err := http.Serve(listener, mux); err != nil {
+				log.Errorf("Failed to serve credentials endpoint: %s", err)
+			}
+		}()
+	})
+	return credentialsServerErr
+}
+
+func serveCredentials(w http.ResponseWriter, r *http.Request) {
+	value, ok := credentialsManagers.Load(strings.TrimPrefix(r.URL.Path, CredentialsPathPrefix))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	m := value.(*credentialsManager)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(m.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	current, renewMargin := m.get()
+	credentials := *current
+	if time.Now().After(credentials.Expiration) {
+		http.Error(w, "temporary credentials are expired and not renewed yet", http.StatusServiceUnavailable)
+		return
+	}
+	// Tell the mounter the credentials expire a little earlier, so that it comes back for the renewed ones before they really expire
+	credentials.Expiration = credentials.Expiration.Add(-renewMargin / 2)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&credentials)
+}
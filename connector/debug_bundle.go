@@ -0,0 +1,416 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+const (
+	// DebugBundleCommand is the subcommand collecting the debug bundle of the node
+	DebugBundleCommand = "debug-bundle"
+	// Name of the systemd service of the connector, see kodo-csi-connector.service
+	ConnectorServiceName = "csiplugin-connector"
+	// Timeout of each command run to collect the debug bundle
+	DebugBundleCommandTimeout = 30 * time.Second
+)
+
+var (
+	// When the connector daemon is started, reported in the debug state
+	startedAt = time.Now()
+
+	// kodoMountCmds saves *protocol.InitKodoMountCmd by mount path, to report the rclone configs in the debug state
+	kodoMountCmds sync.Map
+)
+
+// logSecretRegexps match the secrets may be printed in the logs, e.g. the headers dumped by --dump headers of rclone
+var logSecretRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:authorization|x-amz-security-token)["']?\s*[:=]\s*).*`),
+	regexp.MustCompile(`(?i)((?:access_key_id|secret_access_key|session_token|accesskey|secretkey|accesstoken|token)["']?\s*[:=]\s*["']?)[^"'\s,&]+`),
+}
+
+type (
+	// debugState is replied by the connector daemon for DebugStateCmd
+	debugState struct {
+		Version        string            `json:"version"`
+		CommitId       string            `json:"commit_id"`
+		BuildTime      string            `json:"build_time"`
+		RcloneVersion  string            `json:"rclone_version"`
+		KodoFSVersion  string            `json:"kodofs_version"`
+		KodoFSFeatures string            `json:"kodofs_features"`
+		Fusermount     string            `json:"fusermount"`
+		Pid            int               `json:"pid"`
+		StartedAt      time.Time         `json:"started_at"`
+		Mounters       []debugMounter    `json:"mounters"`
+		Flags          map[string]string `json:"flags"`
+	}
+
+	debugMounter struct {
+		MounterStatus
+		Cmd          protocol.Cmd    `json:"cmd,omitempty"`
+		RcloneConfig string          `json:"rclone_config,omitempty"`
+		VfsStats     json.RawMessage `json:"vfs_stats,omitempty"`
+	}
+)
+
+// collectDebugState collects the state of the connector daemon, the secrets are masked by redactCmd
+func collectDebugState() *debugState {
+	state := &debugState{
+		Version:        VERSION,
+		CommitId:       COMMITID,
+		BuildTime:      BUILDTIME,
+		RcloneVersion:  rcloneVersion,
+		KodoFSVersion:  kodofsVersion,
+		KodoFSFeatures: fmt.Sprintf("%+v", kodofsFeatures),
+		Fusermount:     fusermountCmd,
+		Pid:            os.Getpid(),
+		StartedAt:      startedAt,
+		Flags:          make(map[string]string),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		state.Flags[f.Name] = f.Value.String()
+	})
+	for _, status := range mounterSupervisor.list() {
+		mounter := debugMounter{MounterStatus: status}
+		if value, ok := kodoMountCmds.Load(status.MountPath); ok {
+			redacted := redactCmd(value.(*protocol.InitKodoMountCmd))
+			mounter.Cmd = redacted
+			if config, err := renderRcloneConfig(redacted.(*protocol.InitKodoMountCmd)); err == nil {
+				mounter.RcloneConfig = string(config)
+			}
+		}
+		if rc, err := getRcloneRemoteControl(status.MountPath); err == nil {
+			if stats, err := rc.call(context.Background(), "vfs/stats", nil); err == nil {
+				mounter.VfsStats = stats
+			}
+		}
+		state.Mounters = append(state.Mounters, mounter)
+	}
+	sort.Slice(state.Mounters, func(i, j int) bool { return state.Mounters[i].MountPath < state.Mounters[j].MountPath })
+	return state
+}
+
+// debugBundle is the tarball of the debug bundle
+type debugBundle struct {
+	tarWriter *tar.Writer
+	prefix    string
+	now       time.Time
+}
+
+func (b *debugBundle) add(name string, data []byte) error {
+	header := &tar.Header{Name: b.prefix + "/" + name, Mode: 0600, Size: int64(len(data)), ModTime: b.now}
+	if err := b.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tarWriter.Write(data)
+	return err
+}
+
+// runDebugBundle collects the versions, the connector state, the mount points, the recent logs and the processes of the node
+// into a tarball for support tickets, the secrets are masked. It returns the exit code.
+func runDebugBundle(args []string) int {
+	flagSet := flag.NewFlagSet(DebugBundleCommand, flag.ContinueOnError)
+	output := flagSet.String("output", "", "Path of the tarball, - for stdout, qiniu-csi-debug-<hostname>-<time>.tar.gz in the current directory by default")
+	maxLogSize := flagSet.Int64("max-log-size", 4<<20, "Max bytes collected from the end of each log file")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	prefix := fmt.Sprintf("qiniu-csi-debug-%s-%s", hostname, now.Format("20060102-150405"))
+	var writer io.Writer = os.Stdout
+	if *output != "-" {
+		if *output == "" {
+			*output = prefix + ".tar.gz"
+		}
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %s\n", *output, err)
+			return 1
+		}
+		defer file.Close()
+		writer = file
+	}
+	gzipWriter := gzip.NewWriter(writer)
+	bundle := &debugBundle{tarWriter: tar.NewWriter(gzipWriter), prefix: prefix, now: now}
+	resolveRcloneDirs()
+
+	collectors := []struct {
+		name    string
+		collect func() ([]byte, error)
+	}{
+		{"version.txt", collectVersions},
+		{"connector-state.json", requestDebugState},
+		{"connector-service.txt", func() ([]byte, error) {
+			return runDebugCommand("systemctl", "status", "--no-pager", ConnectorServiceName)
+		}},
+		{"connector-journal.log", func() ([]byte, error) {
+			output, err := runDebugCommand("journalctl", "--no-pager", "--unit", ConnectorServiceName, "--lines", "2000")
+			return redactLog(output), err
+		}},
+		{"mountinfo.txt", collectMountInfo},
+		{"processes.txt", collectProcesses},
+		{"logs/connector.log", func() ([]byte, error) {
+			return tailLog(LogFilename, *maxLogSize)
+		}},
+	}
+	failed := false
+	for _, collector := range collectors {
+		data, err := collector.collect()
+		if err != nil {
+			// Collect as much as possible, the error is recorded in the bundle as well
+			fmt.Fprintf(os.Stderr, "Failed to collect %s: %s\n", collector.name, err)
+			data = append(data, []byte(fmt.Sprintf("\nFailed to collect %s: %s\n", collector.name, err))...)
+		}
+		if err = bundle.add(collector.name, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s into debug bundle: %s\n", collector.name, err)
+			failed = true
+		}
+	}
+
+	// Logs of rclone are saved in <rcloneLogDir>/<volume id>/<mount point uuid>.log
+	logFiles, _ := filepath.Glob(filepath.Join(rcloneLogDir, "*", "*.log"))
+	for _, logFile := range logFiles {
+		name := filepath.Join("logs", "rclone", filepath.Base(filepath.Dir(logFile)), filepath.Base(logFile))
+		data, err := tailLog(logFile, *maxLogSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to collect %s: %s\n", logFile, err)
+			continue
+		}
+		if err = bundle.add(name, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s into debug bundle: %s\n", name, err)
+			failed = true
+		}
+	}
+
+	// Crash reports of the mounters are saved in <CrashReportDir>/<time>-<volume id>-<pid>/, already with the secrets masked
+	crashFiles, _ := filepath.Glob(filepath.Join(CrashReportDir, "*", "*"))
+	for _, crashFile := range crashFiles {
+		name := filepath.Join("crashes", filepath.Base(filepath.Dir(crashFile)), filepath.Base(crashFile))
+		data, err := os.ReadFile(crashFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to collect %s: %s\n", crashFile, err)
+			continue
+		}
+		if err = bundle.add(name, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s into debug bundle: %s\n", name, err)
+			failed = true
+		}
+	}
+
+	if err := bundle.tarWriter.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write debug bundle: %s\n", err)
+		return 1
+	} else if err = gzipWriter.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write debug bundle: %s\n", err)
+		return 1
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Debug bundle is saved to %s\n", *output)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func collectVersions() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CSI Connector Version: %s, CommitID: %s, Build time: %s\n\n", VERSION, COMMITID, BUILDTIME)
+	for _, command := range [][]string{{RcloneCmd, "version"}, {KodoFSCmd, "--version"}, {"uname", "-a"}} {
+		output, err := runDebugCommand(command[0], command[1:]...)
+		fmt.Fprintf(&buf, "$ %s\n%s\n", strings.Join(command, " "), output)
+		if err != nil {
+			fmt.Fprintf(&buf, "Failed to run: %s\n", err)
+		}
+		buf.WriteString("\n")
+	}
+	if osRelease, err := os.ReadFile("/etc/os-release"); err == nil {
+		fmt.Fprintf(&buf, "$ cat /etc/os-release\n%s", osRelease)
+	}
+	return buf.Bytes(), nil
+}
+
+// requestDebugState requests the state from the connector daemon by DebugStateCmd
+func requestDebugState() ([]byte, error) {
+	data, err := requestConnector(protocol.DebugStateCmdName, struct{}{}, DebugBundleCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err = json.Indent(&indented, data, "", "  "); err != nil {
+		return data, nil
+	}
+	return indented.Bytes(), nil
+}
+
+// requestConnector sends the command to the connector daemon, and returns the data replied once the command terminates
+func requestConnector(cmdName string, cmd interface{}, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", SocketPath, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to connector: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// Kept alive so that the commands replied only to the long-lived connections also terminate
+	request, err := json.Marshal(&protocol.Request{Version: protocol.Version, Cmd: cmdName, Payload: payload, KeepAlive: true})
+	if err != nil {
+		return nil, err
+	} else if _, err = conn.Write(append(request, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send request to connector: %w", err)
+	}
+
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var response protocol.Request
+		if err = json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			return nil, fmt.Errorf("failed to parse response of connector: %w", err)
+		}
+		switch response.Cmd {
+		case protocol.ResponseDataCmdName:
+			var payload protocol.ResponseDataCmd
+			if err = json.Unmarshal(response.Payload, &payload); err != nil {
+				return nil, fmt.Errorf("failed to parse response of connector: %w", err)
+			} else if payload.IsError {
+				return nil, fmt.Errorf("connector replies error: %s", payload.Data)
+			}
+			data.WriteString(payload.Data)
+		case protocol.TerminateCmdName:
+			var payload protocol.TerminateCmd
+			if err = json.Unmarshal(response.Payload, &payload); err != nil {
+				return nil, fmt.Errorf("failed to parse response of connector: %w", err)
+			} else if payload.Code != 0 {
+				return nil, fmt.Errorf("connector terminates %s with code %d", cmdName, payload.Code)
+			}
+			return data.Bytes(), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read response of connector: %w", err)
+	}
+	return nil, fmt.Errorf("connection is closed by connector, it may not support %s, please upgrade it", cmdName)
+}
+
+// collectMountInfo collects the entries of the FUSE mount points of the connector
+func collectMountInfo() ([]byte, error) {
+	content, err := os.ReadFile(MountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, line := range strings.Split(string(content), "\n") {
+		// The filesystem type follows the separator of the optional fields
+		if _, fields, ok := strings.Cut(line, " - "); ok && isMounterFsType(strings.SplitN(fields, " ", 2)[0]) {
+			buf.WriteString(line)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// collectProcesses collects the processes of the connector and the mounters, whose arguments never contain secrets, see protocol.CheckArgs
+func collectProcesses() ([]byte, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{ConnectorName: true, "connector.plugin.storage.qiniu.com": true, FusermountCmd: true, Fusermount3Cmd: true}
+	for name := range registeredMounters {
+		names[name] = true
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-8s %-8s %-12s %-12s %s\n", "PID", "PPID", "STATE", "RSS", "COMMAND")
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if !names[filepath.Base(args[0])] {
+			continue
+		}
+		fields := map[string]string{"PPid": "-", "State": "-", "VmRSS": "-"}
+		if status, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "status")); err == nil {
+			for _, line := range strings.Split(string(status), "\n") {
+				if key, value, ok := strings.Cut(line, ":"); ok {
+					if _, wanted := fields[key]; wanted {
+						fields[key] = strings.Join(strings.Fields(value), "")
+					}
+				}
+			}
+		}
+		fmt.Fprintf(&buf, "%-8s %-8s %-12s %-12s %s\n", entry.Name(), fields["PPid"], fields["State"], fields["VmRSS"], strings.Join(args, " "))
+	}
+	return buf.Bytes(), nil
+}
+
+// tailLog reads at most maxSize bytes from the end of the log file, with the secrets masked
+func tailLog(path string, maxSize int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxSize {
+		if _, err = file.Seek(info.Size()-maxSize, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxSize {
+		// Drop the partial first line
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return redactLog(data), nil
+}
+
+func redactLog(data []byte) []byte {
+	for _, r := range logSecretRegexps {
+		data = r.ReplaceAll(data, []byte("${1}******"))
+	}
+	return data
+}
+
+func runDebugCommand(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DebugBundleCommandTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Directory of the mount points detached from the volumes, which keep the mounters alive until the cache is uploaded
+	DrainingKodoMountsDir = "/var/lib/qiniu/storage/csi-plugin/draining"
+)
+
+// detachKodo unmounts the volume lazily without waiting for the write-back cache, which is uploaded in background.
+// The mount point is bound to a draining directory first, so that the mounter keeps running after the mount path is detached.
+func detachKodo(logger *log.Entry, c *protocol.KodoDetachCmd) error {
+	wait, err := time.ParseDuration(c.Wait)
+	if err != nil {
+		return fmt.Errorf("invalid wait duration %s: %w", c.Wait, err)
+	} else if wait < VfsCacheFlushCheckInterval {
+		wait = VfsCacheFlushCheckInterval
+	}
+
+	if shared := sharedKodoMounts.lookup(c.MountPath); shared != nil {
+		shared.lock.Lock()
+		remaining := shared.unbind(logger, c.MountPath, syscall.MNT_DETACH)
+		shared.lock.Unlock()
+		if remaining == 0 {
+			go drainKodo(logger, shared.volumeId, shared.mountPath, wait, func() {
+				shared.lock.Lock()
+				defer shared.lock.Unlock()
+				// Another volume may use the shared mount point again while draining
+				if sharedKodoMounts.count(shared) == 0 {
+					shared.release(logger)
+				}
+			})
+		}
+		return nil
+	}
+
+	// The mounter is already kept alive by its own mount point, or there is no mounter at all in the sync mode
+	if umountWriteCacheKodo(logger, c.MountPath, syscall.MNT_DETACH, wait) || umountSyncedKodo(logger, c.MountPath, syscall.MNT_DETACH) {
+		return nil
+	}
+
+	if _, supervised := mounterSupervisor.get(c.MountPath); !supervised {
+		return fmt.Errorf("%s is not mounted by any supervised mounter", c.MountPath)
+	}
+	drainingPath := filepath.Join(DrainingKodoMountsDir, rcloneCacheId(c.MountPath))
+	if err = ensureDirectoryExists(drainingPath); err != nil {
+		return fmt.Errorf("failed to create draining directory %s: %w", drainingPath, err)
+	} else if err = syscall.Mount(c.MountPath, drainingPath, "", syscall.MS_BIND, ""); err != nil {
+		os.Remove(drainingPath)
+		return fmt.Errorf("failed to bind %s to draining directory %s: %w", c.MountPath, drainingPath, err)
+	}
+	mounterSupervisor.drain(c.MountPath)
+	if err = syscall.Unmount(c.MountPath, syscall.MNT_DETACH); err != nil {
+		logger.Warnf("Failed to unmount %s lazily: %s", c.MountPath, err)
+	}
+	logger.Infof("%s is detached, the mounter is kept on %s until the cache is uploaded", c.MountPath, drainingPath)
+	go drainKodo(logger, c.VolumeId, c.MountPath, wait, func() {
+		if err := syscall.Unmount(drainingPath, 0); err != nil {
+			logger.Warnf("Failed to unmount draining directory %s: %s", drainingPath, err)
+		}
+		mounterSupervisor.stop(c.MountPath)
+		removeRcloneFiles(c.VolumeId, c.MountPath)
+		os.Remove(drainingPath)
+		logger.Infof("Mounter of detached %s is stopped", c.MountPath)
+	})
+	return nil
+}
+
+// drainKodo waits until all dirty files of the mounter are uploaded, then calls stop.
+// The mounter is never stopped with dirty files, which are kept in the cache if it exits by itself.
+func drainKodo(logger *log.Entry, volumeId, mountPath string, wait time.Duration, stop func()) {
+	volumeCacheDir := filepath.Join(rcloneCacheDir, volumeId, rcloneCacheId(mountPath))
+	for {
+		rc, _ := getRcloneRemoteControl(mountPath)
+		dirtyFiles, err := waitForVfsCacheFlushed(context.Background(), volumeCacheDir, rc, wait)
+		if err == nil && dirtyFiles == 0 {
+			stop()
+			return
+		}
+		if status, supervised := mounterSupervisor.get(mountPath); !supervised || status.State != MOUNTER_STATE_RUNNING {
+			logger.Errorf("Mounter of detached %s exits before the cache is uploaded, %d dirty files are kept in %s", mountPath, dirtyFiles, volumeCacheDir)
+			return
+		} else if err != nil {
+			logger.Warnf("Failed to inspect vfs cache of detached %s: %s", mountPath, err)
+			time.Sleep(wait)
+		} else {
+			logger.Warnf("%d files of detached %s are not uploaded in %s, keep waiting", dirtyFiles, mountPath, wait)
+		}
+	}
+}
+
+// cleanupDrainingKodoMounts unmounts the draining mount points left by the previous connector, whose mounters are already gone
+func cleanupDrainingKodoMounts() error {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount.fsType != FuseTypeRclone || filepath.Dir(mount.mountPoint) != DrainingKodoMountsDir {
+			continue
+		}
+		if err := unmountFuseLazily(mount.mountPoint); err != nil {
+			log.Warnf("Failed to unmount stale draining directory %s lazily: %s", mount.mountPoint, err)
+		} else {
+			os.Remove(mount.mountPoint)
+			log.Infof("Stale draining directory %s is unmounted", mount.mountPoint)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Directory under the cache of the volume keeping its persistent directory cache, next to the caches of its mount points
+const KodoDirCacheDirName = "dircache"
+
+// kodoDirCacheHolders saves the mount path of the mounter using the persistent directory cache of each volume,
+// since the database of the rclone cache backend can't be opened by more than one mounter at the same time
+var kodoDirCacheHolders = struct {
+	lock    sync.Mutex
+	holders map[string]string
+}{holders: make(map[string]string)}
+
+// kodoDirCacheDir returns the directory of the persistent directory cache of the volume, which is kept once the volume is unmounted
+func kodoDirCacheDir(volumeId string) string {
+	return filepath.Join(rcloneCacheDir, volumeId, KodoDirCacheDirName)
+}
+
+// acquireKodoDirCache returns false if the persistent directory cache of the volume is used by the mounter of another mount path
+func acquireKodoDirCache(volumeId, mountPath string) bool {
+	kodoDirCacheHolders.lock.Lock()
+	defer kodoDirCacheHolders.lock.Unlock()
+
+	if holder, ok := kodoDirCacheHolders.holders[volumeId]; ok && holder != mountPath {
+		return false
+	}
+	kodoDirCacheHolders.holders[volumeId] = mountPath
+	return true
+}
+
+func releaseKodoDirCache(volumeId, mountPath string) {
+	kodoDirCacheHolders.lock.Lock()
+	defer kodoDirCacheHolders.lock.Unlock()
+
+	if kodoDirCacheHolders.holders[volumeId] == mountPath {
+		delete(kodoDirCacheHolders.holders, volumeId)
+	}
+}
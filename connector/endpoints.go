@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+var volumeEndpointSelections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Subsystem: "volume",
+	Name:      "endpoint_selections_total",
+	Help:      "Total number of mounts of the volume with an internal S3 endpoint, by the endpoint selected, internal or public",
+}, []string{"volume_id", "endpoint"})
+
+func init() {
+	metricsRegistry.MustRegister(volumeEndpointSelections)
+}
+
+// selectKodoEndpoint replaces the S3 endpoint of the volume by its internal one if it's reachable from the node,
+// otherwise the public one is kept, so the nodes out of the internal network still mount the volume
+func selectKodoEndpoint(logger *log.Entry, c *protocol.InitKodoMountCmd) {
+	if c.S3InternalEndpoint == "" || c.S3InternalEndpoint == c.S3Endpoint {
+		return
+	}
+	if address := endpointProbeAddress(c, c.S3InternalEndpoint); address != "" && probeAddress(c, address) {
+		logger.Infof("Internal endpoint %s is reachable, mount %s by it instead of %s", c.S3InternalEndpoint, c.MountPath, c.S3Endpoint)
+		c.S3Endpoint = c.S3InternalEndpoint
+		volumeEndpointSelections.WithLabelValues(c.VolumeId, "internal").Inc()
+		return
+	}
+	logger.Warnf("Internal endpoint %s is unreachable, mount %s by %s", c.S3InternalEndpoint, c.MountPath, c.S3Endpoint)
+	volumeEndpointSelections.WithLabelValues(c.VolumeId, "public").Inc()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Directory prepended to PATH of the mounters, where fusermount is linked to fusermount3 if fuse2 isn't installed
+	FusermountShimDir = "/var/lib/qiniu/storage/csi-plugin/bin"
+)
+
+// fusermountCmd is fusermount3 of fuse3 or fusermount of fuse2 found on the node by detectFusermount, empty if neither is installed
+var fusermountCmd string
+
+// detectFusermount finds fusermount3 or the legacy fusermount, which is no longer installed by default on the distributions shipping fuse3.
+// Either of them unmounts the mount points of both versions, fusermount3 is preferred if both are installed.
+func detectFusermount() (string, error) {
+	var errs []string
+	for _, name := range []string{Fusermount3Cmd, FusermountCmd} {
+		if err := ensureCommandExists(name); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			return name, nil
+		}
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+// unmountFuseLazily detaches the FUSE mount point by fusermount -u -z,
+// or by umount2 directly if no fusermount is installed, which is enough since the connector runs as root
+func unmountFuseLazily(mountPath string) error {
+	if fusermountCmd == "" {
+		return syscall.Unmount(mountPath, syscall.MNT_DETACH)
+	}
+	if output, err := exec.Command(fusermountCmd, "-u", "-z", mountPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", fusermountCmd, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// provideLegacyFusermount links fusermount to fusermount3 under FusermountShimDir and prepends it to PATH, which is inherited by the mounters.
+// Both rclone and kodofs run the legacy fusermount to mount, whose options and protocol are still accepted by fusermount3.
+func provideLegacyFusermount() error {
+	path, err := exec.LookPath(Fusermount3Cmd)
+	if err != nil {
+		return err
+	}
+	if err = ensureDirectoryExists(FusermountShimDir); err != nil {
+		return err
+	}
+	link := filepath.Join(FusermountShimDir, FusermountCmd)
+	// Linked again every time, in case fusermount3 is moved by the upgrade of the node
+	if err = os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err = os.Symlink(path, link); err != nil {
+		return err
+	}
+	return os.Setenv("PATH", FusermountShimDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+var volumeIntegrityChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Subsystem: "volume",
+	Name:      "integrity_checks_total",
+	Help:      "Total number of verifications of the files of the volume against its integrity manifest before mounted, by result",
+}, []string{"volume_id", "result"})
+
+func init() {
+	metricsRegistry.MustRegister(volumeIntegrityChecks)
+}
+
+// verifyKodoIntegrity verifies the files listed in the integrity manifest of the volume by rclone checksum before it's mounted,
+// it fails if any of them is missing or differs from the manifest, or its hash can't be known without downloading it
+func verifyKodoIntegrity(logger *log.Entry, c *protocol.InitKodoMountCmd) error {
+	begin := time.Now()
+	err := runRclone(c, func(ctx context.Context) *exec.Cmd {
+		return c.ChecksumCommand(ctx)
+	})
+	if err != nil {
+		volumeIntegrityChecks.WithLabelValues(c.VolumeId, "failed").Inc()
+		return fmt.Errorf("files of %s don't match integrity manifest %s: %w", c.Remote(), c.IntegrityManifest, err)
+	}
+	volumeIntegrityChecks.WithLabelValues(c.VolumeId, "passed").Inc()
+	logger.WithField("duration", time.Since(begin).Seconds()).Infof("Files of %s match integrity manifest %s", c.Remote(), c.IntegrityManifest)
+	return nil
+}
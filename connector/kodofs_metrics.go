@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest time to wait for statfs of a KodoFS mount point, the mount point is considered as down if exceeded
+	KodoFSProbeTimeout = 5 * time.Second
+	// Prefix of the source of KodoFS mount points
+	KodoFSSourcePrefix = "KodoFS-"
+)
+
+// kodofsMounts saves gateway id by mount path of the KodoFS mount points mounted by the connector
+var kodofsMounts sync.Map
+
+var (
+	kodofsMountTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodofs",
+		Name:      "mount_total",
+		Help:      "Total number of KodoFS mount operations by result",
+	}, []string{"result"})
+	kodofsMountDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodofs",
+		Name:      "mount_duration_seconds",
+		Help:      "Duration of successful KodoFS mount operations",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+)
+
+// observeKodoFSMount records the result of a KodoFS mount operation
+func observeKodoFSMount(gatewayID, mountPath string, code int, duration time.Duration) {
+	if code != 0 {
+		kodofsMountTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	kodofsMountTotal.WithLabelValues("success").Inc()
+	kodofsMountDuration.Observe(duration.Seconds())
+	kodofsMounts.Store(mountPath, gatewayID)
+}
+
+// kodofsCollector probes the KodoFS mount points on every scrape.
+// kodofs only reports its statistics to the master, so the connector measures the mount points by statfs like any other client.
+type kodofsCollector struct {
+	up, probeDuration                        *prometheus.Desc
+	capacityBytes, availableBytes, usedBytes *prometheus.Desc
+	inodes, inodesFree                       *prometheus.Desc
+
+	// Mount paths whose statfs is still running, a hung mount point is never probed again until it returns
+	probing sync.Map
+}
+
+func newKodoFSCollector() *kodofsCollector {
+	labels := []string{"gateway_id", "mount_path"}
+	newDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "kodofs", name), help, labels, nil)
+	}
+	return &kodofsCollector{
+		up:             newDesc("up", "Whether the KodoFS mount point responds to statfs in time"),
+		probeDuration:  newDesc("probe_duration_seconds", "Duration of statfs on the KodoFS mount point"),
+		capacityBytes:  newDesc("capacity_bytes", "Total capacity of the KodoFS volume"),
+		availableBytes: newDesc("available_bytes", "Available capacity of the KodoFS volume"),
+		usedBytes:      newDesc("used_bytes", "Used capacity of the KodoFS volume"),
+		inodes:         newDesc("inodes", "Total inodes of the KodoFS volume"),
+		inodesFree:     newDesc("inodes_free", "Free inodes of the KodoFS volume"),
+	}
+}
+
+func (c *kodofsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.up, c.probeDuration, c.capacityBytes, c.availableBytes, c.usedBytes, c.inodes, c.inodesFree} {
+		ch <- desc
+	}
+}
+
+func (c *kodofsCollector) Collect(ch chan<- prometheus.Metric) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		log.Warnf("Failed to read mount info for KodoFS metrics: %s", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, mount := range mounts {
+		if mount.fsType != FuseTypeKodoFS {
+			continue
+		}
+		// kodofs mounts the volume with source KodoFS-<volume>, used if the mount point is mounted before the connector starts
+		gatewayID := strings.TrimPrefix(mount.source, KodoFSSourcePrefix)
+		if value, ok := kodofsMounts.Load(mount.mountPoint); ok {
+			gatewayID = value.(string)
+		}
+		wg.Add(1)
+		go func(gatewayID, mountPath string) {
+			defer wg.Done()
+			c.collectMount(ch, gatewayID, mountPath)
+		}(gatewayID, mount.mountPoint)
+	}
+	wg.Wait()
+}
+
+func (c *kodofsCollector) collectMount(ch chan<- prometheus.Metric, gatewayID, mountPath string) {
+	labels := []string{gatewayID, mountPath}
+	if _, probing := c.probing.LoadOrStore(mountPath, struct{}{}); probing {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0, labels...)
+		return
+	}
+
+	type statfsResult struct {
+		stat syscall.Statfs_t
+		err  error
+	}
+	begin := time.Now()
+	resultCh := make(chan statfsResult, 1)
+	go func() {
+		defer c.probing.Delete(mountPath)
+		var result statfsResult
+		result.err = syscall.Statfs(mountPath, &result.stat)
+		resultCh <- result
+	}()
+
+	select {
+	case result := <-resultCh:
+		ch <- prometheus.MustNewConstMetric(c.probeDuration, prometheus.GaugeValue, time.Since(begin).Seconds(), labels...)
+		if result.err != nil {
+			log.Warnf("Failed to statfs KodoFS mount point %s: %s", mountPath, result.err)
+			ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0, labels...)
+			return
+		}
+		bsize := float64(result.stat.Bsize)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1, labels...)
+		ch <- prometheus.MustNewConstMetric(c.capacityBytes, prometheus.GaugeValue, float64(result.stat.Blocks)*bsize, labels...)
+		ch <- prometheus.MustNewConstMetric(c.availableBytes, prometheus.GaugeValue, float64(result.stat.Bavail)*bsize, labels...)
+		ch <- prometheus.MustNewConstMetric(c.usedBytes, prometheus.GaugeValue, float64(result.stat.Blocks-result.stat.Bfree)*bsize, labels...)
+		ch <- prometheus.MustNewConstMetric(c.inodes, prometheus.GaugeValue, float64(result.stat.Files), labels...)
+		ch <- prometheus.MustNewConstMetric(c.inodesFree, prometheus.GaugeValue, float64(result.stat.Ffree), labels...)
+	case <-time.After(KodoFSProbeTimeout):
+		log.Warnf("KodoFS mount point %s doesn't respond to statfs in %s", mountPath, KodoFSProbeTimeout)
+		ch <- prometheus.MustNewConstMetric(c.probeDuration, prometheus.GaugeValue, time.Since(begin).Seconds(), labels...)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0, labels...)
+	}
+}
+
+func init() {
+	metricsRegistry.MustRegister(newKodoFSCollector(), kodofsMountTotal, kodofsMountDuration)
+}
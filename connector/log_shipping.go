@@ -0,0 +1,280 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Name of the rclone remote of the diagnostics bucket, and of its config file under rcloneConfigDir
+	LogShippingRemote = "qiniu-csi-log-shipping"
+	// Defaults of the config of the log shipping
+	LogShippingDefaultPrefix     = "qiniu-csi-logs"
+	LogShippingDefaultInterval   = time.Hour
+	LogShippingDefaultRetention  = 7 * 24 * time.Hour
+	LogShippingDefaultMaxLogSize = 16 << 20
+)
+
+var (
+	logShippingTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "log_shipping",
+		Name:      "uploads_total",
+		Help:      "Total number of the log archives uploaded to the diagnostics bucket by result",
+	}, []string{"result"})
+	logShippingLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "log_shipping",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last log archive uploaded to the diagnostics bucket",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(logShippingTotal, logShippingLastSuccess)
+}
+
+// logShipper periodically uploads the logs of the connector and of the mounters appended since the last upload to the diagnostics bucket,
+// so that the logs of the nodes which can't be reached by SSH are still available to the support engineers
+type logShipper struct {
+	bucket, prefix       string
+	s3Endpoint, s3Region string
+	accessKey, secretKey string
+	interval, retention  time.Duration
+	maxLogSize           int64
+	hostname             string
+	configPath           string
+	followers            map[string]*logFollower
+}
+
+// logShipping ships the logs if -log-shipping-config is given, nil otherwise
+var logShipping *logShipper
+
+// loadLogShipper loads the config of the log shipping, which is an INI file without sections to keep the keys out of the command line:
+//
+//	bucket = <diagnostics bucket>
+//	s3_endpoint = https://s3.cn-east-1.qiniucs.com
+//	s3_region = cn-east-1
+//	access_key = <access key>
+//	secret_key = <secret key>
+//	prefix = qiniu-csi-logs
+//	interval = 1h
+//	retention = 168h
+//	max_log_size = 16M
+func loadLogShipper(path string) (*logShipper, error) {
+	config, err := goconfig.LoadConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	shipper := &logShipper{
+		bucket:     config.MustValue(goconfig.DEFAULT_SECTION, "bucket"),
+		prefix:     strings.Trim(config.MustValue(goconfig.DEFAULT_SECTION, "prefix", LogShippingDefaultPrefix), "/"),
+		s3Endpoint: config.MustValue(goconfig.DEFAULT_SECTION, "s3_endpoint"),
+		s3Region:   config.MustValue(goconfig.DEFAULT_SECTION, "s3_region"),
+		accessKey:  config.MustValue(goconfig.DEFAULT_SECTION, "access_key"),
+		secretKey:  config.MustValue(goconfig.DEFAULT_SECTION, "secret_key"),
+		interval:   LogShippingDefaultInterval,
+		retention:  LogShippingDefaultRetention,
+		maxLogSize: LogShippingDefaultMaxLogSize,
+		configPath: filepath.Join(rcloneConfigDir, LogShippingRemote+"-"+rcloneCacheId(path)+".conf"),
+		followers:  make(map[string]*logFollower),
+	}
+	for key, value := range map[string]string{"bucket": shipper.bucket, "s3_endpoint": shipper.s3Endpoint, "s3_region": shipper.s3Region, "access_key": shipper.accessKey, "secret_key": shipper.secretKey} {
+		if value == "" {
+			return nil, fmt.Errorf("%s is required in %s", key, path)
+		}
+	}
+	if value := config.MustValue(goconfig.DEFAULT_SECTION, "interval"); value != "" {
+		if shipper.interval, err = time.ParseDuration(value); err != nil || shipper.interval < time.Minute {
+			return nil, fmt.Errorf("invalid interval %s, expect a duration of at least 1m", value)
+		}
+	}
+	if value := config.MustValue(goconfig.DEFAULT_SECTION, "retention"); value != "" {
+		// The archives are kept forever if 0, e.g. when they expire by the lifecycle rules of the bucket
+		if shipper.retention, err = time.ParseDuration(value); err != nil || shipper.retention < 0 {
+			return nil, fmt.Errorf("invalid retention %s, expect a duration, or 0 to keep the archives forever", value)
+		}
+	}
+	if value := config.MustValue(goconfig.DEFAULT_SECTION, "max_log_size"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("invalid max_log_size %s, expect bytes with an optional suffix of K, M, G or T", value)
+		}
+		shipper.maxLogSize = int64(size)
+	}
+	if shipper.hostname, err = os.Hostname(); err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return shipper, nil
+}
+
+// renderRcloneConfig renders the rclone config of the diagnostics bucket in plain text.
+// Unlike the volumes, the archives are private since the logs may reveal the paths and the names of the files.
+func (s *logShipper) renderRcloneConfig() ([]byte, error) {
+	config, _ := goconfig.LoadFromReader(bytes.NewReader([]byte{}))
+
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_TYPE, RCLONE_CONFIG_S3_TYPE)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_PROVIDER, RCLONE_CONFIG_QINIU_PROVIDER)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_ACCESS_KEY, s.accessKey)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_SECRET_KEY, s.secretKey)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_REGION, s.s3Region)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_ENDPOINT, s.s3Endpoint)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_LOCATION_CONSTRAINT, s.s3Region)
+	config.SetValue(LogShippingRemote, RCLONE_CONFIG_KEY_NO_CHECK_BUCKET, RCLONE_CONFIG_BOOL_TRUE)
+
+	var buf bytes.Buffer
+	if err := goconfig.SaveConfigData(config, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nodeRemote returns the directory of the archives of the node in the diagnostics bucket, which is <prefix>/<hostname>
+func (s *logShipper) nodeRemote() string {
+	remote := fmt.Sprintf("%s:%s", LogShippingRemote, s.bucket)
+	if s.prefix != "" {
+		remote += "/" + s.prefix
+	}
+	return remote + "/" + s.hostname
+}
+
+// run ships the logs every interval until the connector exits
+func (s *logShipper) run() {
+	config, err := s.renderRcloneConfig()
+	if err == nil {
+		config, err = encryptRcloneConfig(config, rcloneConfigPassword)
+	}
+	if err == nil {
+		err = os.WriteFile(s.configPath, config, 0600)
+	}
+	if err != nil {
+		log.Errorf("Failed to write rclone config of log shipping, logs are never shipped: %s", err)
+		return
+	}
+	log.Infof("Shipping logs to %s every %s", s.nodeRemote(), s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.ship(); err != nil {
+			logShippingTotal.WithLabelValues("failure").Inc()
+			log.Warnf("Failed to ship logs to %s: %s", s.nodeRemote(), err)
+			continue
+		}
+		logShippingTotal.WithLabelValues("success").Inc()
+		logShippingLastSuccess.SetToCurrentTime()
+	}
+}
+
+// ship uploads the archive of the logs appended since the last upload, then removes the archives older than the retention.
+// The logs are read again next time if the upload fails.
+func (s *logShipper) ship() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+	defer cancel()
+
+	now := time.Now()
+	offsets := make(map[string]int64, len(s.followers))
+	for path, follower := range s.followers {
+		offsets[path] = follower.offset
+	}
+	archive, err := s.archive(now)
+	if err == nil {
+		key := s.nodeRemote() + "/" + now.UTC().Format("20060102-150405") + ".tar.gz"
+		err = s.rclone(ctx, "copyto", archive, key)
+		os.Remove(archive)
+	}
+	if err != nil {
+		for path, follower := range s.followers {
+			follower.offset = offsets[path]
+		}
+		return err
+	}
+
+	if s.retention > 0 {
+		if err = s.rclone(ctx, "delete", "--min-age", fmt.Sprintf("%ds", int64(s.retention.Seconds())), s.nodeRemote()); err != nil {
+			return fmt.Errorf("failed to remove archives older than %s: %w", s.retention, err)
+		}
+	}
+	return nil
+}
+
+// archive writes the logs appended since the last upload with the secrets masked into a temporary tarball, and returns its path
+func (s *logShipper) archive(now time.Time) (string, error) {
+	// Logs of rclone are saved in <rcloneLogDir>/<volume id>/<mount point uuid>.log
+	logFiles, _ := filepath.Glob(filepath.Join(rcloneLogDir, "*", "*.log"))
+	logFiles = append([]string{LogFilename}, logFiles...)
+	found := make(map[string]bool, len(logFiles))
+	for _, logFile := range logFiles {
+		found[logFile] = true
+		if _, ok := s.followers[logFile]; !ok {
+			s.followers[logFile] = &logFollower{path: logFile}
+		}
+	}
+	for path := range s.followers {
+		// Removed once the volume is unmounted
+		if !found[path] {
+			delete(s.followers, path)
+		}
+	}
+
+	file, err := os.CreateTemp("", LogShippingRemote+"-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	prefix := fmt.Sprintf("qiniu-csi-logs-%s-%s", s.hostname, now.UTC().Format("20060102-150405"))
+	bundle := &debugBundle{tarWriter: tar.NewWriter(gzipWriter), prefix: prefix, now: now}
+	for _, logFile := range logFiles {
+		data, err := s.followers[logFile].read(s.maxLogSize)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		name := "connector.log"
+		if logFile != LogFilename {
+			name = filepath.Join("rclone", filepath.Base(filepath.Dir(logFile)), filepath.Base(logFile))
+		}
+		if err = bundle.add(name, data); err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+	if err = bundle.tarWriter.Close(); err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// rclone runs the rclone command against the diagnostics bucket, the keys only reach rclone by the encrypted config
+func (s *logShipper) rclone(ctx context.Context, args ...string) error {
+	flags := []string{"--config", s.configPath, "--user-agent", userAgent + "/log-shipping"}
+	if *caCert != "" {
+		flags = append(flags, "--ca-cert", *caCert)
+	}
+	execCmd := exec.CommandContext(ctx, RcloneCmd, append(flags, args...)...)
+	execCmd.Env = append(os.Environ(), "RCLONE_CONFIG_PASS="+rcloneConfigPassword)
+	if err := protocol.CheckArgs(execCmd, s.accessKey, s.secretKey); err != nil {
+		return err
+	}
+	if output, err := execCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", RcloneCmd, args[0], err, bytes.TrimSpace(redactLog(output)))
+	}
+	return nil
+}
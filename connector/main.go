@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -12,8 +13,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/qiniu/csi-driver/protocol"
@@ -30,12 +33,26 @@ const (
 	SocketPath = "/var/lib/qiniu/storage/csi-plugin/connector.sock"
 	// Connector name
 	ConnectorName = "connector.csi-plugin.storage.qiniu.com"
-	// Fusermount executable name
+	// Fusermount executable name of fuse2
 	FusermountCmd = "fusermount"
+	// Fusermount executable name of fuse3
+	Fusermount3Cmd = "fusermount3"
 	// KodoFS executable name
 	KodoFSCmd = protocol.KodoFSCmd
 	// Rclone executable name
 	RcloneCmd = protocol.RcloneCmd
+	// Filesystem type of rclone mount points
+	FuseTypeRclone = "fuse.rclone"
+	// Filesystem type of kodofs mount points
+	FuseTypeKodoFS = "fuse.KodoFS"
+	// Deadline of every command sent through a connection
+	ConnDeadline = 30 * time.Second
+	// How long a connection kept alive by the plugin waits for the next command
+	KeepAliveIdleTimeout = 2 * time.Minute
+	// How often the heartbeats are sent to the plugins asking for them while the commands run
+	HeartbeatInterval = 10 * time.Second
+	// The connection is closed once the plugin answers no heartbeat for so long
+	HeartbeatTimeout = 3 * HeartbeatInterval
 )
 
 var (
@@ -48,7 +65,27 @@ var (
 	// BUILDTIME is CSI Driver Buildtime
 	BUILDTIME = ""
 
-	isTest = flag.Bool("test", false, "To test whether the connect could start or not")
+	isTest                   = flag.Bool("test", false, "To test whether the connect could start or not")
+	caCert                   = flag.String("ca-cert", "", "Path of the PEM encoded CA bundle trusted by all Kodo mounts, in addition to the CA certificate of each volume")
+	instanceMetadataEndpoint = flag.String("instance-metadata-endpoint", "http://169.254.169.254", "Endpoint of the instance metadata service to retrieve temporary credentials of instance roles")
+	metricsAddress           = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. 127.0.0.1:9810, disabled if empty")
+	otlpEndpoint             = flag.String("otlp-endpoint", "", "OTLP gRPC endpoint to export traces to, e.g. 127.0.0.1:4317, disabled if empty")
+	otlpInsecure             = flag.Bool("otlp-insecure", false, "Export traces to the OTLP endpoint without TLS")
+	logFormat                = flag.String("log-format", "text", "Format of the logs, text or json")
+	logLevel                 = flag.String("log-level", "info", "Minimum level of the logs, one of debug, info, warning and error")
+	shareKodoMounts          = flag.Bool("share-kodo-mounts", false, "Back the Kodo volumes of the same bucket, sub directory, credentials and options on the node by a single rclone mounter, bind mounted to each mount path")
+	slowOperationThreshold   = flag.Duration("slow-operation-threshold", 30*time.Second, "Mounter startups and commands taking longer are logged and counted as slow operations with the slowest stage, 0 to disable")
+	mounterMemoryLimit       = flag.String("mounter-memory-limit", "", "Memory limit of each mounter, e.g. 2G, enforced by its own cgroup v2 under the delegated cgroup of the connector service, unlimited if empty")
+	mounterCpuLimit          = flag.Float64("mounter-cpu-limit", 0, "CPU limit of each mounter in cores, e.g. 1.5, enforced by its own cgroup v2 under the delegated cgroup of the connector service, unlimited if 0")
+	enableMounterCgroups     = flag.Bool("mounter-cgroups", false, "Place each mounter into its own cgroup v2 with both the memory and the cpu controllers enabled, so the mounters are limited by the limits of their volumes even without -mounter-memory-limit and -mounter-cpu-limit")
+	remountAfterPartition    = flag.Duration("remount-after-partition", 5*time.Minute, "Refresh or restart the rclone mounters failing while their Kodo endpoints are unreachable for so long, once the endpoints are reachable again, 0 to disable")
+	hostAliases              = flag.String("host-aliases", "", "Comma-separated pairs of the host names of the Kodo endpoints and their IP addresses, e.g. s3.example.com=10.0.0.1, used by all mounters instead of the DNS of the node")
+	nameservers              = flag.String("nameservers", "", "Comma-separated DNS servers resolving the Kodo endpoints for all mounters instead of the ones of the node, e.g. 10.0.0.53,10.0.0.54:5353")
+	listenAddress            = flag.String("listen-address", "", "TCP address to accept the plugins of other nodes on besides the unix socket, e.g. :9443, with mutual TLS by -tls-cert, -tls-key and -tls-client-ca, disabled if empty")
+	tlsCert                  = flag.String("tls-cert", "", "Path of the PEM encoded server certificate of -listen-address")
+	tlsKey                   = flag.String("tls-key", "", "Path of the PEM encoded private key of -tls-cert")
+	tlsClientCa              = flag.String("tls-client-ca", "", "Path of the PEM encoded CA bundle the client certificates of the plugins connecting to -listen-address must be signed by")
+	logShippingConfig        = flag.String("log-shipping-config", "", "Path of the config of the diagnostics bucket the logs of the connector and the mounters are periodically uploaded to, disabled if empty")
 
 	rcloneConfigDir, rcloneCacheDir, rcloneLogDir string
 	rcloneVersion, osVersion, osKernel            string
@@ -56,8 +93,25 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == DebugBundleCommand {
+		// Collected by the support engineers, so it's never started as the daemon
+		os.Exit(runDebugBundle(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == MountsCommand {
+		// Run on the host to debug the mounts, it only asks the connector daemon for the state
+		os.Exit(runMounts(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == CleanupCommand {
+		// Run on the host by hand once a mount is stuck, it asks the connector daemon to stop the mounter if it's reachable
+		os.Exit(runCleanup(os.Args[2:]))
+	}
 	flag.Parse()
 
+	if err := setLogFormat(*logFormat, *logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log settings: %s", err)
+		os.Exit(1)
+	}
+
 	log.Infof("CSI Connector Version: %s, CommitID: %s, Build time: %s\n", VERSION, COMMITID, BUILDTIME)
 
 	var err error
@@ -80,28 +134,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	if userConfigDir, err := os.UserConfigDir(); err != nil {
-		rcloneConfigDir = filepath.Join(os.TempDir(), ".rclone", "config")
-	} else {
-		rcloneConfigDir = filepath.Join(userConfigDir, "rclone")
-	}
-
-	if userCacheDir, err := os.UserCacheDir(); err != nil {
-		rcloneCacheDir = filepath.Join(os.TempDir(), ".rclone", "cache")
-	} else {
-		rcloneCacheDir = filepath.Join(userCacheDir, "rclone")
-	}
-
-	if userLogDir, err := userLogDir(); err != nil {
-		rcloneLogDir = filepath.Join(os.TempDir(), ".rclone", "log")
-	} else {
-		rcloneLogDir = filepath.Join(userLogDir, "rclone")
-	}
+	resolveRcloneDirs()
 
 	if err = ensureDirectoryExists(rcloneConfigDir); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to ensure directory %s exists: %s", rcloneConfigDir, err)
 		os.Exit(1)
 	}
+	if err = removeStaleRcloneConfigFiles(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to remove stale config files in %s: %s", rcloneConfigDir, err)
+		os.Exit(1)
+	}
+	if err = initRcloneConfigPassword(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate password of rclone config: %s", err)
+		os.Exit(1)
+	}
 	if err = ensureDirectoryExists(rcloneCacheDir); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to ensure directory %s exists: %s", rcloneCacheDir, err)
 		os.Exit(1)
@@ -111,23 +157,66 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := ensureCommandExists(KodoFSCmd); err != nil {
-		log.Errorf("Please make sure kodofs is installed in PATH: %s", err)
+	for _, mounter := range listMounters() {
+		if err = mounter.Validate(); err != nil {
+			log.Errorf("Unsupported %s: %s", mounter.Name(), err)
+			os.Exit(1)
+		}
+	}
+	if fusermountCmd, err = detectFusermount(); err != nil {
+		log.Warnf("Neither fusermount3 nor fusermount for linux/%s is installed in PATH, the mount points are unmounted by umount2 instead: %s", runtime.GOARCH, err)
+	} else if _, err = exec.LookPath(FusermountCmd); err != nil {
+		if err = provideLegacyFusermount(); err != nil {
+			log.Errorf("Failed to provide fusermount of fuse3 to the mounters: %s", err)
+			os.Exit(1)
+		}
+		log.Infof("Only fuse3 is installed, fusermount of the mounters is linked to %s under %s", Fusermount3Cmd, FusermountShimDir)
+	}
+
+	if err = protocol.CheckFuse(); err != nil {
+		log.Errorf("FUSE is not usable on the node: %s", err)
 		os.Exit(1)
 	}
-	if err := ensureCommandExists(RcloneCmd); err != nil {
-		log.Errorf("Please make sure rclone is installed in PATH: %s", err)
+
+	log.Infof("rclone version: %s, kodofs version: %s, kodofs features: %+v, fusermount: %s, arch: %s", rcloneVersion, kodofsVersion, kodofsFeatures, fusermountCmd, runtime.GOARCH)
+
+	if *caCert != "" {
+		if *caCert, err = filepath.Abs(*caCert); err != nil {
+			log.Errorf("Failed to get absolute path of CA certificate: %s", err)
+			os.Exit(1)
+		}
+		if _, err = os.Stat(*caCert); err != nil {
+			log.Errorf("Failed to access CA certificate %s: %s", *caCert, err)
+			os.Exit(1)
+		}
+	}
+
+	if mounterLimits, err = newMounterCgroups(*enableMounterCgroups, *mounterMemoryLimit, *mounterCpuLimit); err != nil {
+		log.Errorf("Invalid limits of the mounters: %s", err)
 		os.Exit(1)
 	}
-	if err := ensureCommandExists(FusermountCmd); err != nil {
-		log.Errorf("Please make sure fusermount is installed in PATH: %s", err)
+	if connectorHostAliases, err = protocol.ParseHostAliases(*hostAliases); err != nil {
+		log.Errorf("Invalid host aliases: %s", err)
 		os.Exit(1)
 	}
-
-	if rcloneVersion, osVersion, osKernel, err = getRcloneVersion(); err != nil {
-		log.Errorf("Failed to get rclone version", err)
+	if connectorNameservers, err = protocol.ParseNameservers(*nameservers); err != nil {
+		log.Errorf("Invalid nameservers: %s", err)
 		os.Exit(1)
 	}
+	if *logShippingConfig != "" {
+		if logShipping, err = loadLogShipper(*logShippingConfig); err != nil {
+			log.Errorf("Invalid config of log shipping: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	var remoteTLSConfig *tls.Config
+	if *listenAddress != "" {
+		if remoteTLSConfig, err = loadRemoteTLSConfig(*tlsCert, *tlsKey, *tlsClientCa); err != nil {
+			log.Errorf("Invalid TLS of %s: %s", *listenAddress, err)
+			os.Exit(1)
+		}
+	}
 
 	if *isTest {
 		os.Exit(0)
@@ -142,7 +231,7 @@ func main() {
 		LogFilePerm: 0640,
 		WorkDir:     "./",
 		Umask:       077,
-		Args:        []string{ConnectorName},
+		Args:        append([]string{ConnectorName}, os.Args[1:]...),
 	}
 	child, err := daemonCtx.Reborn()
 	if err != nil {
@@ -157,6 +246,15 @@ func main() {
 	// Now we're in the child process, continue
 	log.Infoln("Starting connector as daemon ...")
 
+	// Set up in the daemon, which is the process left in the cgroup of the service
+	if mounterLimits != nil {
+		if err = mounterLimits.setup(); err != nil {
+			log.Errorf("Failed to limit the mounters: %s", err)
+			os.Exit(1)
+		}
+		log.Infof("Mounters are limited by the cgroups under %s", mounterLimits.dir)
+	}
+
 	if err = ensureDirectoryExists(sockDir); err != nil {
 		log.Errorf("Failed to ensure directory %s exists: %s", sockDir, err)
 		os.Exit(1)
@@ -171,280 +269,599 @@ func main() {
 		os.Exit(1)
 	}
 	defer socket.Close()
-	log.Infoln("Connector daemon is started ...")
-
-	for {
-		conn, err := socket.Accept()
+	if remoteTLSConfig != nil {
+		remote, err := tls.Listen("tcp", *listenAddress, remoteTLSConfig)
 		if err != nil {
-			log.Infof("Failed to accept connection: %s", err)
-			continue
+			log.Errorf("Failed to listen on %s: %s", *listenAddress, err)
+			os.Exit(1)
 		}
-		conn.SetDeadline(time.Now().Add(30 * time.Second))
-
-		cmdIn := make(chan protocol.Cmd)
-		cmdOut := make(chan protocol.Cmd)
-		go handleConn(conn, cmdIn, cmdOut)
-		go handleCmd(cmdIn, cmdOut)
+		defer remote.Close()
+		log.Infof("Accepting remote plugins on %s", *listenAddress)
+		go acceptConns(remote)
+	}
+	if *metricsAddress != "" {
+		serveMetrics(*metricsAddress)
+		go pollTransferUsage()
 	}
+	if *otlpEndpoint != "" {
+		if err = initTracing(*otlpEndpoint, *otlpInsecure); err != nil {
+			log.Errorf("Failed to export traces to %s: %s", *otlpEndpoint, err)
+			os.Exit(1)
+		}
+	}
+	// The mounters of the draining mount points are stopped together with the previous connector
+	if err = cleanupDrainingKodoMounts(); err != nil {
+		log.Warnf("Failed to clean up draining Kodo mounts: %s", err)
+	}
+	if *shareKodoMounts {
+		if err = recoverSharedKodoMounts(); err != nil {
+			log.Warnf("Failed to recover shared Kodo mounts: %s", err)
+		}
+	}
+	if logShipping != nil {
+		go logShipping.run()
+	}
+	if *remountAfterPartition > 0 {
+		go watchPartitions()
+	}
+	log.Infoln("Connector daemon is started ...")
+
+	acceptConns(socket)
 }
 
-func handleConn(conn net.Conn, cmdIn <-chan protocol.Cmd, cmdOut chan<- protocol.Cmd) {
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	wg.Add(1)
+// serveConn runs the commands sent through the connection one after another.
+// The connection is closed once the first command terminates, unless the plugin asks to keep it alive for the next command.
+func serveConn(conn net.Conn) {
+	defer conn.Close()
 
-	go func() {
-		defer wg.Done()
-		defer conn.Close()
+	requests := make(chan *protocol.Request)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go readRequests(conn, requests, stopped)
+	// Numbers the responses of all the commands sent through the connection
+	frames := new(protocol.FrameSequence)
 
-		marshalToConn := func(conn net.Conn, cmdName string, cmd protocol.Cmd) {
-			bytes, err := json.Marshal(cmd)
-			if err != nil {
-				log.Errorf("Protocol marshal error: %s", err)
-				return
-			}
-			bytes, err = json.Marshal(protocol.Request{
-				Version: protocol.Version,
-				Cmd:     cmdName,
-				Payload: json.RawMessage(bytes),
-			})
-			if err != nil {
-				log.Errorf("Protocol marshal error: %s", err)
-				return
-			}
-			if _, err = conn.Write(bytes); err != nil {
-				log.Errorf("Write into conn error: %s", err)
-				return
-			}
-			if _, err = conn.Write([]byte("\n")); err != nil {
-				log.Errorf("Write into conn error: %s", err)
+	conn.SetDeadline(time.Now().Add(ConnDeadline))
+	var request *protocol.Request
+	for {
+		if request == nil {
+			var ok bool
+			if request, ok = <-requests; !ok {
 				return
 			}
 		}
+		if request.Cmd == protocol.HeartbeatCmdName || request.Cmd == protocol.AckDataCmdName {
+			// Answers the last heartbeat of the previous command, or acknowledges its last responses
+			request = nil
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(ConnDeadline))
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case cmd := <-cmdIn:
-				switch cmd.(type) {
-				case *protocol.ResponseDataCmd:
-					marshalToConn(conn, protocol.ResponseDataCmdName, cmd)
-				case *protocol.TerminateCmd:
-					marshalToConn(conn, protocol.TerminateCmdName, cmd)
-				}
-			}
+		terminated, next := newSession(conn, frames).run(request, requests)
+		if !terminated || !request.KeepAlive {
+			return
 		}
-	}()
+		if request = next; request == nil {
+			// Idle until the plugin sends the next command or closes the connection
+			conn.SetDeadline(time.Now().Add(KeepAliveIdleTimeout))
+		}
+	}
+}
 
-	defer wg.Wait()
-	defer cancel()
-	defer close(cmdOut)
+// readRequests reads the requests from the connection until it's closed or stopped is closed, then closes the channel
+func readRequests(conn net.Conn, requests chan<- *protocol.Request, stopped <-chan struct{}) {
+	defer close(requests)
 
+	var frames protocol.FrameSequence
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
-		var request protocol.Request
-		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+		request := new(protocol.Request)
+		if err := json.Unmarshal(scanner.Bytes(), request); err != nil {
 			log.Warnf("Protocol parse error: %s", err)
 			return
 		} else if request.Version != protocol.Version {
 			log.Warnf("Unrecognized protocol version: %s", request.Version)
 			return
+		} else if err = frames.Check(request); err != nil {
+			// Nothing received through the connection could be trusted anymore, the running command is stopped as the connection is gone
+			log.Warnf("Protocol desynchronized: %s, the connection is closed", err)
+			desynchronizedConnectionTotal.Inc()
+			return
 		}
-		switch request.Cmd {
-		case protocol.InitKodoFsMountCmdName:
-			payload := new(protocol.InitKodoFSMountCmd)
-			if err := json.Unmarshal([]byte(request.Payload), payload); err != nil {
-				log.Warnf("Protocol %s payload parse error: %s", request.Cmd, err)
-				return
-			} else {
-				log.Infof("Received initKodoFsMountCmd: %#v", payload)
-				cmdOut <- payload
-			}
-		case protocol.InitKodoMountCmdName:
-			payload := new(protocol.InitKodoMountCmd)
-			if err := json.Unmarshal([]byte(request.Payload), payload); err != nil {
-				log.Warnf("Protocol %s payload parse error: %s", request.Cmd, err)
-				return
-			} else {
-				log.Infof("Received initKodoMountCmd: %#v", payload)
-				cmdOut <- payload
-			}
-		case protocol.RequestDataCmdName:
-			payload := new(protocol.RequestDataCmd)
-			if err := json.Unmarshal([]byte(request.Payload), payload); err != nil {
-				log.Warnf("Protocol %s payload parse error: %s", request.Cmd, err)
-				return
-			} else {
-				log.Infof("Received requestDataCmd: %#v", payload)
-				cmdOut <- payload
-			}
-		case protocol.KodoUmountCmdName:
-			payload := new(protocol.KodoUmountCmd)
-			if err := json.Unmarshal([]byte(request.Payload), payload); err != nil {
-				log.Warnf("Protocol %s payload parse error: %s", request.Cmd, err)
-				return
-			} else {
-				log.Infof("Received kodoUmountCmd: %#v", payload)
-				cmdOut <- payload
-			}
-		default:
-			log.Warnf("Unrecognized request cmd: %s", request.Cmd)
+		select {
+		case requests <- request:
+		case <-stopped:
 			return
 		}
 	}
-	if err := scanner.Err(); err != nil {
+	if err := scanner.Err(); errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Debugf("Read from conn error: %s", err)
+	} else if err != nil && !errors.Is(err, net.ErrClosed) {
 		log.Warnf("Read from conn error: %s", err)
-		return
 	}
 }
 
-func handleCmd(cmdOut chan<- protocol.Cmd, cmdIn <-chan protocol.Cmd) {
-	defer close(cmdOut)
+// handleCmd runs the command of the session, and replies its responses through the session until it terminates.
+// It stops once the session finishes, e.g. the connection is gone, and the processes run for the command are killed then.
+func handleCmd(s *session, cmd protocol.Cmd) {
+	if _, ok := cmd.(*protocol.PingCmd); ok {
+		// Replied at once without being logged, see session.run
+		s.reply(&protocol.TerminateCmd{Code: 0})
+		return
+	}
+	ctx, logger := s.ctx, s.cc.logger(cmd)
+	logger.Infof("Execute cmd: %#v", redactCmd(cmd))
 
 	var (
-		isClosed         uint32         = 0
-		execCmd          *exec.Cmd      = nil
-		rcloneConfigPath string         = ""
-		stdin            io.WriteCloser = nil
-		stdout           io.ReadCloser  = nil
-		stderr           io.ReadCloser  = nil
+		stdin  io.WriteCloser = nil
+		stdout io.ReadCloser  = nil
+		stderr io.ReadCloser  = nil
+		// Guards stdin, stdout and stderr which are replaced by each command in the sequence
+		pipesLock sync.Mutex
 	)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	defer func() {
-		atomic.StoreUint32(&isClosed, 1)
-
-		if stdin != nil {
-			stdin.Close()
-		}
-		if stdout != nil {
-			stdout.Close()
-		}
-		if stderr != nil {
-			stderr.Close()
+		pipesLock.Lock()
+		defer pipesLock.Unlock()
+		for _, closer := range []io.Closer{stdin, stdout, stderr} {
+			if closer != nil {
+				closer.Close()
+			}
 		}
 	}()
 
 	outputReader := func(name string, output io.Reader, isError bool) {
 		for {
 			buf := make([]byte, 4096)
-			n, err := stdout.Read(buf)
+			n, err := output.Read(buf)
 			if err != nil {
 				if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
 					return
 				}
-				log.Errorf("Failed to read from %s: %s", name, err)
+				logger.Errorf("Failed to read from %s: %s", name, err)
 				return
 			}
-			if atomic.LoadUint32(&isClosed) > 0 {
+			if !s.reply(&protocol.ResponseDataCmd{Data: string(buf[:n]), IsError: isError}) {
 				return
 			}
-			cmdOut <- &protocol.ResponseDataCmd{Data: string(buf[:n]), IsError: isError}
 		}
 	}
 
-	execCommand := func(ec *exec.Cmd, afterRun func()) bool {
+	preparePipes := func(ec *exec.Cmd) error {
 		var err error
-		if execCmd != nil {
-			log.Warnf("Received duplicated init cmd, which is unacceptable")
-			return false
+		pipesLock.Lock()
+		defer pipesLock.Unlock()
+
+		// Pipes of the previous command in the sequence are useless now
+		for _, closer := range []io.Closer{stdin, stdout, stderr} {
+			if closer != nil {
+				closer.Close()
+			}
 		}
-		execCmd = ec
-		stdin, err = execCmd.StdinPipe()
-		if err != nil {
-			log.Errorf("Failed to create stdin pipe: %s", err)
-			return false
+		stdin, stdout, stderr = nil, nil, nil
+		if stdin, err = ec.StdinPipe(); err != nil {
+			return fmt.Errorf("failed to create stdin pipe: %w", err)
 		}
-		stdout, err = execCmd.StdoutPipe()
-		if err != nil {
-			log.Errorf("Failed to create stdout pipe: %s", err)
-			return false
+		if stdout, err = ec.StdoutPipe(); err != nil {
+			return fmt.Errorf("failed to create stdout pipe: %w", err)
 		}
 		go outputReader("stdout", stdout, false)
-		stderr, err = execCmd.StderrPipe()
-		if err != nil {
-			log.Errorf("Failed to create stderr pipe: %s", err)
-			return false
+		if stderr, err = ec.StderrPipe(); err != nil {
+			return fmt.Errorf("failed to create stderr pipe: %w", err)
 		}
 		go outputReader("stderr", stderr, true)
+		return nil
+	}
+
+	// execCommands runs the commands one by one in background and stops at the first failed one, then terminates the command
+	execCommands := func(operation string, ecs []*exec.Cmd, afterRun func(code int), volumeId, mountPath string) {
 		go func() {
-			defer cancel()
-			err := execCmd.Run()
-			if afterRun != nil {
-				afterRun()
-			}
-			if atomic.LoadUint32(&isClosed) > 0 {
-				return
+			code := 0
+			timer := newStageTimer(operation)
+			for _, ec := range ecs {
+				timer.next(strings.Join(ec.Args[:2], " "))
+				if err := preparePipes(ec); err != nil {
+					logger.Errorf("Failed to prepare command (%s): %s", ec, err)
+					code = 1
+					break
+				}
+				_, ecSpan := startMounterSpan(s.cc.context(), "exec "+strings.Join(ec.Args[:2], " "), volumeId, mountPath)
+				begin := time.Now()
+				err := ec.Run()
+				endSpan(ecSpan, err)
+				if ec.ProcessState != nil {
+					code = ec.ProcessState.ExitCode()
+				} else {
+					code = 1
+				}
+				if err != nil {
+					logger.Warnf("Failed to run command (%s): %s", ec, err)
+					break
+				} else {
+					logger.WithField("duration", time.Since(begin).Seconds()).Infof("Run command (%s) successfully", ec)
+				}
 			}
-			cmdOut <- &protocol.TerminateCmd{Code: execCmd.ProcessState.ExitCode()}
-			if err != nil {
-				log.Warnf("Failed to run command (%s): %s", execCmd, err)
-			} else {
-				log.Infof("Run command (%s) successfully", execCmd)
+			timer.done(logger)
+			if afterRun != nil {
+				afterRun(code)
 			}
+			s.reply(&protocol.TerminateCmd{Code: code})
 		}()
-		return true
 	}
 
-	for {
-		var err error
-		select {
-		case cmd, ok := <-cmdIn:
-			if !ok {
-				return
-			}
-			log.Infof("Execute cmd: %#v", cmd)
-			switch c := cmd.(type) {
-			case *protocol.InitKodoFSMountCmd:
-				if ok := execCommand(c.ExecCommand(ctx), nil); !ok {
-					return
-				}
-			case *protocol.InitKodoMountCmd:
-				if rcloneConfigPath, err = writeRcloneConfig(c); err != nil {
-					log.Warnf("Failed to write rclone config: %s", err)
-					return
-				}
-				uuid := rcloneCacheId(c.MountPath)
-				volumeCacheDir := filepath.Join(rcloneCacheDir, c.VolumeId, uuid)
-				if err = ensureDirectoryExists(volumeCacheDir); err != nil {
-					log.Errorf("Failed to ensure directory %s exists: %s", volumeCacheDir, err)
-					return
-				}
-				rcloneLogFile := filepath.Join(rcloneLogDir, c.VolumeId, uuid+".log")
-				if err = ensureDirectoryExists(filepath.Dir(rcloneLogFile)); err != nil {
-					log.Errorf("Failed to ensure directory %s exists: %s", filepath.Dir(rcloneLogFile), err)
-					return
-				}
-				ctx = context.WithValue(ctx, protocol.ContextKeyConfigFilePath, rcloneConfigPath)
-				ctx = context.WithValue(ctx, protocol.ContextKeyUserAgent, userAgent)
-				ctx = context.WithValue(ctx, protocol.ContextKeyLogFilePath, rcloneLogFile)
-				ctx = context.WithValue(ctx, protocol.ContextKeyCacheDirPath, volumeCacheDir)
-				if ok := execCommand(c.ExecCommand(ctx), func() { os.Remove(rcloneConfigPath) }); !ok {
-					return
-				}
-			case *protocol.KodoUmountCmd:
-				uuid := rcloneCacheId(c.MountPath)
-				volumeCacheDir := filepath.Join(rcloneCacheDir, c.VolumeId, uuid)
-				rcloneLogFile := filepath.Join(rcloneLogDir, c.VolumeId, uuid+".log")
-				os.RemoveAll(volumeCacheDir)
-				os.Remove(rcloneLogFile)
-				os.Remove(filepath.Dir(rcloneLogFile))
-				os.Remove(filepath.Dir(volumeCacheDir))
-			case *protocol.RequestDataCmd:
-				if stdin == nil {
-					log.Warnf("Received RequestDataCmd when process is not started")
+	var err error
+	switch c := cmd.(type) {
+	case *protocol.InitKodoFSMountCmd:
+		var ecs []*exec.Cmd
+		if err = checkMountConn(s.conn, c.MountPath, nil); err != nil {
+			logger.Warnf("Refused to mount %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+			return
+		}
+		if err = protocol.CheckFuse(); err == nil {
+			ecs, err = getMounter(KodoFSCmd).BuildCommand(ctx, c)
+		}
+		if err != nil {
+			logger.Warnf("Failed to mount %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+			return
+		}
+		begin := time.Now()
+		afterRun := func(code int) {
+			observeKodoFSMount(c.GatewayID, c.MountPath, code, time.Since(begin))
+		}
+		execCommands("mount "+KodoFSCmd, ecs, afterRun, c.GatewayID, c.MountPath)
+		// The prompts of kodofs are answered by the plugin, stdin is always redirected to the running one
+		for {
+			select {
+			case data := <-s.data:
+				pipesLock.Lock()
+				w := stdin
+				pipesLock.Unlock()
+				if w == nil {
+					logger.Warnf("Received RequestDataCmd when process is not started")
 					return
 				}
-				if _, err = stdin.Write([]byte(c.Data)); err != nil {
-					log.Warnf("Failed to write data into stdin: %s", err)
+				if _, err = w.Write([]byte(data.Data)); err != nil {
+					logger.Warnf("Failed to write data into stdin: %s", err)
 					return
 				}
+				s.ackData()
+			case <-ctx.Done():
+				return
+			}
+		}
+	case *protocol.InitKodoMountCmd:
+		begin := time.Now()
+		if err = checkMountConn(s.conn, c.MountPath, c.CredentialSource); err != nil {
+			logger.Warnf("Refused to mount %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+			return
+		}
+		// The credential files of the volumes are read in the root directory of the Kodo CSI plugin
+		recordKodoPluginPid(s.conn)
+		selectKodoEndpoint(logger, c)
+		if c.IntegrityManifest != "" {
+			// Verified every time the volume is published, since the bucket may be changed by others since then
+			err = verifyKodoIntegrity(logger, c)
+		}
+		if err == nil {
+			err = mountKodo(s.cc, logger, c)
+		}
+		if err == nil && !c.SyncMode {
+			// The mounter may be mounted but not functional, e.g. the bucket isn't accessible by the credentials
+			if err = getMounter(RcloneCmd).HealthCheck(c.MountPath, c.MountCheck); err != nil {
+				err = fmt.Errorf("mount point is not functional: %w", err)
+				umountKodo(logger, c.VolumeId, c.MountPath)
+			}
+		}
+		if err != nil {
+			logger.Warnf("Failed to mount %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+		} else {
+			logger.WithField("duration", time.Since(begin).Seconds()).Infof("Mounted %s", c.MountPath)
+			if len(c.Prewarm) > 0 || c.PrewarmManifest != "" {
+				go prewarmKodo(logger, c)
+			}
+			s.reply(&protocol.TerminateCmd{Code: 0})
+		}
+	case *protocol.KodoUmountCmd:
+		umountKodo(logger, c.VolumeId, c.MountPath)
+		// The plugin closes the connection without waiting for the reply, unless it's kept alive
+		if s.cc.keepAlive {
+			s.reply(&protocol.TerminateCmd{Code: 0})
+		}
+	case *protocol.KodoFlushCmd:
+		if _, synced := syncedKodoMounts.Load(c.MountPath); synced {
+			// Nothing is cached by the volume in the sync mode, it's copied back once unmounted
+			s.reply(&protocol.TerminateCmd{Code: 0})
+			return
+		}
+		// The dirty files of all volumes sharing the mounter are waited for
+		volumeId, mountPath := resolveKodoMount(c.VolumeId, c.MountPath)
+		volumeCacheDir := filepath.Join(rcloneCacheDir, volumeId, rcloneCacheId(mountPath))
+		wait, err := time.ParseDuration(c.Wait)
+		if err != nil {
+			logger.Warnf("Invalid wait duration of flush cmd: %s", c.Wait)
+			return
+		}
+		rc, _ := getRcloneRemoteControl(mountPath)
+		// Stops waiting once the plugin is gone
+		dirtyFiles, err := waitForVfsCacheFlushed(ctx, volumeCacheDir, rc, wait)
+		if err != nil {
+			s.replyError(fmt.Sprintf("failed to inspect vfs cache: %s", err))
+		} else if dirtyFiles > 0 {
+			s.replyError(fmt.Sprintf("%d files are not uploaded yet", dirtyFiles))
+		} else {
+			s.reply(&protocol.TerminateCmd{Code: 0})
+		}
+	case *protocol.KodoDetachCmd:
+		if err = detachKodo(logger, c); err != nil {
+			logger.Warnf("Failed to detach %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+		} else {
+			s.reply(&protocol.TerminateCmd{Code: 0})
+		}
+	case *protocol.UmountCmd:
+		// Sent by the plugin running without privilege, which can't unmount in its own mount namespace
+		flags := syscall.MNT_FORCE
+		if c.Lazy {
+			flags = syscall.MNT_DETACH
+		}
+		if err = checkUmountPath(c.MountPath); err != nil {
+			logger.Warnf("Refused to unmount %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+		} else if err = syscall.Unmount(c.MountPath, flags); err != nil {
+			logger.Warnf("Failed to unmount %s: %s", c.MountPath, err)
+			s.replyError(err.Error())
+		} else {
+			logger.Infof("Unmounted %s", c.MountPath)
+			s.reply(&protocol.TerminateCmd{Code: 0})
+		}
+	case *protocol.KodoVfsStatsCmd:
+		_, mountPath := resolveKodoMount(c.VolumeId, c.MountPath)
+		replyRcloneRemoteControl(s, mountPath, "vfs/stats", nil)
+	case *protocol.KodoVfsForgetCmd:
+		// Forget the whole directory cache if no path is given
+		params := make(map[string]string, len(c.Paths))
+		for i, path := range c.Paths {
+			params[fmt.Sprintf("dir%d", i+1)] = path
+		}
+		_, mountPath := resolveKodoMount(c.VolumeId, c.MountPath)
+		replyRcloneRemoteControl(s, mountPath, "vfs/forget", params)
+	case *protocol.KodoMountLogsCmd:
+		replyKodoMountLogs(s, c)
+	case *protocol.DebugStateCmd:
+		if state, err := json.Marshal(collectDebugState()); err != nil {
+			s.replyError(err.Error())
+		} else if s.reply(&protocol.ResponseDataCmd{Data: string(state)}) {
+			s.reply(&protocol.TerminateCmd{Code: 0})
+		}
+	case *protocol.RequestDataCmd:
+		logger.Warnf("Received RequestDataCmd when process is not started")
+	}
+}
+
+// mountKodo mounts the volume on the mount path, in the sync mode, with the write cache, shared with other volumes or by its own mounter
+func mountKodo(cc *connContext, logger *log.Entry, c *protocol.InitKodoMountCmd) error {
+	if c.SyncMode {
+		// Copied into a directory on the node, FUSE is never used
+		return mountSyncedKodo(logger, c)
+	}
+	// Checked again before each mount, since the module could be unloaded or the device removed after the connector starts
+	if err := protocol.CheckFuse(); err != nil {
+		return err
+	}
+	if c.LocalWriteCache {
+		// Never shared, since the write cache directory belongs to the volume
+		return mountWriteCacheKodo(cc, logger, c)
+	} else if *shareKodoMounts {
+		return mountSharedKodo(cc, logger, c)
+	}
+	return mountRclone(cc, logger, c, nil)
+}
+
+// umountKodo unmounts the volume from the mount path, whichever way it's mounted
+func umountKodo(logger *log.Entry, volumeId, mountPath string) {
+	if !umountSharedKodo(logger, mountPath) && !umountWriteCacheKodo(logger, mountPath, 0, KodoWriteCacheFlushWait) &&
+		!umountSyncedKodo(logger, mountPath, 0) {
+		mounterSupervisor.stop(mountPath)
+		getMounter(RcloneCmd).Cleanup(volumeId, mountPath)
+	}
+	killOrphanedKodoMounters(logger, volumeId, mountPath)
+}
+
+// killOrphanedKodoMounters kills the mounters of the mount path, or of the vanished target paths of the volume,
+// which are not supervised by the connector, e.g. left by the previous connector once the pods are force deleted
+func killOrphanedKodoMounters(logger *log.Entry, volumeId, mountPath string) {
+	mounters, err := findMounterProcesses()
+	if err != nil {
+		logger.Warnf("Failed to find mounters left of %s: %s", mountPath, err)
+		return
+	}
+	supervised := make(map[string]bool)
+	for _, status := range mounterSupervisor.list() {
+		supervised[status.MountPath] = true
+	}
+	for _, mounter := range mounters {
+		if supervised[mounter.mountPath] {
+			continue
+		} else if mounter.mountPath != filepath.Clean(mountPath) {
+			if volumeId == "" || mounter.volumeId != volumeId || !isVolumeTargetPath(mounter.mountPath, volumeId) {
+				continue
+			} else if _, err := os.Stat(mounter.mountPath); !errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+		}
+		if err := killMounter(mounter.pid); err != nil {
+			logger.Warnf("Failed to kill mounter %d left of %s: %s", mounter.pid, mounter.mountPath, err)
+		} else {
+			logger.Infof("Killed mounter %d left of %s: %s", mounter.pid, mounter.mountPath, mounter.command)
+		}
+	}
+}
+
+// mountRclone starts the rclone mounter supervised by the connector, and returns once it's mounted
+// afterRestarted, if not nil, is called every time the mounter is restarted and mounted again.
+func mountRclone(cc *connContext, logger *log.Entry, c *protocol.InitKodoMountCmd, afterRestarted func()) error {
+	uuid := rcloneCacheId(c.MountPath)
+	volumeCacheDir := filepath.Join(rcloneCacheDir, c.VolumeId, uuid)
+	if err := ensureDirectoryExists(volumeCacheDir); err != nil {
+		logger.Errorf("Failed to ensure directory %s exists: %s", volumeCacheDir, err)
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	rcloneLogFile := filepath.Join(rcloneLogDir, c.VolumeId, uuid+".log")
+	if err := ensureDirectoryExists(filepath.Dir(rcloneLogFile)); err != nil {
+		logger.Errorf("Failed to ensure directory %s exists: %s", filepath.Dir(rcloneLogFile), err)
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	if c.PersistentDirCache != "" {
+		if !acquireKodoDirCache(c.VolumeId, c.MountPath) {
+			logger.Warnf("Persistent directory cache of volume %s is used by another mount point on the node, mount %s without it", c.VolumeId, c.MountPath)
+			c.PersistentDirCache = ""
+		} else if err := ensureDirectoryExists(kodoDirCacheDir(c.VolumeId)); err != nil {
+			releaseKodoDirCache(c.VolumeId, c.MountPath)
+			return fmt.Errorf("failed to create directory cache directory: %w", err)
+		}
+	}
+	if mounterLimits == nil && hasMounterOverrides(c) {
+		logger.Warnf("Limits and weights of volume %s are ignored, the mounters are not placed into cgroups, start the connector with -mounter-cgroups", c.VolumeId)
+	}
+	// Never changed by the restarts, unlike the credentials retrieved again if failed
+	proxy, err := startResolverProxy(c)
+	if err != nil {
+		if c.PersistentDirCache != "" {
+			releaseKodoDirCache(c.VolumeId, c.MountPath)
+		}
+		return fmt.Errorf("failed to start resolver proxy: %w", err)
+	}
+	var rcloneConfigPath, caCertPath string
+	var credentials *credentialsManager
+	// Measures the stages of the first start only, the restarts are logged by the supervisor
+	timer := newStageTimer("mount " + RcloneCmd)
+	mounting := timer
+	// The config is written again on every restart of the mounter, in case it's removed by anyone
+	newCmd := func() (*exec.Cmd, error) {
+		var err error
+		if c.CredentialSource != nil && credentials == nil {
+			if mounting != nil {
+				mounting.next("retrieve credentials")
+			}
+			if credentials, err = startCredentialsManager(c); err != nil {
+				return nil, err
+			}
+		}
+		if mounting != nil {
+			mounting.next("write config")
+		}
+		// Set again on every restart, since the limits are removed together with the cgroup once the mounter is stopped
+		if mounterLimits != nil && hasMounterOverrides(c) {
+			if ignored := mounterLimits.override(c); len(ignored) > 0 {
+				logger.Warnf("The %s of volume %s are ignored, their controllers are not enabled for the mounters, start the connector with -mounter-cgroups",
+					strings.Join(ignored, ", "), c.VolumeId)
+			}
+		}
+		if rcloneConfigPath, err = writeRcloneConfig(c); err != nil {
+			return nil, fmt.Errorf("failed to write rclone config: %w", err)
+		}
+		if caCertPath, err = writeCaCert(c); err != nil {
+			return nil, fmt.Errorf("failed to write CA certificate: %w", err)
+		}
+		rc, err := newRcloneRemoteControl()
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare remote control: %w", err)
+		}
+		rcloneRemoteControls.Store(c.MountPath, rc)
+		kodoMountCmds.Store(c.MountPath, c)
+		// The mounter is supervised by the connector, so it must not be bound to the lifecycle of the connection
+		mounterCtx := context.WithValue(context.Background(), protocol.ContextKeyCaCertFilePath, caCertPath)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyConfigFilePath, rcloneConfigPath)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyConfigPassword, rcloneConfigPassword)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyUserAgent, userAgent)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyLogFilePath, rcloneLogFile)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyCacheDirPath, volumeCacheDir)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyRcAddr, rc.addr)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyRcUser, rc.user)
+		mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyRcPassword, rc.password)
+		if credentials != nil {
+			mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyCredentialsUri, credentials.uri())
+			mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyCredentialsToken, credentials.token)
+		}
+		if proxy != nil {
+			mounterCtx = context.WithValue(mounterCtx, protocol.ContextKeyResolverProxyUrl, proxy.url())
+		}
+		execCmds, err := getMounter(RcloneCmd).BuildCommand(mounterCtx, c)
+		if err != nil {
+			return nil, err
+		}
+		execCmd := execCmds[len(execCmds)-1]
+		secrets := append(c.Secrets(), rcloneConfigPassword, rc.password)
+		if credentials != nil {
+			secrets = append(secrets, credentials.token)
+		}
+		if proxy != nil {
+			secrets = append(secrets, proxy.token)
+		}
+		if err = protocol.CheckArgs(execCmd, secrets...); err != nil {
+			return nil, err
+		}
+		if mounting != nil {
+			mounting.next("wait for mounted")
+			mounting = nil
+		}
+		return execCmd, nil
+	}
+	cleanup := func() {
+		rcloneRemoteControls.Delete(c.MountPath)
+		kodoMountCmds.Delete(c.MountPath)
+		if credentials != nil {
+			credentials.stop()
+		}
+		if rcloneConfigPath != "" {
+			os.Remove(rcloneConfigPath)
+		}
+		if caCertPath != "" && caCertPath != *caCert {
+			os.Remove(caCertPath)
+		}
+		if c.PersistentDirCache != "" {
+			releaseKodoDirCache(c.VolumeId, c.MountPath)
+		}
+		if proxy != nil {
+			proxy.stop()
+		}
+	}
+	_, mountSpan := startMounterSpan(cc.context(), "mount "+RcloneCmd, c.VolumeId, c.MountPath)
+	err = mounterSupervisor.start(c.VolumeId, c.MountPath, FuseTypeRclone, newCmd, afterRestarted, cleanup)
+	endSpan(mountSpan, err)
+	timer.done(logger)
+	if err != nil {
+		return fmt.Errorf("%w, see %s for details", err, rcloneLogFile)
+	}
+	return nil
+}
+
+// removeRcloneFiles removes the cache and the log of the rclone mounter after unmounted
+func removeRcloneFiles(volumeId, mountPath string) {
+	uuid := rcloneCacheId(mountPath)
+	volumeCacheDir := filepath.Join(rcloneCacheDir, volumeId, uuid)
+	rcloneLogFile := filepath.Join(rcloneLogDir, volumeId, uuid+".log")
+	os.RemoveAll(volumeCacheDir)
+	os.Remove(rcloneLogFile)
+	os.Remove(filepath.Dir(rcloneLogFile))
+	os.Remove(filepath.Dir(volumeCacheDir))
+}
+
+// replyRcloneRemoteControl calls remote control of the mounter and replies the json output
+func replyRcloneRemoteControl(s *session, mountPath, method string, params interface{}) {
+	rc, err := getRcloneRemoteControl(mountPath)
+	if err == nil {
+		var output []byte
+		if output, err = rc.call(s.ctx, method, params); err == nil {
+			if s.reply(&protocol.ResponseDataCmd{Data: string(output)}) {
+				s.reply(&protocol.TerminateCmd{Code: 0})
 			}
-		case <-ctx.Done():
 			return
 		}
 	}
+	log.Warnf("Failed to call %s of %s: %s", method, mountPath, err)
+	s.replyError(err.Error())
 }
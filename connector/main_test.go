@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// Commands mounting, unmounting or waiting for the mounts of the node, which are never run by the fuzz targets
+var mountingCmdNames = map[string]bool{
+	protocol.InitKodoMountCmdName:   true,
+	protocol.InitKodoFsMountCmdName: true,
+	protocol.KodoUmountCmdName:      true,
+	protocol.KodoFlushCmdName:       true,
+	protocol.KodoDetachCmdName:      true,
+	protocol.UmountCmdName:          true,
+}
+
+// connSeeds returns the lines sent by the plugins, both sealed and unsealed, and the malformed ones
+func connSeeds() [][]byte {
+	line := func(frames *protocol.FrameSequence, request protocol.Request) []byte {
+		request.Version = protocol.Version
+		if frames != nil {
+			frames.Seal(&request)
+		}
+		buf, _ := json.Marshal(&request)
+		return append(buf, '\n')
+	}
+	seeds := [][]byte{
+		line(nil, protocol.Request{Cmd: protocol.PingCmdName}),
+		line(&protocol.FrameSequence{}, protocol.Request{Cmd: protocol.PingCmdName}),
+		line(nil, protocol.Request{Cmd: protocol.DebugStateCmdName, RequestId: "1"}),
+		line(nil, protocol.Request{Cmd: protocol.KodoVfsStatsCmdName, Payload: []byte(`{"volume_id":"pv-1","mount_path":"/mnt/kodo"}`)}),
+		line(nil, protocol.Request{Cmd: protocol.KodoMountLogsCmdName, Payload: []byte(`{"volume_id":"pv-1","lines":10}`)}),
+		line(nil, protocol.Request{Cmd: protocol.UmountCmdName, Payload: []byte(`{"volume_id":"pv-1","mount_path":"/"}`)}),
+		[]byte("{\n"),
+		[]byte("not json\n"),
+		[]byte(`{"version":"v1","cmd":"ping"}` + "\n"),
+		[]byte(`{"version":"v2","cmd":"ping","seq":2,"checksum":"00000000"}` + "\n"),
+		[]byte(`{"version":"v2","cmd":"ack_data","payload":{"credits":100}}` + "\n"),
+		[]byte(`{"version":"v2","cmd":"request_data","payload":{"data":1}}` + "\n"),
+		bytes.Repeat([]byte("x"), bufio.MaxScanTokenSize+1),
+	}
+
+	// Commands sent one by one through a connection kept alive, with heartbeats and flow control
+	frames := new(protocol.FrameSequence)
+	var keepAlive []byte
+	keepAlive = append(keepAlive, line(frames, protocol.Request{Cmd: protocol.PingCmdName, KeepAlive: true, Heartbeat: true})...)
+	keepAlive = append(keepAlive, line(frames, protocol.Request{Cmd: protocol.HeartbeatCmdName})...)
+	keepAlive = append(keepAlive, line(frames, protocol.Request{Cmd: protocol.DebugStateCmdName, KeepAlive: true, FlowControl: true})...)
+	keepAlive = append(keepAlive, line(frames, protocol.Request{Cmd: protocol.AckDataCmdName, Payload: []byte(`{"credits":1}`)})...)
+	keepAlive = append(keepAlive, line(frames, protocol.Request{Cmd: protocol.RequestDataCmdName, Payload: []byte(`{"data":"y\n"}`)})...)
+	keepAlive = append(keepAlive, line(frames, protocol.Request{Cmd: protocol.PingCmdName})...)
+	return append(seeds, keepAlive)
+}
+
+// skipMountingCmds skips the input sending any valid command mounting or unmounting, since it would change the node,
+// while the invalid ones are still rejected by serveConn
+func skipMountingCmds(t *testing.T, input []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		var request protocol.Request
+		if json.Unmarshal(scanner.Bytes(), &request) != nil || !mountingCmdNames[request.Cmd] {
+			continue
+		} else if _, err := protocol.DecodeCmd(&request); err == nil {
+			t.Skip()
+		}
+	}
+}
+
+// unixConnPair returns both ends of a unix socket, so the client could close its writing half like the plugins
+func unixConnPair(t *testing.T) (*net.UnixConn, net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socket pair: %s", err)
+	}
+	conns := make([]net.Conn, len(fds))
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		if conns[i], err = net.FileConn(file); err != nil {
+			t.Fatalf("failed to create conn: %s", err)
+		}
+		file.Close()
+	}
+	return conns[0].(*net.UnixConn), conns[1]
+}
+
+func FuzzReadRequests(f *testing.F) {
+	for _, seed := range connSeeds() {
+		f.Add(seed)
+	}
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			client.Write(input)
+			client.Close()
+		}()
+
+		requests := make(chan *protocol.Request)
+		stopped := make(chan struct{})
+		defer close(stopped)
+		go readRequests(server, requests, stopped)
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case request, ok := <-requests:
+				if !ok {
+					return
+				} else if request.Version != protocol.Version {
+					t.Fatalf("request of version %q is read", request.Version)
+				}
+			case <-timeout:
+				t.Fatalf("requests are still read after the connection is closed")
+			}
+		}
+	})
+}
+
+func FuzzServeConn(f *testing.F) {
+	for _, seed := range connSeeds() {
+		f.Add(seed)
+	}
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		skipMountingCmds(t, input)
+
+		client, server := unixConnPair(t)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			serveConn(server)
+		}()
+		go func() {
+			// The plugin sends nothing more, but still reads the responses
+			client.Write(input)
+			client.CloseWrite()
+		}()
+
+		// Every response is a well-formed frame sealed by the connector
+		var frames protocol.FrameSequence
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			var response protocol.Request
+			if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+				t.Fatalf("failed to parse response %s: %s", scanner.Bytes(), err)
+			} else if response.Version != protocol.Version {
+				t.Fatalf("response of version %q is written", response.Version)
+			} else if err = frames.Check(&response); err != nil {
+				t.Fatalf("response %s is not sealed: %s", scanner.Bytes(), err)
+			}
+		}
+		client.Close()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection is still served after it's closed")
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Namespace of all metrics exported by the connector
+	MetricsNamespace = "qiniu_csi_connector"
+	// Path of the metrics endpoint
+	MetricsPath = "/metrics"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var deadConnectionTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Name:      "dead_connections_total",
+	Help:      "Total number of connections closed since the plugins stopped answering the heartbeats",
+})
+
+var desynchronizedConnectionTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Name:      "desynchronized_connections_total",
+	Help:      "Total number of connections closed since the frames received are out of sequence or corrupted",
+})
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		deadConnectionTotal,
+		desynchronizedConnectionTotal,
+	)
+}
+
+// serveMetrics serves the metrics endpoint in background, the connector keeps working even if it fails
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{ErrorLog: log.StandardLogger()}))
+	go func() {
+		log.Infof("Serving metrics on %s%s", address, MetricsPath)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Errorf("Failed to serve metrics on %s: %s", address, err)
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// Timeout of verifying the mount point once mounted, which takes longer if the root directory is listed from Kodo
+	MountCheckTimeout = 10 * time.Second
+	// Bytes read from the head of the file by the read check
+	MountCheckReadSize = 4 << 10
+)
+
+// checkKodoMount verifies the mount point of the volume responds to the check, which is none, statfs, list or read.
+// The mount point not responding in MountCheckTimeout is also failed, though the check is still blocked in background.
+func checkKodoMount(mountPath, check string) error {
+	if check == "none" {
+		return nil
+	} else if check == "" {
+		check = "statfs"
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- runKodoMountCheck(mountPath, check)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(MountCheckTimeout):
+		return fmt.Errorf("mount point does not respond to %s check in %s", check, MountCheckTimeout)
+	}
+}
+
+func runKodoMountCheck(mountPath, check string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPath, &stat); err != nil {
+		return fmt.Errorf("statfs error: %w", err)
+	}
+	if check == "statfs" {
+		return nil
+	}
+
+	dir, err := os.Open(mountPath)
+	if err != nil {
+		return fmt.Errorf("open root directory error: %w", err)
+	}
+	defer dir.Close()
+	if check == "list" {
+		if _, err = dir.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("list root directory error: %w", err)
+		}
+		return nil
+	}
+	// The read check lists the directory until the first regular file, the empty volume has nothing to read
+	for {
+		entries, err := dir.ReadDir(32)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("list root directory error: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				return readKodoMountFile(filepath.Join(mountPath, entry.Name()))
+			}
+		}
+	}
+}
+
+func readKodoMountFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open %s error: %w", path, err)
+	}
+	defer file.Close()
+	if _, err = io.ReadFull(file, make([]byte, MountCheckReadSize)); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("read %s error: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+const (
+	// Lines replied for KodoMountLogsCmd from the end of each log file if not given, and the max lines allowed
+	MountLogsDefaultLines = 100
+	MountLogsMaxLines     = 10000
+	// How often the followed log files are checked for the new lines
+	MountLogsFollowInterval = time.Second
+)
+
+// logFollower reads the lines appended to a log file since the last read
+type logFollower struct {
+	path   string
+	offset int64
+}
+
+// read returns the complete lines written since the last read with the secrets masked, at most maxSize bytes from the end.
+// The file is read from the start again once it's truncated.
+func (f *logFollower) read(maxSize int64) ([]byte, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < f.offset {
+		f.offset = 0
+	}
+	start := f.offset
+	if size-start > maxSize {
+		start = size - maxSize
+	}
+	data := make([]byte, size-start)
+	if _, err = file.ReadAt(data, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if start > f.offset {
+		// Drop the partial first line
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		} else {
+			data = nil
+		}
+	}
+	// The last line may be still being written, it's read next time
+	end := bytes.LastIndexByte(data, '\n') + 1
+	f.offset = size - int64(len(data)-end)
+	return redactLog(data[:end]), nil
+}
+
+// lastLines returns the last n lines of the data ending with a newline
+func lastLines(data []byte, n int) []byte {
+	for i := len(data) - 2; i >= 0; i-- {
+		if data[i] == '\n' {
+			if n--; n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
+
+// kodoMountLogFiles returns the log files of the mounter serving the mount path, or of all the mounters of the volume if the mount path is empty
+func kodoMountLogFiles(volumeId, mountPath string) ([]string, error) {
+	if mountPath != "" {
+		volumeId, mountPath = resolveKodoMount(volumeId, mountPath)
+		// Logs of rclone are saved in <rcloneLogDir>/<volume id>/<mount point uuid>.log
+		logFile := filepath.Join(rcloneLogDir, volumeId, rcloneCacheId(mountPath)+".log")
+		if _, err := os.Stat(logFile); err != nil {
+			return nil, fmt.Errorf("no log of the mounter of %s is found: %w", mountPath, err)
+		}
+		return []string{logFile}, nil
+	}
+	logFiles, err := filepath.Glob(filepath.Join(rcloneLogDir, volumeId, "*.log"))
+	if err != nil {
+		return nil, err
+	} else if len(logFiles) == 0 {
+		return nil, fmt.Errorf("no log of the mounters of volume %s is found", volumeId)
+	}
+	return logFiles, nil
+}
+
+// replyKodoMountLogs replies the last lines of the logs of the mounters, then the new lines every MountLogsFollowInterval
+// until the session finishes if following. The files are headed by their paths like tail if there are more than one.
+func replyKodoMountLogs(s *session, c *protocol.KodoMountLogsCmd) {
+	lines := c.Lines
+	if lines <= 0 {
+		lines = MountLogsDefaultLines
+	} else if lines > MountLogsMaxLines {
+		lines = MountLogsMaxLines
+	}
+	logFiles, err := kodoMountLogFiles(c.VolumeId, c.MountPath)
+	if err != nil {
+		s.replyError(err.Error())
+		return
+	}
+	followers := make([]*logFollower, 0, len(logFiles))
+	for _, logFile := range logFiles {
+		follower := &logFollower{path: logFile}
+		data, err := follower.read(MountsLogTailSize)
+		if err != nil {
+			s.replyError(fmt.Sprintf("failed to read %s: %s", logFile, err))
+			return
+		}
+		data = lastLines(data, lines)
+		if len(logFiles) > 1 {
+			data = append([]byte(fmt.Sprintf("==> %s <==\n", logFile)), data...)
+		}
+		if !s.reply(&protocol.ResponseDataCmd{Data: string(data)}) {
+			return
+		}
+		followers = append(followers, follower)
+	}
+	if !c.Follow {
+		s.reply(&protocol.TerminateCmd{Code: 0})
+		return
+	}
+
+	ticker := time.NewTicker(MountLogsFollowInterval)
+	defer ticker.Stop()
+	last := logFiles[len(logFiles)-1]
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, follower := range followers {
+				// The log file is removed once the volume is unmounted
+				data, err := follower.read(MountsLogTailSize)
+				if err != nil || len(data) == 0 {
+					continue
+				}
+				if len(followers) > 1 && follower.path != last {
+					data = append([]byte(fmt.Sprintf("\n==> %s <==\n", follower.path)), data...)
+					last = follower.path
+				}
+				if !s.reply(&protocol.ResponseDataCmd{Data: string(data)}) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// mounterCollector reads the CPU time and the resident memory of every running mounter from /proc on every scrape,
+// so that a runaway mounter is found by its volume
+type mounterCollector struct {
+	cpuSeconds, residentMemoryBytes *prometheus.Desc
+}
+
+func newMounterCollector() *mounterCollector {
+	labels := []string{"volume_id", "mount_path"}
+	newDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "mounter", name), help, labels, nil)
+	}
+	return &mounterCollector{
+		cpuSeconds:          newDesc("cpu_seconds_total", "User and system CPU time spent by the mounter since it starts"),
+		residentMemoryBytes: newDesc("resident_memory_bytes", "Resident memory of the mounter"),
+	}
+}
+
+func (c *mounterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuSeconds
+	ch <- c.residentMemoryBytes
+}
+
+func (c *mounterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range mounterSupervisor.list() {
+		if status.Pid == 0 {
+			continue
+		}
+		proc, err := procfs.NewProc(status.Pid)
+		if err != nil {
+			log.Warnf("Failed to find mounter of %s with pid %d: %s", status.MountPath, status.Pid, err)
+			continue
+		}
+		stat, err := proc.Stat()
+		if err != nil {
+			log.Warnf("Failed to read stat of mounter of %s with pid %d: %s", status.MountPath, status.Pid, err)
+			continue
+		}
+		labels := []string{status.VolumeId, status.MountPath}
+		ch <- prometheus.MustNewConstMetric(c.cpuSeconds, prometheus.CounterValue, stat.CPUTime(), labels...)
+		ch <- prometheus.MustNewConstMetric(c.residentMemoryBytes, prometheus.GaugeValue, float64(stat.ResidentMemory()), labels...)
+	}
+}
+
+func init() {
+	metricsRegistry.MustRegister(newMounterCollector())
+}
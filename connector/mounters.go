@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+// Mounter is a backend serving the volumes by the FUSE mount points on the node, registered by its name by registerMounter.
+// The connector checks, finds and cleans up the mount points of all the backends through the registered mounters,
+// so a new backend, e.g. goofys, is added by implementing Mounter together with the command mounting by it.
+type Mounter interface {
+	// Name is the executable of the mounter, which the mounter is registered by
+	Name() string
+	// FsType is the filesystem type of the mount points in the mount table
+	FsType() string
+	// Validate checks the mounter installed on the node is supported, once the connector starts
+	Validate() error
+	// BuildCommand returns the commands run one by one to mount by the command, the last of which serves the mount point,
+	// it fails if the command is not served by the mounter, or requires the features the mounter installed doesn't support
+	BuildCommand(ctx context.Context, cmd protocol.Cmd) ([]*exec.Cmd, error)
+	// HealthCheck verifies the mount point responds to the check, which is none, statfs, list or read, statfs by default
+	HealthCheck(mountPath, check string) error
+	// Cleanup removes the files written for the mount path by the mounter once it's unmounted
+	Cleanup(volumeId, mountPath string)
+	// ParseProcess returns the volume id and the mount path served by the process of the mounter by its arguments,
+	// ok is false if the process doesn't serve any mount point, the volume id is empty if it's unknown by the arguments
+	ParseProcess(args []string) (volumeId, mountPath string, ok bool)
+}
+
+var registeredMounters = make(map[string]Mounter)
+
+func init() {
+	registerMounter(rcloneMounter{})
+	registerMounter(kodofsMounter{})
+}
+
+func registerMounter(mounter Mounter) {
+	if _, exists := registeredMounters[mounter.Name()]; exists {
+		panic(fmt.Sprintf("mounter %s is registered twice", mounter.Name()))
+	}
+	registeredMounters[mounter.Name()] = mounter
+}
+
+// getMounter returns the mounter registered by the name, which must be registered
+func getMounter(name string) Mounter {
+	mounter, ok := registeredMounters[name]
+	if !ok {
+		panic(fmt.Sprintf("mounter %s is not registered", name))
+	}
+	return mounter
+}
+
+// listMounters returns the registered mounters sorted by their names
+func listMounters() []Mounter {
+	mounters := make([]Mounter, 0, len(registeredMounters))
+	for _, mounter := range registeredMounters {
+		mounters = append(mounters, mounter)
+	}
+	sort.Slice(mounters, func(i, j int) bool {
+		return mounters[i].Name() < mounters[j].Name()
+	})
+	return mounters
+}
+
+// isMounterFsType returns true if the filesystem type is of the mount points served by any registered mounter
+func isMounterFsType(fsType string) bool {
+	for _, mounter := range registeredMounters {
+		if mounter.FsType() == fsType {
+			return true
+		}
+	}
+	return false
+}
+
+// rcloneMounter mounts the Kodo volumes by InitKodoMountCmd, supervised by mounterSupervisor
+type rcloneMounter struct{}
+
+func (rcloneMounter) Name() string {
+	return RcloneCmd
+}
+
+func (rcloneMounter) FsType() string {
+	return FuseTypeRclone
+}
+
+func (rcloneMounter) Validate() error {
+	if err := ensureCommandExists(RcloneCmd); err != nil {
+		return fmt.Errorf("please make sure rclone for linux/%s is installed in PATH: %w", runtime.GOARCH, err)
+	}
+	var err error
+	if rcloneVersion, osVersion, osKernel, err = getRcloneVersion(); err != nil {
+		return fmt.Errorf("failed to get rclone version: %w", err)
+	}
+	return ensureMinVersion(RcloneCmd, rcloneVersion, RcloneMinVersion)
+}
+
+// BuildCommand returns the single command of the mounter, the paths of its files are given by ctx, see mountRclone
+func (rcloneMounter) BuildCommand(ctx context.Context, cmd protocol.Cmd) ([]*exec.Cmd, error) {
+	c, ok := cmd.(*protocol.InitKodoMountCmd)
+	if !ok {
+		return nil, fmt.Errorf("rclone doesn't mount by %T", cmd)
+	}
+	return []*exec.Cmd{c.ExecCommand(ctx)}, nil
+}
+
+func (rcloneMounter) HealthCheck(mountPath, check string) error {
+	return checkKodoMount(mountPath, check)
+}
+
+func (rcloneMounter) Cleanup(volumeId, mountPath string) {
+	removeRcloneFiles(volumeId, mountPath)
+}
+
+// ParseProcess parses rclone [flags] mount [flags] <volume id>:<bucket>/<sub dir> <mount path>, see InitKodoMountCmd.ExecCommand
+func (rcloneMounter) ParseProcess(args []string) (string, string, bool) {
+	if len(args) < 3 || !isRcloneMount(args) {
+		return "", "", false
+	}
+	volumeId, _, _ := strings.Cut(args[len(args)-2], ":")
+	return volumeId, args[len(args)-1], true
+}
+
+// kodofsMounter mounts the KodoFS volumes by InitKodoFSMountCmd, which runs in background by itself once mounted
+type kodofsMounter struct{}
+
+func (kodofsMounter) Name() string {
+	return KodoFSCmd
+}
+
+func (kodofsMounter) FsType() string {
+	return FuseTypeKodoFS
+}
+
+func (kodofsMounter) Validate() error {
+	if err := ensureCommandExists(KodoFSCmd); err != nil {
+		return fmt.Errorf("please make sure kodofs for linux/%s is installed in PATH: %w", runtime.GOARCH, err)
+	}
+	var err error
+	if kodofsVersion, err = getKodoFSVersion(); err != nil {
+		return fmt.Errorf("failed to get kodofs version: %w", err)
+	} else if err = ensureMinVersion(KodoFSCmd, kodofsVersion, KodoFSMinVersion); err != nil {
+		return err
+	}
+	kodofsFeatures = detectKodoFSFeatures()
+	return nil
+}
+
+// BuildCommand returns the commands applying the kodofs parameters followed by the mount command, all of which prompt
+// for the master address and the AccessToken answered by the plugin
+func (kodofsMounter) BuildCommand(ctx context.Context, cmd protocol.Cmd) ([]*exec.Cmd, error) {
+	c, ok := cmd.(*protocol.InitKodoFSMountCmd)
+	if !ok {
+		return nil, fmt.Errorf("kodofs doesn't mount by %T", cmd)
+	} else if err := kodofsFeatures.check(c); err != nil {
+		return nil, err
+	}
+	return append(c.PrepareCommands(ctx, kodofsConfigExists(c.GatewayID)), c.ExecCommand(ctx)), nil
+}
+
+func (kodofsMounter) HealthCheck(mountPath, check string) error {
+	return checkKodoMount(mountPath, check)
+}
+
+// Cleanup removes nothing, since the config of the gateway is kept for the next mount
+func (kodofsMounter) Cleanup(volumeId, mountPath string) {}
+
+// ParseProcess parses kodofs mount <gateway id> <mount path> [flags], see InitKodoFSMountCmd.ExecCommand
+func (kodofsMounter) ParseProcess(args []string) (string, string, bool) {
+	if len(args) < 4 || args[1] != "mount" {
+		return "", "", false
+	}
+	return "", args[3], true
+}
+
+// parseMounterProcess returns the volume id and the mount path served by the process of any registered mounter by its arguments
+func parseMounterProcess(args []string) (volumeId, mountPath string, ok bool) {
+	mounter, registered := registeredMounters[filepath.Base(args[0])]
+	if !registered {
+		return "", "", false
+	}
+	return mounter.ParseProcess(args)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MountInfoPath is the mount table of the connector's mount namespace
+	MountInfoPath = "/proc/self/mountinfo"
+)
+
+// mountInfo is a single entry of /proc/self/mountinfo
+type mountInfo struct {
+	// major:minor of the st_dev of the filesystem, shared by the bind mounts of the same filesystem
+	device string
+	// Root of the mount within the filesystem, which is the source directory of a bind mount
+	root       string
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	file, err := os.Open(MountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("unrecognized line in %s: %s", MountInfoPath, scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			device:     fields[2],
+			root:       unescapeMountInfo(fields[3]),
+			mountPoint: unescapeMountInfo(fields[4]),
+			fsType:     fields[separator+1],
+			source:     unescapeMountInfo(fields[separator+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// findMountInfo returns the entry mounted on the path, or nil if nothing is mounted there
+func findMountInfo(mountPath string) (*mountInfo, error) {
+	mountPath = filepath.Clean(mountPath)
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	// The last entry wins if multiple filesystems are stacked on the same path
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].mountPoint == mountPath {
+			return &mounts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func isMountedBy(mountPath, fsType string) (bool, error) {
+	if info, err := findMountInfo(mountPath); err != nil {
+		return false, err
+	} else {
+		return info != nil && info.fsType == fsType, nil
+	}
+}
+
+// checkUmountPath rejects UmountCmd on the paths which are neither mount paths of the supervised mounters nor target
+// paths published by kubelet or Nomad mounted by the mounters, so the plugins, including the remote ones, can't unmount
+// anything else of the node by the connector
+func checkUmountPath(mountPath string) error {
+	if !filepath.IsAbs(mountPath) || filepath.Clean(mountPath) != mountPath {
+		return fmt.Errorf("mount path %s is not a clean absolute path", mountPath)
+	}
+	if _, supervised := mounterSupervisor.get(mountPath); supervised {
+		return nil
+	} else if sharedKodoMounts.lookup(mountPath) != nil {
+		return nil
+	}
+	if !isTargetPath(mountPath) {
+		return fmt.Errorf("mount path %s is not a target path of volumes", mountPath)
+	}
+	// The mounter may have exited, leaving the disconnected mount point to be unmounted
+	if info, err := findMountInfo(mountPath); err != nil {
+		return err
+	} else if info == nil || !isMounterFsType(info.fsType) {
+		return fmt.Errorf("mount path %s is not mounted by any mounter", mountPath)
+	}
+	return nil
+}
+
+// isTargetPath reports whether the path is a target path published by kubelet or Nomad, which are
+// <kubelet root dir>/pods/<pod uid>/volumes/kubernetes.io~csi/<pv>/mount and <csi dir>/per-alloc/<alloc id>/<volume>/<rw|ro>-<mode>
+func isTargetPath(path string) bool {
+	// The names of the path from the last, e.g. mount, <pv>, kubernetes.io~csi, volumes, <pod uid> and pods
+	var names []string
+	for dir := path; dir != "/" && len(names) < 6; dir = filepath.Dir(dir) {
+		names = append(names, filepath.Base(dir))
+	}
+	if len(names) == 6 && names[0] == "mount" {
+		return names[2] == "kubernetes.io~csi" && names[3] == "volumes" && names[5] == "pods"
+	}
+	return len(names) >= 4 && (strings.HasPrefix(names[0], "rw-") || strings.HasPrefix(names[0], "ro-")) && names[3] == "per-alloc"
+}
+
+// unescapeMountInfo decodes the octal escapes like \040 used by the kernel for spaces and other special characters
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				builder.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(s[i])
+	}
+	return builder.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestIsTargetPath(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount":          true,
+		"/var/lib/k0s/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount":      true,
+		"/opt/nomad/client/csi/node/kodo/per-alloc/9a1c/data/rw-file-system-multi": true,
+		"/opt/nomad/client/csi/node/kodo/per-alloc/9a1c/data/ro-file-system":       true,
+		"/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1":                false,
+		"/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~empty-dir/cache/mount":   false,
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount":           false,
+		"/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount":                          true,
+		"/volumes/kubernetes.io~csi/pv-1/mount":                                    false,
+		"/per-alloc/9a1c/data/rw-file-system":                                      true,
+		"/data/rw-file-system":                                                     false,
+		"/":                                                                        false,
+		"/proc":                                                                    false,
+	} {
+		if actual := isTargetPath(path); actual != expected {
+			t.Errorf("isTargetPath(%q) = %v, expected %v", path, actual, expected)
+		}
+	}
+}
+
+func TestCheckUmountPathRejectsOtherPaths(t *testing.T) {
+	for _, path := range []string{
+		"",
+		"relative/mount",
+		"/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount/../../../../../../../../etc",
+		"/etc",
+		// Not mounted by any mounter
+		"/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount",
+		"/",
+	} {
+		if err := checkUmountPath(path); err == nil {
+			t.Errorf("checkUmountPath(%q) is expected to fail", path)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// MountsCommand is the subcommand listing and inspecting the mounts of the node
+	MountsCommand = "mounts"
+	// Max bytes read from the end of each log file to find the recent errors
+	MountsLogTailSize = 4 << 20
+)
+
+// mountEntry is a FUSE mount point on the node, or a mounter supervised by the connector, reported by the mounts command
+type mountEntry struct {
+	MountPath string `json:"mount_path"`
+	FsType    string `json:"fs_type,omitempty"`
+	VolumeId  string `json:"volume_id,omitempty"`
+	// Empty if the mount point is not supervised by the connector, e.g. KodoFS or bound to a shared mount point
+	State        MounterState `json:"state,omitempty"`
+	Pid          int          `json:"pid,omitempty"`
+	Restarts     int          `json:"restarts"`
+	LastExitCode int          `json:"last_exit_code"`
+	StartedAt    *time.Time   `json:"started_at,omitempty"`
+	Mounted      bool         `json:"mounted"`
+	// Directory of the crash report of the last crash of the mounter
+	LastCrashReport string `json:"last_crash_report,omitempty"`
+	// Mount path of the supervised mount point which the mount point is bound to
+	BoundTo string `json:"bound_to,omitempty"`
+
+	// Only reported by mounts show
+	Parameters   json.RawMessage `json:"parameters,omitempty"`
+	RcloneConfig string          `json:"rclone_config,omitempty"`
+	VfsStats     json.RawMessage `json:"vfs_stats,omitempty"`
+	Process      string          `json:"process,omitempty"`
+	RecentErrors []string        `json:"recent_errors,omitempty"`
+}
+
+// runMounts lists the mounts of the node, or shows the details of the mounts of a mount path or a volume id, returns the exit code
+func runMounts(args []string) int {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s list [-o table|json]\n", filepath.Base(os.Args[0]), MountsCommand)
+		fmt.Fprintf(os.Stderr, "       %s %s show [-o text|json] [-errors N] <mount path or volume id>\n", filepath.Base(os.Args[0]), MountsCommand)
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	var subcommand string
+	subcommand, args = args[0], args[1:]
+	flagSet := flag.NewFlagSet(MountsCommand+" "+subcommand, flag.ContinueOnError)
+	output := flagSet.String("o", "", "Output format, table or json for list, text or json for show")
+	maxErrors := flagSet.Int("errors", 20, "Max recent errors shown from the log of the mounter and from the log of the connector each")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+
+	switch subcommand {
+	case "list":
+		if flagSet.NArg() != 0 {
+			usage()
+			return 2
+		}
+		entries, err := collectMountEntries()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list mounts: %s\n", err)
+			return 1
+		}
+		for _, entry := range entries {
+			entry.Parameters, entry.RcloneConfig, entry.VfsStats = nil, "", nil
+		}
+		switch *output {
+		case "", "table":
+			printMountsTable(os.Stdout, entries)
+		case "json":
+			printJSON(os.Stdout, entries)
+		default:
+			usage()
+			return 2
+		}
+	case "show":
+		if flagSet.NArg() != 1 {
+			usage()
+			return 2
+		}
+		entries, err := collectMountEntries()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list mounts: %s\n", err)
+			return 1
+		}
+		key := flagSet.Arg(0)
+		var matched []*mountEntry
+		for _, entry := range entries {
+			if entry.MountPath == filepath.Clean(key) || entry.VolumeId == key {
+				matched = append(matched, entry)
+			}
+		}
+		if len(matched) == 0 {
+			fmt.Fprintf(os.Stderr, "No mount of %s is found\n", key)
+			return 1
+		}
+		resolveRcloneDirs()
+		for _, entry := range matched {
+			entry.Process = describeProcess(entry.Pid)
+			entry.RecentErrors = recentMountErrors(entry, *maxErrors)
+		}
+		switch *output {
+		case "", "text":
+			for i, entry := range matched {
+				if i > 0 {
+					fmt.Println()
+				}
+				printMountDetails(os.Stdout, entry)
+			}
+		case "json":
+			printJSON(os.Stdout, matched)
+		default:
+			usage()
+			return 2
+		}
+	default:
+		usage()
+		return 2
+	}
+	return 0
+}
+
+// collectMountEntries merges the mounters supervised by the connector daemon and the FUSE mount points of the node
+func collectMountEntries() ([]*mountEntry, error) {
+	var state struct {
+		Mounters []struct {
+			MounterStatus
+			Cmd          json.RawMessage `json:"cmd,omitempty"`
+			RcloneConfig string          `json:"rclone_config,omitempty"`
+			VfsStats     json.RawMessage `json:"vfs_stats,omitempty"`
+		} `json:"mounters"`
+	}
+	if data, err := requestDebugState(); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state of connector: %w", err)
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	mountsByPath := make(map[string]mountInfo, len(mounts))
+	for _, mount := range mounts {
+		// The last entry wins if multiple filesystems are stacked on the same path
+		mountsByPath[mount.mountPoint] = mount
+	}
+
+	var entries []*mountEntry
+	supervised := make(map[string]bool)
+	supervisedDevices := make(map[string]string)
+	for _, mounter := range state.Mounters {
+		entry := &mountEntry{
+			MountPath:       mounter.MountPath,
+			FsType:          FuseTypeRclone,
+			VolumeId:        mounter.VolumeId,
+			State:           mounter.State,
+			Pid:             mounter.Pid,
+			Restarts:        mounter.Restarts,
+			LastExitCode:    mounter.LastExitCode,
+			LastCrashReport: mounter.LastCrashReport,
+			Parameters:      mounter.Cmd,
+			RcloneConfig:    mounter.RcloneConfig,
+			VfsStats:        mounter.VfsStats,
+		}
+		if !mounter.StartedAt.IsZero() {
+			startedAt := mounter.StartedAt
+			entry.StartedAt = &startedAt
+		}
+		if mount, ok := mountsByPath[mounter.MountPath]; ok && mount.fsType == FuseTypeRclone {
+			entry.Mounted = true
+			supervisedDevices[mount.device] = mounter.MountPath
+		}
+		supervised[mounter.MountPath] = true
+		entries = append(entries, entry)
+	}
+	for _, mount := range mounts {
+		if !isMounterFsType(mount.fsType) || supervised[mount.mountPoint] {
+			continue
+		}
+		entry := &mountEntry{MountPath: mount.mountPoint, FsType: mount.fsType, Mounted: true}
+		if mount.fsType == FuseTypeRclone {
+			entry.BoundTo = supervisedDevices[mount.device]
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].MountPath < entries[j].MountPath })
+	return entries, nil
+}
+
+func printMountsTable(w io.Writer, entries []*mountEntry) {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "MOUNT PATH\tFS TYPE\tVOLUME ID\tSTATE\tPID\tRESTARTS\tLAST EXIT\tUPTIME\tMOUNTED")
+	for _, entry := range entries {
+		state, pid, uptime := string(entry.State), "-", "-"
+		if state == "" {
+			state = "unsupervised"
+			if entry.BoundTo != "" {
+				state = "bound to " + entry.BoundTo
+			}
+		}
+		if entry.Pid > 0 {
+			pid = fmt.Sprint(entry.Pid)
+			if entry.StartedAt != nil {
+				uptime = time.Since(*entry.StartedAt).Round(time.Second).String()
+			}
+		}
+		volumeId := entry.VolumeId
+		if volumeId == "" {
+			volumeId = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%t\n",
+			entry.MountPath, entry.FsType, volumeId, state, pid, entry.Restarts, entry.LastExitCode, uptime, entry.Mounted)
+	}
+	table.Flush()
+}
+
+func printMountDetails(w io.Writer, entry *mountEntry) {
+	fmt.Fprintf(w, "Mount Path:      %s\n", entry.MountPath)
+	fmt.Fprintf(w, "FS Type:         %s\n", entry.FsType)
+	fmt.Fprintf(w, "Mounted:         %t\n", entry.Mounted)
+	if entry.BoundTo != "" {
+		fmt.Fprintf(w, "Bound To:        %s\n", entry.BoundTo)
+	}
+	if entry.State == "" {
+		fmt.Fprintf(w, "State:           not supervised by the connector\n")
+	} else {
+		fmt.Fprintf(w, "Volume ID:       %s\n", entry.VolumeId)
+		fmt.Fprintf(w, "State:           %s\n", entry.State)
+		fmt.Fprintf(w, "Pid:             %d\n", entry.Pid)
+		fmt.Fprintf(w, "Restarts:        %d\n", entry.Restarts)
+		fmt.Fprintf(w, "Last Exit Code:  %d\n", entry.LastExitCode)
+		if entry.StartedAt != nil {
+			fmt.Fprintf(w, "Started At:      %s\n", entry.StartedAt.Format(time.RFC3339))
+		}
+		if entry.LastCrashReport != "" {
+			fmt.Fprintf(w, "Last Crash:      %s\n", entry.LastCrashReport)
+		}
+	}
+	if entry.Process != "" {
+		fmt.Fprintf(w, "Process:         %s\n", entry.Process)
+	}
+	if len(entry.Parameters) > 0 {
+		var indented bytes.Buffer
+		if json.Indent(&indented, entry.Parameters, "  ", "  ") == nil {
+			fmt.Fprintf(w, "Parameters:\n  %s\n", indented.String())
+		}
+	}
+	if entry.RcloneConfig != "" {
+		fmt.Fprintf(w, "Rclone Config:\n  %s\n", strings.ReplaceAll(strings.TrimSpace(entry.RcloneConfig), "\n", "\n  "))
+	}
+	if len(entry.VfsStats) > 0 {
+		fmt.Fprintf(w, "VFS Stats:       %s\n", entry.VfsStats)
+	}
+	fmt.Fprintf(w, "Recent Errors:\n")
+	if len(entry.RecentErrors) == 0 {
+		fmt.Fprintf(w, "  <none>\n")
+	}
+	for _, line := range entry.RecentErrors {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+}
+
+func printJSON(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// describeProcess returns the state, the memory and the command line of the process, whose arguments never contain secrets
+func describeProcess(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	procDir := filepath.Join("/proc", fmt.Sprint(pid))
+	cmdline, err := os.ReadFile(filepath.Join(procDir, "cmdline"))
+	if err != nil {
+		return fmt.Sprintf("not found: %s", err)
+	}
+	fields := map[string]string{"State": "-", "VmRSS": "-"}
+	if status, err := os.ReadFile(filepath.Join(procDir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if key, value, ok := strings.Cut(line, ":"); ok {
+				if _, wanted := fields[key]; wanted {
+					fields[key] = strings.Join(strings.Fields(value), " ")
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("state %s, rss %s, %s", fields["State"], fields["VmRSS"], strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " "))
+}
+
+// recentMountErrors returns the last errors logged by the rclone mounter of the mount point and by the connector about it, at most max of each
+func recentMountErrors(entry *mountEntry, max int) []string {
+	var lines []string
+	if entry.VolumeId != "" && entry.FsType == FuseTypeRclone {
+		// Logs of rclone are saved in <rcloneLogDir>/<volume id>/<mount point uuid>.log
+		logFile := filepath.Join(rcloneLogDir, entry.VolumeId, rcloneCacheId(entry.MountPath)+".log")
+		lines = append(lines, matchLogLines(logFile, max, func(line string) bool {
+			return strings.Contains(line, " ERROR ") || strings.Contains(line, " CRITICAL ")
+		})...)
+	}
+	lines = append(lines, matchLogLines(LogFilename, max, func(line string) bool {
+		if !strings.Contains(line, entry.MountPath) {
+			return false
+		}
+		for _, level := range []string{"level=error", "level=warning", `"level":"error"`, `"level":"warning"`} {
+			if strings.Contains(line, level) {
+				return true
+			}
+		}
+		return false
+	})...)
+	return lines
+}
+
+// matchLogLines returns the last max lines matched in the end of the log file, prefixed by the path
+func matchLogLines(path string, max int, match func(line string) bool) []string {
+	data, err := tailLog(path, MountsLogTailSize)
+	if err != nil {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if match(line) {
+			lines = append(lines, path+": "+line)
+		}
+	}
+	if len(lines) > max {
+		lines = lines[len(lines)-max:]
+	}
+	return lines
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often the Kodo endpoints of the rclone mounters failing to transfer are checked
+	PartitionCheckInterval = 30 * time.Second
+	// Timeout to connect to the Kodo endpoint, or to the proxy in front of it
+	PartitionDialTimeout = 5 * time.Second
+	// Timeout to stat the mount point once the endpoint is reachable again
+	PartitionStatTimeout = 10 * time.Second
+)
+
+var mounterPartitionRecoveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Subsystem: "mounter",
+	Name:      "partition_recoveries_total",
+	Help:      "Total number of rclone mounters refreshed or restarted once the Kodo endpoint is reachable again after a network partition, by volume and action",
+}, []string{"volume_id", "action"})
+
+func init() {
+	metricsRegistry.MustRegister(mounterPartitionRecoveries)
+}
+
+// partitionState is what's known about the partition of a rclone mounter from its Kodo endpoint
+type partitionState struct {
+	rc *rcloneRemoteControl
+	// Errors of the mounter last time, which only increase if the mounter keeps failing to transfer
+	errors int64
+	// When the endpoint is found unreachable while the mounter is failing, zero if it's reachable
+	since time.Time
+}
+
+// watchPartitions recovers the rclone mounters once their Kodo endpoints are reachable again after unreachable for
+// -remount-after-partition while the mounters keep failing, until the connector exits
+func watchPartitions() {
+	states := make(map[string]*partitionState)
+	ticker := time.NewTicker(PartitionCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkPartitions(states)
+	}
+}
+
+func checkPartitions(states map[string]*partitionState) {
+	current := make(map[string]bool)
+	reachable := make(map[string]bool)
+	rcloneRemoteControls.Range(func(key, value interface{}) bool {
+		mountPath, rc := key.(string), value.(*rcloneRemoteControl)
+		cmd, ok := kodoMountCmds.Load(mountPath)
+		if !ok {
+			return true
+		}
+		c := cmd.(*protocol.InitKodoMountCmd)
+		current[mountPath] = true
+		state := states[mountPath]
+		if state == nil || state.rc != rc {
+			// The mounter is started or restarted, whose errors start from zero
+			state = &partitionState{rc: rc, errors: -1}
+			states[mountPath] = state
+		}
+
+		// The mounter not responding to the remote control is also failing
+		failing := true
+		if stats, err := rc.coreStats(context.Background()); err == nil {
+			failing = state.errors >= 0 && stats.Errors > state.errors
+			state.errors = stats.Errors
+		}
+		if !failing && state.since.IsZero() {
+			return true
+		}
+		address := partitionProbeAddress(c)
+		if address == "" {
+			return true
+		}
+		up, probed := reachable[address]
+		if !probed {
+			up = probeAddress(c, address)
+			reachable[address] = up
+		}
+
+		switch {
+		case !up && state.since.IsZero() && failing:
+			state.since = time.Now()
+			log.Warnf("Kodo endpoint %s of mounter of %s is unreachable, the mounter is recovered once it's reachable again after %s", address, mountPath, *remountAfterPartition)
+		case up && !state.since.IsZero():
+			partitioned := time.Since(state.since)
+			state.since = time.Time{}
+			if partitioned < *remountAfterPartition {
+				log.Infof("Kodo endpoint %s of mounter of %s is reachable again after %s", address, mountPath, partitioned.Round(time.Second))
+				return true
+			}
+			// Checked in background, since a wedged mount point may block the stat for long
+			go recoverPartitionedMounter(c.VolumeId, mountPath, rc, partitioned)
+		}
+		return true
+	})
+	for mountPath := range states {
+		if !current[mountPath] {
+			delete(states, mountPath)
+		}
+	}
+}
+
+// recoverPartitionedMounter drops the directory cache of the mounter if it still responds, otherwise restarts it
+func recoverPartitionedMounter(volumeId, mountPath string, rc *rcloneRemoteControl, partitioned time.Duration) {
+	err := statWithTimeout(mountPath, PartitionStatTimeout)
+	if err == nil {
+		// The directories listed during the partition may be stale
+		if _, err = rc.call(context.Background(), "vfs/forget", nil); err == nil {
+			mounterPartitionRecoveries.WithLabelValues(volumeId, "refresh").Inc()
+			log.Infof("Mounter of %s is refreshed after partitioned from Kodo for %s", mountPath, partitioned.Round(time.Second))
+			return
+		}
+	}
+	log.Warnf("Mounter of %s is wedged after partitioned from Kodo for %s, restart it: %s", mountPath, partitioned.Round(time.Second), err)
+	if err = mounterSupervisor.restart(mountPath); err != nil {
+		log.Warnf("Failed to restart mounter of %s: %s", mountPath, err)
+		return
+	}
+	mounterPartitionRecoveries.WithLabelValues(volumeId, "restart").Inc()
+}
+
+// partitionProbeAddress returns the address to connect to for the S3 endpoint of the mount, which is the proxy if the endpoint is behind one
+func partitionProbeAddress(c *protocol.InitKodoMountCmd) string {
+	return endpointProbeAddress(c, c.S3Endpoint)
+}
+
+// endpointProbeAddress returns the address to connect to for the endpoint by the mount, or empty if the endpoint is invalid
+func endpointProbeAddress(c *protocol.InitKodoMountCmd, rawEndpoint string) string {
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil || endpoint.Hostname() == "" {
+		return ""
+	}
+	target := endpoint
+	proxy := c.HttpsProxy
+	if endpoint.Scheme == "http" {
+		proxy = c.HttpProxy
+	}
+	if proxy != "" && !matchNoProxy(endpoint.Hostname(), c.NoProxy) {
+		if proxyUrl, err := url.Parse(proxy); err == nil && proxyUrl.Hostname() != "" {
+			target = proxyUrl
+		}
+	}
+	if port := target.Port(); port != "" {
+		return target.Host
+	} else if target.Scheme == "http" {
+		return net.JoinHostPort(target.Hostname(), "80")
+	}
+	return net.JoinHostPort(target.Hostname(), "443")
+}
+
+// matchNoProxy returns whether the host is excluded from the proxy by the comma-separated domains
+func matchNoProxy(host, noProxy string) bool {
+	for _, domain := range strings.Split(noProxy, ",") {
+		if domain = strings.TrimPrefix(strings.TrimSpace(domain), "."); domain == "*" || domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeAddress connects to the address, which is resolved like the mounter of the volume
+func probeAddress(c *protocol.InitKodoMountCmd, address string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), PartitionDialTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if resolver := newKodoResolver(c); resolver != nil {
+		conn, err = resolver.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// statWithTimeout stats the mount point in background, and returns an error if it doesn't respond in time
+func statWithTimeout(mountPath string, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		var stat syscall.Statfs_t
+		result <- syscall.Statfs(mountPath, &stat)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New("mount point does not respond to statfs")
+	}
+}
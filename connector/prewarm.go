@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How many files are read at the same time to prewarm the vfs cache
+	PrewarmConcurrency = 4
+)
+
+// prewarmKodo reads the files of the prewarm paths through the mount path, so that they're downloaded into the vfs cache
+// before the workload reads them. It stops once the mount path is unmounted, the files failed to read are skipped.
+func prewarmKodo(logger *log.Entry, c *protocol.InitKodoMountCmd) {
+	paths := c.Prewarm
+	if c.PrewarmManifest != "" {
+		if manifest, err := readPrewarmManifest(volumePath(c.MountPath, c.PrewarmManifest)); err != nil {
+			logger.Warnf("Failed to read prewarm manifest %s of %s: %s", c.PrewarmManifest, c.MountPath, err)
+		} else {
+			paths = append(paths, manifest...)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	var (
+		begin        = time.Now()
+		files        = make(chan string)
+		wg           sync.WaitGroup
+		count, bytes int64
+	)
+	for i := 0; i < PrewarmConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				if n, err := readThrough(path); err != nil {
+					logger.Warnf("Failed to prewarm %s: %s", path, err)
+				} else {
+					atomic.AddInt64(&count, 1)
+					atomic.AddInt64(&bytes, n)
+				}
+			}
+		}()
+	}
+	for _, path := range paths {
+		if mounted, _ := isMountedBy(c.MountPath, FuseTypeRclone); !mounted {
+			logger.Warnf("%s is unmounted, stop prewarming", c.MountPath)
+			break
+		}
+		filepath.WalkDir(volumePath(c.MountPath, path), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				logger.Warnf("Failed to list %s to prewarm: %s", path, err)
+			} else if entry.Type().IsRegular() {
+				files <- path
+			}
+			return nil
+		})
+	}
+	close(files)
+	wg.Wait()
+	logger.WithField("duration", time.Since(begin).Seconds()).Infof("Prewarmed %d files of %d bytes in %s", count, bytes, c.MountPath)
+}
+
+// readPrewarmManifest returns the paths listed in the manifest, the empty lines and the lines starting with # are ignored
+func readPrewarmManifest(manifestPath string) ([]string, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// volumePath returns the path in the volume mounted on the mount path, which never escapes from the mount path
+func volumePath(mountPath, path string) string {
+	return filepath.Join(mountPath, filepath.Clean("/"+path))
+}
+
+// readThrough reads the whole file and discards the content, returns how many bytes are read
+func readThrough(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.Copy(io.Discard, file)
+}
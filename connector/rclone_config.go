@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// rcloneConfigPassword encrypts the rclone config files written by the connector.
+// It's generated on every start of the connector and only kept in memory and in the environment of the mounters,
+// so the Kodo keys in the config files cannot be recovered from the disk.
+var rcloneConfigPassword string
+
+// rcloneConfigFileRegexp matches the config files and CA bundles written by the connector for each mount point
+var rcloneConfigFileRegexp = regexp.MustCompile(`^.+-[0-9a-f]{32}\.(conf|ca\.pem)$`)
+
+func initRcloneConfigPassword() (err error) {
+	rcloneConfigPassword, err = randomHex(32)
+	return
+}
+
+// encryptRcloneConfig encrypts the config in the format of rclone config encryption, which is decrypted by rclone with RCLONE_CONFIG_PASS
+func encryptRcloneConfig(config []byte, password string) ([]byte, error) {
+	key := sha256.Sum256([]byte("[" + password + "][rclone-config]"))
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	box := secretbox.Seal(nonce[:], config, &nonce, &key)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Encrypted rclone configuration File\n\nRCLONE_ENCRYPT_V0:\n")
+	buf.WriteString(base64.StdEncoding.EncodeToString(box))
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// removeStaleRcloneConfigFiles removes the config files left by the previous run of the connector,
+// they're never used again since the mounters are supervised by the connector, and may be written in plain text by old versions.
+func removeStaleRcloneConfigFiles() error {
+	entries, err := os.ReadDir(rcloneConfigDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && rcloneConfigFileRegexp.MatchString(entry.Name()) {
+			if err = os.Remove(filepath.Join(rcloneConfigDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// rcloneCollector polls the remote control of every rclone mounter on every scrape.
+// Each volume is mounted by its own rclone process, so the stats of the process are the stats of the volume.
+type rcloneCollector struct {
+	up                                       *prometheus.Desc
+	transferredBytes, transfers, errors      *prometheus.Desc
+	transferring                             *prometheus.Desc
+	cacheUsedBytes, cacheFiles, cacheErrored *prometheus.Desc
+	uploadsInProgress, uploadsQueued         *prometheus.Desc
+	cacheDirtyBytes, cacheDirtyFiles         *prometheus.Desc
+}
+
+func newRcloneCollector() *rcloneCollector {
+	labels := []string{"volume_id", "mount_path"}
+	newDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "rclone", name), help, labels, nil)
+	}
+	return &rcloneCollector{
+		up:                newDesc("up", "Whether the remote control of the rclone mounter responds in time"),
+		transferredBytes:  newDesc("transferred_bytes_total", "Bytes transferred from and to Kodo since the mounter starts"),
+		transfers:         newDesc("transfers_total", "Completed transfers of files since the mounter starts"),
+		errors:            newDesc("errors_total", "Errors of transfers and other operations since the mounter starts"),
+		transferring:      newDesc("transferring", "Files being transferred"),
+		cacheUsedBytes:    newDesc("vfs_cache_used_bytes", "Bytes used by the vfs cache on the disk"),
+		cacheFiles:        newDesc("vfs_cache_files", "Files in the vfs cache"),
+		cacheErrored:      newDesc("vfs_cache_errored_files", "Files in the vfs cache failed to be uploaded"),
+		uploadsInProgress: newDesc("vfs_cache_uploads_in_progress", "Files in the vfs cache being uploaded"),
+		uploadsQueued:     newDesc("vfs_cache_uploads_queued", "Files in the vfs cache waiting to be uploaded"),
+		cacheDirtyBytes:   newDesc("vfs_cache_dirty_bytes", "Size of the files in the vfs cache modified but not uploaded yet"),
+		cacheDirtyFiles:   newDesc("vfs_cache_dirty_files", "Files in the vfs cache modified but not uploaded yet"),
+	}
+}
+
+func (c *rcloneCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.up, c.transferredBytes, c.transfers, c.errors, c.transferring,
+		c.cacheUsedBytes, c.cacheFiles, c.cacheErrored, c.uploadsInProgress, c.uploadsQueued, c.cacheDirtyBytes, c.cacheDirtyFiles,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *rcloneCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	rcloneRemoteControls.Range(func(key, value interface{}) bool {
+		mountPath, rc := key.(string), value.(*rcloneRemoteControl)
+		cmd, ok := kodoMountCmds.Load(mountPath)
+		if !ok {
+			return true
+		}
+		wg.Add(1)
+		go func(volumeId string) {
+			defer wg.Done()
+			c.collectMount(ch, rc, volumeId, mountPath)
+		}(cmd.(*protocol.InitKodoMountCmd).VolumeId)
+		return true
+	})
+	wg.Wait()
+}
+
+func (c *rcloneCollector) collectMount(ch chan<- prometheus.Metric, rc *rcloneRemoteControl, volumeId, mountPath string) {
+	labels := []string{volumeId, mountPath}
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	counter := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+
+	coreStats, err := rc.coreStats(context.Background())
+	if err != nil {
+		log.Warnf("Failed to get core stats of rclone mounter on %s: %s", mountPath, err)
+		gauge(c.up, 0)
+		return
+	}
+	vfsStats, err := rc.vfsStats(context.Background())
+	if err != nil {
+		log.Warnf("Failed to get vfs stats of rclone mounter on %s: %s", mountPath, err)
+		gauge(c.up, 0)
+		return
+	}
+	gauge(c.up, 1)
+	counter(c.transferredBytes, float64(coreStats.Bytes))
+	counter(c.transfers, float64(coreStats.Transfers))
+	counter(c.errors, float64(coreStats.Errors))
+	gauge(c.transferring, float64(len(coreStats.Transferring)))
+	if vfsStats.DiskCache == nil {
+		// vfs cache is disabled
+		return
+	}
+	gauge(c.cacheUsedBytes, float64(vfsStats.DiskCache.BytesUsed))
+	gauge(c.cacheFiles, float64(vfsStats.DiskCache.Files))
+	gauge(c.cacheErrored, float64(vfsStats.DiskCache.ErroredFiles))
+	gauge(c.uploadsInProgress, float64(vfsStats.DiskCache.UploadsInProgress))
+	gauge(c.uploadsQueued, float64(vfsStats.DiskCache.UploadsQueued))
+
+	// rclone doesn't report the size of dirty files, which is read from the metadata of the vfs cache
+	volumeCacheDir := filepath.Join(rcloneCacheDir, volumeId, rcloneCacheId(mountPath))
+	dirtyFiles, dirtyBytes, err := scanVfsCacheDirtyFiles(volumeCacheDir)
+	if err != nil {
+		log.Warnf("Failed to scan dirty files in vfs cache %s: %s", volumeCacheDir, err)
+		return
+	}
+	gauge(c.cacheDirtyFiles, float64(dirtyFiles))
+	gauge(c.cacheDirtyBytes, float64(dirtyBytes))
+}
+
+func init() {
+	metricsRegistry.MustRegister(newRcloneCollector())
+}
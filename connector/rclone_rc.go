@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout of a single rclone remote control call
+	RcloneRcCallTimeout = 10 * time.Second
+	// How often the status of an async rclone job is polled
+	RcloneRcJobPollInterval = 2 * time.Second
+)
+
+// rcloneRemoteControl is the remote control endpoint of a rclone mounter.
+// rclone doesn't support serving remote control on unix socket, so it listens on a random loopback port protected by random credentials.
+type rcloneRemoteControl struct {
+	addr, user, password string
+}
+
+// rcloneRemoteControls saves *rcloneRemoteControl by mount path
+var rcloneRemoteControls sync.Map
+
+func newRcloneRemoteControl() (*rcloneRemoteControl, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate loopback port: %w", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	user, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	password, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	return &rcloneRemoteControl{addr: addr, user: user, password: password}, nil
+}
+
+func getRcloneRemoteControl(mountPath string) (*rcloneRemoteControl, error) {
+	if rc, ok := rcloneRemoteControls.Load(mountPath); ok {
+		return rc.(*rcloneRemoteControl), nil
+	}
+	return nil, fmt.Errorf("%s is not mounted by any supervised mounter", mountPath)
+}
+
+// call calls the remote control method of rclone and returns the json output
+func (rc *rcloneRemoteControl) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = struct{}{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal params of %s: %w", method, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RcloneRcCallTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/%s", rc.addr, method), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(rc.user, rc.password)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	output, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response of %s: %w", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var rcError struct {
+			Error string `json:"error"`
+		}
+		if err = json.Unmarshal(output, &rcError); err == nil && rcError.Error != "" {
+			return nil, fmt.Errorf("failed to call %s: %s", method, rcError.Error)
+		}
+		return nil, fmt.Errorf("failed to call %s: status code %d", method, resp.StatusCode)
+	}
+	return json.RawMessage(output), nil
+}
+
+// runJob calls the remote control method as an async job, which may run much longer than RcloneRcCallTimeout, and waits until it finishes
+func (rc *rcloneRemoteControl) runJob(ctx context.Context, method string, params map[string]interface{}) error {
+	params["_async"] = true
+	output, err := rc.call(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	var job struct {
+		JobId int64 `json:"jobid"`
+	}
+	if err = json.Unmarshal(output, &job); err != nil {
+		return fmt.Errorf("failed to parse job of %s: %w", method, err)
+	}
+
+	ticker := time.NewTicker(RcloneRcJobPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			rc.call(context.Background(), "job/stop", map[string]int64{"jobid": job.JobId})
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if output, err = rc.call(ctx, "job/status", map[string]int64{"jobid": job.JobId}); err != nil {
+			return err
+		}
+		var status struct {
+			Finished bool   `json:"finished"`
+			Success  bool   `json:"success"`
+			Error    string `json:"error"`
+		}
+		if err = json.Unmarshal(output, &status); err != nil {
+			return fmt.Errorf("failed to parse job/status: %w", err)
+		} else if !status.Finished {
+			continue
+		} else if !status.Success {
+			return fmt.Errorf("job %d of %s failed: %s", job.JobId, method, status.Error)
+		}
+		return nil
+	}
+}
+
+// rcloneVfsStats is the part of vfs/stats output used by the connector
+type rcloneVfsStats struct {
+	DiskCache *struct {
+		BytesUsed         int64 `json:"bytesUsed"`
+		Files             int   `json:"files"`
+		ErroredFiles      int   `json:"erroredFiles"`
+		UploadsInProgress int   `json:"uploadsInProgress"`
+		UploadsQueued     int   `json:"uploadsQueued"`
+	} `json:"diskCache"`
+}
+
+// rcloneCoreStats is the part of core/stats output used by the connector, the stats are accumulated since the mounter starts
+type rcloneCoreStats struct {
+	Bytes        int64             `json:"bytes"`
+	Errors       int64             `json:"errors"`
+	Transfers    int64             `json:"transfers"`
+	Transferring []json.RawMessage `json:"transferring"`
+}
+
+// pendingUploads returns how many files are being uploaded or waiting to be uploaded by the mounter
+func (rc *rcloneRemoteControl) pendingUploads(ctx context.Context) (int, error) {
+	stats, err := rc.vfsStats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if stats.DiskCache == nil {
+		// vfs cache is disabled, nothing to upload
+		return 0, nil
+	}
+	return stats.DiskCache.UploadsInProgress + stats.DiskCache.UploadsQueued, nil
+}
+
+func (rc *rcloneRemoteControl) vfsStats(ctx context.Context) (*rcloneVfsStats, error) {
+	output, err := rc.call(ctx, "vfs/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	var stats rcloneVfsStats
+	if err = json.Unmarshal(output, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse vfs/stats: %w", err)
+	}
+	return &stats, nil
+}
+
+func (rc *rcloneRemoteControl) coreStats(ctx context.Context) (*rcloneCoreStats, error) {
+	output, err := rc.call(ctx, "core/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	var stats rcloneCoreStats
+	if err = json.Unmarshal(output, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse core/stats: %w", err)
+	}
+	return &stats, nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadRemoteTLSConfig returns the config of the remote listener of -listen-address, which only accepts the plugins
+// presenting the client certificates signed by the CA of -tls-client-ca, so nobody else could mount or unmount through it
+func loadRemoteTLSConfig(certFile, keyFile, clientCaFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || clientCaFile == "" {
+		return nil, fmt.Errorf("-tls-cert, -tls-key and -tls-client-ca are all required")
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	pem, err := os.ReadFile(clientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificate is found in %s", clientCaFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// isLocalConn reports whether the connection is accepted by the unix socket from the plugin of this node,
+// rather than by the remote listener of -listen-address
+func isLocalConn(conn net.Conn) bool {
+	_, local := conn.(*net.UnixConn)
+	return local
+}
+
+// checkMountConn restricts what the remote plugins could mount, since they are verified by their certificates only:
+// the mount points must be target paths of volumes, so no system directory of the node is covered by a mounter,
+// and the credential files can't be read, since they are looked up in the container of the plugin of this node
+func checkMountConn(conn net.Conn, mountPath string, credentialSource *protocol.CredentialSource) error {
+	if isLocalConn(conn) {
+		return nil
+	}
+	if filepath.Clean(mountPath) != mountPath || !isTargetPath(mountPath) {
+		return fmt.Errorf("mount path %s of the remote plugin is not a target path of volumes", mountPath)
+	}
+	if credentialSource != nil && credentialSource.Type == protocol.CredentialSourceTypeFile {
+		return errors.New("credential files can't be read for the remote plugin")
+	}
+	return nil
+}
+
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = 1 * time.Second
+)
+
+// acceptConns serves the connections accepted by the listener until it's closed, backing off on the other errors
+// of Accept like net/http does, so running out of file descriptors doesn't spin the loop
+func acceptConns(listener net.Listener) {
+	var retryDelay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if retryDelay == 0 {
+				retryDelay = minAcceptRetryDelay
+			} else if retryDelay *= 2; retryDelay > maxAcceptRetryDelay {
+				retryDelay = maxAcceptRetryDelay
+			}
+			log.Infof("Failed to accept connection: %s, retrying in %s", err, retryDelay)
+			time.Sleep(retryDelay)
+			continue
+		}
+		retryDelay = 0
+		go serveConn(conn)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+func TestCheckMountConn(t *testing.T) {
+	local, _ := unixConnPair(t)
+	defer local.Close()
+	remote, plugin := net.Pipe()
+	defer remote.Close()
+	defer plugin.Close()
+
+	const targetPath = "/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount"
+	fileSource := &protocol.CredentialSource{Type: protocol.CredentialSourceTypeFile, AccessKeyFile: "/secrets/ak", SecretKeyFile: "/secrets/sk"}
+	stsSource := &protocol.CredentialSource{Type: protocol.CredentialSourceTypeSTS, Endpoint: "http://sts"}
+	for name, test := range map[string]struct {
+		conn             net.Conn
+		mountPath        string
+		credentialSource *protocol.CredentialSource
+		allowed          bool
+	}{
+		"local target path":             {conn: local, mountPath: targetPath, allowed: true},
+		"local other path":              {conn: local, mountPath: "/etc", allowed: true},
+		"local credential files":        {conn: local, mountPath: targetPath, credentialSource: fileSource, allowed: true},
+		"remote target path":            {conn: remote, mountPath: targetPath, allowed: true},
+		"remote sts":                    {conn: remote, mountPath: targetPath, credentialSource: stsSource, allowed: true},
+		"remote other path":             {conn: remote, mountPath: "/etc"},
+		"remote path escaping the pods": {conn: remote, mountPath: targetPath + "/../../../../../../../../usr/bin"},
+		"remote credential files":       {conn: remote, mountPath: targetPath, credentialSource: fileSource},
+	} {
+		if err := checkMountConn(test.conn, test.mountPath, test.credentialSource); (err == nil) != test.allowed {
+			t.Errorf("%s: checkMountConn = %v, expected allowed %v", name, err, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeout to connect to the Kodo endpoints or the DNS servers resolved by the host aliases and the nameservers
+const ResolverDialTimeout = 10 * time.Second
+
+var (
+	// Host aliases and nameservers of -host-aliases and -nameservers applied to all volumes
+	connectorHostAliases map[string]string
+	connectorNameservers []string
+)
+
+// kodoResolver connects to the Kodo endpoints of a volume by its host aliases and nameservers, in addition to the ones of the connector
+type kodoResolver struct {
+	aliases map[string]string
+	dialer  *net.Dialer
+}
+
+// newKodoResolver returns nil if the endpoints of the volume are resolved by the DNS of the node,
+// or by its own proxies, which resolve the endpoints themselves
+func newKodoResolver(c *protocol.InitKodoMountCmd) *kodoResolver {
+	if c.HttpProxy != "" || c.HttpsProxy != "" {
+		return nil
+	}
+	aliases := make(map[string]string, len(connectorHostAliases)+len(c.HostAliases))
+	for host, ip := range connectorHostAliases {
+		aliases[host] = ip
+	}
+	for host, ip := range c.HostAliases {
+		aliases[strings.ToLower(host)] = ip
+	}
+	nameservers := c.Nameservers
+	if len(nameservers) == 0 {
+		nameservers = connectorNameservers
+	}
+	if len(aliases) == 0 && len(nameservers) == 0 {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: ResolverDialTimeout}
+	if len(nameservers) > 0 {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			// The nameservers of the node are replaced, each of the given ones is tried in order
+			Dial: func(ctx context.Context, network, _ string) (conn net.Conn, err error) {
+				d := net.Dialer{Timeout: ResolverDialTimeout}
+				for _, nameserver := range nameservers {
+					if conn, err = d.DialContext(ctx, network, nameserver); err == nil {
+						return conn, nil
+					}
+				}
+				return nil, err
+			},
+		}
+	}
+	return &kodoResolver{aliases: aliases, dialer: dialer}
+}
+
+func (r *kodoResolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if ip, ok := r.aliases[strings.ToLower(host)]; ok {
+			address = net.JoinHostPort(ip, port)
+		}
+	}
+	return r.dialer.DialContext(ctx, network, address)
+}
+
+// newKodoHttpClient returns the client connecting to the endpoints of the volume by its resolver, which is http.DefaultClient without one
+func newKodoHttpClient(c *protocol.InitKodoMountCmd) *http.Client {
+	resolver := newKodoResolver(c)
+	if resolver == nil {
+		return http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = resolver.DialContext
+	return &http.Client{Transport: transport}
+}
+
+// resolverProxy lets the rclone process of a volume connect to its S3 endpoint through the loopback proxy of the connector,
+// which resolves the endpoint by the resolver of the volume, since rclone can't be given the addresses of the host names
+type resolverProxy struct {
+	id, token string
+	resolver  *kodoResolver
+	transport *http.Transport
+	// Host of the S3 endpoint, whose sub domains are also proxied for the buckets accessed in the virtual-hosted style
+	endpointHost string
+}
+
+var (
+	resolverProxyServerOnce sync.Once
+	resolverProxyServerAddr string
+	resolverProxyServerErr  error
+	// Resolver proxies of the running rclone processes by their ids
+	resolverProxies sync.Map
+)
+
+// startResolverProxy returns nil if the volume has no resolver, the proxy is stopped once the rclone process exits
+func startResolverProxy(c *protocol.InitKodoMountCmd) (*resolverProxy, error) {
+	resolver := newKodoResolver(c)
+	if resolver == nil {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(c.S3Endpoint)
+	if err != nil || endpoint.Hostname() == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %s to resolve", c.S3Endpoint)
+	}
+	if err = startResolverProxyServer(); err != nil {
+		return nil, err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	p := &resolverProxy{
+		id:           id,
+		token:        token,
+		resolver:     resolver,
+		transport:    &http.Transport{DialContext: resolver.DialContext, Proxy: nil},
+		endpointHost: strings.ToLower(endpoint.Hostname()),
+	}
+	resolverProxies.Store(p.id, p)
+	return p, nil
+}
+
+// url returns the url of the proxy including its credentials, which must only be passed by the environment
+func (p *resolverProxy) url() string {
+	return "http://" + p.id + ":" + p.token + "@" + resolverProxyServerAddr
+}
+
+func (p *resolverProxy) stop() {
+	resolverProxies.Delete(p.id)
+	p.transport.CloseIdleConnections()
+}
+
+func (p *resolverProxy) allows(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	return host == p.endpointHost || strings.HasSuffix(host, "."+p.endpointHost)
+}
+
+// startResolverProxyServer serves the resolver proxies on a random loopback port, shared by all rclone processes
+func startResolverProxyServer() error {
+	resolverProxyServerOnce.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			resolverProxyServerErr = fmt.Errorf("failed to listen for resolver proxy: %w", err)
+			return
+		}
+		resolverProxyServerAddr = listener.Addr().String()
+		go func() {
+			if err := http.Serve(listener, http.HandlerFunc(serveResolverProxy)); err != nil {
+				log.Errorf("Failed to serve resolver proxy: %s", err)
+			}
+		}()
+	})
+	return resolverProxyServerErr
+}
+
+// lookupResolverProxy returns the proxy authenticated by the Proxy-Authorization of the request, or nil
+func lookupResolverProxy(r *http.Request) *resolverProxy {
+	authorization := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(authorization, "Basic ") {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+	if err != nil {
+		return nil
+	}
+	id, token, _ := strings.Cut(string(decoded), ":")
+	value, ok := resolverProxies.Load(id)
+	if !ok {
+		return nil
+	}
+	p := value.(*resolverProxy)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+		return nil
+	}
+	return p
+}
+
+func serveResolverProxy(w http.ResponseWriter, r *http.Request) {
+	p := lookupResolverProxy(r)
+	if p == nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="resolver"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	} else if !p.allows(r.Host) {
+		http.Error(w, fmt.Sprintf("%s is not the endpoint of the volume", r.Host), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		tunnelResolverProxy(w, r, p)
+		return
+	}
+
+	// The requests to the endpoints of plain HTTP are forwarded as is
+	request := r.Clone(r.Context())
+	request.RequestURI = ""
+	request.Header.Del("Proxy-Authorization")
+	request.Header.Del("Proxy-Connection")
+	resp, err := p.transport.RoundTrip(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnelResolverProxy connects to the endpoint by the resolver, then copies the bytes between both sides, e.g. of TLS
+func tunnelResolverProxy(w http.ResponseWriter, r *http.Request, p *resolverProxy) {
+	upstream, err := p.resolver.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Warnf("Failed to hijack connection of resolver proxy: %s", err)
+		return
+	}
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	go func() {
+		defer upstream.Close()
+		io.Copy(upstream, buffered.Reader)
+	}()
+	go func() {
+		defer conn.Close()
+		io.Copy(conn, upstream)
+	}()
+}
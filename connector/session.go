@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionState is the state of a session, which only moves from sessionRunning to one of the others
+type sessionState int32
+
+const (
+	// The command is running, and its responses are written into the connection
+	sessionRunning sessionState = iota
+	// The command terminates, so the connection could be used by the next command
+	sessionTerminated
+	// The connection is gone or broken, or the command stops without terminating, nothing is replied anymore
+	sessionClosed
+)
+
+func (state sessionState) String() string {
+	switch state {
+	case sessionRunning:
+		return "running"
+	case sessionTerminated:
+		return "terminated"
+	case sessionClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// session runs a command received from a connection. It owns the goroutines of the command: the loop forwarding the
+// requests in run, the writer of the responses, handleCmd and the goroutines started by it, all of which stop once
+// the context of the session is done, which is cancelled as soon as the session leaves sessionRunning.
+// None of the channels is ever closed, so nothing could be sent into a closed channel, and a goroutine replying
+// after the session finishes gives up instead of blocking forever.
+type session struct {
+	conn net.Conn
+	// Numbers the frames written into the connection, shared by all the sessions of the connection
+	frames *protocol.FrameSequence
+	cc     *connContext
+	ctx    context.Context
+	cancel context.CancelFunc
+	state  int32
+	// Responses of the command written into the connection in order, nil tells that handleCmd stops
+	responses chan protocol.Cmd
+	// Data sent by the plugin into the stdin of the running command, i.e. the answers to the prompts of kodofs
+	data chan *protocol.RequestDataCmd
+	// Set if the plugin asks for flow control, then the data of both directions is sent by the credits granted by the other side
+	flowControl bool
+	// Credits granted by the plugin to send more responses, read by the writer
+	credits chan int
+	// Acknowledgements of the data written into the stdin, written by the writer without waiting for the credits
+	acks chan int
+	// Number of the data received but not acknowledged yet, which never exceeds protocol.DataWindow under flow control
+	unacked int32
+	// Set if the plugin answers the heartbeats, then the connection lives as long as the plugin answers instead of by the deadline
+	heartbeat bool
+	// Set if the command replies until the plugin closes the connection, then only each write is bounded by the deadline instead of the whole command
+	following bool
+}
+
+func newSession(conn net.Conn, frames *protocol.FrameSequence) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		conn:      conn,
+		frames:    frames,
+		cc:        new(connContext),
+		ctx:       ctx,
+		cancel:    cancel,
+		responses: make(chan protocol.Cmd),
+		// Never blocks the loop reading the requests, since no more data than the window is sent before it's acknowledged
+		data:    make(chan *protocol.RequestDataCmd, protocol.DataWindow),
+		credits: make(chan int),
+		acks:    make(chan int),
+	}
+}
+
+func (s *session) getState() sessionState {
+	return sessionState(atomic.LoadInt32(&s.state))
+}
+
+// finish moves the running session into the state and stops all of its goroutines, returns false if it's finished already
+func (s *session) finish(state sessionState) bool {
+	finished := atomic.CompareAndSwapInt32(&s.state, int32(sessionRunning), int32(state))
+	s.cancel()
+	if finished {
+		s.cc.logger(nil).Debugf("Session is %s", state)
+	}
+	return finished
+}
+
+// reply sends the response to the writer, returns false if the session is finished, when the response is dropped
+func (s *session) reply(cmd protocol.Cmd) bool {
+	select {
+	case s.responses <- cmd:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// ackData acknowledges the data written into the stdin of the command, which grants the plugin the credit to send more
+func (s *session) ackData() {
+	if !s.flowControl {
+		return
+	}
+	atomic.AddInt32(&s.unacked, -1)
+	select {
+	case s.acks <- 1:
+	case <-s.ctx.Done():
+	}
+}
+
+// replyError replies the error and terminates the command with code 1
+func (s *session) replyError(message string) {
+	if s.reply(&protocol.ResponseDataCmd{Data: message, IsError: true}) {
+		s.reply(&protocol.TerminateCmd{Code: 1})
+	}
+}
+
+// run serves the command of the request until the session finishes, returns true if the command terminates normally
+// so that the connection could be used by the next command, together with the request of the next command if it's received before then.
+func (s *session) run(request *protocol.Request, requests <-chan *protocol.Request) (bool, *protocol.Request) {
+	defer s.cc.end()
+
+	s.heartbeat, s.flowControl = request.Heartbeat, request.FlowControl
+	answered := time.Now()
+	if s.heartbeat {
+		s.conn.SetDeadline(time.Time{})
+		s.conn.SetReadDeadline(answered.Add(HeartbeatTimeout))
+	}
+	s.cc.start(request)
+	cmd, err := protocol.DecodeCmd(request)
+	if err != nil {
+		s.cc.logger(nil).Warnf("Protocol error: %s", err)
+		s.finish(sessionClosed)
+		return false, nil
+	}
+	if _, ok := cmd.(*protocol.PingCmd); ok {
+		// Sent by the readiness probe of the plugin every few seconds
+		s.cc.logger(cmd).Debugf("Received %s", request.Cmd)
+	} else {
+		s.cc.logger(cmd).Infof("Received %s: %#v", request.Cmd, redactCmd(cmd))
+	}
+	if c, ok := cmd.(*protocol.KodoMountLogsCmd); ok && c.Follow {
+		s.following = true
+		s.conn.SetDeadline(time.Time{})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.writeResponses()
+	}()
+	go func() {
+		handleCmd(s, cmd)
+		// Queued after the responses of handleCmd, so the session is closed only if it doesn't terminate the command
+		s.reply(nil)
+	}()
+
+	var next *protocol.Request
+loop:
+	for {
+		select {
+		case <-s.ctx.Done():
+			break loop
+		case request, ok := <-requests:
+			if !ok {
+				if s.heartbeat && time.Since(answered) >= HeartbeatTimeout {
+					s.cc.logger(cmd).Warnf("Plugin answered no heartbeat in %s, the connection is closed", HeartbeatTimeout)
+					deadConnectionTotal.Inc()
+				}
+				s.finish(sessionClosed)
+				break loop
+			}
+			if request.Cmd == protocol.HeartbeatCmdName {
+				answered = time.Now()
+				s.conn.SetReadDeadline(answered.Add(HeartbeatTimeout))
+				continue
+			} else if request.Cmd != protocol.RequestDataCmdName && request.Cmd != protocol.AckDataCmdName {
+				// Sent once the command terminates, it belongs to the next command
+				next = request
+				<-s.ctx.Done()
+				break loop
+			}
+			received, err := protocol.DecodeCmd(request)
+			if err != nil {
+				s.cc.logger(cmd).Warnf("Protocol error: %s", err)
+				s.finish(sessionClosed)
+				break loop
+			}
+			switch c := received.(type) {
+			case *protocol.AckDataCmd:
+				select {
+				case s.credits <- c.Credits:
+				case <-s.ctx.Done():
+					break loop
+				}
+			case *protocol.RequestDataCmd:
+				if s.flowControl && atomic.AddInt32(&s.unacked, 1) > protocol.DataWindow {
+					s.cc.logger(cmd).Warnf("Protocol error: plugin sent more data than %d credits", protocol.DataWindow)
+					s.finish(sessionClosed)
+					break loop
+				}
+				select {
+				case s.data <- c:
+				case <-s.ctx.Done():
+					break loop
+				}
+			}
+		}
+	}
+	// The termination is written once the writer stops
+	wg.Wait()
+	return s.getState() == sessionTerminated, next
+}
+
+// writeResponses writes the responses of the command and the heartbeats into the connection until the session finishes,
+// the session is terminated once the termination is written, and closed if any write fails.
+func (s *session) writeResponses() {
+	// Never ticks unless the plugin asks for the heartbeats
+	var heartbeats <-chan time.Time
+	if s.heartbeat {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+	credits := protocol.DataWindow
+	for {
+		// The responses wait in handleCmd until the plugin grants more credits, while the heartbeats and the acknowledgements never wait
+		responses := s.responses
+		if s.flowControl && credits <= 0 {
+			responses = nil
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case n := <-s.credits:
+			credits += n
+		case n := <-s.acks:
+			if !s.write(protocol.AckDataCmdName, &protocol.AckDataCmd{Credits: n}) {
+				s.finish(sessionClosed)
+				return
+			}
+		case <-heartbeats:
+			s.conn.SetWriteDeadline(time.Now().Add(ConnDeadline))
+			if !s.write(protocol.HeartbeatCmdName, &protocol.HeartbeatCmd{}) {
+				s.finish(sessionClosed)
+				return
+			}
+		case cmd := <-responses:
+			if s.following || s.heartbeat {
+				s.conn.SetWriteDeadline(time.Now().Add(ConnDeadline))
+			}
+			switch cmd.(type) {
+			case nil:
+				s.finish(sessionClosed)
+				return
+			case *protocol.ResponseDataCmd:
+				if !s.write(protocol.ResponseDataCmdName, cmd) {
+					s.finish(sessionClosed)
+					return
+				}
+				credits--
+			case *protocol.TerminateCmd:
+				if s.write(protocol.TerminateCmdName, cmd) {
+					s.finish(sessionTerminated)
+				} else {
+					s.finish(sessionClosed)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (s *session) write(cmdName string, cmd protocol.Cmd) bool {
+	bytes, err := json.Marshal(cmd)
+	if err != nil {
+		log.Errorf("Protocol marshal error: %s", err)
+		return false
+	}
+	request := &protocol.Request{
+		Version: protocol.Version,
+		Cmd:     cmdName,
+		Payload: json.RawMessage(bytes),
+	}
+	s.frames.Seal(request)
+	bytes, err = json.Marshal(request)
+	if err != nil {
+		log.Errorf("Protocol marshal error: %s", err)
+		return false
+	}
+	if _, err = s.conn.Write(append(bytes, '\n')); err != nil {
+		log.Errorf("Write into conn error: %s", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+// pipeSession returns a session over net.Pipe and the responses read from the plugin end, which are read until it's closed
+func pipeSession(t *testing.T, flowControl bool) (*session, net.Conn, <-chan *protocol.Request) {
+	plugin, conn := net.Pipe()
+	t.Cleanup(func() {
+		plugin.Close()
+		conn.Close()
+	})
+	s := newSession(conn, new(protocol.FrameSequence))
+	s.flowControl = flowControl
+	responses := make(chan *protocol.Request, 2*protocol.DataWindow)
+	go func() {
+		defer close(responses)
+		scanner := bufio.NewScanner(plugin)
+		for scanner.Scan() {
+			response := new(protocol.Request)
+			if err := json.Unmarshal(scanner.Bytes(), response); err != nil {
+				t.Errorf("failed to parse response %s: %s", scanner.Bytes(), err)
+				return
+			}
+			responses <- response
+		}
+	}()
+	return s, plugin, responses
+}
+
+func expectResponse(t *testing.T, responses <-chan *protocol.Request, cmdName string) *protocol.Request {
+	t.Helper()
+	select {
+	case response, ok := <-responses:
+		if !ok {
+			t.Fatalf("connection is closed before %s is written", cmdName)
+		} else if response.Cmd != cmdName {
+			t.Fatalf("%s is written, but %s is expected", response.Cmd, cmdName)
+		}
+		return response
+	case <-time.After(time.Second):
+		t.Fatalf("%s is not written", cmdName)
+	}
+	return nil
+}
+
+func expectNoResponse(t *testing.T, responses <-chan *protocol.Request) {
+	t.Helper()
+	select {
+	case response, ok := <-responses:
+		if ok {
+			t.Fatalf("%s is written unexpectedly", response.Cmd)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// expectGoroutines waits for the goroutines started by the test to exit
+func expectGoroutines(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > count {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines are left, %d expected:\n%s", runtime.NumGoroutine(), count, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionFinishesOnce(t *testing.T) {
+	s, _, _ := pipeSession(t, false)
+	if !s.finish(sessionTerminated) {
+		t.Fatalf("running session is not finished")
+	} else if s.finish(sessionClosed) {
+		t.Fatalf("session is finished twice")
+	} else if state := s.getState(); state != sessionTerminated {
+		t.Fatalf("session is %s after finished twice, expected terminated", state)
+	}
+	select {
+	case <-s.ctx.Done():
+	default:
+		t.Fatalf("context of the finished session is not done")
+	}
+}
+
+func TestSessionDropsTerminationAfterClosed(t *testing.T) {
+	s, _, responses := pipeSession(t, false)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeResponses()
+	}()
+	s.finish(sessionClosed)
+	<-done
+
+	replied := make(chan bool, 1)
+	go func() {
+		replied <- s.reply(&protocol.TerminateCmd{Code: 0})
+	}()
+	select {
+	case ok := <-replied:
+		if ok {
+			t.Fatalf("termination is replied after the session is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("reply blocks after the session is closed")
+	}
+	// Nothing is written, neither the error
+	s.replyError("failed")
+	expectNoResponse(t, responses)
+	if state := s.getState(); state != sessionClosed {
+		t.Fatalf("closed session is %s after replied", state)
+	}
+}
+
+func TestSessionTerminates(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	s, plugin, responses := pipeSession(t, false)
+	requests := make(chan *protocol.Request)
+	result := make(chan bool, 1)
+	go func() {
+		terminated, _ := s.run(&protocol.Request{Version: protocol.Version, Cmd: protocol.DebugStateCmdName}, requests)
+		result <- terminated
+	}()
+
+	var frames protocol.FrameSequence
+	for _, cmdName := range []string{protocol.ResponseDataCmdName, protocol.TerminateCmdName} {
+		if err := frames.Check(expectResponse(t, responses, cmdName)); err != nil {
+			t.Fatalf("%s is not sealed: %s", cmdName, err)
+		}
+	}
+	if !<-result {
+		t.Fatalf("session is not terminated")
+	}
+	// Neither the writer nor handleCmd is left once run returns
+	plugin.Close()
+	expectGoroutines(t, goroutines)
+}
+
+func TestSessionClosesWhenPluginHangsUp(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	plugin, conn := net.Pipe()
+	defer conn.Close()
+	s := newSession(conn, new(protocol.FrameSequence))
+	requests := make(chan *protocol.Request)
+	result := make(chan bool, 1)
+	go func() {
+		terminated, _ := s.run(&protocol.Request{Version: protocol.Version, Cmd: protocol.DebugStateCmdName}, requests)
+		result <- terminated
+	}()
+
+	// The plugin hangs up without reading the response, which blocks the writer until the write fails
+	time.Sleep(50 * time.Millisecond)
+	plugin.Close()
+	select {
+	case terminated := <-result:
+		if terminated {
+			t.Fatalf("session is terminated after the plugin hangs up")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("session still runs after the plugin hangs up")
+	}
+	if state := s.getState(); state != sessionClosed {
+		t.Fatalf("session is %s after the plugin hangs up, expected closed", state)
+	}
+	expectGoroutines(t, goroutines)
+}
+
+func TestSessionClosesWhenRequestsEnd(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	plugin, conn := net.Pipe()
+	defer conn.Close()
+	s := newSession(conn, new(protocol.FrameSequence))
+	requests := make(chan *protocol.Request)
+	result := make(chan bool, 1)
+	go func() {
+		terminated, _ := s.run(&protocol.Request{Version: protocol.Version, Cmd: protocol.DebugStateCmdName}, requests)
+		result <- terminated
+	}()
+
+	// readRequests closes the channel once the connection is gone, while the writer is still blocked by the write
+	close(requests)
+	time.Sleep(50 * time.Millisecond)
+	if state := s.getState(); state != sessionClosed {
+		t.Fatalf("session is %s once the requests end, expected closed", state)
+	}
+	// The connection is closed by serveConn then, which unblocks the writer
+	plugin.Close()
+	if terminated := <-result; terminated {
+		t.Fatalf("session is terminated once the requests end")
+	}
+	expectGoroutines(t, goroutines)
+}
+
+func TestSessionWaitsForCredits(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	s, plugin, responses := pipeSession(t, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeResponses()
+	}()
+
+	for i := 0; i < protocol.DataWindow; i++ {
+		if !s.reply(&protocol.ResponseDataCmd{Data: "data"}) {
+			t.Fatalf("response %d is dropped", i)
+		}
+		expectResponse(t, responses, protocol.ResponseDataCmdName)
+	}
+	// No credit is left, the next response waits until the plugin grants more
+	replied := make(chan bool, 1)
+	go func() {
+		replied <- s.reply(&protocol.ResponseDataCmd{Data: "data"})
+	}()
+	expectNoResponse(t, responses)
+	select {
+	case <-replied:
+		t.Fatalf("response is accepted without any credit")
+	default:
+	}
+
+	s.credits <- 1
+	expectResponse(t, responses, protocol.ResponseDataCmdName)
+	if !<-replied {
+		t.Fatalf("response is dropped after the credit is granted")
+	}
+	// The termination waits for the credits too, since it's queued after the responses
+	go s.reply(&protocol.TerminateCmd{Code: 0})
+	expectNoResponse(t, responses)
+	s.credits <- 1
+	expectResponse(t, responses, protocol.TerminateCmdName)
+	<-done
+	if state := s.getState(); state != sessionTerminated {
+		t.Fatalf("session is %s, expected terminated", state)
+	}
+	plugin.Close()
+	expectGoroutines(t, goroutines)
+}
+
+func TestSessionClosesWhenPluginSendsMoreDataThanCredits(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	plugin, conn := net.Pipe()
+	defer conn.Close()
+	s := newSession(conn, new(protocol.FrameSequence))
+	requests := make(chan *protocol.Request)
+	result := make(chan bool, 1)
+	go func() {
+		terminated, _ := s.run(&protocol.Request{Version: protocol.Version, Cmd: protocol.DebugStateCmdName, FlowControl: true}, requests)
+		result <- terminated
+	}()
+
+	// Nothing is terminated before the response is read, all the data is taken by the session
+	for i := 0; i <= protocol.DataWindow; i++ {
+		select {
+		case requests <- &protocol.Request{Version: protocol.Version, Cmd: protocol.RequestDataCmdName, Payload: []byte(`{"data":"y"}`)}:
+		case <-s.ctx.Done():
+			t.Fatalf("session is finished after %d data", i)
+		}
+	}
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("session still runs after the plugin sends more data than the credits")
+	}
+	if state := s.getState(); state != sessionClosed {
+		t.Fatalf("session is %s, expected closed", state)
+	}
+	plugin.Close()
+	if terminated := <-result; terminated {
+		t.Fatalf("session is terminated after the plugin sends more data than the credits")
+	}
+	expectGoroutines(t, goroutines)
+}
+
+func TestSessionAcknowledgesData(t *testing.T) {
+	s, _, responses := pipeSession(t, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeResponses()
+	}()
+
+	s.unacked = 2
+	s.ackData()
+	if ack := expectResponse(t, responses, protocol.AckDataCmdName); string(ack.Payload) != `{"credits":1}` {
+		t.Fatalf("ack payload is %s", ack.Payload)
+	} else if s.unacked != 1 {
+		t.Fatalf("%d data are unacknowledged, expected 1", s.unacked)
+	}
+	// The acknowledgements are written even if no credit is left for the responses
+	s.credits <- -protocol.DataWindow
+	s.ackData()
+	expectResponse(t, responses, protocol.AckDataCmdName)
+
+	s.finish(sessionClosed)
+	<-done
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		s.ackData()
+	}()
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatalf("ackData blocks after the session is closed")
+	}
+	expectNoResponse(t, responses)
+}
+
+func TestSessionNeverAcknowledgesDataWithoutFlowControl(t *testing.T) {
+	s, _, responses := pipeSession(t, false)
+	go s.writeResponses()
+	defer s.finish(sessionClosed)
+
+	s.ackData()
+	expectNoResponse(t, responses)
+	if s.unacked != 0 {
+		t.Fatalf("%d data are unacknowledged without flow control", s.unacked)
+	}
+}
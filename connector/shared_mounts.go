@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Directory of the rclone mount points shared by Kodo volumes, which are bind mounted to the mount paths of the volumes
+	SharedKodoMountsDir = "/var/lib/qiniu/storage/csi-plugin/shared"
+	// Prefix of the volume id of the shared mounters, followed by the key of the shared mount
+	SharedKodoVolumeIdPrefix = "shared-"
+)
+
+// sharedKodoMount is a rclone mount point shared by the Kodo volumes mounting the same bucket with the same options
+type sharedKodoMount struct {
+	key, volumeId, mountPath string
+	// Serializes mounting and unmounting of the shared mount point
+	lock sync.Mutex
+}
+
+type sharedKodoMountRegistry struct {
+	lock sync.Mutex
+	// Shared mounts by key, never removed so that a mount point released and acquired concurrently is guarded by the same lock
+	mounts map[string]*sharedKodoMount
+	// Shared mounts by the mount paths of the volumes bound to them, which are the references of the shared mounts
+	targets map[string]*sharedKodoMount
+}
+
+var sharedKodoMounts = &sharedKodoMountRegistry{
+	mounts:  make(map[string]*sharedKodoMount),
+	targets: make(map[string]*sharedKodoMount),
+}
+
+func (r *sharedKodoMountRegistry) get(key string) *sharedKodoMount {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	shared, exists := r.mounts[key]
+	if !exists {
+		shared = &sharedKodoMount{
+			key:       key,
+			volumeId:  SharedKodoVolumeIdPrefix + key,
+			mountPath: filepath.Join(SharedKodoMountsDir, key),
+		}
+		r.mounts[key] = shared
+	}
+	return shared
+}
+
+func (r *sharedKodoMountRegistry) lookup(target string) *sharedKodoMount {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.targets[target]
+}
+
+func (r *sharedKodoMountRegistry) bind(target string, shared *sharedKodoMount) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.targets[target] = shared
+}
+
+// unbind removes the reference of the target, and returns how many targets are still bound to the shared mount
+func (r *sharedKodoMountRegistry) unbind(target string, shared *sharedKodoMount) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.targets, target)
+	return r.countLocked(shared)
+}
+
+func (r *sharedKodoMountRegistry) count(shared *sharedKodoMount) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.countLocked(shared)
+}
+
+func (r *sharedKodoMountRegistry) countLocked(shared *sharedKodoMount) int {
+	count := 0
+	for _, s := range r.targets {
+		if s == shared {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (r *sharedKodoMountRegistry) targetsOf(shared *sharedKodoMount) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var targets []string
+	for target, s := range r.targets {
+		if s == shared {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// sharedKodoMountKey returns the key of the mount point which could be shared by the volume.
+// Volumes are compatible only if they mount the same sub directory of the same bucket by the same credentials and options,
+// only the identities of the volume and the workload, and the paths prewarmed through the mount path are ignored.
+func sharedKodoMountKey(c *protocol.InitKodoMountCmd) (string, error) {
+	cmd := *c
+	cmd.VolumeId, cmd.MountPath = "", ""
+	cmd.PvcNamespace, cmd.PvcName, cmd.PodNamespace, cmd.PodName = "", "", "", ""
+	cmd.Prewarm, cmd.PrewarmManifest = nil, ""
+	buf, err := json.Marshal(&cmd)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(buf)
+	return hex.EncodeToString(hash[:])[:16], nil
+}
+
+// cmd returns the command to mount the shared mount point, which isn't attributed to any volume or workload
+func (shared *sharedKodoMount) cmd(c *protocol.InitKodoMountCmd) *protocol.InitKodoMountCmd {
+	cmd := *c
+	cmd.VolumeId, cmd.MountPath = shared.volumeId, shared.mountPath
+	cmd.PvcNamespace, cmd.PvcName, cmd.PodNamespace, cmd.PodName = "", "", "", ""
+	return &cmd
+}
+
+// rebind binds the shared mount point to all targets again, since the bind mounts of a dead mounter never recover
+func (shared *sharedKodoMount) rebind() {
+	for _, target := range sharedKodoMounts.targetsOf(shared) {
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+			log.Warnf("Failed to unmount %s lazily: %s", target, err)
+		}
+		if err := syscall.Mount(shared.mountPath, target, "", syscall.MS_BIND, ""); err != nil {
+			log.Warnf("Failed to bind shared mount point %s to %s again: %s", shared.mountPath, target, err)
+		} else {
+			log.Infof("Shared mount point %s is bound to %s again", shared.mountPath, target)
+		}
+	}
+}
+
+// mountSharedKodo mounts the volume by binding the shared mount point to the mount path,
+// the shared mount point is mounted first if no volume uses it yet
+func mountSharedKodo(cc *connContext, logger *log.Entry, c *protocol.InitKodoMountCmd) error {
+	key, err := sharedKodoMountKey(c)
+	if err != nil {
+		return fmt.Errorf("failed to compute key of shared mount point: %w", err)
+	}
+	shared := sharedKodoMounts.get(key)
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+
+	if status, supervised := mounterSupervisor.get(shared.mountPath); supervised &&
+		(status.State == MOUNTER_STATE_RUNNING || status.State == MOUNTER_STATE_STARTING) {
+		logger.Infof("Reuse shared mount point %s for %s", shared.mountPath, c.MountPath)
+	} else {
+		// Left by the previous connector, whose mounters are stopped together with it
+		if mounted, _ := isMountedBy(shared.mountPath, FuseTypeRclone); mounted {
+			if err := unmountFuseLazily(shared.mountPath); err != nil {
+				logger.Warnf("Failed to unmount stale shared mount point %s lazily: %s", shared.mountPath, err)
+			}
+		}
+		if err = ensureDirectoryExists(shared.mountPath); err != nil {
+			return fmt.Errorf("failed to create shared mount point %s: %w", shared.mountPath, err)
+		}
+		if err = mountRclone(cc, logger, shared.cmd(c), shared.rebind); err != nil {
+			return err
+		}
+		logger.Infof("Shared mount point %s of bucket %s is mounted", shared.mountPath, c.BucketId)
+		// The volumes recovered after the connector restarts are still bound to the stale mount point
+		shared.rebind()
+	}
+
+	if mounted, err := isMountedBy(c.MountPath, FuseTypeRclone); err != nil {
+		return fmt.Errorf("failed to detect mount point %s: %w", c.MountPath, err)
+	} else if !mounted {
+		if err = syscall.Mount(shared.mountPath, c.MountPath, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind shared mount point %s to %s: %w", shared.mountPath, c.MountPath, err)
+		}
+	}
+	sharedKodoMounts.bind(c.MountPath, shared)
+	logger.Infof("Shared mount point %s is bound to %s", shared.mountPath, c.MountPath)
+	return nil
+}
+
+// umountSharedKodo releases the shared mount point bound to the mount path, which is unmounted once no volume uses it.
+// It returns false if the mount path isn't bound to any shared mount point.
+func umountSharedKodo(logger *log.Entry, mountPath string) bool {
+	shared := sharedKodoMounts.lookup(mountPath)
+	if shared == nil {
+		return false
+	}
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+
+	// Usually unmounted by the plugin already
+	if remaining := shared.unbind(logger, mountPath, 0); remaining == 0 {
+		shared.release(logger)
+	}
+	return true
+}
+
+// unbind unmounts the mount path with the flags and removes its reference, returns how many volumes still use the shared mount point
+func (shared *sharedKodoMount) unbind(logger *log.Entry, mountPath string, flags int) int {
+	if mounted, _ := isMountedBy(mountPath, FuseTypeRclone); mounted {
+		if err := syscall.Unmount(mountPath, flags); err != nil {
+			logger.Warnf("Failed to unmount %s: %s", mountPath, err)
+		}
+	}
+	remaining := sharedKodoMounts.unbind(mountPath, shared)
+	logger.Infof("%s is unbound from shared mount point %s, %d volumes are still using it", mountPath, shared.mountPath, remaining)
+	return remaining
+}
+
+// release unmounts the shared mount point which is no longer used by any volume, must be called with the lock held
+func (shared *sharedKodoMount) release(logger *log.Entry) {
+	mounterSupervisor.stop(shared.mountPath)
+	if mounted, _ := isMountedBy(shared.mountPath, FuseTypeRclone); mounted {
+		// Not supervised if mounted by the previous connector
+		if err := unmountFuseLazily(shared.mountPath); err != nil {
+			logger.Warnf("Failed to unmount shared mount point %s lazily: %s", shared.mountPath, err)
+		}
+	}
+	removeRcloneFiles(shared.volumeId, shared.mountPath)
+	os.Remove(shared.mountPath)
+	logger.Infof("Shared mount point %s is unmounted", shared.mountPath)
+}
+
+// resolveKodoMount returns the volume id and the mount path of the mounter actually serving the volume
+func resolveKodoMount(volumeId, mountPath string) (string, string) {
+	if shared := sharedKodoMounts.lookup(mountPath); shared != nil {
+		return shared.volumeId, shared.mountPath
+	} else if wc, ok := lookupKodoWriteCache(mountPath); ok {
+		return wc.volumeId, wc.mountPath
+	}
+	return volumeId, mountPath
+}
+
+// recoverSharedKodoMounts recovers the references of the shared mount points after the connector restarts,
+// the bind mounts of a shared mount point are on the same device as it
+func recoverSharedKodoMounts() error {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+	devices := make(map[string]*sharedKodoMount)
+	for _, mount := range mounts {
+		if mount.fsType == FuseTypeRclone && filepath.Dir(mount.mountPoint) == SharedKodoMountsDir {
+			devices[mount.device] = sharedKodoMounts.get(filepath.Base(mount.mountPoint))
+		}
+	}
+	for _, mount := range mounts {
+		shared, ok := devices[mount.device]
+		if !ok || mount.fsType != FuseTypeRclone || strings.HasPrefix(mount.mountPoint, SharedKodoMountsDir+"/") {
+			continue
+		}
+		sharedKodoMounts.bind(mount.mountPoint, shared)
+		log.Infof("Recovered %s bound to shared mount point %s", mount.mountPoint, shared.mountPath)
+	}
+	return nil
+}
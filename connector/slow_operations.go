@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var slowOperationTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Name:      "slow_operations_total",
+	Help:      "Total number of mounter startups and commands exceeding --slow-operation-threshold by operation and the slowest stage",
+}, []string{"operation", "stage"})
+
+func init() {
+	metricsRegistry.MustRegister(slowOperationTotal)
+}
+
+// stageTimer measures the stages of an operation run one after another, e.g. preparing and starting a mounter
+type stageTimer struct {
+	operation  string
+	begin      time.Time
+	stage      string
+	stageBegin time.Time
+	stages     []string
+	durations  map[string]time.Duration
+}
+
+func newStageTimer(operation string) *stageTimer {
+	now := time.Now()
+	return &stageTimer{operation: operation, begin: now, stageBegin: now, durations: make(map[string]time.Duration)}
+}
+
+// next ends the current stage and starts the next one
+func (t *stageTimer) next(stage string) {
+	now := time.Now()
+	if t.stage != "" {
+		t.durations[t.stage] += now.Sub(t.stageBegin)
+	}
+	if _, exists := t.durations[stage]; !exists {
+		t.stages = append(t.stages, stage)
+		t.durations[stage] = 0
+	}
+	t.stage, t.stageBegin = stage, now
+}
+
+// done ends the operation, which is logged and counted with the slowest stage if it exceeds --slow-operation-threshold
+func (t *stageTimer) done(logger *log.Entry) {
+	t.next("")
+	total := time.Since(t.begin)
+	if *slowOperationThreshold <= 0 || total <= *slowOperationThreshold {
+		return
+	}
+	slowest := ""
+	details := make([]string, 0, len(t.stages))
+	for _, stage := range t.stages {
+		if stage == "" {
+			continue
+		}
+		if slowest == "" || t.durations[stage] > t.durations[slowest] {
+			slowest = stage
+		}
+		details = append(details, fmt.Sprintf("%s=%s", stage, t.durations[stage].Round(time.Millisecond)))
+	}
+	slowOperationTotal.WithLabelValues(t.operation, slowest).Inc()
+	logger.WithField("duration", total.Seconds()).
+		Warnf("Slow operation: %s takes %s, exceeding %s, the slowest stage is %s (%s)",
+			t.operation, total.Round(time.Millisecond), *slowOperationThreshold, slowest, strings.Join(details, ", "))
+}
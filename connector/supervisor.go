@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest time to wait for a mounter to be mounted, must be shorter than the connection deadline
+	MounterReadyTimeout = 20 * time.Second
+	// Interval to check whether the mounter is mounted
+	MounterReadyCheckInterval = 200 * time.Millisecond
+	// Longest time to wait for a mounter to exit after SIGTERM before killing it
+	MounterStopTimeout = 10 * time.Second
+	// The mounter is considered as failed after restarted so many times in a row
+	MounterMaxRestarts = 10
+	// The restart counter is reset once the mounter keeps running for such a long time
+	MounterRestartResetDuration = 10 * time.Minute
+	// Backoff between two restarts of the mounter, doubled every time until reaching the max one
+	MounterMinRestartBackoff = time.Second
+	MounterMaxRestartBackoff = time.Minute
+)
+
+type MounterState string
+
+const (
+	MOUNTER_STATE_STARTING   MounterState = "starting"
+	MOUNTER_STATE_RUNNING    MounterState = "running"
+	MOUNTER_STATE_RESTARTING MounterState = "restarting"
+	MOUNTER_STATE_STOPPED    MounterState = "stopped"
+	MOUNTER_STATE_FAILED     MounterState = "failed"
+)
+
+// mounterRecord is the lifecycle record of a mounter supervised by the connector
+type mounterRecord struct {
+	volumeId, mountPath, fsType string
+	newCmd                      func() (*exec.Cmd, error)
+	afterRestarted              func()
+	cleanup                     func()
+
+	lock         sync.Mutex
+	state        MounterState
+	pid          int
+	restarts     int
+	lastExitCode int
+	startedAt    time.Time
+	// Directory of the crash report of the last crash of the mounter, empty if it never crashes
+	lastCrashReport string
+	// The mount point is detached, so the mounter is never restarted
+	draining bool
+	// The mounter is killed by restart, so its exit is not counted as a failure
+	restartRequested bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// MounterStatus is a snapshot of a mounterRecord
+type MounterStatus struct {
+	VolumeId        string
+	MountPath       string
+	State           MounterState
+	Pid             int
+	Restarts        int
+	LastExitCode    int
+	StartedAt       time.Time
+	LastCrashReport string
+}
+
+type supervisor struct {
+	lock    sync.Mutex
+	records map[string]*mounterRecord
+}
+
+var mounterSupervisor = &supervisor{records: make(map[string]*mounterRecord)}
+
+// start runs the mounter in the foreground and returns once the mount point is mounted by fsType,
+// the mounter will be restarted if it exits unexpectedly until stop is called.
+// afterRestarted, if not nil, is called every time the restarted mounter is mounted again.
+// cleanup is called when the mounter is stopped or failed.
+func (s *supervisor) start(volumeId, mountPath, fsType string, newCmd func() (*exec.Cmd, error), afterRestarted, cleanup func()) error {
+	s.lock.Lock()
+	if record, exists := s.records[mountPath]; exists {
+		if state := record.status().State; state == MOUNTER_STATE_RUNNING || state == MOUNTER_STATE_STARTING {
+			s.lock.Unlock()
+			record.lock.Lock()
+			draining := record.draining
+			record.lock.Unlock()
+			if draining {
+				return fmt.Errorf("mounter of %s is still uploading the cache of the detached mount point", mountPath)
+			}
+			if mounted, err := isMountedBy(mountPath, fsType); err == nil && mounted {
+				log.Infof("Mounter of %s is already running, reuse it", mountPath)
+				return nil
+			}
+			return fmt.Errorf("mounter of %s is %s but not mounted", mountPath, state)
+		}
+		// Stop the restarting or dead mounter before starting a new one, wait for its cleanup to avoid removing the new config
+		delete(s.records, mountPath)
+		record.stop()
+	}
+	record := &mounterRecord{
+		volumeId:       volumeId,
+		mountPath:      mountPath,
+		fsType:         fsType,
+		newCmd:         newCmd,
+		afterRestarted: afterRestarted,
+		cleanup:        cleanup,
+		state:          MOUNTER_STATE_STARTING,
+		stopCh:         make(chan struct{}),
+		doneCh:         make(chan struct{}),
+	}
+	s.records[mountPath] = record
+	s.lock.Unlock()
+
+	ready := make(chan error, 1)
+	go record.run(ready)
+	if err := <-ready; err != nil {
+		s.lock.Lock()
+		if s.records[mountPath] == record {
+			delete(s.records, mountPath)
+		}
+		s.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// stop stops the mounter of the mount point and forgets it
+func (s *supervisor) stop(mountPath string) {
+	s.lock.Lock()
+	record, exists := s.records[mountPath]
+	if exists {
+		delete(s.records, mountPath)
+	}
+	s.lock.Unlock()
+
+	if exists {
+		record.stop()
+	}
+}
+
+// drain stops restarting the mounter of the mount point, which is detached and exits once the cache is uploaded
+func (s *supervisor) drain(mountPath string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if record, exists := s.records[mountPath]; exists {
+		record.lock.Lock()
+		record.draining = true
+		record.lock.Unlock()
+	}
+}
+
+// restart kills the running mounter of the mount point, which is restarted right away by the supervisor without counting as a failure.
+// The cache of the mounter is kept on the node, so the files not uploaded yet are uploaded by the new mounter.
+func (s *supervisor) restart(mountPath string) error {
+	s.lock.Lock()
+	record, exists := s.records[mountPath]
+	s.lock.Unlock()
+	if !exists {
+		return fmt.Errorf("mounter of %s is not supervised", mountPath)
+	}
+
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	if record.state != MOUNTER_STATE_RUNNING || record.draining || record.pid == 0 {
+		return fmt.Errorf("mounter of %s is %s, not restarted", mountPath, record.state)
+	}
+	record.restartRequested = true
+	// A wedged mounter may never exit by SIGTERM
+	return syscall.Kill(record.pid, syscall.SIGKILL)
+}
+
+func (s *supervisor) list() []MounterStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statuses := make([]MounterStatus, 0, len(s.records))
+	for _, record := range s.records {
+		statuses = append(statuses, record.status())
+	}
+	return statuses
+}
+
+func (s *supervisor) get(mountPath string) (MounterStatus, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if record, exists := s.records[mountPath]; exists {
+		return record.status(), true
+	}
+	return MounterStatus{}, false
+}
+
+func (r *mounterRecord) status() MounterStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return MounterStatus{
+		VolumeId:        r.volumeId,
+		MountPath:       r.mountPath,
+		State:           r.state,
+		Pid:             r.pid,
+		Restarts:        r.restarts,
+		LastExitCode:    r.lastExitCode,
+		StartedAt:       r.startedAt,
+		LastCrashReport: r.lastCrashReport,
+	}
+}
+
+func (r *mounterRecord) setState(state MounterState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.state = state
+}
+
+func (r *mounterRecord) stop() {
+	r.stopOnce.Do(func() { close(r.stopCh) })
+	<-r.doneCh
+}
+
+func (r *mounterRecord) isStopping() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *mounterRecord) run(ready chan<- error) {
+	defer close(r.doneCh)
+	defer func() {
+		if r.cleanup != nil {
+			r.cleanup()
+		}
+		if mounterLimits != nil {
+			mounterLimits.remove(r.mountPath)
+		}
+	}()
+
+	backoff := MounterMinRestartBackoff
+	for {
+		cmd, err := r.newCmd()
+		stderr := &stderrTail{}
+		if err == nil {
+			cmd.Stdout = &mounterLogWriter{mountPath: r.mountPath}
+			cmd.Stderr = &mounterLogWriter{mountPath: r.mountPath, isError: true, tail: stderr}
+			err = cmd.Start()
+		}
+		if err != nil {
+			r.setState(MOUNTER_STATE_FAILED)
+			log.Errorf("Failed to start mounter of %s: %s", r.mountPath, err)
+			if ready != nil {
+				ready <- fmt.Errorf("failed to start mounter: %w", err)
+			}
+			return
+		}
+		r.lock.Lock()
+		r.pid = cmd.Process.Pid
+		r.startedAt = time.Now()
+		r.lock.Unlock()
+		log.Infof("Mounter of %s is started with pid %d", r.mountPath, cmd.Process.Pid)
+		if mounterLimits != nil {
+			// The mounter still runs without the limits rather than failing the mount
+			if err := mounterLimits.place(r.mountPath, cmd.Process.Pid); err != nil {
+				log.Warnf("Failed to limit resources of mounter of %s: %s", r.mountPath, err)
+			}
+		}
+
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			cmd.Wait()
+		}()
+
+		notMounted := false
+		if err := r.waitForMounted(exited); err != nil {
+			terminateMounter(cmd, exited)
+			r.captureExitCode(cmd, stderr)
+			if ready != nil {
+				r.setState(MOUNTER_STATE_FAILED)
+				ready <- err
+				return
+			}
+			notMounted = true
+			log.Warnf("Mounter of %s is restarted but not mounted: %s", r.mountPath, err)
+		} else {
+			r.setState(MOUNTER_STATE_RUNNING)
+			if ready != nil {
+				ready <- nil
+				ready = nil
+			} else if r.afterRestarted != nil {
+				r.afterRestarted()
+			}
+
+			select {
+			case <-exited:
+				r.captureExitCode(cmd, stderr)
+			case <-r.stopCh:
+				terminateMounter(cmd, exited)
+				r.captureExitCode(cmd, stderr)
+				r.setState(MOUNTER_STATE_STOPPED)
+				log.Infof("Mounter of %s is stopped", r.mountPath)
+				return
+			}
+		}
+
+		mounted, _ := isMountedBy(r.mountPath, r.fsType)
+		status := r.status()
+		r.lock.Lock()
+		draining, requested := r.draining, r.restartRequested
+		r.restartRequested = false
+		r.lock.Unlock()
+		if r.isStopping() || draining || (!notMounted && status.LastExitCode == 0 && !mounted) {
+			// The mount point is unmounted, so the mounter exits normally
+			r.setState(MOUNTER_STATE_STOPPED)
+			log.Infof("Mounter of %s exits with code %d", r.mountPath, status.LastExitCode)
+			return
+		}
+		if requested {
+			backoff = MounterMinRestartBackoff
+		} else if time.Since(status.StartedAt) > MounterRestartResetDuration {
+			r.lock.Lock()
+			r.restarts = 0
+			r.lock.Unlock()
+			status.Restarts = 0
+			backoff = MounterMinRestartBackoff
+		}
+		if !requested && status.Restarts >= MounterMaxRestarts {
+			r.setState(MOUNTER_STATE_FAILED)
+			log.Errorf("Mounter of %s exits with code %d, give up after %d restarts", r.mountPath, status.LastExitCode, status.Restarts)
+			return
+		}
+
+		r.setState(MOUNTER_STATE_RESTARTING)
+		if requested {
+			log.Infof("Mounter of %s is killed to be restarted, restart it in %s", r.mountPath, backoff)
+		} else {
+			log.Warnf("Mounter of %s exits unexpectedly with code %d, restart it in %s", r.mountPath, status.LastExitCode, backoff)
+		}
+		if mounted {
+			// Release the dead FUSE mount point, otherwise the new mounter cannot be mounted on it
+			if err := unmountFuseLazily(r.mountPath); err != nil {
+				log.Warnf("Failed to unmount %s lazily: %s", r.mountPath, err)
+			}
+		}
+		select {
+		case <-r.stopCh:
+			r.setState(MOUNTER_STATE_STOPPED)
+			return
+		case <-time.After(backoff):
+		}
+		if requested {
+			continue
+		}
+		if backoff *= 2; backoff > MounterMaxRestartBackoff {
+			backoff = MounterMaxRestartBackoff
+		}
+		r.lock.Lock()
+		r.restarts += 1
+		r.lock.Unlock()
+	}
+}
+
+func (r *mounterRecord) waitForMounted(exited <-chan struct{}) error {
+	deadline := time.Now().Add(MounterReadyTimeout)
+	for {
+		if mounted, err := isMountedBy(r.mountPath, r.fsType); err != nil {
+			return fmt.Errorf("failed to detect mount point %s: %w", r.mountPath, err)
+		} else if mounted {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("mounter is not mounted on %s in %s", r.mountPath, MounterReadyTimeout)
+		}
+		select {
+		case <-exited:
+			return errors.New("mounter exits before mounted")
+		case <-r.stopCh:
+			return errors.New("mounter is stopped before mounted")
+		case <-time.After(MounterReadyCheckInterval):
+		}
+	}
+}
+
+// captureExitCode records the exit code of the mounter, and saves the crash report if it's killed by a crash
+func (r *mounterRecord) captureExitCode(cmd *exec.Cmd, stderr *stderrTail) {
+	if signal, crashed := crashSignal(cmd.ProcessState); crashed {
+		mounterCrashTotal.WithLabelValues(r.volumeId, crashSignals[signal]).Inc()
+		dir, err := r.reportCrash(cmd, signal, stderr)
+		if err != nil {
+			log.Errorf("Mounter of %s is killed by %s, failed to save crash report: %s", r.mountPath, crashSignals[signal], err)
+		} else {
+			log.Errorf("Mounter of %s is killed by %s, crash report is saved to %s", r.mountPath, crashSignals[signal], dir)
+		}
+		r.lock.Lock()
+		r.lastCrashReport = dir
+		r.lock.Unlock()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pid = 0
+	if cmd.ProcessState != nil {
+		r.lastExitCode = cmd.ProcessState.ExitCode()
+	}
+}
+
+// terminateMounter sends SIGTERM to the mounter, then kills it if it doesn't exit in time
+func terminateMounter(cmd *exec.Cmd, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	default:
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(MounterStopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// mounterLogWriter redirects the output of the mounter to the connector log, stderr is also kept in the tail for the crash report
+type mounterLogWriter struct {
+	mountPath string
+	isError   bool
+	tail      *stderrTail
+}
+
+func (w *mounterLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if w.isError {
+			w.tail.add(line)
+			log.Warnf("Mounter of %s stderr: %s", w.mountPath, line)
+		} else {
+			log.Infof("Mounter of %s stdout: %s", w.mountPath, line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// syncedKodoMount is a Kodo volume in the sync mode, whose bucket is copied into a directory on the node bound to the mount path,
+// so the workload gets the full POSIX semantics of the local filesystem instead of FUSE
+type syncedKodoMount struct {
+	// cmd mounted the volume, whose mount path is the directory on the node
+	cmd    *protocol.InitKodoMountCmd
+	target string
+	// How often the directory is copied back to the bucket, 0 means only once unmounted if cmd.SyncBack
+	interval time.Duration
+	stopCh   chan struct{}
+	// Serializes the copies between the directory and the bucket
+	lock sync.Mutex
+}
+
+// syncedKodoMounts saves *syncedKodoMount by the mount paths of the volumes
+var syncedKodoMounts sync.Map
+
+// syncedKodoDir returns the directory on the node which the volume mounted on the mount path is copied into
+func syncedKodoDir(volumeId, mountPath string) string {
+	return filepath.Join(protocol.SyncedKodoDir, volumeId, rcloneCacheId(mountPath))
+}
+
+// mountSyncedKodo copies the bucket into the directory on the node, then binds it to the mount path of the volume.
+// The files already in the directory are also deleted if they're not in the bucket, like rclone sync.
+func mountSyncedKodo(logger *log.Entry, c *protocol.InitKodoMountCmd) error {
+	var interval time.Duration
+	if c.SyncBackInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(c.SyncBackInterval); err != nil {
+			return fmt.Errorf("invalid sync back interval %s: %w", c.SyncBackInterval, err)
+		}
+	}
+	cmd := *c
+	cmd.MountPath = syncedKodoDir(c.VolumeId, c.MountPath)
+	value, _ := syncedKodoMounts.LoadOrStore(c.MountPath, &syncedKodoMount{target: c.MountPath, stopCh: make(chan struct{})})
+	synced := value.(*syncedKodoMount)
+	synced.lock.Lock()
+	defer synced.lock.Unlock()
+
+	if bound, err := isBoundFrom(c.MountPath, cmd.MountPath); err != nil {
+		syncedKodoMounts.Delete(c.MountPath)
+		return fmt.Errorf("failed to detect mount point %s: %w", c.MountPath, err)
+	} else if bound {
+		// Never copied again, which deletes the changes not copied back yet, e.g. published again after the connector restarts
+		logger.Infof("%s is already bound from %s, reuse it", c.MountPath, cmd.MountPath)
+		if synced.cmd == nil {
+			synced.cmd, synced.interval = &cmd, interval
+			if synced.interval > 0 {
+				go synced.syncBackPeriodically(logger)
+			}
+		}
+		return nil
+	}
+	if err := ensureDirectoryExists(cmd.MountPath); err != nil {
+		syncedKodoMounts.Delete(c.MountPath)
+		return fmt.Errorf("failed to create directory %s: %w", cmd.MountPath, err)
+	}
+	begin := time.Now()
+	if err := transferKodo(&cmd, cmd.Remote(), cmd.MountPath, true); err != nil {
+		syncedKodoMounts.Delete(c.MountPath)
+		return fmt.Errorf("failed to copy bucket into %s: %w", cmd.MountPath, err)
+	}
+	logger.WithField("duration", time.Since(begin).Seconds()).Infof("Bucket %s is copied into %s", cmd.Remote(), cmd.MountPath)
+	if err := syscall.Mount(cmd.MountPath, c.MountPath, "", syscall.MS_BIND, ""); err != nil {
+		syncedKodoMounts.Delete(c.MountPath)
+		return fmt.Errorf("failed to bind %s to %s: %w", cmd.MountPath, c.MountPath, err)
+	}
+	synced.cmd, synced.interval = &cmd, interval
+	if synced.interval > 0 {
+		go synced.syncBackPeriodically(logger)
+	}
+	logger.Infof("%s is bound from %s in the sync mode", c.MountPath, cmd.MountPath)
+	return nil
+}
+
+// isBoundFrom returns true if the directory is bound to the mount path
+func isBoundFrom(mountPath, dir string) (bool, error) {
+	info, err := findMountInfo(mountPath)
+	if err != nil || info == nil {
+		return false, err
+	}
+	return info.root != "/" && strings.HasSuffix(dir, info.root), nil
+}
+
+func (synced *syncedKodoMount) syncBackPeriodically(logger *log.Entry) {
+	ticker := time.NewTicker(synced.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-synced.stopCh:
+			return
+		case <-ticker.C:
+			if err := synced.syncBack(logger); err != nil {
+				logger.Warnf("Failed to copy %s back to %s, retry in %s: %s", synced.cmd.MountPath, synced.cmd.Remote(), synced.interval, err)
+			}
+		}
+	}
+}
+
+// syncBack copies the files changed in the directory back to the bucket, the files deleted from the directory are kept in the bucket
+func (synced *syncedKodoMount) syncBack(logger *log.Entry) error {
+	synced.lock.Lock()
+	defer synced.lock.Unlock()
+
+	begin := time.Now()
+	if err := transferKodo(synced.cmd, synced.cmd.MountPath, synced.cmd.Remote(), false); err != nil {
+		return err
+	}
+	logger.WithField("duration", time.Since(begin).Seconds()).Infof("%s is copied back to %s", synced.cmd.MountPath, synced.cmd.Remote())
+	return nil
+}
+
+// umountSyncedKodo unbinds the directory from the mount path, the directory is copied back to the bucket in background if the volume asks for it,
+// then removed. It returns false if the mount path isn't mounted in the sync mode.
+func umountSyncedKodo(logger *log.Entry, mountPath string, flags int) bool {
+	value, ok := syncedKodoMounts.LoadAndDelete(mountPath)
+	if !ok {
+		return false
+	}
+	synced := value.(*syncedKodoMount)
+	close(synced.stopCh)
+	// Waits for the bucket being copied into the directory
+	synced.lock.Lock()
+	mounted := synced.cmd != nil
+	synced.lock.Unlock()
+	if !mounted {
+		return true
+	}
+	if bound, _ := isBoundFrom(mountPath, synced.cmd.MountPath); bound {
+		if err := syscall.Unmount(mountPath, flags); err != nil {
+			logger.Warnf("Failed to unmount %s: %s", mountPath, err)
+		}
+	}
+	go func() {
+		if synced.cmd.SyncBack {
+			if err := synced.syncBack(logger); err != nil {
+				logger.Errorf("Failed to copy %s back to %s, the files are kept on the node: %s", synced.cmd.MountPath, synced.cmd.Remote(), err)
+				return
+			}
+		}
+		if err := os.RemoveAll(synced.cmd.MountPath); err != nil {
+			logger.Warnf("Failed to remove %s: %s", synced.cmd.MountPath, err)
+		}
+		os.Remove(filepath.Dir(synced.cmd.MountPath))
+		removeRcloneFiles(synced.cmd.VolumeId, synced.cmd.MountPath)
+		logger.Infof("%s of %s is removed", synced.cmd.MountPath, mountPath)
+	}()
+	return true
+}
+
+// transferKodo copies src to dst by rclone with the config of the volume, see protocol.InitKodoMountCmd.TransferCommand
+func transferKodo(c *protocol.InitKodoMountCmd, src, dst string, deleteExtraneous bool) error {
+	return runRclone(c, func(ctx context.Context) *exec.Cmd {
+		return c.TransferCommand(ctx, src, dst, deleteExtraneous)
+	})
+}
+
+// runRclone runs the rclone command out of the mount with the config of the volume, until it exits
+func runRclone(c *protocol.InitKodoMountCmd, command func(ctx context.Context) *exec.Cmd) error {
+	logFile := filepath.Join(rcloneLogDir, c.VolumeId, rcloneCacheId(c.MountPath)+".log")
+	if err := ensureDirectoryExists(filepath.Dir(logFile)); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	configPath, err := writeRcloneConfig(c)
+	if err != nil {
+		return fmt.Errorf("failed to write rclone config: %w", err)
+	}
+	defer os.Remove(configPath)
+	caCertPath, err := writeCaCert(c)
+	if err != nil {
+		return fmt.Errorf("failed to write CA certificate: %w", err)
+	} else if caCertPath != "" && caCertPath != *caCert {
+		defer os.Remove(caCertPath)
+	}
+
+	ctx := context.WithValue(context.Background(), protocol.ContextKeyCaCertFilePath, caCertPath)
+	ctx = context.WithValue(ctx, protocol.ContextKeyConfigFilePath, configPath)
+	ctx = context.WithValue(ctx, protocol.ContextKeyConfigPassword, rcloneConfigPassword)
+	ctx = context.WithValue(ctx, protocol.ContextKeyUserAgent, userAgent)
+	ctx = context.WithValue(ctx, protocol.ContextKeyLogFilePath, logFile)
+	secrets := c.Secrets()
+	if c.CredentialSource != nil {
+		credentials, err := startCredentialsManager(c)
+		if err != nil {
+			return err
+		}
+		defer credentials.stop()
+		ctx = context.WithValue(ctx, protocol.ContextKeyCredentialsUri, credentials.uri())
+		ctx = context.WithValue(ctx, protocol.ContextKeyCredentialsToken, credentials.token)
+		secrets = append(secrets, credentials.token)
+	}
+	proxy, err := startResolverProxy(c)
+	if err != nil {
+		return fmt.Errorf("failed to start resolver proxy: %w", err)
+	} else if proxy != nil {
+		defer proxy.stop()
+		ctx = context.WithValue(ctx, protocol.ContextKeyResolverProxyUrl, proxy.url())
+		secrets = append(secrets, proxy.token)
+	}
+	execCmd := command(ctx)
+	if err = protocol.CheckArgs(execCmd, append(secrets, rcloneConfigPassword)...); err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	execCmd.Stderr = &stderr
+	if err = execCmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%w: %s, see %s for details", err, message, logFile)
+		}
+		return fmt.Errorf("%w, see %s for details", err, logFile)
+	}
+	return nil
+}
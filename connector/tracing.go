@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the connector, which are dropped unless initTracing is called
+var tracer = otel.Tracer("github.com/qiniu/csi-driver/connector")
+
+// initTracing exports the spans to the OTLP gRPC endpoint, must be called in the daemon process
+func initTracing(endpoint string, insecure bool) error {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("qiniu-csi-connector"),
+			semconv.ServiceVersionKey.String(VERSION),
+			semconv.HostNameKey.String(hostname),
+		)),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("Tracing error: %s", err)
+	}))
+	log.Infof("Exporting traces to %s", endpoint)
+	return nil
+}
+
+// startMounterSpan starts the span of running a mounter command on the mount point
+func startMounterSpan(ctx context.Context, name, volumeId, mountPath string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("csi.volume_id", volumeId),
+		attribute.String("mount_path", mountPath),
+	))
+}
+
+// endSpan ends the span with the error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the transferred bytes of the rclone mounters are added to the usage of their volumes
+const TransferUsagePollInterval = 15 * time.Second
+
+var (
+	volumeTransferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "volume",
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes transferred from and to Kodo by the rclone mounters of the volume on the node, kept across the restarts and the remounts of the mounters",
+	}, []string{"volume_id", "pvc", "namespace"})
+	volumeTransfers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "volume",
+		Name:      "transfers_total",
+		Help:      "Completed transfers of files from and to Kodo by the rclone mounters of the volume on the node, kept across the restarts and the remounts of the mounters",
+	}, []string{"volume_id", "pvc", "namespace"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(volumeTransferredBytes, volumeTransfers)
+}
+
+// transferUsage accumulates the stats of the rclone mounters into the counters of their volumes.
+// The stats of rclone start from zero with every mounter, and are gone once it's unmounted, so they can't be summed up by the volume directly.
+type transferUsage struct {
+	// Last stats of each mount point, reset once its mounter is restarted with a new remote control
+	last map[string]*transferStats
+}
+
+type transferStats struct {
+	rc               *rcloneRemoteControl
+	bytes, transfers int64
+}
+
+// pollTransferUsage adds the stats of the rclone mounters to the usage of their volumes every TransferUsagePollInterval until the connector exits
+func pollTransferUsage() {
+	usage := &transferUsage{last: make(map[string]*transferStats)}
+	ticker := time.NewTicker(TransferUsagePollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		usage.poll()
+	}
+}
+
+func (u *transferUsage) poll() {
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		current = make(map[string]*transferStats)
+		cmds    = make(map[string]*protocol.InitKodoMountCmd)
+	)
+	rcloneRemoteControls.Range(func(key, value interface{}) bool {
+		mountPath, rc := key.(string), value.(*rcloneRemoteControl)
+		cmd, ok := kodoMountCmds.Load(mountPath)
+		if !ok {
+			return true
+		}
+		cmds[mountPath] = cmd.(*protocol.InitKodoMountCmd)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			coreStats, err := rc.coreStats(context.Background())
+			if err != nil {
+				log.Debugf("Failed to get core stats of rclone mounter on %s: %s", mountPath, err)
+				return
+			}
+			lock.Lock()
+			current[mountPath] = &transferStats{rc: rc, bytes: coreStats.Bytes, transfers: coreStats.Transfers}
+			lock.Unlock()
+		}()
+		return true
+	})
+	wg.Wait()
+
+	for mountPath, stats := range current {
+		bytes, transfers := stats.bytes, stats.transfers
+		if last, ok := u.last[mountPath]; ok && last.rc == stats.rc && last.bytes <= bytes && last.transfers <= transfers {
+			bytes, transfers = bytes-last.bytes, transfers-last.transfers
+		}
+		cmd := cmds[mountPath]
+		// The shared mount points are counted by their own volume ids, since they belong to no PVC
+		volumeTransferredBytes.WithLabelValues(cmd.VolumeId, cmd.PvcName, cmd.PvcNamespace).Add(float64(bytes))
+		volumeTransfers.WithLabelValues(cmd.VolumeId, cmd.PvcName, cmd.PvcNamespace).Add(float64(transfers))
+	}
+	for mountPath, last := range u.last {
+		// Kept if the remote control doesn't respond this time
+		if _, ok := current[mountPath]; !ok && cmds[mountPath] != nil {
+			current[mountPath] = last
+		}
+	}
+	u.last = current
+}
@@ -3,19 +3,24 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"debug/elf"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/Unknwon/goconfig"
 	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -32,11 +37,25 @@ const (
 	RCLONE_CONFIG_KEY_UPLOAD_CHUNK_SIZE   = "chunk_size"
 	RCLONE_CONFIG_KEY_UPLOAD_CUTOFF       = "upload_cutoff"
 	RCLONE_CONFIG_KEY_UPLOAD_CONCURRENCY  = "upload_concurrency"
+	RCLONE_CONFIG_KEY_V2_AUTH             = "v2_auth"
+	RCLONE_CONFIG_KEY_ENV_AUTH            = "env_auth"
+	RCLONE_CONFIG_KEY_UPSTREAMS           = "upstreams"
+	RCLONE_CONFIG_KEY_CREATE_POLICY       = "create_policy"
+	RCLONE_CONFIG_KEY_SEARCH_POLICY       = "search_policy"
+	RCLONE_CONFIG_KEY_REMOTE              = "remote"
+	RCLONE_CONFIG_KEY_INFO_AGE            = "info_age"
+	RCLONE_CONFIG_KEY_DB_PATH             = "db_path"
+	RCLONE_CONFIG_KEY_CHUNK_PATH          = "chunk_path"
 
 	RCLONE_CONFIG_S3_TYPE               = "s3"
 	RCLONE_CONFIG_QINIU_PROVIDER        = "Qiniu"
 	RCLONE_CONFIG_PUBLIC_READ_WRITE_ACL = "public-read-write"
 	RCLONE_CONFIG_BOOL_TRUE             = "true"
+	RCLONE_CONFIG_S3_SIGNATURE_V2       = "v2"
+	RCLONE_CONFIG_UNION_TYPE            = "union"
+	RCLONE_CONFIG_FIRST_FOUND_POLICY    = "ff"
+	RCLONE_CONFIG_NEWEST_POLICY         = "newest"
+	RCLONE_CONFIG_CACHE_TYPE            = "cache"
 )
 
 func userLogDir() (string, error) {
@@ -70,6 +89,27 @@ func userLogDir() (string, error) {
 	return dir, nil
 }
 
+// resolveRcloneDirs resolves the directories of the rclone configs, caches and logs
+func resolveRcloneDirs() {
+	if userConfigDir, err := os.UserConfigDir(); err != nil {
+		rcloneConfigDir = filepath.Join(os.TempDir(), ".rclone", "config")
+	} else {
+		rcloneConfigDir = filepath.Join(userConfigDir, "rclone")
+	}
+
+	if userCacheDir, err := os.UserCacheDir(); err != nil {
+		rcloneCacheDir = filepath.Join(os.TempDir(), ".rclone", "cache")
+	} else {
+		rcloneCacheDir = filepath.Join(userCacheDir, "rclone")
+	}
+
+	if userLogDir, err := userLogDir(); err != nil {
+		rcloneLogDir = filepath.Join(os.TempDir(), ".rclone", "log")
+	} else {
+		rcloneLogDir = filepath.Join(userLogDir, "rclone")
+	}
+}
+
 func rcloneCacheId(items ...string) string {
 	hasher := md5.New()
 	for _, item := range items {
@@ -96,28 +136,81 @@ func ensureFileNotExists(path string) error {
 	}
 }
 
+// ensureCommandExists also returns error if the command is built for another architecture than the node,
+// which would only fail with exec format error when mounting
 func ensureCommandExists(name string) error {
-	_, err := exec.LookPath(name)
+	path, err := exec.LookPath(name)
 	if err != nil {
 		return fmt.Errorf("cannot find command %s: %w", name, err)
-	} else {
+	}
+	file, err := elf.Open(path)
+	if err != nil {
+		// Scripts wrapping the commands are not checked
 		return nil
 	}
+	defer file.Close()
+	if arch, ok := elfMachineArchs[file.Machine]; ok && arch != runtime.GOARCH {
+		return fmt.Errorf("%s is built for linux/%s, but the node is linux/%s", path, arch, runtime.GOARCH)
+	}
+	return nil
+}
+
+// elfMachineArchs maps the machines of the ELF executables to GOARCH
+var elfMachineArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_386:     "386",
+	elf.EM_ARM:     "arm",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
 }
 
 func writeRcloneConfig(cmd *protocol.InitKodoMountCmd) (string, error) {
+	// The config is kept during the whole lifecycle of the mounter to restart it, so each mount point has its own one
+	configPath := filepath.Join(rcloneConfigDir, cmd.VolumeId+"-"+rcloneCacheId(cmd.MountPath)+".conf")
+	config, err := renderRcloneConfig(cmd)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encryptRcloneConfig(config, rcloneConfigPassword)
+	if err != nil {
+		return "", err
+	}
+	return configPath, os.WriteFile(configPath, encrypted, 0600)
+}
+
+// renderRcloneConfig renders the rclone config of the mount in plain text
+func renderRcloneConfig(cmd *protocol.InitKodoMountCmd) ([]byte, error) {
 	config, _ := goconfig.LoadFromReader(bytes.NewReader([]byte{}))
 
 	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_TYPE, RCLONE_CONFIG_S3_TYPE)
-	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_PROVIDER, RCLONE_CONFIG_QINIU_PROVIDER)
-	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_ACCESS_KEY, cmd.AccessKey)
-	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_SECRET_KEY, cmd.SecretKey)
+	// The S3-compatible storages other than Kodo are given by their own providers
+	provider := cmd.S3Provider
+	if provider == "" {
+		provider = RCLONE_CONFIG_QINIU_PROVIDER
+	}
+	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_PROVIDER, provider)
+	if cmd.CredentialSource != nil {
+		// The temporary credentials are served by the connector, see credentialsManager
+		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_ENV_AUTH, RCLONE_CONFIG_BOOL_TRUE)
+	} else {
+		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_ACCESS_KEY, cmd.AccessKey)
+		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_SECRET_KEY, cmd.SecretKey)
+	}
 	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_REGION, cmd.S3Region)
 	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_ENDPOINT, cmd.S3Endpoint)
 	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_LOCATION_CONSTRAINT, cmd.S3Region)
-	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_ACL, RCLONE_CONFIG_PUBLIC_READ_WRITE_ACL)
-	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_STORAGE_CLASS, cmd.StorageClass)
+	if provider == RCLONE_CONFIG_QINIU_PROVIDER {
+		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_ACL, RCLONE_CONFIG_PUBLIC_READ_WRITE_ACL)
+	}
+	// Objects are private by default elsewhere, and stored in the default storage class of the storage if not given
+	if cmd.StorageClass != "" {
+		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_STORAGE_CLASS, cmd.StorageClass)
+	}
 	config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_NO_CHECK_BUCKET, RCLONE_CONFIG_BOOL_TRUE)
+	if cmd.S3SignatureVersion == RCLONE_CONFIG_S3_SIGNATURE_V2 {
+		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_V2_AUTH, RCLONE_CONFIG_BOOL_TRUE)
+	}
 	if cmd.UploadChunkSize != nil {
 		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_UPLOAD_CHUNK_SIZE, formatByteSize(*cmd.UploadChunkSize))
 	}
@@ -127,9 +220,120 @@ func writeRcloneConfig(cmd *protocol.InitKodoMountCmd) (string, error) {
 	if cmd.UploadConcurrency != nil {
 		config.SetValue(cmd.VolumeId, RCLONE_CONFIG_KEY_UPLOAD_CONCURRENCY, formatUint(*cmd.UploadConcurrency))
 	}
+	if cmd.PersistentDirCache != "" {
+		// The listings are saved in the database of the volume instead of the cache of the mount point, so they're reused once remounted
+		dirCache := strings.TrimSuffix(cmd.DirCacheRemote(), ":")
+		config.SetValue(dirCache, RCLONE_CONFIG_KEY_TYPE, RCLONE_CONFIG_CACHE_TYPE)
+		config.SetValue(dirCache, RCLONE_CONFIG_KEY_REMOTE, cmd.Remote())
+		config.SetValue(dirCache, RCLONE_CONFIG_KEY_INFO_AGE, cmd.PersistentDirCache)
+		config.SetValue(dirCache, RCLONE_CONFIG_KEY_DB_PATH, kodoDirCacheDir(cmd.VolumeId))
+		config.SetValue(dirCache, RCLONE_CONFIG_KEY_CHUNK_PATH, filepath.Join(kodoDirCacheDir(cmd.VolumeId), "chunks"))
+	}
+	if cmd.LocalWriteCache {
+		// The bucket is never written by the mounter, so the files are always created in the write cache directory,
+		// and the newer one of the write cache and the bucket is read for the files changed locally
+		union := strings.TrimSuffix(cmd.WriteCacheRemote(), ":")
+		config.SetValue(union, RCLONE_CONFIG_KEY_TYPE, RCLONE_CONFIG_UNION_TYPE)
+		config.SetValue(union, RCLONE_CONFIG_KEY_UPSTREAMS, kodoWriteCacheDir(cmd.VolumeId, cmd.MountPath)+" "+cmd.BucketRemote()+":ro")
+		config.SetValue(union, RCLONE_CONFIG_KEY_CREATE_POLICY, RCLONE_CONFIG_FIRST_FOUND_POLICY)
+		config.SetValue(union, RCLONE_CONFIG_KEY_SEARCH_POLICY, RCLONE_CONFIG_NEWEST_POLICY)
+	}
+
+	var buf bytes.Buffer
+	if err := goconfig.SaveConfigData(config, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	configPath := filepath.Join(rcloneConfigDir, cmd.VolumeId+".conf")
-	return configPath, goconfig.SaveConfigFile(config, configPath)
+// writeCaCert writes the CA bundle trusted by the mount, which combines the connector-wide bundle with the CA certificate of the volume.
+// It returns an empty path when neither is configured, or the path of the connector-wide bundle when the volume has no CA certificate.
+func writeCaCert(cmd *protocol.InitKodoMountCmd) (string, error) {
+	if cmd.CaCert == "" {
+		return *caCert, nil
+	}
+	var bundle []byte
+	if *caCert != "" {
+		var err error
+		if bundle, err = os.ReadFile(*caCert); err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", *caCert, err)
+		}
+		bundle = append(bundle, '\n')
+	}
+	bundle = append(bundle, []byte(cmd.CaCert)...)
+	bundle = append(bundle, '\n')
+
+	caCertPath := filepath.Join(rcloneConfigDir, cmd.VolumeId+"-"+rcloneCacheId(cmd.MountPath)+".ca.pem")
+	return caCertPath, os.WriteFile(caCertPath, bundle, 0600)
+}
+
+// setLogFormat sets the format and the minimum level of the logs
+func setLogFormat(format, level string) error {
+	switch strings.ToLower(format) {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format %q, expect text or json", format)
+	}
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+	go toggleDebugLogOnSignal(l)
+	return nil
+}
+
+// toggleDebugLogOnSignal switches the level of the logs between debug and the configured level on every SIGUSR1,
+// so that the debug logs of a reproduction could be captured without restarting and losing the broken state
+func toggleDebugLogOnSignal(level log.Level) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		if log.GetLevel() == log.DebugLevel && level != log.DebugLevel {
+			log.SetLevel(level)
+		} else {
+			log.SetLevel(log.DebugLevel)
+		}
+		log.Warnf("Log level is changed to %s by SIGUSR1", log.GetLevel())
+	}
+}
+
+// redactCmd returns a copy of the command with the secrets masked for logging
+func redactCmd(cmd protocol.Cmd) protocol.Cmd {
+	const mask = "******"
+	switch c := cmd.(type) {
+	case *protocol.InitKodoMountCmd:
+		redacted := *c
+		if redacted.AccessKey != "" {
+			redacted.AccessKey = mask
+		}
+		if redacted.SecretKey != "" {
+			redacted.SecretKey = mask
+		}
+		if redacted.CredentialSource != nil && redacted.CredentialSource.Token != "" {
+			credentialSource := *redacted.CredentialSource
+			credentialSource.Token = mask
+			redacted.CredentialSource = &credentialSource
+		}
+		return &redacted
+	case *protocol.RequestDataCmd:
+		// The data answers the prompts of kodofs, including the AccessToken
+		return &protocol.RequestDataCmd{Data: mask}
+	}
+	return cmd
+}
+
+// kodofsConfigExists returns whether the config of the volume is initialized by kodofs
+func kodofsConfigExists(volume string) bool {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(homeDir, ".kodofs", volume+".conf"))
+	return err == nil
 }
 
 var rcloneVersionRegexp, osVersionRegexp, osKernelRegexp *regexp.Regexp
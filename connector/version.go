@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+const (
+	// Minimum version of kodofs supported by the connector
+	KodoFSMinVersion = "2.4.0"
+	// Minimum version of rclone supported by the connector, vfs/stats with disk cache status and --vfs-fast-fingerprint are required
+	RcloneMinVersion = "1.58.0"
+)
+
+var (
+	kodofsVersion  string
+	kodofsFeatures kodofsFeatureSet
+)
+
+// kodofsFeatureSet records the optional features supported by the installed kodofs
+type kodofsFeatureSet struct {
+	noRwCache bool
+	modify    bool
+}
+
+// semanticVersion is the major.minor.patch part of versions like v2.4.18-13-gf3ce742c
+type semanticVersion [3]int
+
+var semanticVersionRegexp = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+func parseSemanticVersion(s string) (v semanticVersion, err error) {
+	matches := semanticVersionRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if len(matches) < 3 {
+		err = fmt.Errorf("unrecognized version %q", s)
+		return
+	}
+	for i, match := range matches[1:] {
+		if match == "" {
+			continue
+		}
+		if v[i], err = strconv.Atoi(match); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (v semanticVersion) less(other semanticVersion) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+// ensureMinVersion returns error if the version of the executable is older than the minimum one
+func ensureMinVersion(name, version, minVersion string) error {
+	v, err := parseSemanticVersion(version)
+	if err != nil {
+		return fmt.Errorf("failed to parse version of %s: %w", name, err)
+	}
+	min, err := parseSemanticVersion(minVersion)
+	if err != nil {
+		return err
+	}
+	if v.less(min) {
+		return fmt.Errorf("%s %s is older than the minimum supported version %s, please upgrade it", name, version, minVersion)
+	}
+	return nil
+}
+
+var kodofsVersionRegexp = regexp.MustCompile(`version:\s+([^\s]+)`)
+
+func getKodoFSVersion() (string, error) {
+	output, err := exec.Command(KodoFSCmd, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	if matches := kodofsVersionRegexp.FindStringSubmatch(string(output)); len(matches) > 1 {
+		return matches[1], nil
+	}
+	return "", fmt.Errorf("unrecognized output of %s --version: %s", KodoFSCmd, strings.TrimSpace(string(output)))
+}
+
+// detectKodoFSFeatures detects the optional features from the usage of kodofs, which is more reliable than guessing by version
+func detectKodoFSFeatures() kodofsFeatureSet {
+	// The error is ignored since old versions may exit with non-zero code after printing the usage
+	usage, _ := exec.Command(KodoFSCmd, "--help").CombinedOutput()
+	mountUsage, _ := exec.Command(KodoFSCmd, "mount", "--help").CombinedOutput()
+	return kodofsFeatureSet{
+		noRwCache: strings.Contains(string(mountUsage), "--no_rw_cache"),
+		modify:    regexp.MustCompile(`(?m)^\s+modify\s`).Match(usage),
+	}
+}
+
+// check returns error if the mount cmd requires features not supported by the installed kodofs
+func (features kodofsFeatureSet) check(c *protocol.InitKodoFSMountCmd) error {
+	var unsupported []string
+	if c.NoRwCache && !features.noRwCache {
+		unsupported = append(unsupported, "no_rw_cache")
+	}
+	if c.Params != "" && !features.modify {
+		unsupported = append(unsupported, "params")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("kodofs %s installed on the node doesn't support %s, please upgrade it", kodofsVersion, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Directory under rclone cache dir which saves the metadata of cached files
+	RcloneVfsMetaDir = "vfsMeta"
+	// Interval to check whether the dirty files are uploaded
+	VfsCacheFlushCheckInterval = time.Second
+)
+
+// rcloneVfsItemInfo is the metadata of a cached file saved by rclone vfs cache
+type rcloneVfsItemInfo struct {
+	Size  int64 `json:"Size"`
+	Dirty bool  `json:"Dirty"`
+}
+
+// countVfsCacheDirtyFiles returns how many files in rclone vfs cache are modified but not uploaded yet
+func countVfsCacheDirtyFiles(volumeCacheDir string) (int, error) {
+	dirtyFiles, _, err := scanVfsCacheDirtyFiles(volumeCacheDir)
+	return dirtyFiles, err
+}
+
+// scanVfsCacheDirtyFiles returns how many files in rclone vfs cache are modified but not uploaded yet, and their total size
+func scanVfsCacheDirtyFiles(volumeCacheDir string) (int, int64, error) {
+	var dirtyFiles int
+	var dirtyBytes int64
+	metaDir := filepath.Join(volumeCacheDir, RcloneVfsMetaDir)
+	err := filepath.WalkDir(metaDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		var info rcloneVfsItemInfo
+		if err = json.Unmarshal(data, &info); err != nil {
+			// rclone may be rewriting the metadata, count it as dirty to be safe
+			dirtyFiles += 1
+			return nil
+		}
+		if info.Dirty {
+			dirtyFiles += 1
+			dirtyBytes += info.Size
+		}
+		return nil
+	})
+	return dirtyFiles, dirtyBytes, err
+}
+
+// waitForVfsCacheFlushed waits at most for the given duration until all dirty files in rclone vfs cache are uploaded,
+// returns how many dirty files are left.
+// The upload queue reported by remote control is also taken into account if rc is not nil.
+func waitForVfsCacheFlushed(ctx context.Context, volumeCacheDir string, rc *rcloneRemoteControl, wait time.Duration) (int, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		dirtyFiles, err := countVfsCacheDirtyFiles(volumeCacheDir)
+		if err == nil && rc != nil {
+			if pendingUploads, rcErr := rc.pendingUploads(ctx); rcErr == nil && pendingUploads > dirtyFiles {
+				dirtyFiles = pendingUploads
+			}
+		}
+		if err != nil || dirtyFiles == 0 || time.Now().After(deadline) {
+			return dirtyFiles, err
+		}
+		select {
+		case <-ctx.Done():
+			return dirtyFiles, ctx.Err()
+		case <-time.After(VfsCacheFlushCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Directory of the write cache directories on the node, which take the writes of the Kodo volumes mounted with the local write cache
+	KodoWriteCachesDir = "/var/lib/qiniu/storage/csi-plugin/writecache"
+	// Directory of the rclone mount points of the volumes with the local write cache, which are bind mounted to the mount paths of the volumes,
+	// so that the mounter outlives the mount path to copy the changed files back to the bucket once it's unmounted
+	WriteCacheKodoMountsDir = "/var/lib/qiniu/storage/csi-plugin/writecache-mounts"
+	// How long to wait for the vfs cache to be written to the write cache directory each time before warning, if the volume is unmounted without being flushed
+	KodoWriteCacheFlushWait = time.Minute
+)
+
+// kodoWriteCache is a Kodo volume whose writes go to a directory on the node, which are copied back to the bucket in background
+type kodoWriteCache struct {
+	volumeId, target, mountPath string
+	// rclone remote of the bucket, which the write cache directory is copied to
+	remote string
+	// How often the write cache directory is copied to the bucket, 0 means only once unmounted
+	interval time.Duration
+	stopCh   chan struct{}
+	// Serializes the copies of the write cache directory
+	syncLock sync.Mutex
+}
+
+// kodoWriteCaches saves *kodoWriteCache by the mount paths of the volumes
+var kodoWriteCaches sync.Map
+
+// kodoWriteCacheDir returns the write cache directory of the rclone mount point, which is kept until it's copied to the bucket
+func kodoWriteCacheDir(volumeId, mountPath string) string {
+	return filepath.Join(KodoWriteCachesDir, volumeId, rcloneCacheId(mountPath))
+}
+
+func (wc *kodoWriteCache) dir() string {
+	return kodoWriteCacheDir(wc.volumeId, wc.mountPath)
+}
+
+// mountWriteCacheKodo mounts the union of the write cache directory and the read-only bucket, and binds it to the mount path of the volume
+func mountWriteCacheKodo(cc *connContext, logger *log.Entry, c *protocol.InitKodoMountCmd) error {
+	var interval time.Duration
+	if c.WriteCacheSyncInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(c.WriteCacheSyncInterval); err != nil {
+			return fmt.Errorf("invalid write cache sync interval %s: %w", c.WriteCacheSyncInterval, err)
+		}
+	}
+	wc := &kodoWriteCache{
+		volumeId:  c.VolumeId,
+		target:    c.MountPath,
+		mountPath: filepath.Join(WriteCacheKodoMountsDir, rcloneCacheId(c.MountPath)),
+		remote:    c.Remote(),
+		interval:  interval,
+		stopCh:    make(chan struct{}),
+	}
+	if existing, ok := kodoWriteCaches.Load(c.MountPath); ok {
+		if status, supervised := mounterSupervisor.get(existing.(*kodoWriteCache).mountPath); supervised && status.State == MOUNTER_STATE_RUNNING {
+			if mounted, err := isMountedBy(c.MountPath, FuseTypeRclone); err == nil && mounted {
+				logger.Infof("Mounter of %s with the local write cache is already running, reuse it", c.MountPath)
+				return nil
+			}
+		}
+		existing.(*kodoWriteCache).stop()
+	}
+
+	// Left by the previous connector, whose mounters are stopped together with it
+	if mounted, _ := isMountedBy(wc.mountPath, FuseTypeRclone); mounted {
+		if err := unmountFuseLazily(wc.mountPath); err != nil {
+			logger.Warnf("Failed to unmount stale mount point %s lazily: %s", wc.mountPath, err)
+		}
+	}
+	if err := ensureDirectoryExists(wc.mountPath); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %w", wc.mountPath, err)
+	}
+	// The files not copied to the bucket by the previous mounter are still taken by the new one
+	if err := ensureDirectoryExists(wc.dir()); err != nil {
+		return fmt.Errorf("failed to create write cache directory %s: %w", wc.dir(), err)
+	}
+	cmd := *c
+	cmd.MountPath = wc.mountPath
+	if err := mountRclone(cc, logger, &cmd, wc.rebind); err != nil {
+		return err
+	}
+	if mounted, _ := isMountedBy(c.MountPath, FuseTypeRclone); mounted {
+		// Bound to the stale mount point before the connector restarts
+		if err := syscall.Unmount(c.MountPath, syscall.MNT_DETACH); err != nil {
+			logger.Warnf("Failed to unmount stale %s lazily: %s", c.MountPath, err)
+		}
+	}
+	if err := syscall.Mount(wc.mountPath, c.MountPath, "", syscall.MS_BIND, ""); err != nil {
+		mounterSupervisor.stop(wc.mountPath)
+		return fmt.Errorf("failed to bind %s to %s: %w", wc.mountPath, c.MountPath, err)
+	}
+	kodoWriteCaches.Store(c.MountPath, wc)
+	if wc.interval > 0 {
+		go wc.syncPeriodically(logger)
+	}
+	logger.Infof("%s is mounted with the local write cache %s, bound from %s", c.MountPath, wc.dir(), wc.mountPath)
+	return nil
+}
+
+// rebind binds the mount point to the mount path again after the mounter restarts, since the bind mount of a dead mounter never recovers
+func (wc *kodoWriteCache) rebind() {
+	if err := syscall.Unmount(wc.target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		log.Warnf("Failed to unmount %s lazily: %s", wc.target, err)
+	}
+	if err := syscall.Mount(wc.mountPath, wc.target, "", syscall.MS_BIND, ""); err != nil {
+		log.Warnf("Failed to bind %s to %s again: %s", wc.mountPath, wc.target, err)
+	} else {
+		log.Infof("%s is bound to %s again", wc.mountPath, wc.target)
+	}
+}
+
+func (wc *kodoWriteCache) syncPeriodically(logger *log.Entry) {
+	ticker := time.NewTicker(wc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wc.stopCh:
+			return
+		case <-ticker.C:
+			if err := wc.sync(context.Background()); err != nil {
+				logger.Warnf("Failed to copy write cache %s to %s, retry in %s: %s", wc.dir(), wc.remote, wc.interval, err)
+			}
+		}
+	}
+}
+
+// sync copies the files changed in the write cache directory to the bucket by the mounter, the unchanged ones are skipped by rclone
+func (wc *kodoWriteCache) sync(ctx context.Context) error {
+	wc.syncLock.Lock()
+	defer wc.syncLock.Unlock()
+
+	rc, err := getRcloneRemoteControl(wc.mountPath)
+	if err != nil {
+		return err
+	}
+	begin := time.Now()
+	if err = rc.runJob(ctx, "sync/copy", map[string]interface{}{"srcFs": wc.dir(), "dstFs": wc.remote}); err != nil {
+		return err
+	}
+	log.WithField("duration", time.Since(begin).Seconds()).Infof("Write cache %s is copied to %s", wc.dir(), wc.remote)
+	return nil
+}
+
+// stop stops copying the write cache directory periodically
+func (wc *kodoWriteCache) stop() {
+	select {
+	case <-wc.stopCh:
+	default:
+		close(wc.stopCh)
+	}
+}
+
+// umountWriteCacheKodo copies the write cache directory back to the bucket in background and stops the mounter once it's done.
+// The mount path is unmounted with the flags if it's not unmounted by the plugin yet,
+// and the vfs cache is waited for by each wait to be written to the write cache directory before copying it, just like a detached volume.
+// It returns false if the mount path isn't mounted with the local write cache.
+func umountWriteCacheKodo(logger *log.Entry, mountPath string, flags int, wait time.Duration) bool {
+	value, ok := kodoWriteCaches.LoadAndDelete(mountPath)
+	if !ok {
+		return false
+	}
+	wc := value.(*kodoWriteCache)
+	wc.stop()
+	if mounted, _ := isMountedBy(mountPath, FuseTypeRclone); mounted {
+		if err := syscall.Unmount(mountPath, flags); err != nil {
+			logger.Warnf("Failed to unmount %s: %s", mountPath, err)
+		}
+	}
+	go drainKodo(logger, wc.volumeId, wc.mountPath, wait, func() { wc.release(logger) })
+	return true
+}
+
+// release copies the write cache directory to the bucket once the mount path is unmounted, then stops the mounter.
+// The directory is removed only if it's copied, otherwise it's kept on the node to be taken by the volume mounted there again.
+func (wc *kodoWriteCache) release(logger *log.Entry) {
+	err := wc.sync(context.Background())
+	mounterSupervisor.stop(wc.mountPath)
+	if mounted, _ := isMountedBy(wc.mountPath, FuseTypeRclone); mounted {
+		if err := unmountFuseLazily(wc.mountPath); err != nil {
+			logger.Warnf("Failed to unmount %s lazily: %s", wc.mountPath, err)
+		}
+	}
+	removeRcloneFiles(wc.volumeId, wc.mountPath)
+	os.Remove(wc.mountPath)
+	if err != nil {
+		logger.Errorf("Failed to copy write cache %s to %s, the files are kept on the node: %s", wc.dir(), wc.remote, err)
+		return
+	}
+	if err = os.RemoveAll(wc.dir()); err != nil {
+		logger.Warnf("Failed to remove write cache %s: %s", wc.dir(), err)
+	}
+	os.Remove(filepath.Dir(wc.dir()))
+	logger.Infof("Write cache of %s is copied to %s and removed", wc.target, wc.remote)
+}
+
+// lookupKodoWriteCache returns the rclone mount point actually serving the mount path if it's mounted with the local write cache
+func lookupKodoWriteCache(mountPath string) (*kodoWriteCache, bool) {
+	if value, ok := kodoWriteCaches.Load(mountPath); ok {
+		return value.(*kodoWriteCache), true
+	}
+	return nil, false
+}
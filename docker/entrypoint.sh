@@ -4,16 +4,33 @@ set -e
 
 HOST_CMD="/usr/local/bin/nsenter --all --target 1 --"
 
-rm -f /host/usr/local/bin/kodofs /host/usr/local/bin/connector.plugin.storage.qiniu.com
-cp /usr/local/bin/kodofs /host/usr/local/bin/kodofs
-cp /usr/local/bin/rclone /host/usr/local/bin/rclone
-cp /usr/local/bin/connector.plugin.storage.qiniu.com /host/usr/local/bin/connector.plugin.storage.qiniu.com
-cp /csiplugin-connector.service /host/etc/systemd/system/csiplugin-connector.service
+# The connector is installed onto the node by the init container of the unprivileged plugin, or beforehand if INSTALL_CONNECTOR=false
+if [ "$INSTALL_CONNECTOR" != "false" ]; then
+    # The mounters copied to the node must be of its architecture, which may differ from the image if it's emulated
+    HOST_ARCH=$($HOST_CMD uname -m)
+    case "$HOST_ARCH" in
+        x86_64) HOST_ARCH=amd64 ;;
+        aarch64) HOST_ARCH=arm64 ;;
+    esac
+    if [ -n "$IMAGE_ARCH" ] && [ "$HOST_ARCH" != "$IMAGE_ARCH" ]; then
+        echo "The image of linux/$IMAGE_ARCH is running on a node of linux/$HOST_ARCH, please use the image of linux/$HOST_ARCH" >&2
+        exit 1
+    fi
 
-$HOST_CMD /usr/local/bin/connector.plugin.storage.qiniu.com -test
+    rm -f /host/usr/local/bin/kodofs /host/usr/local/bin/connector.plugin.storage.qiniu.com
+    cp /usr/local/bin/kodofs /host/usr/local/bin/kodofs
+    cp /usr/local/bin/rclone /host/usr/local/bin/rclone
+    cp /usr/local/bin/connector.plugin.storage.qiniu.com /host/usr/local/bin/connector.plugin.storage.qiniu.com
+    cp /csiplugin-connector.service /host/etc/systemd/system/csiplugin-connector.service
 
-$HOST_CMD systemctl daemon-reload
-$HOST_CMD systemctl enable csiplugin-connector
-$HOST_CMD systemctl restart csiplugin-connector
+    $HOST_CMD /usr/local/bin/connector.plugin.storage.qiniu.com -test
+
+    $HOST_CMD systemctl daemon-reload
+    $HOST_CMD systemctl enable csiplugin-connector
+    $HOST_CMD systemctl restart csiplugin-connector
+fi
+if [ "$1" = "install-connector" ]; then
+    exit 0
+fi
 
 /usr/local/bin/plugin.storage.qiniu.com $@
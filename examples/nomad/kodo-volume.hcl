@@ -0,0 +1,24 @@
+# Registers an existing Kodo bucket as a volume by nomad volume register
+id          = "kodo-csi-volume"
+name        = "kodo-csi-volume"
+type        = "csi"
+plugin_id   = "kodoplugin.storage.qiniu.com"
+external_id = "kodo-csi-volume"
+
+capability {
+  access_mode     = "multi-node-multi-writer"
+  attachment_mode = "file-system"
+}
+
+# The same as volumeAttributes of the PV in ../kodo/static-provisioning/pv.yaml
+context {
+  # vfscachemode = "writes"
+}
+
+secrets {
+  accesskey  = "MUST FILL OUT THIS FIELD"
+  secretkey  = "MUST FILL OUT THIS FIELD"
+  bucketname = "MUST FILL OUT THIS FIELD"
+  ucendpoint = "MUST FILL OUT THIS FIELD"
+  region     = "MUST FILL OUT THIS FIELD"
+}
@@ -0,0 +1,191 @@
+// Package testing provides in-memory fakes of the services the plugin talks to,
+// so that the CSI servers can be tested without root, FUSE, network or a Kubernetes cluster.
+package testing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+// FakeConnector speaks the protocol of the connector on a unix socket without mounting anything.
+// Every command succeeds unless it's failed by Fail, the mount paths are just recorded.
+type FakeConnector struct {
+	listener net.Listener
+
+	lock sync.Mutex
+	// Connections being served, closed together with the listener so the plugin never reuses them
+	conns map[net.Conn]struct{}
+	// Volume ids by the mount paths mounted and not unmounted yet
+	mounts map[string]string
+	// Codes terminating the commands by the command names
+	codes    map[string]int
+	requests []protocol.Request
+}
+
+// NewFakeConnector listens on the socket path, which is passed to the plugin by --connector-socket
+func NewFakeConnector(socketPath string) (*FakeConnector, error) {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	connector := &FakeConnector{listener: listener, conns: make(map[net.Conn]struct{}), mounts: make(map[string]string), codes: make(map[string]int)}
+	go connector.serve()
+	return connector, nil
+}
+
+// Close stops listening and closes the connections kept alive by the plugin
+func (connector *FakeConnector) Close() {
+	connector.listener.Close()
+
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+
+	for conn := range connector.conns {
+		conn.Close()
+	}
+}
+
+// Fail makes the command terminate with the code from now on, 0 to succeed again
+func (connector *FakeConnector) Fail(cmdName string, code int) {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+
+	connector.codes[cmdName] = code
+}
+
+// Mounts returns the volume ids by the mount paths mounted and not unmounted yet
+func (connector *FakeConnector) Mounts() map[string]string {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+
+	mounts := make(map[string]string, len(connector.mounts))
+	for mountPath, volumeId := range connector.mounts {
+		mounts[mountPath] = volumeId
+	}
+	return mounts
+}
+
+// Requests returns the requests received so far in order
+func (connector *FakeConnector) Requests() []protocol.Request {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+
+	return append([]protocol.Request(nil), connector.requests...)
+}
+
+func (connector *FakeConnector) serve() {
+	for {
+		conn, err := connector.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("fake connector: failed to accept: %s", err)
+			}
+			return
+		}
+		go connector.serveConn(conn)
+	}
+}
+
+func (connector *FakeConnector) serveConn(conn net.Conn) {
+	connector.lock.Lock()
+	connector.conns[conn] = struct{}{}
+	connector.lock.Unlock()
+	defer func() {
+		connector.lock.Lock()
+		delete(connector.conns, conn)
+		connector.lock.Unlock()
+		conn.Close()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var request protocol.Request
+		if err := decoder.Decode(&request); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("fake connector: failed to decode request: %s", err)
+			}
+			return
+		}
+		if err := connector.handle(encoder, &request); err != nil {
+			log.Printf("fake connector: failed to handle %s: %s", request.Cmd, err)
+			return
+		} else if !request.KeepAlive {
+			return
+		}
+	}
+}
+
+func (connector *FakeConnector) handle(encoder *json.Encoder, request *protocol.Request) error {
+	// Rejected just like the connector does
+	cmd, err := protocol.DecodeCmd(request)
+	if err != nil {
+		return err
+	}
+	var mount struct {
+		VolumeId  string `json:"volume_id"`
+		MountPath string `json:"mount_path"`
+	}
+	if len(request.Payload) > 0 {
+		if err = json.Unmarshal(request.Payload, &mount); err != nil {
+			// Replied like replyError of the connector
+			return replyError(encoder, fmt.Sprintf("%s payload parse error: %s", request.Cmd, err))
+		}
+	}
+	if c, ok := cmd.(*protocol.InitKodoFSMountCmd); ok {
+		mount.VolumeId = c.GatewayID
+	}
+
+	connector.lock.Lock()
+	connector.requests = append(connector.requests, *request)
+	code := connector.codes[request.Cmd]
+	if code == 0 {
+		switch request.Cmd {
+		case protocol.InitKodoMountCmdName, protocol.InitKodoFsMountCmdName:
+			connector.mounts[mount.MountPath] = mount.VolumeId
+		case protocol.KodoUmountCmdName, protocol.UmountCmdName:
+			delete(connector.mounts, mount.MountPath)
+		}
+	}
+	connector.lock.Unlock()
+
+	switch request.Cmd {
+	case protocol.KodoUmountCmdName:
+		// The connector replies umount only if the connection is kept alive
+		if !request.KeepAlive {
+			return nil
+		}
+	case protocol.KodoVfsStatsCmdName, protocol.KodoVfsForgetCmdName:
+		if code == 0 {
+			if err := reply(encoder, protocol.ResponseDataCmdName, &protocol.ResponseDataCmd{Data: "{}"}); err != nil {
+				return err
+			}
+		}
+	}
+	return reply(encoder, protocol.TerminateCmdName, &protocol.TerminateCmd{Code: code})
+}
+
+// replyError replies the error and terminates the command with code 1
+func replyError(encoder *json.Encoder, message string) error {
+	if err := reply(encoder, protocol.ResponseDataCmdName, &protocol.ResponseDataCmd{Data: message, IsError: true}); err != nil {
+		return err
+	}
+	return reply(encoder, protocol.TerminateCmdName, &protocol.TerminateCmd{Code: 1})
+}
+
+func reply(encoder *json.Encoder, cmdName string, cmd protocol.Cmd) error {
+	buf, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(&protocol.Request{Version: protocol.Version, Cmd: cmdName, Payload: buf})
+}
@@ -0,0 +1,244 @@
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	// The only region of the mock Kodo API
+	MockKodoRegion   = "z0"
+	MockKodoS3Region = "cn-east-1"
+
+	// Status code of Kodo if the account owns too many buckets to create another one
+	KodoStatusTooManyBuckets = 630
+)
+
+type MockBucket struct {
+	ID     string `json:"id"`
+	Name   string `json:"tbl"`
+	Region string `json:"region"`
+}
+
+type mockKodoFailure struct {
+	pathPrefix string
+	statusCode int
+	message    string
+}
+
+// MockKodo serves the Kodo APIs called by the controller in memory, uc, rs, rsf, s3 and api are all served by the same server.
+// Requests are not authenticated unless failed by FailAuth, every bucket is empty.
+type MockKodo struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	buckets  map[string]*MockBucket
+	users    map[string][2]string
+	policies map[string]struct{}
+	failures []mockKodoFailure
+	nextId   int
+}
+
+func NewMockKodo() *MockKodo {
+	kodo := &MockKodo{
+		buckets:  make(map[string]*MockBucket),
+		users:    make(map[string][2]string),
+		policies: make(map[string]struct{}),
+	}
+	kodo.server = httptest.NewServer(http.HandlerFunc(kodo.serveHTTP))
+	return kodo
+}
+
+// URL returns the endpoint of all Kodo services, e.g. ucendpoint of the StorageClass
+func (kodo *MockKodo) URL() string {
+	return kodo.server.URL
+}
+
+func (kodo *MockKodo) Close() {
+	kodo.server.Close()
+}
+
+// Fail makes the requests whose path starts with the prefix respond the status code with the error message from now on,
+// the prefix of the latest call wins if multiple prefixes match. An empty prefix matches every request.
+func (kodo *MockKodo) Fail(pathPrefix string, statusCode int, message string) {
+	kodo.lock.Lock()
+	defer kodo.lock.Unlock()
+
+	kodo.failures = append([]mockKodoFailure{{pathPrefix: pathPrefix, statusCode: statusCode, message: message}}, kodo.failures...)
+}
+
+// FailQuota makes creating buckets fail as if the account owns too many buckets
+func (kodo *MockKodo) FailQuota() {
+	kodo.Fail("/mkbucketv3/", KodoStatusTooManyBuckets, "too many buckets")
+}
+
+// FailAuth makes every request fail by the status code, 401 for wrong credentials or 403 for credentials not permitted
+func (kodo *MockKodo) FailAuth(statusCode int) {
+	kodo.Fail("", statusCode, "bad token")
+}
+
+// Recover removes all failures injected so far
+func (kodo *MockKodo) Recover() {
+	kodo.lock.Lock()
+	defer kodo.lock.Unlock()
+
+	kodo.failures = nil
+}
+
+// Buckets returns the buckets created and not dropped yet
+func (kodo *MockKodo) Buckets() []MockBucket {
+	kodo.lock.Lock()
+	defer kodo.lock.Unlock()
+
+	buckets := make([]MockBucket, 0, len(kodo.buckets))
+	for _, bucket := range kodo.buckets {
+		buckets = append(buckets, *bucket)
+	}
+	return buckets
+}
+
+// Users returns the aliases of the IAM users created and not deleted yet
+func (kodo *MockKodo) Users() []string {
+	kodo.lock.Lock()
+	defer kodo.lock.Unlock()
+
+	users := make([]string, 0, len(kodo.users))
+	for alias := range kodo.users {
+		users = append(users, alias)
+	}
+	return users
+}
+
+// FindBucket returns the bucket created for the volume, whose name is the volume id followed by a random suffix
+func (kodo *MockKodo) FindBucket(volumeId string) *MockBucket {
+	kodo.lock.Lock()
+	defer kodo.lock.Unlock()
+
+	for name, bucket := range kodo.buckets {
+		if strings.HasPrefix(name, volumeId+"-") {
+			copied := *bucket
+			return &copied
+		}
+	}
+	return nil
+}
+
+func (kodo *MockKodo) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	kodo.lock.Lock()
+	defer kodo.lock.Unlock()
+
+	for _, failure := range kodo.failures {
+		if strings.HasPrefix(r.URL.Path, failure.pathPrefix) {
+			WriteJSON(w, failure.statusCode, map[string]string{"error": failure.message})
+			return
+		}
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/regions":
+		service := map[string]interface{}{"region_alias": MockKodoS3Region, "domains": []string{kodo.server.URL}}
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"regions": []interface{}{map[string]interface{}{
+			"id": MockKodoRegion, "s3": service, "rs": service, "rsf": service, "api": service,
+		}}})
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/buckets":
+		buckets := make([]*MockBucket, 0, len(kodo.buckets))
+		for _, bucket := range kodo.buckets {
+			buckets = append(buckets, bucket)
+		}
+		WriteJSON(w, http.StatusOK, buckets)
+	case r.Method == http.MethodPost && segments[0] == "mkbucketv3" && len(segments) >= 4:
+		if _, exists := kodo.buckets[segments[1]]; exists {
+			WriteJSON(w, 614, map[string]string{"error": "the bucket already exists and you own it"})
+			return
+		}
+		kodo.nextId += 1
+		kodo.buckets[segments[1]] = &MockBucket{ID: fmt.Sprintf("bucket-%d", kodo.nextId), Name: segments[1], Region: segments[3]}
+		WriteJSON(w, http.StatusOK, struct{}{})
+	case r.Method == http.MethodPost && segments[0] == "drop" && len(segments) == 2:
+		if _, exists := kodo.buckets[segments[1]]; !exists {
+			WriteJSON(w, 631, map[string]string{"error": "no such bucket"})
+			return
+		}
+		delete(kodo.buckets, segments[1])
+		WriteJSON(w, http.StatusOK, struct{}{})
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/list":
+		// No objects in the bucket
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && r.URL.Path == "/batch":
+		WriteJSON(w, http.StatusOK, []interface{}{})
+	case len(segments) >= 3 && segments[0] == "iam" && segments[1] == "v1":
+		kodo.serveIAM(w, r, segments[2:])
+	default:
+		WriteJSON(w, http.StatusNotFound, map[string]string{"error": "mock Kodo API: unsupported " + r.Method + " " + r.URL.Path})
+	}
+}
+
+func (kodo *MockKodo) serveIAM(w http.ResponseWriter, r *http.Request, segments []string) {
+	switch {
+	case segments[0] == "users" && len(segments) == 1 && r.Method == http.MethodPost:
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		kodo.users[body.Alias] = [2]string{}
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"data": body})
+	case segments[0] == "users" && len(segments) == 1 && r.Method == http.MethodGet:
+		users := make([]map[string]string, 0, len(kodo.users))
+		for alias := range kodo.users {
+			users = append(users, map[string]string{"alias": alias})
+		}
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"count": len(users), "list": users}})
+	case segments[0] == "users" && len(segments) == 2 && r.Method == http.MethodDelete:
+		delete(kodo.users, segments[1])
+		WriteJSON(w, http.StatusOK, struct{}{})
+	case segments[0] == "users" && len(segments) == 3 && segments[2] == "keypairs":
+		keyPair, exists := kodo.users[segments[1]]
+		if !exists {
+			WriteJSON(w, http.StatusNotFound, map[string]string{"error": "no such user"})
+			return
+		}
+		if r.Method == http.MethodPost {
+			keyPair = [2]string{"ak-" + segments[1], "sk-" + segments[1]}
+			kodo.users[segments[1]] = keyPair
+			WriteJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]string{"access_key": keyPair[0], "secret_key": keyPair[1]}})
+			return
+		}
+		keyPairs := []map[string]string{}
+		if keyPair[0] != "" {
+			keyPairs = append(keyPairs, map[string]string{"access_key": keyPair[0], "secret_key": keyPair[1]})
+		}
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"list": keyPairs}})
+	case segments[0] == "users" && len(segments) == 3 && segments[2] == "policies":
+		WriteJSON(w, http.StatusOK, struct{}{})
+	case segments[0] == "policies" && len(segments) == 1 && r.Method == http.MethodPost:
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		kodo.policies[body.Alias] = struct{}{}
+		WriteJSON(w, http.StatusOK, struct{}{})
+	case segments[0] == "policies" && len(segments) == 2 && r.Method == http.MethodDelete:
+		delete(kodo.policies, segments[1])
+		WriteJSON(w, http.StatusOK, struct{}{})
+	default:
+		WriteJSON(w, http.StatusNotFound, map[string]string{"error": "mock Kodo API: unsupported " + r.Method + " " + r.URL.Path})
+	}
+}
+
+// WriteJSON responds the body in JSON with the status code
+func WriteJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
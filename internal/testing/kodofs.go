@@ -0,0 +1,195 @@
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Code of the KodoFS master if the volume does not exist
+const KodoFSCodeNoSuchVolume = -2000
+
+type MockKodoFSVolume struct {
+	Name      string
+	GatewayID string
+	Region    string
+}
+
+// MockKodoFS serves the KodoFS master APIs called by the controller in memory, the requests are not authenticated unless failed by FailAuth
+type MockKodoFS struct {
+	server *httptest.Server
+
+	lock    sync.Mutex
+	volumes map[string]*MockKodoFSVolume
+	// Volume names by the ids of the access points
+	accessPoints map[string]string
+	failures     []mockKodoFailure
+	nextId       int
+}
+
+func NewMockKodoFS() *MockKodoFS {
+	kodofs := &MockKodoFS{volumes: make(map[string]*MockKodoFSVolume), accessPoints: make(map[string]string)}
+	kodofs.server = httptest.NewServer(http.HandlerFunc(kodofs.serveHTTP))
+	return kodofs
+}
+
+// URL returns the address of the master, e.g. mastersvraddr of the StorageClass
+func (kodofs *MockKodoFS) URL() string {
+	return kodofs.server.URL
+}
+
+func (kodofs *MockKodoFS) Close() {
+	kodofs.server.Close()
+}
+
+// Fail makes the requests whose path starts with the prefix respond the status code with the error message from now on,
+// like MockKodo.Fail
+func (kodofs *MockKodoFS) Fail(pathPrefix string, statusCode int, message string) {
+	kodofs.lock.Lock()
+	defer kodofs.lock.Unlock()
+
+	kodofs.failures = append([]mockKodoFailure{{pathPrefix: pathPrefix, statusCode: statusCode, message: message}}, kodofs.failures...)
+}
+
+// FailAuth makes every request fail by the status code, 401 for wrong credentials or 403 for credentials not permitted
+func (kodofs *MockKodoFS) FailAuth(statusCode int) {
+	kodofs.Fail("", statusCode, "bad token")
+}
+
+// Recover removes all failures injected so far
+func (kodofs *MockKodoFS) Recover() {
+	kodofs.lock.Lock()
+	defer kodofs.lock.Unlock()
+
+	kodofs.failures = nil
+}
+
+// Volumes returns the volumes by their names, which are renamed instead of removed if the PVs are retained
+func (kodofs *MockKodoFS) Volumes() map[string]MockKodoFSVolume {
+	kodofs.lock.Lock()
+	defer kodofs.lock.Unlock()
+
+	volumes := make(map[string]MockKodoFSVolume, len(kodofs.volumes))
+	for name, volume := range kodofs.volumes {
+		volumes[name] = *volume
+	}
+	return volumes
+}
+
+// AccessPoints returns the names of the volumes by the ids of the access points created and not removed yet
+func (kodofs *MockKodoFS) AccessPoints() map[string]string {
+	kodofs.lock.Lock()
+	defer kodofs.lock.Unlock()
+
+	accessPoints := make(map[string]string, len(kodofs.accessPoints))
+	for id, volumeName := range kodofs.accessPoints {
+		accessPoints[id] = volumeName
+	}
+	return accessPoints
+}
+
+// AddVolume creates the volume as if it's created by others, e.g. the volume archived before
+func (kodofs *MockKodoFS) AddVolume(name string) {
+	kodofs.lock.Lock()
+	defer kodofs.lock.Unlock()
+
+	kodofs.nextId += 1
+	kodofs.volumes[name] = &MockKodoFSVolume{Name: name, GatewayID: fmt.Sprintf("gateway-%d", kodofs.nextId)}
+}
+
+func (kodofs *MockKodoFS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	kodofs.lock.Lock()
+	defer kodofs.lock.Unlock()
+
+	for _, failure := range kodofs.failures {
+		if strings.HasPrefix(r.URL.Path, failure.pathPrefix) {
+			WriteJSON(w, failure.statusCode, map[string]interface{}{"code": -1, "message": failure.message})
+			return
+		}
+	}
+
+	var body struct {
+		VolumeName    string `json:"volumeName"`
+		Volume        string `json:"volume"`
+		Region        string `json:"region"`
+		AccessId      string `json:"accessId"`
+		OldVolumeName string `json:"oldVolumeName"`
+		NewVolumeName string `json:"newVolumeName"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]interface{}{"code": -1, "message": err.Error()})
+			return
+		}
+	}
+	noSuchVolume := func(name string) {
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": KodoFSCodeNoSuchVolume, "message": "no such volume: " + name})
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/kodofs-master/volume/info":
+		name := r.URL.Query().Get("volume")
+		if volume, exists := kodofs.volumes[name]; exists {
+			WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "volume": volume.GatewayID})
+		} else {
+			noSuchVolume(name)
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/kodofs-master/volume/create":
+		if _, exists := kodofs.volumes[body.VolumeName]; exists {
+			WriteJSON(w, http.StatusOK, map[string]interface{}{"code": -1, "message": "volume already exists: " + body.VolumeName})
+			return
+		}
+		kodofs.nextId += 1
+		volume := &MockKodoFSVolume{Name: body.VolumeName, GatewayID: fmt.Sprintf("gateway-%d", kodofs.nextId), Region: body.Region}
+		kodofs.volumes[body.VolumeName] = volume
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "volume": volume.GatewayID})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/kodofs-master/volume/rename":
+		volume, exists := kodofs.volumes[body.OldVolumeName]
+		if !exists {
+			noSuchVolume(body.OldVolumeName)
+			return
+		} else if _, exists = kodofs.volumes[body.NewVolumeName]; exists {
+			WriteJSON(w, http.StatusOK, map[string]interface{}{"code": -1, "message": "volume already exists: " + body.NewVolumeName})
+			return
+		}
+		delete(kodofs.volumes, body.OldVolumeName)
+		volume.Name = body.NewVolumeName
+		kodofs.volumes[body.NewVolumeName] = volume
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/kodofs-master/volume/remove":
+		if _, exists := kodofs.volumes[body.Volume]; !exists {
+			noSuchVolume(body.Volume)
+			return
+		}
+		delete(kodofs.volumes, body.Volume)
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/kodofs-master/accessPoint/create":
+		if _, exists := kodofs.volumes[body.Volume]; !exists {
+			noSuchVolume(body.Volume)
+			return
+		}
+		kodofs.nextId += 1
+		accessId := fmt.Sprintf("access-point-%d", kodofs.nextId)
+		kodofs.accessPoints[accessId] = body.Volume
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "accessId": accessId})
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/kodofs-master/accessPoint/info":
+		accessId := r.URL.Query().Get("accessId")
+		if _, exists := kodofs.accessPoints[accessId]; !exists {
+			WriteJSON(w, http.StatusOK, map[string]interface{}{"code": -1, "message": "no such access point: " + accessId})
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "accessToken": "token-" + accessId})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/kodofs-master/accessPoint/remove":
+		if _, exists := kodofs.accessPoints[body.AccessId]; !exists {
+			WriteJSON(w, http.StatusOK, map[string]interface{}{"code": -1, "message": "no such access point: " + body.AccessId})
+			return
+		}
+		delete(kodofs.accessPoints, body.AccessId)
+		WriteJSON(w, http.StatusOK, map[string]interface{}{"code": 0})
+	default:
+		WriteJSON(w, http.StatusNotFound, map[string]interface{}{"code": -1, "message": "mock KodoFS API: unsupported " + r.Method + " " + r.URL.Path})
+	}
+}
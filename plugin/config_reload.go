@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// How often the ConfigMap of --config-configmap is read again for the changed flags
+	ConfigReloadInterval = 30 * time.Second
+	// Timeout to get the ConfigMap of --config-configmap
+	ConfigReloadTimeout = 10 * time.Second
+)
+
+// reloadableFlags are the flags which could be changed by the ConfigMap of --config-configmap without restarting the plugin,
+// since they're read every time they're used. The other flags are only read once the plugin starts.
+var reloadableFlags = map[string]func(value string) error{
+	"log-level": setConfiguredLogLevel,
+	"feature-gates": func(value string) error {
+		return featureGates.Set(value)
+	},
+	"slow-rpc-threshold": func(value string) error {
+		return slowRPCThreshold.Set(value)
+	},
+	"slow-connector-threshold": func(value string) error {
+		return slowConnectorThreshold.Set(value)
+	},
+	"kodo-flush-timeout": func(value string) error {
+		return kodoFlushTimeout.Set(value)
+	},
+	"kodo-lazy-unmount": func(value string) error {
+		return kodoLazyUnmount.Set(value)
+	},
+}
+
+// reloadableDuration is a duration flag which could be changed by the config reloader while it's read by the RPCs
+type reloadableDuration struct {
+	value int64
+}
+
+func newReloadableDuration(name string, value time.Duration, usage string) *reloadableDuration {
+	d := &reloadableDuration{value: int64(value)}
+	flag.Var(d, name, usage)
+	return d
+}
+
+func (d *reloadableDuration) get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.value))
+}
+
+func (d *reloadableDuration) String() string {
+	return d.get().String()
+}
+
+func (d *reloadableDuration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&d.value, int64(v))
+	return nil
+}
+
+// reloadableBool is a boolean flag which could be changed by the config reloader while it's read by the RPCs
+type reloadableBool struct {
+	value int32
+}
+
+func newReloadableBool(name string, value bool, usage string) *reloadableBool {
+	b := &reloadableBool{}
+	if value {
+		b.value = 1
+	}
+	flag.Var(b, name, usage)
+	return b
+}
+
+func (b *reloadableBool) get() bool {
+	return atomic.LoadInt32(&b.value) != 0
+}
+
+func (b *reloadableBool) String() string {
+	return strconv.FormatBool(b.get())
+}
+
+func (b *reloadableBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	var value int32
+	if v {
+		value = 1
+	}
+	atomic.StoreInt32(&b.value, value)
+	return nil
+}
+
+func (b *reloadableBool) IsBoolFlag() bool {
+	return true
+}
+
+// configuredLogLevel is the level of the logs given by --log-level or the config reloader, which SIGUSR1 toggles debug back to
+var configuredLogLevel uint32
+
+func setConfiguredLogLevel(value string) error {
+	level, err := log.ParseLevel(value)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&configuredLogLevel, uint32(level))
+	log.SetLevel(level)
+	return nil
+}
+
+func getConfiguredLogLevel() log.Level {
+	return log.Level(atomic.LoadUint32(&configuredLogLevel))
+}
+
+// startConfigReloader applies the reloadable flags set in the ConfigMap of --config-configmap in the namespace of the plugin
+// by the flag names, e.g. kodo-flush-timeout: 10m, every ConfigReloadInterval. The flags removed from the ConfigMap,
+// or the whole ConfigMap removed, are changed back to the values given by the command line.
+func startConfigReloader(client kubernetes.Interface) {
+	if *configConfigMap == "" {
+		return
+	} else if client == nil {
+		log.Warnf("Config: --config-configmap is ignored, the plugin is not running in Kubernetes")
+		return
+	}
+	commandLine := make(map[string]string, len(reloadableFlags))
+	for name := range reloadableFlags {
+		commandLine[name] = flag.Lookup(name).Value.String()
+	}
+
+	go func() {
+		applied := make(map[string]string, len(commandLine))
+		for name, value := range commandLine {
+			applied[name] = value
+		}
+		ignored := make(map[string]string)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), ConfigReloadTimeout)
+			configMap, err := client.CoreV1().ConfigMaps(podNamespace()).Get(ctx, *configConfigMap, metav1.GetOptions{})
+			cancel()
+			var data map[string]string
+			if err == nil {
+				data = configMap.Data
+			} else if !apierrors.IsNotFound(err) {
+				log.Warnf("Config: failed to get %s, keep the current flags: %s", *configConfigMap, err)
+				time.Sleep(ConfigReloadInterval)
+				continue
+			}
+			reloadConfig(data, commandLine, applied, ignored)
+			time.Sleep(ConfigReloadInterval)
+		}
+	}()
+}
+
+// reloadConfig applies the flags of the ConfigMap changed since the last time, the flags which are not reloadable and the invalid values are warned once
+func reloadConfig(data, commandLine, applied, ignored map[string]string) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := reloadableFlags[name]; ok {
+			continue
+		} else if value, ok := ignored[name]; !ok || value != data[name] {
+			log.Warnf("Config: %s of %s is ignored, only %s could be changed without restarting the plugin", name, *configConfigMap, reloadableFlagNames())
+			ignored[name] = data[name]
+		}
+	}
+	for name, set := range reloadableFlags {
+		value, ok := data[name]
+		if !ok {
+			value = commandLine[name]
+		}
+		if rejected, ok := ignored[name]; value == applied[name] || ok && value == rejected {
+			continue
+		}
+		if err := set(value); err != nil {
+			log.Warnf("Config: invalid %s %q of %s, keep %q: %s", name, value, *configConfigMap, applied[name], err)
+			// The invalid value is never applied again until it's changed
+			ignored[name] = value
+			continue
+		}
+		log.Infof("Config: %s is changed from %q to %q", name, applied[name], value)
+		applied[name] = value
+		delete(ignored, name)
+	}
+}
+
+func reloadableFlagNames() []string {
+	names := make([]string, 0, len(reloadableFlags))
+	for name := range reloadableFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
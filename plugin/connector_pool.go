@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+const (
+	// Idle connections are closed before the connector does, which waits 2 minutes for the next command
+	connectorIdleTimeout = time.Minute
+	// How long to wait for the connector to reply the commands which used to be sent without waiting, e.g. umount
+	connectorReplyTimeout = 10 * time.Second
+	// How long the readiness probe waits for the connector to reply the ping, shorter than timeoutSeconds of the probe
+	connectorPingTimeout = 3 * time.Second
+)
+
+// connectorConn is a connection to the connector, which is put back to the pool once the command terminates
+type connectorConn struct {
+	net.Conn
+	encoder *frameEncoder
+	decoder *json.Decoder
+	// Checks the frames received from the connector, see protocol.FrameSequence
+	received protocol.FrameSequence
+	// Asks the connector to keep the connection open for the next command
+	keepAlive bool
+	// Set once the command terminates, only then the connection could be reused
+	terminated bool
+	idleSince  time.Time
+	// Credits granted by the connector to send the data of the command, see sendData
+	dataCredits int
+	// Number of the responses of the command read but not acknowledged yet
+	unacked int
+	// Responses read while waiting for the credits, which are returned by decode first
+	pending []*protocol.Request
+}
+
+// connectorPool keeps the idle connections to the connector, so that the commands during a mount storm
+// don't dial the connector one by one
+type connectorPool struct {
+	lock sync.Mutex
+	idle []*connectorConn
+}
+
+var connectors = new(connectorPool)
+
+// dialConnector returns an idle connection to the connector if there is one, otherwise dials a new one.
+// keepAlive must be false if the responses of the command may arrive after it terminates, e.g. running kodofs interactively.
+func dialConnector(keepAlive bool) (*connectorConn, error) {
+	keepAlive = keepAlive && *connectorPoolSize > 0
+	if keepAlive {
+		if conn := connectors.get(); conn != nil {
+			return conn, nil
+		}
+	}
+	conn, err := dialConnectorEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return &connectorConn{Conn: conn, encoder: &frameEncoder{encoder: json.NewEncoder(conn)}, decoder: json.NewDecoder(conn), keepAlive: keepAlive}, nil
+}
+
+// frameEncoder numbers the requests written into the connection, see protocol.FrameSequence
+type frameEncoder struct {
+	encoder *json.Encoder
+	frames  protocol.FrameSequence
+}
+
+func (e *frameEncoder) Encode(request *protocol.Request) error {
+	e.frames.Seal(request)
+	return e.encoder.Encode(request)
+}
+
+// get returns the most recently used idle connection which is still open
+func (p *connectorPool) get() *connectorConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(conn.idleSince) < connectorIdleTimeout && conn.isOpen() {
+			return conn
+		}
+		conn.Conn.Close()
+	}
+	return nil
+}
+
+func (p *connectorPool) put(conn *connectorConn) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.idle) >= *connectorPoolSize {
+		return false
+	}
+	conn.SetDeadline(time.Time{})
+	conn.terminated, conn.idleSince = false, time.Now()
+	p.idle = append(p.idle, conn)
+	return true
+}
+
+// isOpen peeks the connection without blocking, which is closed by the connector if it's restarted or the connection is expired
+func (conn *connectorConn) isOpen() bool {
+	netConn := conn.Conn
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		// A remote connector closing the connection sends close_notify, which is peeked as well
+		netConn = tlsConn.NetConn()
+	}
+	syscallConn, ok := netConn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	open := false
+	if err = rawConn.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		// Nothing is expected from an idle connection, which would block if it's open
+		_, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		open = errors.Is(err, syscall.EAGAIN)
+		return true
+	}); err != nil {
+		return false
+	}
+	return open
+}
+
+// makeRequest makes the request of the command sent through the connection
+func (conn *connectorConn) makeRequest(ctx context.Context, cmdName string, buf []byte) *protocol.Request {
+	request := makeRequest(ctx, cmdName, buf)
+	request.KeepAlive = conn.keepAlive
+	request.Heartbeat = true
+	request.FlowControl = true
+	if cmdName != protocol.RequestDataCmdName {
+		// Every command starts with the whole window in both directions
+		conn.dataCredits, conn.unacked, conn.pending = protocol.DataWindow, 0, nil
+	}
+	return request
+}
+
+// more returns true if there is any response of the command left to decode
+func (conn *connectorConn) more() bool {
+	return len(conn.pending) > 0 || conn.decoder.More()
+}
+
+// decode decodes the next response of the command, and records whether the command terminates.
+// The heartbeats and the acknowledgements of the connector are handled here, so they are never returned.
+// The responses are acknowledged once half of the window is read, so the connector never waits for the credits unless the plugin stops reading.
+func (conn *connectorConn) decode(request *protocol.Request) error {
+	if len(conn.pending) > 0 {
+		*request = *conn.pending[0]
+		conn.pending = conn.pending[1:]
+	} else if err := conn.receive(request); err != nil {
+		return err
+	}
+	switch request.Cmd {
+	case protocol.TerminateCmdName:
+		conn.terminated = true
+	case protocol.ResponseDataCmdName:
+		if conn.unacked++; conn.unacked >= protocol.DataWindow/2 {
+			if err := conn.encoder.Encode(makeAckRequest(conn.unacked)); err != nil {
+				return fmt.Errorf("failed to acknowledge responses: %w", err)
+			}
+			conn.unacked = 0
+		}
+	}
+	return nil
+}
+
+// receive reads the next request from the connector other than the heartbeats and the acknowledgements
+func (conn *connectorConn) receive(request *protocol.Request) error {
+	for {
+		if err := conn.decoder.Decode(request); err != nil {
+			return err
+		} else if err = conn.received.Check(request); err != nil {
+			// The connection is closed instead of put back to the pool, since the command never terminates
+			return fmt.Errorf("connection to the connector is desynchronized: %w", err)
+		}
+		switch request.Cmd {
+		case protocol.HeartbeatCmdName:
+			if err := conn.encoder.Encode(&protocol.Request{Version: protocol.Version, Cmd: protocol.HeartbeatCmdName, Payload: json.RawMessage("{}")}); err != nil {
+				return fmt.Errorf("failed to answer heartbeat: %w", err)
+			}
+		case protocol.AckDataCmdName:
+			var cmd protocol.AckDataCmd
+			if err := json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				return fmt.Errorf("failed to marshal json payload: %w", err)
+			}
+			conn.dataCredits += cmd.Credits
+		default:
+			return nil
+		}
+		*request = protocol.Request{}
+	}
+}
+
+// sendData sends the payload of RequestDataCmd into the stdin of the command, after waiting for the connector to acknowledge
+// the previous data if all the credits are used, the responses read meanwhile are kept for decode
+func (conn *connectorConn) sendData(ctx context.Context, buf []byte) error {
+	for conn.dataCredits <= 0 {
+		request := new(protocol.Request)
+		if err := conn.receive(request); err != nil {
+			return fmt.Errorf("failed to wait for credits: %w", err)
+		}
+		conn.pending = append(conn.pending, request)
+	}
+	if err := conn.encoder.Encode(conn.makeRequest(ctx, protocol.RequestDataCmdName, buf)); err != nil {
+		return fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
+	}
+	conn.dataCredits--
+	return nil
+}
+
+func makeAckRequest(credits int) *protocol.Request {
+	buf, _ := json.Marshal(&protocol.AckDataCmd{Credits: credits})
+	return &protocol.Request{Version: protocol.Version, Cmd: protocol.AckDataCmdName, Payload: json.RawMessage(buf)}
+}
+
+// Close puts the connection back to the pool if the command terminates, otherwise closes it
+func (conn *connectorConn) Close() error {
+	if conn.keepAlive && conn.terminated && connectors.put(conn) {
+		return nil
+	}
+	return conn.Conn.Close()
+}
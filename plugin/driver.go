@@ -10,6 +10,21 @@ const (
 	TypePluginKodo   = "kodoplugin.storage.qiniu.com"
 )
 
+// volumeAccessModes are supported by both drivers, except SINGLE_NODE_SINGLE_WRITER of ReadWriteOncePod and SINGLE_NODE_MULTI_WRITER,
+// which require the node capability SINGLE_NODE_MULTI_WRITER never advertised, since a mounter can't tell the workloads writing through it
+var volumeAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// isReaderOnlyAccessMode returns true if the access mode never writes to the volume
+func isReaderOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
 type Runnable interface {
 	Run()
 }
@@ -23,24 +38,25 @@ func newKodoFSDriver(nodeID, endpoint, version string) *KodoFSDriver {
 	driver := &KodoFSDriver{endpoint: endpoint}
 
 	csiDriver := csicommon.NewCSIDriver(TypePluginKodoFS, version, nodeID)
-	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
-	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-	})
+	csiDriver.AddVolumeCapabilityAccessModes(volumeAccessModes)
+	if servesController() {
+		csiDriver.AddControllerServiceCapabilities(orchestrator.controllerCapabilities())
+	}
 	driver.csiDriver = csiDriver
 
 	return driver
 }
 
 func (driver *KodoFSDriver) Run() {
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(driver.endpoint,
-		csicommon.NewDefaultIdentityServer(driver.csiDriver),
-		newKodoFSControllerServer(driver.csiDriver),
-		newKodoFSNodeServer(driver.csiDriver),
-	)
-	s.Wait()
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
+	if servesController() {
+		cs = newKodoFSControllerServer(driver.csiDriver)
+	}
+	if servesNode() {
+		ns = newKodoFSNodeServer(driver.csiDriver)
+	}
+	serveGRPC(driver.endpoint, newIdentityServer(driver.csiDriver), cs, ns)
 }
 
 type KodoDriver struct {
@@ -52,22 +68,23 @@ func newKodoDriver(nodeID, endpoint, version string) *KodoDriver {
 	driver := &KodoDriver{endpoint: endpoint}
 
 	csiDriver := csicommon.NewCSIDriver(TypePluginKodo, version, nodeID)
-	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
-	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-	})
+	csiDriver.AddVolumeCapabilityAccessModes(volumeAccessModes)
+	if servesController() {
+		csiDriver.AddControllerServiceCapabilities(orchestrator.controllerCapabilities())
+	}
 	driver.csiDriver = csiDriver
 
 	return driver
 }
 
 func (driver *KodoDriver) Run() {
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(driver.endpoint,
-		csicommon.NewDefaultIdentityServer(driver.csiDriver),
-		newKodoControllerServer(driver.csiDriver),
-		newKodoNodeServer(driver.csiDriver),
-	)
-	s.Wait()
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
+	if servesController() {
+		cs = newKodoControllerServer(driver.csiDriver)
+	}
+	if servesNode() {
+		ns = newKodoNodeServer(driver.csiDriver)
+	}
+	serveGRPC(driver.endpoint, newIdentityServer(driver.csiDriver), cs, ns)
 }
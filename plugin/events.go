@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// Reason of the event emitted on the PVC if CreateVolume fails
+	EventReasonProvisionFailed = "VolumeProvisionFailed"
+	// Reason of the event emitted on the Pod if NodePublishVolume fails
+	EventReasonMountFailed = "VolumeMountFailed"
+	// Reason of the event emitted on the Pod if the disconnected volume fails to be re-mounted
+	EventReasonRemountFailed = "VolumeRemountFailed"
+	// Reason of the event emitted on the PVC if the usage of the bucket crosses a threshold of its quota
+	EventReasonNearQuota = "VolumeNearQuota"
+	// Longest message of the events, the details are left in the logs of the plugin
+	EventMessageMaxLength = 256
+	// Timeout to get the object of the event from Kubernetes
+	EventObjectTimeout = 10 * time.Second
+)
+
+var (
+	eventRecorderOnce sync.Once
+	eventRecorder     record.EventRecorder
+	eventClient       kubernetes.Interface
+)
+
+// failureCauses are the well-known causes of failures recognized from the error messages, matched in lower case
+var failureCauses = []struct {
+	patterns []string
+	cause    string
+}{
+	{[]string{"nosuchbucket", "no such bucket", "bucket not exist", "bucket doesn't exist"}, "Bucket does not exist"},
+	{[]string{"quota", "too many buckets"}, "Quota exceeded"},
+	{[]string{"invalidaccesskeyid", "signaturedoesnotmatch", "bad token", "invalid accesstoken", "unauthorized"}, "Invalid credentials, please check the secret of the volume"},
+	{[]string{"accessdenied", "access denied", "forbidden", "not permitted"}, "Permission denied, please check the permissions of the credentials"},
+}
+
+// getEventRecorder creates the event recorder on first use, returns nil if the plugin is not running in Kubernetes
+func getEventRecorder() record.EventRecorder {
+	eventRecorderOnce.Do(func() {
+		if orchestrator.name() != OrchestratorKubernetes {
+			return
+		}
+		config, err := kubeConfig()
+		if err != nil {
+			log.Warnf("Events are not emitted: failed to create config: %s", err)
+			return
+		}
+		if eventClient, err = kubernetes.NewForConfig(config); err != nil {
+			log.Warnf("Events are not emitted: failed to create client: %s", err)
+			return
+		}
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: eventClient.CoreV1().Events("")})
+		eventRecorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: *driverName + "-csi-plugin", Host: *nodeID})
+	})
+	return eventRecorder
+}
+
+// reportGRPCFailure emits a warning event with the cause of the failure on the PVC of CreateVolume or on the Pod of NodePublishVolume,
+// so that the users could find out what's wrong by kubectl describe without reading the logs of the plugin
+func reportGRPCFailure(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err == nil {
+		return resp, err
+	}
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		// Given by csi-provisioner with --extra-create-metadata
+		parameters := r.GetParameters()
+		if name, namespace := parameters[FIELD_PVC_NAME], parameters[FIELD_PVC_NAMESPACE]; name != "" && namespace != "" {
+			go emitFailureEvent("PersistentVolumeClaim", namespace, name, EventReasonProvisionFailed, err)
+		}
+	case *csi.NodePublishVolumeRequest:
+		if namespace, name := orchestrator.workload(r.GetVolumeContext()); name != "" && namespace != "" {
+			go emitFailureEvent("Pod", namespace, name, EventReasonMountFailed, err)
+		}
+	}
+	return resp, err
+}
+
+func emitFailureEvent(kind, namespace, name, reason string, err error) {
+	emitWarningEvent(kind, namespace, name, reason, describeFailure(err))
+}
+
+// emitWarningEvent emits a warning event with the message on the PVC or the Pod
+func emitWarningEvent(kind, namespace, name, reason, message string) {
+	recorder := getEventRecorder()
+	if recorder == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EventObjectTimeout)
+	defer cancel()
+
+	var object runtime.Object
+	var getErr error
+	switch kind {
+	case "PersistentVolumeClaim":
+		object, getErr = eventClient.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "Pod":
+		object, getErr = eventClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if getErr != nil {
+		log.Warnf("Failed to get %s %s/%s to emit event: %s", kind, namespace, name, getErr)
+		return
+	}
+	recorder.Event(object, corev1.EventTypeWarning, reason, message)
+}
+
+// describeFailure returns a concise and user-readable cause of the failure
+func describeFailure(err error) string {
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		return "Invalid credentials, please check the secret of the volume"
+	case codes.PermissionDenied:
+		return "Permission denied, please check the permissions of the credentials"
+	}
+	message := err.Error()
+	if s, ok := status.FromError(err); ok {
+		message = s.Message()
+	}
+	lower := strings.ToLower(message)
+	for _, failureCause := range failureCauses {
+		for _, pattern := range failureCause.patterns {
+			if strings.Contains(lower, pattern) {
+				return failureCause.cause
+			}
+		}
+	}
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		message = message[:i]
+	}
+	if len(message) > EventMessageMaxLength {
+		message = message[:EventMessageMaxLength] + "..."
+	}
+	return message
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Reject the Kodo volumes provisioned beyond the quotas of their namespaces, see --kodo-quota-configmap
+	FeatureKodoNamespaceQuota = "KodoNamespaceQuota"
+	// Reject the volumes of the single node access modes published on a second node, see acquirePublishedNode
+	FeatureSingleNodeAccess = "SingleNodeAccess"
+	// Fill in the options of the Kodo volumes by their mount profiles, see --kodo-mount-profiles-configmap
+	FeatureKodoMountProfiles = "KodoMountProfiles"
+)
+
+// pluginFeatureGates are the optional features of the CSI plugins with their defaults, the new features which are risky
+// should be disabled by default until they're proven. They're toggled by --feature-gates or the ConfigMap of --config-configmap.
+var pluginFeatureGates = map[string]bool{
+	FeatureKodoNamespaceQuota: true,
+	FeatureSingleNodeAccess:   true,
+	FeatureKodoMountProfiles:  true,
+}
+
+// featureGatesFlag is the flag of the feature gates, which could be changed by the config reloader while it's read by the RPCs
+type featureGatesFlag struct {
+	value atomic.Value
+}
+
+// featureGatesValue is the value of the flag as given with all the gates it enables
+type featureGatesValue struct {
+	raw   string
+	gates map[string]bool
+}
+
+func newFeatureGatesFlag() *featureGatesFlag {
+	f := &featureGatesFlag{}
+	flag.Var(f, "feature-gates", "Comma separated features of the plugin to toggle as <name>=<bool>, one of "+featureGateNames(pluginFeatureGates))
+	return f
+}
+
+func (f *featureGatesFlag) enabled(name string) bool {
+	if value, ok := f.value.Load().(*featureGatesValue); ok {
+		return value.gates[name]
+	}
+	return pluginFeatureGates[name]
+}
+
+func (f *featureGatesFlag) String() string {
+	if value, ok := f.value.Load().(*featureGatesValue); ok {
+		return value.raw
+	}
+	return ""
+}
+
+// Set replaces all the gates given before, the gates not given are changed back to their defaults
+func (f *featureGatesFlag) Set(s string) error {
+	gates, err := parseFeatureGates(s, pluginFeatureGates)
+	if err != nil {
+		return err
+	}
+	f.value.Store(&featureGatesValue{raw: s, gates: gates})
+	return nil
+}
+
+// parseFeatureGates returns all the known gates by the comma separated <name>=<bool> toggling them, and by their defaults if not given
+func parseFeatureGates(s string, known map[string]bool) (map[string]bool, error) {
+	gates := make(map[string]bool, len(known))
+	for name, enabled := range known {
+		gates[name] = enabled
+	}
+	for _, gate := range strings.Split(s, ",") {
+		if gate = strings.TrimSpace(gate); gate == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(gate, "=")
+		if !ok {
+			return nil, fmt.Errorf("feature gate must be <name>=<bool>: %s", gate)
+		} else if _, ok = known[name]; !ok {
+			return nil, fmt.Errorf("unrecognized feature gate %s, must be one of %s", name, featureGateNames(known))
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of feature gate %s: %s", name, value)
+		}
+		gates[name] = enabled
+	}
+	return gates, nil
+}
+
+func featureGateNames(known map[string]bool) string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
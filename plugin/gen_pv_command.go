@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// GenPvCommand is the subcommand generating the manifests of a statically provisioned Kodo volume
+const GenPvCommand = "gen-pv"
+
+// placeholderSecrets let the volume attributes be validated without the secret, whose keys and UC endpoint are read on the nodes
+var placeholderSecrets = map[string]string{FIELD_ACCESS_KEY: "-", FIELD_SECRET_KEY: "-", FIELD_UC_ENDPOINT: "https://uc.qiniuapi.com"}
+
+// attributeFlags collects the repeated -attribute key=value flags
+type attributeFlags map[string]string
+
+func (attributes attributeFlags) String() string {
+	pairs := make([]string, 0, len(attributes))
+	for key, value := range attributes {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (attributes attributeFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("expected key=value, got %s", s)
+	}
+	attributes[strings.ToLower(strings.TrimSpace(key))] = value
+	return nil
+}
+
+// runGenPv prints the PV and the PVC bound to each other for an existing bucket, returns the exit code
+func runGenPv(args []string) int {
+	attributes := make(attributeFlags)
+	flagSet := flag.NewFlagSet(GenPvCommand, flag.ContinueOnError)
+	bucket := flagSet.String("bucket", "", "Name of the existing Kodo bucket")
+	region := flagSet.String("region", "", "Kodo region id of the bucket, e.g. z0")
+	secret := flagSet.String("secret", "", "Secret with accesskey, secretkey and ucendpoint used to mount the volume, as <namespace>/<name> or <name> in the namespace of the PVC")
+	name := flagSet.String("name", "", "Name of the PV, also used as its volumeHandle, kodo-<bucket> by default")
+	pvcName := flagSet.String("pvc-name", "", "Name of the PVC, the name of the PV by default")
+	namespace := flagSet.String("namespace", "default", "Namespace of the PVC")
+	capacity := flagSet.String("capacity", "5Gi", "Capacity of the PV, which is not enforced by Kodo")
+	readOnly := flagSet.Bool("read-only", false, "Mount the volume read-only")
+	flagSet.Var(attributes, "attribute", "Extra volume attribute as key=value, e.g. vfscachemode=writes, could be repeated")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s -bucket <bucket> -region <region> -secret [<namespace>/]<name> [flags] > pv.yaml\n", filepath.Base(os.Args[0]), GenPvCommand)
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	} else if *bucket == "" || *region == "" || *secret == "" || flagSet.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "-bucket, -region and -secret are required\n")
+		flagSet.Usage()
+		return 2
+	}
+
+	pv, pvc, err := newStaticKodoVolume(&staticKodoVolume{
+		name: *name, pvcName: *pvcName, namespace: *namespace, capacity: *capacity,
+		bucket: *bucket, region: *region, secret: *secret, readOnly: *readOnly, attributes: attributes,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	for i, object := range []interface{}{pv, pvc} {
+		manifest, err := marshalManifest(object)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to marshal manifest: %s\n", err)
+			return 1
+		}
+		if i > 0 {
+			fmt.Println("---")
+		}
+		os.Stdout.Write(manifest)
+	}
+	return 0
+}
+
+type staticKodoVolume struct {
+	name, pvcName, namespace, capacity string
+	bucket, region, secret             string
+	readOnly                           bool
+	attributes                         map[string]string
+}
+
+// newStaticKodoVolume returns the PV and the PVC of the volume, which are bound to each other by claimRef and volumeName,
+// so that neither of them is bound to another one
+func newStaticKodoVolume(v *staticKodoVolume) (*corev1.PersistentVolume, *corev1.PersistentVolumeClaim, error) {
+	if v.name == "" {
+		v.name = "kodo-" + strings.ToLower(v.bucket)
+	}
+	if v.pvcName == "" {
+		v.pvcName = v.name
+	}
+	// The volume id is joined into the paths of the caches and logs on the nodes, which is safe for the names of the PVs
+	for _, object := range []struct{ kind, name string }{{"PV", v.name}, {"PVC", v.pvcName}, {"namespace", v.namespace}} {
+		if errs := validation.IsDNS1123Subdomain(object.name); len(errs) > 0 {
+			return nil, nil, fmt.Errorf("invalid %s name %s: %s", object.kind, object.name, strings.Join(errs, ", "))
+		}
+	}
+	quantity, err := resource.ParseQuantity(v.capacity)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid capacity %s: %w", v.capacity, err)
+	}
+	secretRef := &corev1.SecretReference{Namespace: v.namespace, Name: v.secret}
+	if namespace, name, ok := strings.Cut(v.secret, "/"); ok {
+		secretRef.Namespace, secretRef.Name = namespace, name
+	}
+	if errs := validation.IsDNS1123Subdomain(secretRef.Name); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid secret name %s: %s", secretRef.Name, strings.Join(errs, ", "))
+	}
+
+	volumeAttributes := make(map[string]string, len(v.attributes)+3)
+	for key, value := range v.attributes {
+		volumeAttributes[key] = value
+	}
+	volumeAttributes[FIELD_BUCKET_NAME] = v.bucket
+	volumeAttributes[FIELD_REGION] = v.region
+	if v.readOnly {
+		volumeAttributes[FIELD_READ_ONLY] = "true"
+	}
+	if _, err = parseKodoStorageClassParameter(GenPvCommand, volumeAttributes, placeholderSecrets); err != nil {
+		return nil, nil, err
+	}
+
+	pv := &corev1.PersistentVolume{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{Name: v.name},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      corev1.ResourceList{corev1.ResourceStorage: quantity},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              "",
+			ClaimRef:                      &corev1.ObjectReference{Namespace: v.namespace, Name: v.pvcName},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver:               TypePluginKodo,
+				VolumeHandle:         v.name,
+				ReadOnly:             v.readOnly,
+				VolumeAttributes:     volumeAttributes,
+				NodePublishSecretRef: secretRef,
+			}},
+		},
+	}
+	storageClassName := ""
+	pvc := &corev1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{Name: v.pvcName, Namespace: v.namespace},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			StorageClassName: &storageClassName,
+			VolumeName:       v.name,
+			Resources:        corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: quantity}},
+		},
+	}
+	return pv, pvc, nil
+}
+
+// marshalManifest marshals the object into YAML without the status and the creation timestamp, which are never applied
+func marshalManifest(object interface{}) ([]byte, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]interface{}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	delete(manifest, "status")
+	if metadata, ok := manifest["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "creationTimestamp")
+	}
+	return yaml.Marshal(manifest)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Timeout to stat the mount point, a FUSE file system whose daemon is stuck never responds
+const MountPointStatTimeout = 10 * time.Second
+
+// errMountPointDisconnected is returned by statMountPoint if the FUSE daemon of the mount point is gone
+var errMountPointDisconnected = errors.New("mount point is disconnected")
+
+// nodeCapabilities are advertised by both node servers, so that kubelet reports the volume conditions as events on the Pods
+var nodeCapabilities = []*csi.NodeServiceCapability{
+	{Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS}}},
+	{Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION}}},
+}
+
+// volumeCondition returns the condition of the volume by the error of the health check
+func volumeCondition(err error) *csi.VolumeCondition {
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: describeFailure(err)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "Volume is healthy"}
+}
+
+// nodeGetVolumeStats checks whether the volume is still mounted by the FUSE file system of the type and responds,
+// the usage is reported by the file system itself
+func nodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest, fsType string) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: volumePath is empty")
+	}
+	if mounted, err := isMounted(volumePath, fsType); err != nil {
+		if _, statErr := os.Lstat(volumePath); os.IsNotExist(statErr) {
+			return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: %s does not exist", volumePath)
+		}
+		return nil, fmt.Errorf("NodeGetVolumeStats: failed to detect mount point %s: %w", volumePath, err)
+	} else if !mounted {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: volumeCondition(fmt.Errorf("volume is not mounted on %s, please recreate the Pod", volumePath)),
+		}, nil
+	}
+
+	statfs, err := statMountPoint(ctx, volumePath)
+	if err != nil {
+		logger(ctx).Warnf("NodeGetVolumeStats: mount point %s is unhealthy: %s", volumePath, err)
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: volumeCondition(err)}, nil
+	}
+	blockSize := int64(statfs.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * blockSize,
+				Available: int64(statfs.Bavail) * blockSize,
+				Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(statfs.Files),
+				Available: int64(statfs.Ffree),
+				Used:      int64(statfs.Files - statfs.Ffree),
+			},
+		},
+		VolumeCondition: volumeCondition(nil),
+	}, nil
+}
+
+// statMountPoint stats the mount point in background, so that a stuck mount point is reported instead of blocking the RPC
+func statMountPoint(ctx context.Context, mountPath string) (*unix.Statfs_t, error) {
+	type result struct {
+		statfs unix.Statfs_t
+		err    error
+	}
+	resultChan := make(chan *result, 1)
+	go func() {
+		var r result
+		r.err = unix.Statfs(mountPath, &r.statfs)
+		resultChan <- &r
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, MountPointStatTimeout)
+	defer cancel()
+	select {
+	case r := <-resultChan:
+		if errors.Is(r.err, unix.ENOTCONN) {
+			return nil, fmt.Errorf("%w, the mounter may have exited, please recreate the Pod", errMountPointDisconnected)
+		} else if r.err != nil {
+			return nil, fmt.Errorf("failed to stat mount point: %w", r.err)
+		}
+		return &r.statfs, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("mount point does not respond in %s", MountPointStatTimeout)
+	}
+}
+
+// getPersistentVolume gets the volume by the volume id, which is the name of the dynamically provisioned volumes,
+// or the volume handle of the statically provisioned ones
+func getPersistentVolume(ctx context.Context, client kubernetes.Interface, driverName, volumeId string) (*corev1.PersistentVolume, error) {
+	pv, err := client.CoreV1().PersistentVolumes().Get(ctx, volumeId, metav1.GetOptions{})
+	if err == nil && pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName && pv.Spec.CSI.VolumeHandle == volumeId {
+		return pv, nil
+	} else if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		if csiSource := pvs.Items[i].Spec.CSI; csiSource != nil && csiSource.Driver == driverName && csiSource.VolumeHandle == volumeId {
+			return &pvs.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// getNodePublishSecrets gets the secrets of the statically provisioned volume, which are not given to the controller
+func getNodePublishSecrets(ctx context.Context, client kubernetes.Interface, pv *corev1.PersistentVolume) (map[string]string, error) {
+	ref := pv.Spec.CSI.NodePublishSecretRef
+	if ref == nil {
+		return nil, nil
+	}
+	secret, err := client.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get secret %s/%s from Kubernetes error: %w", ref.Namespace, ref.Name, err)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		secrets[key] = string(value)
+	}
+	return secrets, nil
+}
+
+// publishedNodeIds returns the nodes the volume is published on recorded by the node servers, the node ids are the node names.
+// VolumeAttachments are not created since the CSIDriver doesn't require attaching, so the volumes published before
+// the nodes are recorded are published on the nodes running the Pods which use them.
+func publishedNodeIds(ctx context.Context, client kubernetes.Interface, pv *corev1.PersistentVolume) ([]string, error) {
+	if _, ok := pv.Annotations[PublishedNodesAnnotation]; ok {
+		return parsePublishedNodes(pv), nil
+	}
+	claimRef := pv.Spec.ClaimRef
+	if claimRef == nil {
+		return nil, nil
+	}
+	pods, err := client.CoreV1().Pods(claimRef.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var nodeIds []string
+	published := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || published[pod.Spec.NodeName] || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimRef.Name {
+				published[pod.Spec.NodeName] = true
+				nodeIds = append(nodeIds, pod.Spec.NodeName)
+				break
+			}
+		}
+	}
+	return nodeIds, nil
+}
+
+// controllerGetVolume responds ControllerGetVolume with the condition checked by the driver
+func controllerGetVolume(ctx context.Context, client kubernetes.Interface, driverName, volumeId string,
+	check func(pv *corev1.PersistentVolume) error) (*csi.ControllerGetVolumeResponse, error) {
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume: volumeId is empty")
+	}
+	pv, err := getPersistentVolume(ctx, client, driverName, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("ControllerGetVolume: get volume %s info from Kubernetes error: %w", volumeId, err)
+	} else if pv == nil {
+		return nil, status.Errorf(codes.NotFound, "ControllerGetVolume: volume %s does not exist", volumeId)
+	}
+	nodeIds, err := publishedNodeIds(ctx, client, pv)
+	if err != nil {
+		return nil, fmt.Errorf("ControllerGetVolume: list Pods using volume %s from Kubernetes error: %w", volumeId, err)
+	}
+	nodes, err := getNodeReadiness(ctx, client)
+	if err != nil {
+		logger(ctx).Warnf("ControllerGetVolume: failed to list nodes to check the nodes volume %s is published on: %s", volumeId, err)
+	}
+	if err = check(pv); err == nil {
+		err = checkPublishedNodes(nodeIds, nodes)
+	}
+	if err != nil {
+		logger(ctx).Warnf("ControllerGetVolume: volume %s is unhealthy: %s", volumeId, err)
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeId,
+			CapacityBytes: pv.Spec.Capacity.Storage().Value(),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: nodeIds,
+			VolumeCondition:  volumeCondition(err),
+		},
+	}, nil
+}
+
+// listVolumes responds ListVolumes with the PVs of the driver sorted by their names, each page starts from the PV named by the token,
+// and the nodes the volumes are published on are found as ControllerGetVolume does. The volumes not published are reported healthy unchecked.
+func listVolumes(ctx context.Context, client kubernetes.Interface, driverName string, req *csi.ListVolumesRequest,
+	check func(pv *corev1.PersistentVolume) error) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ListVolumes: max entries %d is negative", req.GetMaxEntries())
+	}
+	pvList, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("ListVolumes: list PVs from Kubernetes error: %w", err)
+	}
+	var pvs []*corev1.PersistentVolume
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if csiSource := pv.Spec.CSI; csiSource != nil && csiSource.Driver == driverName && pv.Name >= req.GetStartingToken() {
+			pvs = append(pvs, pv)
+		}
+	}
+	if req.GetStartingToken() != "" && len(pvs) == 0 {
+		return nil, status.Errorf(codes.Aborted, "ListVolumes: no volume is left from starting token %s", req.GetStartingToken())
+	}
+	sort.Slice(pvs, func(i, j int) bool { return pvs[i].Name < pvs[j].Name })
+
+	resp := &csi.ListVolumesResponse{}
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && len(pvs) > maxEntries {
+		resp.NextToken = pvs[maxEntries].Name
+		pvs = pvs[:maxEntries]
+	}
+	nodes, err := getNodeReadiness(ctx, client)
+	if err != nil {
+		logger(ctx).Warnf("ListVolumes: failed to list nodes to check the nodes the volumes are published on: %s", err)
+	}
+	for _, pv := range pvs {
+		nodeIds, err := publishedNodeIds(ctx, client, pv)
+		if err != nil {
+			return nil, fmt.Errorf("ListVolumes: list Pods using volume %s from Kubernetes error: %w", pv.Spec.CSI.VolumeHandle, err)
+		}
+		// Only the published volumes are checked by the driver, since the health monitor polls all the volumes periodically,
+		// and the check reads the secrets and calls the APIs of Kodo for each volume
+		if len(nodeIds) > 0 {
+			if err = check(pv); err == nil {
+				err = checkPublishedNodes(nodeIds, nodes)
+			}
+		}
+		if err != nil {
+			logger(ctx).Warnf("ListVolumes: volume %s is unhealthy: %s", pv.Spec.CSI.VolumeHandle, err)
+		}
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      pv.Spec.CSI.VolumeHandle,
+				CapacityBytes: pv.Spec.Capacity.Storage().Value(),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: nodeIds,
+				VolumeCondition:  volumeCondition(err),
+			},
+		})
+	}
+	return resp, nil
+}
+
+// getNodeReadiness returns whether each node in the cluster is ready by its name
+func getNodeReadiness(ctx context.Context, client kubernetes.Interface) (map[string]bool, error) {
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	readiness := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		readiness[node.Name] = false
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == corev1.NodeReady {
+				readiness[node.Name] = condition.Status == corev1.ConditionTrue
+			}
+		}
+	}
+	return readiness, nil
+}
+
+// checkPublishedNodes fails if the volume is still published on the nodes deleted or not ready, whose Pods are likely gone
+// without unpublishing it, which is never checked if the nodes are unknown
+func checkPublishedNodes(nodeIds []string, readiness map[string]bool) error {
+	if readiness == nil {
+		return nil
+	}
+	for _, nodeId := range nodeIds {
+		if ready, ok := readiness[nodeId]; !ok {
+			return fmt.Errorf("volume is published on node %s, which no longer exists", nodeId)
+		} else if !ready {
+			return fmt.Errorf("volume is published on node %s, which is not ready", nodeId)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestPersistentVolume(name string, annotations map[string]string, claimName string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: TypePluginKodo, VolumeHandle: name},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: claimName},
+		},
+	}
+}
+
+func newTestReadyNode(name string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+			{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+		}},
+	}
+}
+
+func TestListVolumesChecksPublishedVolumes(t *testing.T) {
+	client := kubefake.NewSimpleClientset(
+		newTestPersistentVolume("annotated", map[string]string{PublishedNodesAnnotation: "node-1"}, "annotated"),
+		// Published before the nodes are recorded, found by the Pods using it
+		newTestPersistentVolume("legacy", nil, "legacy"),
+		newTestPersistentVolume("unpublished", map[string]string{PublishedNodesAnnotation: ""}, "unpublished"),
+		newTestReadyNode("node-1"),
+		newTestReadyNode("node-2"),
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+			Spec: corev1.PodSpec{
+				NodeName: "node-2",
+				Volumes: []corev1.Volume{{Name: "volume", VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "legacy"},
+				}}},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+	)
+
+	var checked []string
+	resp, err := listVolumes(context.Background(), client, TypePluginKodo, &csi.ListVolumesRequest{}, func(pv *corev1.PersistentVolume) error {
+		checked = append(checked, pv.Name)
+		if pv.Name == "legacy" {
+			return errors.New("bucket does not exist")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %s", err)
+	}
+	if expected := []string{"annotated", "legacy"}; !reflect.DeepEqual(checked, expected) {
+		t.Fatalf("expected volumes %v checked, got %v", expected, checked)
+	}
+
+	expected := map[string]struct {
+		nodeIds  []string
+		abnormal bool
+	}{
+		"annotated":   {nodeIds: []string{"node-1"}},
+		"legacy":      {nodeIds: []string{"node-2"}, abnormal: true},
+		"unpublished": {},
+	}
+	if len(resp.Entries) != len(expected) {
+		t.Fatalf("expected %d volumes listed, got %d", len(expected), len(resp.Entries))
+	}
+	for _, entry := range resp.Entries {
+		volumeId, status := entry.GetVolume().GetVolumeId(), entry.GetStatus()
+		if !reflect.DeepEqual(status.GetPublishedNodeIds(), expected[volumeId].nodeIds) {
+			t.Errorf("expected volume %s published on %v, got %v", volumeId, expected[volumeId].nodeIds, status.GetPublishedNodeIds())
+		}
+		if status.GetVolumeCondition().GetAbnormal() != expected[volumeId].abnormal {
+			t.Errorf("expected volume %s abnormal %t, got condition %v", volumeId, expected[volumeId].abnormal, status.GetVolumeCondition())
+		}
+	}
+}
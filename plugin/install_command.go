@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// InstallCommand is the subcommand rendering the manifests to install the drivers
+	InstallCommand = "install"
+	// Image of the drivers installed by default, which is released together with the manifests under ./k8s
+	DefaultInstallImage = "kodoproduct/csi-plugin.storage.qiniu.com:v0.1.1"
+	// Root directory of kubelet on most distributions
+	DefaultKubeletDir = "/var/lib/kubelet"
+	// Key of the startup taint removed by the node plugins is <CSI driver name>/agent-not-ready, see --startup-taint
+	StartupTaintSuffix = "agent-not-ready"
+
+	// The CSI plugins are privileged and install the connector onto the nodes from the containers
+	SecurityProfilePrivileged = "privileged"
+	// No container is privileged, the capabilities are added only to the containers requiring them,
+	// and the volumes are unmounted by the connector, see --unprivileged
+	SecurityProfileRestricted = "restricted"
+)
+
+//go:embed manifests/*.yaml.tmpl
+var manifestTemplates embed.FS
+
+// installFeatureGates are the optional features of the manifests with their defaults
+var installFeatureGates = map[string]bool{
+	// Serve Prometheus metrics from the CSI plugins
+	"Metrics": true,
+	// Deploy external-health-monitor with csi-provisioner to report the abnormal volumes
+	"HealthMonitor": true,
+	// Unmount Kodo volumes without waiting for the write-back cache to be uploaded, see --kodo-lazy-unmount
+	"KodoLazyUnmount": false,
+	// Deploy the validating admission webhook of the StorageClasses and the PVCs, which requires cert-manager for its certificate
+	"AdmissionWebhook": false,
+}
+
+// allInstallFeatureGates returns the gates of the manifests together with the ones of the CSI plugins, which are passed by --feature-gates of the plugins
+func allInstallFeatureGates() map[string]bool {
+	gates := make(map[string]bool, len(installFeatureGates)+len(pluginFeatureGates))
+	for name, enabled := range installFeatureGates {
+		gates[name] = enabled
+	}
+	for name, enabled := range pluginFeatureGates {
+		gates[name] = enabled
+	}
+	return gates
+}
+
+// installDriver is a driver whose manifests are rendered
+type installDriver struct {
+	name, csiDriverName     string
+	healthPort, metricsPort int
+}
+
+var installDrivers = []installDriver{
+	{KodoDriverName, TypePluginKodo, 11261, 11271},
+	{KodoFSDriverName, TypePluginKodoFS, 11262, 11272},
+}
+
+// manifestValues are the values of the manifest templates of a driver
+type manifestValues struct {
+	Driver, CSIDriverName  string
+	Namespace              string
+	Image, ImagePullPolicy string
+	KubeletDir             string
+	DefaultKubeletDir      string
+	HealthPort             int
+	// Arguments of the node plugins of the DaemonSet and the controller plugins of the Deployment
+	PluginArgs, ControllerArgs []string
+	HealthMonitor              bool
+	// Restricted is the restricted security profile
+	Restricted          bool
+	InstallConnector    bool
+	FuseDeviceResource  string
+	OpenShift           bool
+	AllowedCapabilities []string
+}
+
+// installOptions are the validated flags of install render
+type installOptions struct {
+	drivers                []installDriver
+	namespace              string
+	image, imagePullPolicy string
+	kubeletDir             string
+	featureGates           map[string]bool
+	// Gates of the CSI plugins changed from their defaults as <name>=<bool>
+	pluginFeatureGates []string
+	securityProfile    string
+	installConnector   bool
+	fuseDeviceResource string
+	openShift          bool
+}
+
+// runInstall renders the manifests of the drivers to stdout or to a directory for each driver, returns the exit code
+func runInstall(args []string) int {
+	if len(args) == 0 || args[0] != "render" {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s render [flags] | kubectl apply -f -\n", filepath.Base(os.Args[0]), InstallCommand)
+		return 2
+	}
+	flagSet := flag.NewFlagSet(InstallCommand+" render", flag.ContinueOnError)
+	driver := flagSet.String("driver", "all", "Driver to install, kodo, kodofs or all")
+	namespace := flagSet.String("namespace", "kube-system", "Namespace of the CSI plugins and the provisioners")
+	image := flagSet.String("image", DefaultInstallImage, "Image of the CSI plugins")
+	imagePullPolicy := flagSet.String("image-pull-policy", string(corev1.PullAlways), "Pull policy of the image of the CSI plugins, Always, IfNotPresent or Never")
+	kubeletDir := flagSet.String("kubelet-dir", DefaultKubeletDir, "Root directory of kubelet on the nodes, e.g. /var/lib/k0s/kubelet for k0s")
+	featureGates := flagSet.String("feature-gates", "", "Comma separated features to toggle as <name>=<bool>, one of "+featureGateNames(allInstallFeatureGates()))
+	securityProfile := flagSet.String("security-profile", SecurityProfilePrivileged, "Security profile of the pods, privileged or restricted, which runs no privileged container for the clusters rejecting them, e.g. OpenShift")
+	installConnector := flagSet.Bool("install-connector", true, "Install the connector onto the nodes from the pods of the CSI plugins, otherwise it must be installed beforehand, e.g. by MachineConfig of OpenShift")
+	fuseDeviceResource := flagSet.String("fuse-device-resource", "", "Extended resource of the device plugin providing /dev/fuse, e.g. smarter-devices/fuse, requested by the containers mounting FUSE instead of the device of the node")
+	openShift := flagSet.Bool("openshift", false, "Also render the SecurityContextConstraints allowing exactly what the pods require and granted to their service account")
+	outputDir := flagSet.String("output-dir", "", "Directory to write <driver>/<driver>-{plugin,provisioner,rbac,webhook}.yaml into instead of printing them to stdout")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 2
+	}
+	options, err := parseInstallOptions(*driver, *namespace, *image, *imagePullPolicy, *kubeletDir, *featureGates, *securityProfile, *fuseDeviceResource)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	options.installConnector, options.openShift = *installConnector, *openShift
+
+	for i, driver := range options.drivers {
+		manifests, err := renderManifests(driver, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render manifests of %s: %s\n", driver.name, err)
+			return 1
+		}
+		if *outputDir == "" {
+			for j, manifest := range manifests {
+				if i > 0 || j > 0 {
+					fmt.Println("---")
+				}
+				// The documents are separated already by the lines above
+				os.Stdout.Write(bytes.TrimPrefix(manifest.content, []byte("---\n")))
+			}
+			continue
+		}
+		dir := filepath.Join(*outputDir, driver.name)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %s\n", dir, err)
+			return 1
+		}
+		for _, manifest := range manifests {
+			if err = os.WriteFile(filepath.Join(dir, manifest.name), manifest.content, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write manifest: %s\n", err)
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+func parseInstallOptions(driver, namespace, image, imagePullPolicy, kubeletDir, featureGates, securityProfile, fuseDeviceResource string) (*installOptions, error) {
+	options := &installOptions{namespace: namespace, image: image, imagePullPolicy: imagePullPolicy,
+		securityProfile: securityProfile, fuseDeviceResource: fuseDeviceResource}
+	for _, d := range installDrivers {
+		if driver == "all" || driver == d.name {
+			options.drivers = append(options.drivers, d)
+		}
+	}
+	if len(options.drivers) == 0 {
+		return nil, fmt.Errorf("-driver must be one of kodo, kodofs and all")
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid namespace %s: %s", namespace, strings.Join(errs, ", "))
+	}
+	if image == "" || strings.ContainsAny(image, " \t\n\"'") {
+		return nil, fmt.Errorf("invalid image %q", image)
+	}
+	switch corev1.PullPolicy(imagePullPolicy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return nil, fmt.Errorf("-image-pull-policy must be one of Always, IfNotPresent and Never")
+	}
+	// Joined into the paths and the endpoints of the CSI sockets, which must be absolute
+	if !path.IsAbs(kubeletDir) || strings.ContainsAny(kubeletDir, " \t\n\"'") {
+		return nil, fmt.Errorf("-kubelet-dir must be an absolute path")
+	} else if options.kubeletDir = path.Clean(kubeletDir); options.kubeletDir == "/" {
+		return nil, fmt.Errorf("-kubelet-dir must not be /")
+	}
+	if securityProfile != SecurityProfilePrivileged && securityProfile != SecurityProfileRestricted {
+		return nil, fmt.Errorf("-security-profile must be either %s or %s", SecurityProfilePrivileged, SecurityProfileRestricted)
+	}
+	// Extended resources are always prefixed by the domain of the device plugin
+	if fuseDeviceResource != "" {
+		if errs := validation.IsQualifiedName(fuseDeviceResource); len(errs) > 0 || !strings.Contains(fuseDeviceResource, "/") {
+			return nil, fmt.Errorf("-fuse-device-resource must be an extended resource as <domain>/<name>: %s", fuseDeviceResource)
+		}
+	}
+
+	gates, err := parseFeatureGates(featureGates, allInstallFeatureGates())
+	if err != nil {
+		return nil, err
+	}
+	options.featureGates = gates
+	for name, enabled := range gates {
+		if defaultEnabled, ok := pluginFeatureGates[name]; ok && enabled != defaultEnabled {
+			options.pluginFeatureGates = append(options.pluginFeatureGates, name+"="+strconv.FormatBool(enabled))
+		}
+	}
+	sort.Strings(options.pluginFeatureGates)
+	return options, nil
+}
+
+type renderedManifest struct {
+	name    string
+	content []byte
+}
+
+// renderManifests renders the manifests of the driver in the order they should be applied
+func renderManifests(driver installDriver, options *installOptions) ([]renderedManifest, error) {
+	commonArgs := []string{
+		"--endpoint=$(CSI_ENDPOINT)",
+		"--v=2",
+		"--nodeid=$(KUBE_NODE_NAME)",
+		"--driver=" + driver.name,
+		fmt.Sprintf("--health-port=%d", driver.healthPort),
+	}
+	if options.featureGates["Metrics"] {
+		commonArgs = append(commonArgs, fmt.Sprintf("--metrics-address=:%d", driver.metricsPort))
+	}
+	if len(options.pluginFeatureGates) > 0 {
+		commonArgs = append(commonArgs, "--feature-gates="+strings.Join(options.pluginFeatureGates, ","))
+	}
+	pluginArgs := append([]string{"--mode=" + ModeNode}, commonArgs...)
+	pluginArgs = append(pluginArgs, "--startup-taint="+driver.csiDriverName+"/"+StartupTaintSuffix)
+	controllerArgs := append([]string{"--mode=" + ModeController}, commonArgs...)
+	restricted := options.securityProfile == SecurityProfileRestricted
+	if restricted {
+		pluginArgs = append(pluginArgs, "--unprivileged")
+	}
+	if driver.name == KodoDriverName {
+		pluginArgs = append(pluginArgs, "--kodo-flush-timeout=5m")
+		if options.featureGates["KodoLazyUnmount"] {
+			pluginArgs = append(pluginArgs, "--kodo-lazy-unmount")
+		}
+		controllerArgs = append(controllerArgs, "--kodo-reconcile-interval=1h")
+	}
+	values := &manifestValues{
+		Driver:             driver.name,
+		CSIDriverName:      driver.csiDriverName,
+		Namespace:          options.namespace,
+		Image:              options.image,
+		ImagePullPolicy:    options.imagePullPolicy,
+		KubeletDir:         options.kubeletDir,
+		DefaultKubeletDir:  DefaultKubeletDir,
+		HealthPort:         driver.healthPort,
+		PluginArgs:         pluginArgs,
+		ControllerArgs:     controllerArgs,
+		HealthMonitor:      options.featureGates["HealthMonitor"],
+		Restricted:         restricted,
+		InstallConnector:   options.installConnector,
+		FuseDeviceResource: options.fuseDeviceResource,
+		OpenShift:          options.openShift,
+	}
+	if !restricted {
+		values.AllowedCapabilities = []string{"SYS_ADMIN"}
+	} else if options.installConnector {
+		// nsenter of the init container enters the namespaces of the node to restart the connector there
+		values.AllowedCapabilities = []string{"SYS_ADMIN", "SYS_CHROOT", "SYS_PTRACE"}
+	} else if driver.name == KodoFSDriverName {
+		// The KodoFS controller mounts the volumes in its container to clean them up when deleted
+		values.AllowedCapabilities = []string{"SYS_ADMIN"}
+	}
+
+	templates, err := template.New("").Funcs(template.FuncMap{"quote": strconv.Quote}).ParseFS(manifestTemplates, "manifests/*.yaml.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	var manifests []renderedManifest
+	names := []string{"rbac", "plugin", "provisioner"}
+	if options.featureGates["AdmissionWebhook"] {
+		names = append(names, "webhook")
+	}
+	for _, name := range names {
+		var buf bytes.Buffer
+		if err = templates.ExecuteTemplate(&buf, name+".yaml.tmpl", values); err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, renderedManifest{name: driver.name + "-" + name + ".yaml", content: buf.Bytes()})
+	}
+	return manifests, nil
+}
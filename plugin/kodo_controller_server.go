@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -14,61 +15,95 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 type kodoControllerServer struct {
 	volumes     map[string]*csi.Volume
 	volumesLock sync.Mutex
 	client      kubernetes.Interface
+	// Accounts creating IAM users for volumes, see kodo_reconciler.go
+	accounts      map[string]*kodoAccount
+	accountsLock  sync.Mutex
+	reconcileOnce sync.Once
+	// Exports the storage usage of volumes, see kodo_usage.go
+	usageExporterOnce sync.Once
+	// Highest thresholds of the bucket quotas warned by volume, only accessed by the usage exporter
+	quotaAlerted map[string]float64
+	// Counts the volumes provisioned in every namespace if --kodo-quota-configmap is given, nil otherwise, see kodo_quota.go
+	quota *kodoQuotaTracker
 	*csicommon.DefaultControllerServer
 }
 
 func newKodoControllerServer(d *csicommon.CSIDriver) csi.ControllerServer {
-	config, err := rest.InClusterConfig()
+	clientset, err := orchestrator.kubernetesClient()
 	if err != nil {
-		log.Fatalf("newKodoControllerServer: failed to create config: %v", err)
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatalf("newKodoControllerServer: failed to create client: %v", err)
+		log.Fatalf("newKodoControllerServer: %v", err)
 	}
 
 	c := &kodoControllerServer{
 		volumes:                 make(map[string]*csi.Volume),
 		client:                  clientset,
+		accounts:                make(map[string]*kodoAccount),
+		quotaAlerted:            make(map[string]float64),
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 	}
+	if *kodoQuotaConfigMap != "" {
+		c.quota = newKodoQuotaTracker()
+	}
 	return c
 }
 
 func (cs *kodoControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := requireKubernetes("CreateVolume", cs.client); err != nil {
+		return nil, err
+	}
 	pvName := req.GetName()
-	log.Infof("CreateVolume: starting creating Kodo bucket %s", pvName)
+	logger(ctx).Infof("CreateVolume: starting creating Kodo bucket %s", pvName)
 
 	cs.volumesLock.Lock()
 	defer cs.volumesLock.Unlock()
 
 	if volume, exists := cs.volumes[pvName]; exists {
-		log.Warnf("CreateVolume: bucket %s already exists", pvName)
+		logger(ctx).Warnf("CreateVolume: bucket %s already exists", pvName)
 		return &csi.CreateVolumeResponse{Volume: volume}, nil
 	}
 
 	parameter, err := parseKodoStorageClassParameter("CreateVolume", req.GetParameters(), req.GetSecrets())
 	if err != nil {
 		return nil, err
+	} else if parameter.backend != KODO_BACKEND_KODO {
+		// No bucket could be created without the Kodo APIs, the buckets of the S3-compatible storages are mounted by static volumes
+		return nil, fmt.Errorf("CreateVolume: buckets can only be created with %s %s, create a static volume for the existing bucket instead",
+			FIELD_BACKEND, KODO_BACKEND_KODO)
+	} else if parameter.apiMode != KODO_API_MODE_NATIVE {
+		if parameter.ucEndpoint == nil {
+			return nil, fmt.Errorf("CreateVolume: %s is required to create bucket", FIELD_UC_ENDPOINT)
+		}
+		return nil, fmt.Errorf("CreateVolume: buckets can only be created by the native Kodo APIs, but %s is %s", FIELD_API_MODE, parameter.apiMode)
+	} else if parameter.accessKey == "" || parameter.secretKey == "" {
+		return nil, fmt.Errorf("CreateVolume: both %s and %s are required to create bucket", FIELD_ACCESS_KEY, FIELD_SECRET_KEY)
+	} else if err = cs.checkQuota(ctx, parameter.pvcNamespace, req.GetCapacityRange().GetRequiredBytes()); err != nil {
+		return nil, err
+	} else if err = cs.checkMountProfile(ctx, parameter.mountProfile, req.GetParameters(), req.GetSecrets()); err != nil {
+		return nil, err
+	}
+	cs.startReconciler()
+	cs.startUsageExporter()
+	client := qiniu.NewKodoClient(parameter.accessKey, parameter.secretKey, parameter.ucEndpoint, parameter.tlsConfig(), VERSION, COMMITID)
+	if err = client.VerifyCredentials(ctx); err != nil {
+		return nil, verifyCredentialsError("CreateVolume", err, FIELD_UC_ENDPOINT)
 	}
-	client := qiniu.NewKodoClient(parameter.accessKey, parameter.secretKey, parameter.ucEndpoint, VERSION, COMMITID)
 
 	bucketName := pvName + "-" + randomBucketName(16)
-	bucket, err := client.FindBucketByName(ctx, bucketName, false)
+	// The bucket list is cached for --kodo-api-cache-ttl, while the new bucket is always looked up again after created
+	bucket, err := client.FindBucketByName(ctx, bucketName, true)
 	if err != nil {
 		return nil, fmt.Errorf("CreateVolume: find bucket %s error: %w", bucketName, err)
 	} else if bucket == nil {
 		if err = client.CreateBucket(ctx, bucketName, parameter.region); err != nil {
 			return nil, fmt.Errorf("CreateVolume: create bucket %s error: %w", bucketName, err)
 		}
-		log.Infof("CreateVolume: Kodo bucket %s is created", bucketName)
+		logger(ctx).WithField("bucket", bucketName).Infof("CreateVolume: Kodo bucket %s is created", bucketName)
 		if bucket, err = client.FindBucketByName(ctx, bucketName, false); err != nil {
 			return nil, fmt.Errorf("CreateVolume: find bucket %s error: %w", bucketName, err)
 		} else if bucket == nil {
@@ -76,51 +111,85 @@ func (cs *kodoControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		}
 	} else {
 		parameter.region = bucket.KodoRegionID
-		log.Infof("CreateVolume: Kodo bucket %s has been created, reuse it", bucketName)
+		logger(ctx).WithField("bucket", bucketName).Infof("CreateVolume: Kodo bucket %s has been created, reuse it", bucketName)
 	}
 
-	s3Endpoint, err := client.GetS3Endpoint(ctx, parameter.region)
-	if err != nil {
-		return nil, fmt.Errorf("CreateVolume: get s3 endpoint of %s error: %w", parameter.region, err)
-	} else if s3Endpoint == nil {
-		return nil, fmt.Errorf("CreateVolume: cannot get s3 endpoint of %s", parameter.region)
+	s3Endpoint := parameter.s3Endpoint
+	if s3Endpoint == nil {
+		if s3Endpoint, err = client.GetS3Endpoint(ctx, parameter.region); err != nil {
+			return nil, fmt.Errorf("CreateVolume: get s3 endpoint of %s error: %w", parameter.region, err)
+		} else if s3Endpoint == nil {
+			return nil, fmt.Errorf("CreateVolume: cannot get s3 endpoint of %s", parameter.region)
+		}
 	}
 
-	s3RegionId, err := client.FromKodoRegionIDToS3RegionID(ctx, parameter.region)
-	if err != nil {
-		return nil, fmt.Errorf("CreateVolume: get s3 region id %s error: %w", parameter.region, err)
-	} else if s3RegionId == nil {
-		return nil, fmt.Errorf("CreateVolume: cannot get s3 region id %s", parameter.region)
+	s3RegionId := parameter.s3Region
+	if s3RegionId == "" {
+		if s3Region, err := client.FromKodoRegionIDToS3RegionID(ctx, parameter.region); err != nil {
+			return nil, fmt.Errorf("CreateVolume: get s3 region id %s error: %w", parameter.region, err)
+		} else if s3Region == nil {
+			return nil, fmt.Errorf("CreateVolume: cannot get s3 region id %s", parameter.region)
+		} else {
+			s3RegionId = *s3Region
+		}
 	}
 
 	iamUserName := pvName
 	iamPolicyName := normalizePolicyName(pvName)
 	originalAccessKey, originalSecretKey := parameter.accessKey, parameter.secretKey
-	if err = client.CreateIAMUser(context.Background(), iamUserName, randomPassword(128)); err != nil {
+	account := newKodoAccount(originalAccessKey, originalSecretKey, parameter)
+	cs.rememberAccount(account)
+	if source := parameter.credentialSource(); source != nil {
+		// Nodes mount the volume by temporary credentials, no static keys are kept in the volume
+		logger(ctx).WithField("bucket", bucket.Name).Infof("CreateVolume: Kodo bucket %s is accessed by temporary credentials from %s", bucket.Name, source.Type)
+	} else if err = cs.recordIAMUser(ctx, iamUserName, account); err != nil {
+		return nil, fmt.Errorf("CreateVolume: record IAM user %s error: %w", iamUserName, err)
+	} else if err = client.CreateIAMUser(ctx, iamUserName, randomPassword(128)); err != nil {
 		return nil, fmt.Errorf("CreateVolume: create IAM user %s error: %w", iamUserName, err)
-	} else if parameter.accessKey, parameter.secretKey, err = client.GetIAMUserKeyPair(context.Background(), iamUserName); err != nil {
+	} else if parameter.accessKey, parameter.secretKey, err = client.GetIAMUserKeyPair(ctx, iamUserName); err != nil {
 		return nil, fmt.Errorf("CreateVolume: create key pair for IAM user %s error: %w", iamUserName, err)
 	} else if err = client.CreateIAMPolicy(ctx, iamPolicyName, bucket.Name); err != nil {
 		return nil, fmt.Errorf("CreateVolume: create IAM policy %s error: %w", iamPolicyName, err)
 	} else if err = client.GrantIAMPolicyToUser(ctx, iamUserName, []string{iamPolicyName}); err != nil {
 		return nil, fmt.Errorf("CreateVolume: grant IAM policy %s to %s error: %w", iamPolicyName, iamUserName, err)
 	} else {
-		log.Infof("CreateVolume: Kodo bucket %s is granted", bucket.Name)
+		logger(ctx).WithField("bucket", bucket.Name).Infof("CreateVolume: Kodo bucket %s is granted", bucket.Name)
 	}
 
 	volumeContext := map[string]string{
-		FIELD_BUCKET_ID:           bucket.ID,
-		FIELD_BUCKET_NAME:         bucket.Name,
-		FIELD_S3_ENDPOINT:         s3Endpoint.String(),
-		FIELD_S3_REGION:           *s3RegionId,
-		FIELD_ACCESS_KEY:          parameter.accessKey,
-		FIELD_SECRET_KEY:          parameter.secretKey,
-		FIELD_ORIGINAL_ACCESS_KEY: originalAccessKey,
-		FIELD_ORIGINAL_SECRET_KEY: originalSecretKey,
-		FIELD_UC_ENDPOINT:         parameter.ucEndpoint.String(),
-		FIELD_REGION:              parameter.region,
-		FIELD_STORAGE_CLASS:       parameter.storageClass,
-		FIELD_VFS_CACHE_MODE:      parameter.vfsCacheMode.String(),
+		FIELD_BUCKET_ID:      bucket.ID,
+		FIELD_BUCKET_NAME:    bucket.Name,
+		FIELD_S3_ENDPOINT:    s3Endpoint.String(),
+		FIELD_S3_REGION:      s3RegionId,
+		FIELD_UC_ENDPOINT:    parameter.ucEndpoint.String(),
+		FIELD_REGION:         parameter.region,
+		FIELD_STORAGE_CLASS:  parameter.storageClass,
+		FIELD_VFS_CACHE_MODE: parameter.vfsCacheMode.String(),
+	}
+	if parameter.s3InternalEndpoint != nil {
+		volumeContext[FIELD_S3_INTERNAL_ENDPOINT] = parameter.s3InternalEndpoint.String()
+	}
+	if parameter.s3AccelerateEndpoint != nil {
+		volumeContext[FIELD_S3_ACCELERATE_ENDPOINT] = parameter.s3AccelerateEndpoint.String()
+	}
+	if parameter.stsEndpoint != nil {
+		volumeContext[FIELD_STS_ENDPOINT] = parameter.stsEndpoint.String()
+	} else if parameter.instanceRole != "" {
+		volumeContext[FIELD_INSTANCE_ROLE] = parameter.instanceRole
+	} else if parameter.accessKeyFile != "" {
+		volumeContext[FIELD_ACCESS_KEY_FILE] = parameter.accessKeyFile
+		volumeContext[FIELD_SECRET_KEY_FILE] = parameter.secretKeyFile
+		if parameter.sessionTokenFile != "" {
+			volumeContext[FIELD_SESSION_TOKEN_FILE] = parameter.sessionTokenFile
+		}
+	} else {
+		volumeContext[FIELD_ACCESS_KEY] = parameter.accessKey
+		volumeContext[FIELD_SECRET_KEY] = parameter.secretKey
+		volumeContext[FIELD_ORIGINAL_ACCESS_KEY] = originalAccessKey
+		volumeContext[FIELD_ORIGINAL_SECRET_KEY] = originalSecretKey
+	}
+	if parameter.s3SignatureVersion != "" {
+		volumeContext[FIELD_S3_SIGNATURE_VERSION] = parameter.s3SignatureVersion.String()
 	}
 	if parameter.dirCacheDuration != nil {
 		volumeContext[FIELD_DIR_CACHE_DURATION] = parameter.dirCacheDuration.String()
@@ -194,17 +263,112 @@ func (cs *kodoControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 	if parameter.debugFuse {
 		volumeContext[FIELD_DEBUG_FUSE] = formatBool(parameter.debugFuse)
 	}
+	if parameter.httpProxy != nil {
+		volumeContext[FIELD_HTTP_PROXY] = parameter.httpProxy.String()
+	}
+	if parameter.httpsProxy != nil {
+		volumeContext[FIELD_HTTPS_PROXY] = parameter.httpsProxy.String()
+	}
+	if parameter.noProxy != "" {
+		volumeContext[FIELD_NO_PROXY] = parameter.noProxy
+	}
+	if parameter.caCert != "" {
+		volumeContext[FIELD_CA_CERT] = parameter.caCert
+	}
+	if parameter.insecureSkipVerify {
+		volumeContext[FIELD_INSECURE_SKIP_VERIFY] = formatBool(parameter.insecureSkipVerify)
+	}
+	if parameter.retries != nil {
+		volumeContext[FIELD_RETRIES] = formatUint(*parameter.retries)
+	}
+	if parameter.lowLevelRetries != nil {
+		volumeContext[FIELD_LOW_LEVEL_RETRIES] = formatUint(*parameter.lowLevelRetries)
+	}
+	if parameter.connectTimeout != nil {
+		volumeContext[FIELD_CONNECT_TIMEOUT] = parameter.connectTimeout.String()
+	}
+	if parameter.timeout != nil {
+		volumeContext[FIELD_TIMEOUT] = parameter.timeout.String()
+	}
+	if parameter.writeCache {
+		volumeContext[FIELD_WRITE_CACHE] = formatBool(parameter.writeCache)
+	}
+	if parameter.writeCacheSyncInterval != nil {
+		volumeContext[FIELD_WRITE_CACHE_SYNC_INTERVAL] = parameter.writeCacheSyncInterval.String()
+	}
+	if len(parameter.prewarm) > 0 {
+		volumeContext[FIELD_PREWARM] = strings.Join(parameter.prewarm, ",")
+	}
+	if parameter.prewarmManifest != "" {
+		volumeContext[FIELD_PREWARM_MANIFEST] = parameter.prewarmManifest
+	}
+	if parameter.syncMode {
+		volumeContext[FIELD_SYNC_MODE] = formatBool(parameter.syncMode)
+	}
+	if parameter.syncBack {
+		volumeContext[FIELD_SYNC_BACK] = formatBool(parameter.syncBack)
+	}
+	if parameter.syncBackInterval != nil {
+		volumeContext[FIELD_SYNC_BACK_INTERVAL] = parameter.syncBackInterval.String()
+	}
+	if parameter.mountCheck != "" {
+		volumeContext[FIELD_MOUNT_CHECK] = parameter.mountCheck.String()
+	}
+	if parameter.persistentDirCache != nil {
+		volumeContext[FIELD_PERSISTENT_DIR_CACHE] = parameter.persistentDirCache.String()
+	}
+	if len(parameter.hostAliases) > 0 {
+		volumeContext[FIELD_HOST_ALIASES] = formatHostAliases(parameter.hostAliases)
+	}
+	if len(parameter.nameservers) > 0 {
+		volumeContext[FIELD_NAMESERVERS] = strings.Join(parameter.nameservers, ",")
+	}
+	if parameter.mounterMemoryLimit != nil {
+		volumeContext[FIELD_MOUNTER_MEMORY_LIMIT] = formatUint(*parameter.mounterMemoryLimit)
+	}
+	if parameter.mounterCpuLimit != nil {
+		volumeContext[FIELD_MOUNTER_CPU_LIMIT] = formatFloat(*parameter.mounterCpuLimit)
+	}
+	if parameter.mounterCpuWeight != nil {
+		volumeContext[FIELD_MOUNTER_CPU_WEIGHT] = formatUint(*parameter.mounterCpuWeight)
+	}
+	if parameter.mounterIoWeight != nil {
+		volumeContext[FIELD_MOUNTER_IO_WEIGHT] = formatUint(*parameter.mounterIoWeight)
+	}
+	if parameter.integrityManifest != "" {
+		volumeContext[FIELD_INTEGRITY_MANIFEST] = parameter.integrityManifest
+	}
+	if parameter.integrityCheck != "" {
+		volumeContext[FIELD_INTEGRITY_CHECK] = parameter.integrityCheck.String()
+	}
+	if parameter.mountProfile != "" {
+		volumeContext[FIELD_MOUNT_PROFILE] = parameter.mountProfile
+		if !hasField(req.GetParameters(), FIELD_VFS_CACHE_MODE) {
+			// The cache mode of the profile is applied on mount instead of the default one
+			delete(volumeContext, FIELD_VFS_CACHE_MODE)
+		}
+	}
+	if parameter.pvcName != "" {
+		volumeContext[FIELD_PVC_NAME] = parameter.pvcName
+	}
+	if parameter.pvcNamespace != "" {
+		volumeContext[FIELD_PVC_NAMESPACE] = parameter.pvcNamespace
+	}
 	volume := &csi.Volume{
 		CapacityBytes: int64(req.GetCapacityRange().GetRequiredBytes()),
 		VolumeId:      pvName,
 		VolumeContext: volumeContext,
 	}
 	cs.volumes[pvName] = volume
+	cs.countCreatedVolume(pvName, parameter.pvcNamespace, volume.CapacityBytes)
 	return &csi.CreateVolumeResponse{Volume: volume}, nil
 }
 
 func (cs *kodoControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeId := req.GetVolumeId()
+	if err := requireKubernetes("DeleteVolume", cs.client); err != nil {
+		return nil, err
+	}
 
 	pvInfo, err := cs.client.CoreV1().PersistentVolumes().Get(ctx, volumeId, metav1.GetOptions{})
 	if err != nil {
@@ -217,28 +381,40 @@ func (cs *kodoControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 
 	persistentVolumeReclaimPolicy := pvInfo.Spec.PersistentVolumeReclaimPolicy
 	if persistentVolumeReclaimPolicy != "" {
-		log.Infof("DeleteVolume: starting deleting Kodo volume %s (%s)", volumeId, persistentVolumeReclaimPolicy)
+		logger(ctx).Infof("DeleteVolume: starting deleting Kodo volume %s (%s)", volumeId, persistentVolumeReclaimPolicy)
 	} else {
-		log.Infof("DeleteVolume: starting deleting Kodo volume %s", volumeId)
+		logger(ctx).Infof("DeleteVolume: starting deleting Kodo volume %s", volumeId)
 	}
 
 	cs.volumesLock.Lock()
 	defer cs.volumesLock.Unlock()
 
 	delete(cs.volumes, volumeId)
+	cs.startReconciler()
+	cs.startUsageExporter()
 
-	client := qiniu.NewKodoClient(parameter.originalAccessKey, parameter.originalSecretKey, parameter.ucEndpoint, VERSION, COMMITID)
-	iamUserName := volumeId
-	iamPolicyName := normalizePolicyName(volumeId)
+	if parameter.apiMode != KODO_API_MODE_NATIVE {
+		// Neither the IAM user nor the bucket is created by the driver without the native Kodo APIs
+		logger(ctx).WithField("bucket", parameter.bucketName).Infof("DeleteVolume: bucket %s of %s %s is kept", parameter.bucketName, FIELD_API_MODE, parameter.apiMode)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 
-	if err = client.RevokeIAMPolicyFromUser(ctx, iamUserName, []string{iamPolicyName}); err != nil {
-		return nil, fmt.Errorf("DeleteVolume: revoke IAM policy %s from %s error: %w", iamPolicyName, iamUserName, err)
-	} else if err = client.DeleteIAMPolicy(ctx, iamPolicyName); err != nil {
-		return nil, fmt.Errorf("DeleteVolume: delete IAM policy %s error: %w", iamPolicyName, err)
-	} else if err = client.DeleteIAMUser(ctx, iamUserName); err != nil {
-		return nil, fmt.Errorf("DeleteVolume: delete IAM user %s error: %w", iamUserName, err)
+	originalAccessKey, originalSecretKey := parameter.originalAccessKey, parameter.originalSecretKey
+	if parameter.credentialSource() != nil {
+		// No IAM user is created for volumes accessed by temporary credentials, the keys come from the provisioner secret
+		originalAccessKey, originalSecretKey = parameter.accessKey, parameter.secretKey
+	}
+	client := qiniu.NewKodoClient(originalAccessKey, originalSecretKey, parameter.ucEndpoint, parameter.tlsConfig(), VERSION, COMMITID)
+	if parameter.credentialSource() != nil {
+		logger(ctx).WithField("bucket", parameter.bucketName).Infof("DeleteVolume: Kodo bucket %s is accessed by temporary credentials, no IAM user to revoke", parameter.bucketName)
 	} else {
-		log.Infof("DeleteVolume: Kodo bucket %s is revoked", parameter.bucketName)
+		cs.rememberAccount(newKodoAccount(originalAccessKey, originalSecretKey, &parameter.kodoStorageClassParameter))
+		if err = revokeKodoVolumeCredentials(ctx, client, volumeId); err != nil {
+			return nil, fmt.Errorf("DeleteVolume: %w", err)
+		} else if err = cs.forgetIAMUser(ctx, volumeId); err != nil {
+			logger(ctx).Warnf("DeleteVolume: failed to forget IAM user %s: %s", volumeId, err)
+		}
+		logger(ctx).WithField("bucket", parameter.bucketName).Infof("DeleteVolume: Kodo bucket %s is revoked", parameter.bucketName)
 	}
 
 	if persistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimDelete {
@@ -247,18 +423,87 @@ func (cs *kodoControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		} else if err = client.DeleteBucket(ctx, parameter.bucketName); err != nil {
 			return nil, fmt.Errorf("DeleteVolume: failed to delete bucket %s", parameter.bucketName)
 		} else {
-			log.Infof("DeleteVolume: Kodo bucket %s is deleted", parameter.bucketName)
+			logger(ctx).WithField("bucket", parameter.bucketName).Infof("DeleteVolume: Kodo bucket %s is deleted", parameter.bucketName)
 		}
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+func (cs *kodoControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	var readOnly, syncBack bool
+	for key, value := range req.GetVolumeContext() {
+		switch strings.ToLower(key) {
+		case FIELD_READ_ONLY:
+			readOnly, _ = parseBool(value)
+		case FIELD_SYNC_BACK:
+			syncBack, _ = parseBool(value)
+		}
+	}
+	return validateVolumeCapabilities(cs.Driver, req, func(capability *csi.VolumeCapability) string {
+		mode := capability.GetAccessMode().GetMode()
+		if readOnly && !isReaderOnlyAccessMode(mode) {
+			return fmt.Sprintf("access mode %s is not supported, the volume is mounted by %s", mode, FIELD_READ_ONLY)
+		} else if syncBack && mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			// Each node copies its own copy of the bucket back, which overwrites the changes of the others
+			return fmt.Sprintf("access mode %s is not supported, the copies of the volume on the nodes are copied back by %s", mode, FIELD_SYNC_BACK)
+		}
+		return ""
+	})
+}
+
 func (cs *kodoControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest,
 ) (*csi.ControllerExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (cs *kodoControllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume is called by the external-health-monitor, which emits events on the PVCs if the volumes are abnormal
+func (cs *kodoControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := requireKubernetes("ControllerGetVolume", cs.client); err != nil {
+		return nil, err
+	}
+	return controllerGetVolume(ctx, cs.client, TypePluginKodo, req.GetVolumeId(), func(pv *corev1.PersistentVolume) error {
+		return cs.checkVolume(ctx, pv)
+	})
+}
+
+// ListVolumes is called by the external-health-monitor instead of ControllerGetVolume, which lists the volumes published on the nodes
+// deleted or not ready as abnormal, so the volumes left published by the failed nodes are noticed
+func (cs *kodoControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := requireKubernetes("ListVolumes", cs.client); err != nil {
+		return nil, err
+	}
+	return listVolumes(ctx, cs.client, TypePluginKodo, req, func(pv *corev1.PersistentVolume) error {
+		return cs.checkVolume(ctx, pv)
+	})
+}
+
+// checkVolume checks whether the credentials used to mount the volume are still valid and the bucket still exists
+func (cs *kodoControllerServer) checkVolume(ctx context.Context, pv *corev1.PersistentVolume) error {
+	secrets, err := getNodePublishSecrets(ctx, cs.client, pv)
+	if err != nil {
+		return err
+	}
+	parameter, err := parseKodoPvParameter("ControllerGetVolume", pv.Spec.CSI.VolumeAttributes, secrets)
+	if err != nil {
+		return err
+	} else if parameter.credentialSource() != nil || parameter.accessKey == "" {
+		// Temporary credentials are issued to the nodes on mount, which cannot be checked by the controller
+		return nil
+	} else if parameter.apiMode != KODO_API_MODE_NATIVE {
+		// The credentials are verified by the UC API of Kodo, which is not used by the volume
+		return nil
+	}
+	client := qiniu.NewKodoClient(parameter.accessKey, parameter.secretKey, parameter.ucEndpoint, parameter.tlsConfig(), VERSION, COMMITID)
+	if err = client.VerifyCredentials(ctx); err != nil {
+		return fmt.Errorf("credentials of the volume are rejected: %w", err)
+	}
+	if parameter.bucketName != "" {
+		if bucket, err := client.FindBucketByName(ctx, parameter.bucketName, false); err != nil {
+			return fmt.Errorf("failed to find bucket %s: %w", parameter.bucketName, err)
+		} else if bucket == nil {
+			return fmt.Errorf("no such bucket: %s", parameter.bucketName)
+		}
+	}
+	return nil
 }
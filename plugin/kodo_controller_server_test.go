@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	csitesting "github.com/qiniu/csi-driver/internal/testing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestKodoControllerServer returns the controller calling the mock Kodo API and the fake Kubernetes API,
+// no reconciler or usage exporter is started in the background
+func newTestKodoControllerServer(t *testing.T) (*kodoControllerServer, *csitesting.MockKodo) {
+	reconcileInterval, usageInterval := *kodoReconcileInterval, *kodoUsageInterval
+	*kodoReconcileInterval, *kodoUsageInterval = 0, 0
+	kodo := csitesting.NewMockKodo()
+	t.Cleanup(func() {
+		*kodoReconcileInterval, *kodoUsageInterval = reconcileInterval, usageInterval
+		kodo.Close()
+	})
+	return &kodoControllerServer{
+		volumes:      make(map[string]*csi.Volume),
+		client:       kubefake.NewSimpleClientset(),
+		accounts:     make(map[string]*kodoAccount),
+		quotaAlerted: make(map[string]float64),
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(
+			csicommon.NewCSIDriver("kodoplugin.storage.qiniu.com", "test", "controller")),
+	}, kodo
+}
+
+func newKodoCreateVolumeRequest(kodo *csitesting.MockKodo, name string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+		Parameters: map[string]string{FIELD_UC_ENDPOINT: kodo.URL(), FIELD_REGION: csitesting.MockKodoRegion},
+		Secrets:    map[string]string{FIELD_ACCESS_KEY: "access-key", FIELD_SECRET_KEY: "secret-key"},
+	}
+}
+
+// saveProvisionedVolume saves the volume provisioned by the controller to Kubernetes as csi-provisioner does
+func saveProvisionedVolume(t *testing.T, cs *kodoControllerServer, volume *csi.Volume, policy corev1.PersistentVolumeReclaimPolicy) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: volume.VolumeId},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: policy,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver: TypePluginKodo, VolumeHandle: volume.VolumeId, VolumeAttributes: volume.VolumeContext,
+			}},
+		},
+	}
+	if _, err := cs.client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to save volume %s: %s", volume.VolumeId, err)
+	}
+}
+
+// recordedIAMUsers returns the IAM users recorded by the controller to be reconciled
+func recordedIAMUsers(t *testing.T, cs *kodoControllerServer) map[string]string {
+	configMap, err := cs.client.CoreV1().ConfigMaps(podNamespace()).Get(context.Background(), KodoIAMUsersConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get %s: %s", KodoIAMUsersConfigMapName, err)
+	}
+	return configMap.Data
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("no error is returned, expected %s", code)
+	} else if actual := status.Code(err); actual != code {
+		t.Fatalf("error of code %s is returned, expected %s: %s", actual, code, err)
+	}
+}
+
+func TestKodoControllerServerCreateAndDeleteVolume(t *testing.T) {
+	cs, kodo := newTestKodoControllerServer(t)
+	req := newKodoCreateVolumeRequest(kodo, "pv-1")
+
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	bucket := kodo.FindBucket("pv-1")
+	if bucket == nil {
+		t.Fatalf("no bucket is created for the volume")
+	} else if bucket.Region != csitesting.MockKodoRegion {
+		t.Fatalf("bucket is created in %s, expected %s", bucket.Region, csitesting.MockKodoRegion)
+	}
+	volume := resp.GetVolume()
+	if volume.VolumeId != "pv-1" || volume.CapacityBytes != 1<<30 {
+		t.Fatalf("unexpected volume: %v", volume)
+	}
+	for field, expected := range map[string]string{
+		FIELD_BUCKET_ID:           bucket.ID,
+		FIELD_BUCKET_NAME:         bucket.Name,
+		FIELD_S3_REGION:           csitesting.MockKodoS3Region,
+		FIELD_S3_ENDPOINT:         kodo.URL(),
+		FIELD_ACCESS_KEY:          "ak-pv-1",
+		FIELD_SECRET_KEY:          "sk-pv-1",
+		FIELD_ORIGINAL_ACCESS_KEY: "access-key",
+		FIELD_ORIGINAL_SECRET_KEY: "secret-key",
+	} {
+		if actual := volume.VolumeContext[field]; actual != expected {
+			t.Fatalf("%s of the volume is %q, expected %q", field, actual, expected)
+		}
+	}
+	if users := kodo.Users(); len(users) != 1 || users[0] != "pv-1" {
+		t.Fatalf("IAM users %v are created, expected pv-1", users)
+	} else if _, recorded := recordedIAMUsers(t, cs)["pv-1"]; !recorded {
+		t.Fatalf("IAM user of the volume is not recorded")
+	}
+
+	// Retried by csi-provisioner, the same volume is returned
+	if resp, err = cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to create volume again: %s", err)
+	} else if resp.GetVolume() != volume {
+		t.Fatalf("another volume %v is created", resp.GetVolume())
+	} else if buckets := kodo.Buckets(); len(buckets) != 1 {
+		t.Fatalf("%d buckets are created, expected 1", len(buckets))
+	}
+
+	saveProvisionedVolume(t, cs, volume, corev1.PersistentVolumeReclaimDelete)
+	if _, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pv-1", Secrets: req.Secrets}); err != nil {
+		t.Fatalf("failed to delete volume: %s", err)
+	}
+	if buckets := kodo.Buckets(); len(buckets) != 0 {
+		t.Fatalf("buckets %v are left after the volume is deleted", buckets)
+	} else if users := kodo.Users(); len(users) != 0 {
+		t.Fatalf("IAM users %v are left after the volume is deleted", users)
+	} else if _, recorded := recordedIAMUsers(t, cs)["pv-1"]; recorded {
+		t.Fatalf("IAM user deleted is still recorded")
+	}
+}
+
+func TestKodoControllerServerDeleteVolumeRetainsBucket(t *testing.T) {
+	cs, kodo := newTestKodoControllerServer(t)
+	req := newKodoCreateVolumeRequest(kodo, "pv-1")
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+
+	saveProvisionedVolume(t, cs, resp.GetVolume(), corev1.PersistentVolumeReclaimRetain)
+	if _, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pv-1", Secrets: req.Secrets}); err != nil {
+		t.Fatalf("failed to delete volume: %s", err)
+	}
+	// Only the credentials of the volume are revoked
+	if kodo.FindBucket("pv-1") == nil {
+		t.Fatalf("retained bucket is deleted")
+	} else if users := kodo.Users(); len(users) != 0 {
+		t.Fatalf("IAM users %v are left after the volume is deleted", users)
+	}
+}
+
+func TestKodoControllerServerCreateVolumeFailsByKodo(t *testing.T) {
+	for name, test := range map[string]struct {
+		fail func(kodo *csitesting.MockKodo)
+		code codes.Code
+	}{
+		"wrong credentials":         {fail: func(kodo *csitesting.MockKodo) { kodo.FailAuth(401) }, code: codes.Unauthenticated},
+		"credentials not permitted": {fail: func(kodo *csitesting.MockKodo) { kodo.FailAuth(403) }, code: codes.PermissionDenied},
+		"too many buckets":          {fail: func(kodo *csitesting.MockKodo) { kodo.FailQuota() }, code: codes.Unknown},
+		"IAM unavailable": {fail: func(kodo *csitesting.MockKodo) {
+			kodo.Fail("/iam/", 400, "IAM is not enabled")
+		}, code: codes.Unknown},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cs, kodo := newTestKodoControllerServer(t)
+			req := newKodoCreateVolumeRequest(kodo, "pv-1")
+
+			test.fail(kodo)
+			_, err := cs.CreateVolume(context.Background(), req)
+			expectCode(t, err, test.code)
+			if users := kodo.Users(); len(users) != 0 {
+				t.Fatalf("IAM users %v are created by the failed request", users)
+			} else if _, remembered := cs.volumes["pv-1"]; remembered {
+				t.Fatalf("volume failed to be created is remembered")
+			}
+
+			// Retried by csi-provisioner once Kodo recovers
+			kodo.Recover()
+			if _, err = cs.CreateVolume(context.Background(), req); err != nil {
+				t.Fatalf("failed to create volume once Kodo recovers: %s", err)
+			} else if kodo.FindBucket("pv-1") == nil {
+				t.Fatalf("no bucket is created once Kodo recovers")
+			}
+		})
+	}
+}
+
+func TestKodoControllerServerCreateVolumeRejectsInvalidRequests(t *testing.T) {
+	for name, modify := range map[string]func(req *csi.CreateVolumeRequest){
+		"no secret key": func(req *csi.CreateVolumeRequest) { delete(req.Secrets, FIELD_SECRET_KEY) },
+		"no uc endpoint": func(req *csi.CreateVolumeRequest) {
+			delete(req.Parameters, FIELD_UC_ENDPOINT)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cs, kodo := newTestKodoControllerServer(t)
+			req := newKodoCreateVolumeRequest(kodo, "pv-1")
+			modify(req)
+			if _, err := cs.CreateVolume(context.Background(), req); err == nil {
+				t.Fatalf("invalid request is created")
+			} else if buckets := kodo.Buckets(); len(buckets) != 0 {
+				t.Fatalf("buckets %v are created by the invalid request", buckets)
+			}
+		})
+	}
+}
+
+func TestKodoControllerServerDeleteVolumeFailsByKodo(t *testing.T) {
+	cs, kodo := newTestKodoControllerServer(t)
+	req := newKodoCreateVolumeRequest(kodo, "pv-1")
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	deleteReq := &csi.DeleteVolumeRequest{VolumeId: "pv-1", Secrets: req.Secrets}
+
+	// Not saved to Kubernetes yet
+	if _, err = cs.DeleteVolume(context.Background(), deleteReq); err == nil {
+		t.Fatalf("volume unknown to Kubernetes is deleted")
+	}
+
+	saveProvisionedVolume(t, cs, resp.GetVolume(), corev1.PersistentVolumeReclaimDelete)
+	kodo.Fail("/drop/", 400, "bucket is in use")
+	if _, err = cs.DeleteVolume(context.Background(), deleteReq); err == nil {
+		t.Fatalf("volume is deleted even though the bucket fails to be dropped")
+	} else if kodo.FindBucket("pv-1") == nil {
+		t.Fatalf("bucket failed to be dropped is gone")
+	}
+
+	// Retried by csi-provisioner, the IAM user revoked already is no longer found
+	kodo.Recover()
+	if _, err = cs.DeleteVolume(context.Background(), deleteReq); err != nil {
+		t.Fatalf("failed to delete volume once Kodo recovers: %s", err)
+	} else if buckets := kodo.Buckets(); len(buckets) != 0 {
+		t.Fatalf("buckets %v are left after the volume is deleted", buckets)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Annotations of the Kodo PVs with their estimated monthly costs in the currency of the pricing table
+	KodoCostAnnotation         = "csi.qiniu.com/estimated-monthly-cost"
+	KodoStorageCostAnnotation  = "csi.qiniu.com/estimated-monthly-storage-cost"
+	KodoTransferCostAnnotation = "csi.qiniu.com/estimated-monthly-transfer-cost"
+	// Query of the bytes transferred by the mounters of every volume on all nodes in the last 30 days, exported by the connectors
+	KodoTransferQuery = "sum by (volume_id) (increase(qiniu_csi_connector_volume_transferred_bytes_total[30d]))"
+	// Timeout of the query of the transferred bytes
+	KodoTransferQueryTimeout = 30 * time.Second
+)
+
+// kodoPricing is the pricing table loaded from --kodo-pricing-config, the prices are per GiB
+type kodoPricing struct {
+	Currency string `json:"currency"`
+	// Price of storing one GiB for a month by the storage class, e.g. STANDARD or LINE
+	StoragePerGiBMonth map[string]float64 `json:"storage_per_gib_month"`
+	// Price of transferring one GiB from or to Kodo
+	TransferPerGiB float64 `json:"transfer_per_gib"`
+}
+
+// kodoPricingTable estimates the costs of the Kodo volumes if --kodo-pricing-config is given, nil otherwise
+var kodoPricingTable *kodoPricing
+
+func loadKodoPricing(path string) (*kodoPricing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	var pricing kodoPricing
+	if err = decoder.Decode(&pricing); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	} else if len(pricing.StoragePerGiBMonth) == 0 {
+		return nil, fmt.Errorf("no storage_per_gib_month is given in %s", path)
+	} else if pricing.TransferPerGiB < 0 {
+		return nil, fmt.Errorf("invalid transfer_per_gib %g in %s", pricing.TransferPerGiB, path)
+	}
+	prices := make(map[string]float64, len(pricing.StoragePerGiBMonth))
+	for storageClass, price := range pricing.StoragePerGiBMonth {
+		if price < 0 {
+			return nil, fmt.Errorf("invalid storage_per_gib_month %g of %s in %s", price, storageClass, path)
+		}
+		prices[strings.ToUpper(storageClass)] = price
+	}
+	pricing.StoragePerGiBMonth = prices
+	return &pricing, nil
+}
+
+func (pricing *kodoPricing) format(cost float64) string {
+	return strings.TrimSpace(fmt.Sprintf("%.2f %s", cost, pricing.Currency))
+}
+
+// annotateVolumeCost annotates the PV with the monthly cost of storing the used bytes in the storage class,
+// and of transferring the bytes in the last 30 days if known
+func (cs *kodoControllerServer) annotateVolumeCost(ctx context.Context, pv *corev1.PersistentVolume, storageClass string, usedBytes int64, transferredBytes map[string]float64) error {
+	price, ok := kodoPricingTable.StoragePerGiBMonth[strings.ToUpper(storageClass)]
+	if !ok {
+		return fmt.Errorf("no price of storage class %s", storageClass)
+	}
+	storageCost := float64(usedBytes) / (1 << 30) * price
+	costs := map[string]string{
+		KodoStorageCostAnnotation:  kodoPricingTable.format(storageCost),
+		KodoCostAnnotation:         kodoPricingTable.format(storageCost),
+		KodoTransferCostAnnotation: "",
+	}
+	if transferredBytes != nil {
+		// The volume never mounted in the last 30 days transfers nothing
+		transferCost := transferredBytes[pv.Spec.CSI.VolumeHandle] / (1 << 30) * kodoPricingTable.TransferPerGiB
+		costs[KodoTransferCostAnnotation] = kodoPricingTable.format(transferCost)
+		costs[KodoCostAnnotation] = kodoPricingTable.format(storageCost + transferCost)
+	}
+	// The transfer cost is removed if it's unknown now
+	return cs.updateVolumeAnnotations(ctx, pv, costs)
+}
+
+// queryKodoTransferredBytes queries the bytes transferred by the mounters of every volume in the last 30 days from the Prometheus
+// given by --kodo-transfer-prometheus-url by the volume id
+func queryKodoTransferredBytes(ctx context.Context) (map[string]float64, error) {
+	type ResponseBody struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, KodoTransferQueryTimeout)
+	defer cancel()
+	u := strings.TrimSuffix(*kodoTransferPrometheusUrl, "/") + "/api/v1/query?" + url.Values{"query": {KodoTransferQuery}}.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("query Prometheus error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response of Prometheus error: %w", err)
+	}
+	var responseBody ResponseBody
+	if err = json.Unmarshal(body, &responseBody); err != nil {
+		return nil, fmt.Errorf("parse response of Prometheus error: status code %d: %w", resp.StatusCode, err)
+	} else if responseBody.Status != "success" {
+		return nil, fmt.Errorf("query Prometheus error: %s", responseBody.Error)
+	}
+
+	transferredBytes := make(map[string]float64, len(responseBody.Data.Result))
+	for _, result := range responseBody.Data.Result {
+		if len(result.Value) != 2 {
+			continue
+		}
+		// The value is a pair of the time and the number in string
+		if value, ok := result.Value[1].(string); ok {
+			if bytes, err := strconv.ParseFloat(value, 64); err == nil {
+				transferredBytes[result.Metric["volume_id"]] = bytes
+			}
+		}
+	}
+	log.Debugf("ExportUsage: transferred bytes of %d volumes are queried from Prometheus", len(transferredBytes))
+	return transferredBytes, nil
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
-	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	k8smount "k8s.io/utils/mount"
@@ -15,14 +15,17 @@ import (
 
 type kodoNodeServer struct {
 	k8smounter k8smount.Interface
+	watchdog   *remountWatchdog
 	*csicommon.DefaultNodeServer
 }
 
 func newKodoNodeServer(d *csicommon.CSIDriver) csi.NodeServer {
-	return &kodoNodeServer{
+	server := &kodoNodeServer{
 		k8smounter:        k8smount.New(""),
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 	}
+	server.watchdog = newRemountWatchdog(FuseTypeKodo, *remountInterval, server.mount)
+	return server
 }
 
 func (server *kodoNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -30,28 +33,65 @@ func (server *kodoNodeServer) NodePublishVolume(ctx context.Context, req *csi.No
 	if mountPath == "" {
 		return nil, errors.New("NodePublishVolume: mountPath is empty")
 	}
-	log.Infof("NodePublishVolume: starting mount kodo volume %s to path: %s", req.GetVolumeId(), mountPath)
+	logger(ctx).Infof("NodePublishVolume: starting mount kodo volume %s to path: %s", req.GetVolumeId(), mountPath)
+	if err := acquirePublishedNode(ctx, TypePluginKodo, req.GetVolumeId(), req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+	if err := server.mount(ctx, req); err != nil {
+		releasePublishedNode(ctx, TypePluginKodo, req.GetVolumeId(), mountPath)
+		return nil, err
+	}
+	server.watchdog.publish(req)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
 
-	parameter, err := parseKodoPvParameter("NodePublishVolume", req.GetVolumeContext(), req.GetSecrets())
+// mount mounts the volume on the target path, it's also called by the watchdog to re-mount the disconnected volume
+func (server *kodoNodeServer) mount(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+	mountPath := req.GetTargetPath()
+	volumeContext, err := applyMountProfile(ctx, overrideByPvcAnnotations(ctx, req.GetVolumeContext()))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	parameter, err := parseKodoPvParameter("NodePublishVolume", volumeContext, req.GetSecrets())
+	if err != nil {
+		return err
 	}
 
 	if err = ensureDirectoryCreated(mountPath); err != nil {
-		return nil, fmt.Errorf("NodePublishVolume: create mount path %s error: %w", mountPath, err)
+		return fmt.Errorf("NodePublishVolume: create mount path %s error: %w", mountPath, err)
+	}
+	if parameter.vfsDiskSpaceTotalSize == nil {
+		// df in the containers shows the size of the volume instead of the 1 PiB made up by rclone
+		if space := getKodoVolumeSpace(ctx, req.GetVolumeId()); space != nil && space.total() > 0 {
+			total := uint64(space.total())
+			parameter.vfsDiskSpaceTotalSize = &total
+		}
 	}
-	if err = mountKodo(req.GetVolumeId(), mountPath, "", parameter.accessKey, parameter.secretKey,
-		parameter.bucketID, parameter.s3Region, parameter.s3Endpoint.String(), parameter.storageClass,
+	podNamespace, podName := orchestrator.workload(req.GetVolumeContext())
+	if err = mountKodo(ctx, req.GetVolumeId(), mountPath, "", parameter.accessKey, parameter.secretKey,
+		parameter.bucketID, parameter.s3Region, parameter.mounterS3Endpoint().String(), parameter.s3SignatureVersion, parameter.s3Provider, parameter.storageClass,
 		parameter.vfsCacheMode, parameter.dirCacheDuration, parameter.bufferSize,
 		parameter.vfsCacheMaxAge, parameter.vfsCachePollInterval, parameter.vfsWriteBack, parameter.vfsCacheMaxSize,
 		parameter.vfsReadAhead, parameter.vfsFastFingerprint, parameter.vfsReadChunkSize, parameter.vfsReadChunkSizeLimit,
 		parameter.noCheckSum, parameter.noModTime, parameter.noSeek, parameter.readOnly,
 		parameter.vfsReadWait, parameter.vfsWriteWait, parameter.transfers, parameter.vfsDiskSpaceTotalSize, parameter.writeBackCache,
-		parameter.uploadCutoff, parameter.uploadChunkSize, parameter.uploadConcurrency, parameter.debugHttp, parameter.debugFuse); err != nil {
-		return nil, fmt.Errorf("NodePublishVolume: failed to to mount kodo to %s: %w", mountPath, err)
+		parameter.uploadCutoff, parameter.uploadChunkSize, parameter.uploadConcurrency, parameter.debugHttp, parameter.debugFuse,
+		formatUrl(parameter.httpProxy), formatUrl(parameter.httpsProxy), parameter.noProxy,
+		parameter.caCert, parameter.insecureSkipVerify,
+		parameter.pvcNamespace, parameter.pvcName, podNamespace, podName,
+		parameter.retries, parameter.lowLevelRetries, parameter.connectTimeout, parameter.timeout,
+		parameter.credentialSource(), parameter.writeCache, parameter.writeCacheSyncInterval,
+		parameter.prewarm, parameter.prewarmManifest, parameter.syncMode, parameter.syncBack, parameter.syncBackInterval,
+		parameter.mountCheck, parameter.integrityManifest, parameter.integrityCheck, parameter.persistentDirCache,
+		parameter.hostAliases, parameter.nameservers, formatUrl(parameter.s3InternalEndpoint),
+		parameter.mounterMemoryLimit, parameter.mounterCpuLimit, parameter.mounterCpuWeight, parameter.mounterIoWeight); err != nil {
+		return fmt.Errorf("NodePublishVolume: failed to to mount kodo to %s: %w", mountPath, err)
 	}
-	log.Infof("NodePublishVolume: kodo volume %s is mounted on %s", req.GetVolumeId(), mountPath)
-	return &csi.NodePublishVolumeResponse{}, nil
+	if err = checkRemoteMounted(ctx, req.GetVolumeId(), mountPath, isKodoMounted, cleanAfterKodoUmount); err != nil {
+		return fmt.Errorf("NodePublishVolume: kodo volume mounted by the remote connector can't be used: %w", err)
+	}
+	logger(ctx).WithField("bucket", parameter.bucketID).Infof("NodePublishVolume: kodo volume %s is mounted on %s", req.GetVolumeId(), mountPath)
+	return nil
 }
 
 func (server *kodoNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
@@ -59,25 +99,71 @@ func (server *kodoNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.
 	if mountPath == "" {
 		return nil, errors.New("NodeUnpublishVolume: mountPath is empty")
 	}
-	log.Infof("NodeUnpublishVolume: starting umount kodo volume from path: %s", mountPath)
-	mounted, err := isKodoMounted(mountPath)
+	logger(ctx).Infof("NodeUnpublishVolume: starting umount kodo volume from path: %s", mountPath)
+	server.watchdog.unpublish(mountPath)
+	// The mount point of the remote connector is only known on its node, where the connector flushes or detaches it, or fails
+	if _, err := os.Stat(mountPath); errors.Is(err, os.ErrNotExist) && !isRemoteConnector() {
+		// The pod is force deleted, the mounter left running is stopped by the connector below, which always succeeds to let kubelet move on
+		logger(ctx).Warnf("NodeUnpublishVolume: mountPath no longer exists, clean up the mounters left of kodo volume %s", req.VolumeId)
+		if err = cleanAfterKodoUmount(ctx, req.VolumeId, mountPath); err != nil {
+			logger(ctx).Warnf("NodeUnpublishVolume: failed to clean up kodo volume of the vanished mountPath: %s", err)
+		}
+		releasePublishedNode(ctx, TypePluginKodo, req.VolumeId, mountPath)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	mounted := true
+	var err error
+	if !isRemoteConnector() {
+		mounted, err = isKodoMounted(mountPath)
+	}
 	if err != nil {
-		log.Warnf("NodeUnpublishVolume: failed to detect mount point: %s", err)
+		logger(ctx).Warnf("NodeUnpublishVolume: failed to detect mount point: %s", err)
 	} else if !mounted {
-		log.Warnf("NodeUnpublishVolume: mountPath is not mounted by kodo")
-	} else if err = umount(mountPath); err != nil {
+		logger(ctx).Warnf("NodeUnpublishVolume: mountPath is not mounted by kodo")
+	} else if server.detach(ctx, req.VolumeId, mountPath) {
+		// The connector cleans the cache and log files after the cache is uploaded
+		logger(ctx).Infof("NodeUnpublishVolume: detached kodo volume from path: %s, the cache is uploaded in background", mountPath)
+		releasePublishedNode(ctx, TypePluginKodo, req.VolumeId, mountPath)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	} else if err = server.flush(ctx, req.VolumeId, mountPath); err != nil {
+		return nil, fmt.Errorf("NodeUnpublishVolume: refuse to unmount kodo to avoid data loss: %w", err)
+	} else if isRemoteConnector() {
+		// Unmounted on the node of the connector once the mounter is stopped below
+		logger(ctx).Infof("NodeUnpublishVolume: write-back cache of kodo volume on path %s is uploaded by the remote connector", mountPath)
+	} else if err = unmountVolume(ctx, req.VolumeId, mountPath, false); err != nil {
 		return nil, fmt.Errorf("NodeUnpublishVolume: failed to unmount kodo: %w", err)
 	} else {
-		log.Infof("NodeUnpublishVolume: umounted kodo volume from path: %s", mountPath)
+		logger(ctx).Infof("NodeUnpublishVolume: umounted kodo volume from path: %s", mountPath)
 	}
-	if err = cleanAfterKodoUmount(req.VolumeId, mountPath); err != nil {
-		log.Warnf("NodeUnpublishVolume: failed to clean kodo volume cache and log files: %s", err)
+	if err = cleanAfterKodoUmount(ctx, req.VolumeId, mountPath); err != nil {
+		logger(ctx).Warnf("NodeUnpublishVolume: failed to clean kodo volume cache and log files: %s", err)
 	} else {
-		log.Infof("NodeUnpublishVolume: kodo volume cache and log files are cleaned")
+		logger(ctx).Infof("NodeUnpublishVolume: kodo volume cache and log files are cleaned")
 	}
+	releasePublishedNode(ctx, TypePluginKodo, req.VolumeId, mountPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+func (server *kodoNodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: nodeCapabilities}, nil
+}
+
+// NodeGetVolumeStats is called by kubelet, which emits events on the Pods if the mount points are abnormal
+func (server *kodoNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if synced, _ := isSyncedKodoMounted(req.GetVolumePath()); synced {
+		// Bound from the directory on the node in the sync mode, whose filesystem is whatever the node has
+		return nodeGetVolumeStats(ctx, req, "")
+	}
+	resp, err := nodeGetVolumeStats(ctx, req, FuseTypeKodo)
+	if err == nil && len(resp.GetUsage()) > 0 {
+		// rclone never knows the used bytes of the bucket, which are counted by Kodo
+		if space := getKodoVolumeSpace(ctx, req.GetVolumeId()); space != nil {
+			space.apply(resp.Usage[0])
+		}
+	}
+	return resp, err
+}
+
 func (server *kodoNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -89,3 +175,23 @@ func (server *kodoNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.No
 func (server *kodoNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
+
+func (server *kodoNodeServer) flush(ctx context.Context, volumeId, mountPath string) error {
+	if kodoFlushTimeout.get() <= 0 {
+		return nil
+	}
+	logger(ctx).Infof("NodeUnpublishVolume: waiting for write-back cache of %s to be uploaded", mountPath)
+	return flushKodo(ctx, volumeId, mountPath, kodoFlushTimeout.get())
+}
+
+// detach unmounts the volume lazily if --kodo-lazy-unmount is enabled, returns false to unmount it synchronously
+func (server *kodoNodeServer) detach(ctx context.Context, volumeId, mountPath string) bool {
+	if !kodoLazyUnmount.get() {
+		return false
+	}
+	if err := detachKodo(ctx, volumeId, mountPath, kodoFlushWaitInterval); err != nil {
+		logger(ctx).Warnf("NodeUnpublishVolume: failed to detach kodo volume, fall back to unmount it synchronously: %s", err)
+		return false
+	}
+	return true
+}
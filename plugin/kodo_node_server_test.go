@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	csitesting "github.com/qiniu/csi-driver/internal/testing"
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+// startFakeConnector serves the connector on a socket of the test, which is dialed by the plugin instead of the connector on the node
+func startFakeConnector(t *testing.T) *csitesting.FakeConnector {
+	socketPath := filepath.Join(t.TempDir(), "connector.sock")
+	connector, err := csitesting.NewFakeConnector(socketPath)
+	if err != nil {
+		t.Fatalf("failed to start fake connector: %s", err)
+	}
+	socket := *connectorSocket
+	*connectorSocket = socketPath
+	t.Cleanup(func() {
+		*connectorSocket = socket
+		connector.Close()
+	})
+	return connector
+}
+
+// requestsOf returns the payloads of the requests of the command received by the connector
+func requestsOf(connector *csitesting.FakeConnector, cmdName string) []json.RawMessage {
+	var payloads []json.RawMessage
+	for _, request := range connector.Requests() {
+		if request.Cmd == cmdName {
+			payloads = append(payloads, request.Payload)
+		}
+	}
+	return payloads
+}
+
+func newTestKodoNodeServer(t *testing.T) *kodoNodeServer {
+	interval := *remountInterval
+	*remountInterval = 0
+	t.Cleanup(func() {
+		*remountInterval = interval
+	})
+	return newKodoNodeServer(csicommon.NewCSIDriver("kodoplugin.storage.qiniu.com", "test", "node")).(*kodoNodeServer)
+}
+
+func newKodoPublishRequest(t *testing.T) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   "pv-kodo",
+		TargetPath: filepath.Join(t.TempDir(), "pods", "6f2b", "volumes", "kubernetes.io~csi", "pv-kodo", "mount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{
+			// The bucket is never looked up by UC with its id and S3 endpoint given
+			FIELD_BUCKET_ID:      "bucket",
+			FIELD_S3_ENDPOINT:    "https://s3.example.com",
+			FIELD_S3_REGION:      csitesting.MockKodoS3Region,
+			FIELD_VFS_CACHE_MODE: "writes",
+		},
+		Secrets: map[string]string{FIELD_ACCESS_KEY: "access-key", FIELD_SECRET_KEY: "secret-key"},
+	}
+}
+
+func TestKodoNodeServerPublishAndUnpublish(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoNodeServer(t)
+	req := newKodoPublishRequest(t)
+
+	if _, err := server.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to publish volume: %s", err)
+	}
+	if volumeId := connector.Mounts()[req.TargetPath]; volumeId != req.VolumeId {
+		t.Fatalf("volume mounted on %s is %q, expected %s", req.TargetPath, volumeId, req.VolumeId)
+	}
+	payloads := requestsOf(connector, protocol.InitKodoMountCmdName)
+	if len(payloads) != 1 {
+		t.Fatalf("%d mount requests are sent, expected 1", len(payloads))
+	}
+	var cmd protocol.InitKodoMountCmd
+	if err := json.Unmarshal(payloads[0], &cmd); err != nil {
+		t.Fatalf("failed to parse mount request: %s", err)
+	} else if cmd.BucketId != "bucket" || cmd.AccessKey != "access-key" || cmd.SecretKey != "secret-key" || cmd.VfsCacheMode != "writes" {
+		t.Fatalf("unexpected mount request: %s", payloads[0])
+	}
+	if _, published := server.watchdog.published[req.TargetPath]; !published {
+		t.Fatalf("published volume is not watched")
+	}
+
+	// The mounter is stopped by the connector even though nothing is mounted by the fake connector on the target path
+	if _, err := server.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId: req.VolumeId, TargetPath: req.TargetPath,
+	}); err != nil {
+		t.Fatalf("failed to unpublish volume: %s", err)
+	}
+	if mounts := connector.Mounts(); len(mounts) != 0 {
+		t.Fatalf("%v are still mounted after unpublished", mounts)
+	} else if len(requestsOf(connector, protocol.KodoUmountCmdName)) != 1 {
+		t.Fatalf("mounter is not stopped by the connector")
+	}
+	if _, published := server.watchdog.published[req.TargetPath]; published {
+		t.Fatalf("unpublished volume is still watched")
+	}
+}
+
+func TestKodoNodeServerPublishFailsByConnector(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoNodeServer(t)
+	req := newKodoPublishRequest(t)
+
+	connector.Fail(protocol.InitKodoMountCmdName, 1)
+	if _, err := server.NodePublishVolume(context.Background(), req); err == nil {
+		t.Fatalf("volume is published even though the connector fails to mount it")
+	}
+	if mounts := connector.Mounts(); len(mounts) != 0 {
+		t.Fatalf("%v are mounted by the failed request", mounts)
+	} else if _, published := server.watchdog.published[req.TargetPath]; published {
+		t.Fatalf("volume failed to be published is watched")
+	}
+
+	connector.Fail(protocol.InitKodoMountCmdName, 0)
+	if _, err := server.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to publish volume once the connector recovers: %s", err)
+	}
+}
+
+func TestKodoNodeServerPublishRejectsInvalidRequests(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoNodeServer(t)
+
+	for name, modify := range map[string]func(req *csi.NodePublishVolumeRequest){
+		"no target path": func(req *csi.NodePublishVolumeRequest) { req.TargetPath = "" },
+		"no secret key":  func(req *csi.NodePublishVolumeRequest) { delete(req.Secrets, FIELD_SECRET_KEY) },
+		"invalid cache mode": func(req *csi.NodePublishVolumeRequest) {
+			req.VolumeContext[FIELD_VFS_CACHE_MODE] = "all"
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := newKodoPublishRequest(t)
+			modify(req)
+			if _, err := server.NodePublishVolume(context.Background(), req); err == nil {
+				t.Fatalf("invalid request is published")
+			}
+		})
+	}
+	if payloads := requestsOf(connector, protocol.InitKodoMountCmdName); len(payloads) != 0 {
+		t.Fatalf("invalid requests are sent to the connector: %s", payloads)
+	}
+}
+
+func TestKodoNodeServerUnpublishVanishedTargetPath(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoNodeServer(t)
+	targetPath := filepath.Join(t.TempDir(), "mount")
+
+	// Succeeds to let kubelet move on even if the connector fails to stop the mounter left
+	connector.Fail(protocol.KodoUmountCmdName, 1)
+	if _, err := server.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId: "pv-kodo", TargetPath: targetPath,
+	}); err != nil {
+		t.Fatalf("failed to unpublish vanished target path: %s", err)
+	}
+	if len(requestsOf(connector, protocol.KodoUmountCmdName)) != 1 {
+		t.Fatalf("mounter left on the vanished target path is not stopped by the connector")
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Fatalf("vanished target path is created again: %v", err)
+	}
+
+	if _, err := server.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "pv-kodo"}); err == nil {
+		t.Fatalf("volume is unpublished without target path")
+	}
+}
@@ -2,20 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/url"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/qiniu/csi-driver/protocol"
 	"github.com/qiniu/csi-driver/qiniu"
 )
 
 const (
+	FIELD_BACKEND                   = "backend"
+	FIELD_API_MODE                  = "apimode"
+	FIELD_S3_PROVIDER               = "s3provider"
 	FIELD_BUCKET_ID                 = "bucketid"
 	FIELD_BUCKET_NAME               = "bucketname"
+	FIELD_BUCKET_OWNER              = "bucketowner"
 	FIELD_S3_REGION                 = "s3region"
 	FIELD_S3_ENDPOINT               = "s3endpoint"
+	FIELD_S3_INTERNAL_ENDPOINT      = "s3internalendpoint"
+	FIELD_S3_ACCELERATE_ENDPOINT    = "s3accelerateendpoint"
+	FIELD_S3_SIGNATURE_VERSION      = "s3signatureversion"
 	FIELD_UC_ENDPOINT               = "ucendpoint"
 	FIELD_STORAGE_CLASS             = "storageclass"
 	FIELD_VFS_CACHE_MODE            = "vfscachemode"
@@ -43,8 +55,45 @@ const (
 	FIELD_UPLOAD_CONCURRENCY        = "uploadconcurrency"
 	FIELD_DEBUG_HTTP                = "debughttp"
 	FIELD_DEBUG_FUSE                = "debugfuse"
+	FIELD_HTTP_PROXY                = "httpproxy"
+	FIELD_HTTPS_PROXY               = "httpsproxy"
+	FIELD_NO_PROXY                  = "noproxy"
+	FIELD_CA_CERT                   = "cacert"
+	FIELD_INSECURE_SKIP_VERIFY      = "insecureskipverify"
+	FIELD_RETRIES                   = "retries"
+	FIELD_LOW_LEVEL_RETRIES         = "lowlevelretries"
+	FIELD_CONNECT_TIMEOUT           = "contimeout"
+	FIELD_TIMEOUT                   = "timeout"
+	FIELD_WRITE_CACHE               = "writecache"
+	FIELD_WRITE_CACHE_SYNC_INTERVAL = "writecachesyncinterval"
+	FIELD_PREWARM                   = "prewarm"
+	FIELD_PREWARM_MANIFEST          = "prewarmmanifest"
+	FIELD_SYNC_MODE                 = "syncmode"
+	FIELD_SYNC_BACK                 = "syncback"
+	FIELD_SYNC_BACK_INTERVAL        = "syncbackinterval"
+	FIELD_MOUNT_CHECK               = "mountcheck"
+	FIELD_INTEGRITY_MANIFEST        = "integritymanifest"
+	FIELD_INTEGRITY_CHECK           = "integritycheck"
+	FIELD_PERSISTENT_DIR_CACHE      = "persistentdircache"
+	FIELD_HOST_ALIASES              = "hostaliases"
+	FIELD_NAMESERVERS               = "nameservers"
+	FIELD_MOUNTER_MEMORY_LIMIT      = "mountermemorylimit"
+	FIELD_MOUNTER_CPU_LIMIT         = "mountercpulimit"
+	FIELD_MOUNTER_CPU_WEIGHT        = "mountercpuweight"
+	FIELD_MOUNTER_IO_WEIGHT         = "mounterioweight"
+	FIELD_MOUNT_PROFILE             = "mountprofile"
+	FIELD_PVC_NAME                  = "csi.storage.k8s.io/pvc/name"
+	FIELD_PVC_NAMESPACE             = "csi.storage.k8s.io/pvc/namespace"
+	FIELD_POD_NAME                  = "csi.storage.k8s.io/pod.name"
+	FIELD_POD_NAMESPACE             = "csi.storage.k8s.io/pod.namespace"
 	FIELD_ORIGINAL_ACCESS_KEY       = "originalaccesskey"
 	FIELD_ORIGINAL_SECRET_KEY       = "originalsecretkey"
+	FIELD_STS_ENDPOINT              = "stsendpoint"
+	FIELD_STS_TOKEN                 = "ststoken"
+	FIELD_INSTANCE_ROLE             = "instancerole"
+	FIELD_ACCESS_KEY_FILE           = "accesskeyfile"
+	FIELD_SECRET_KEY_FILE           = "secretkeyfile"
+	FIELD_SESSION_TOKEN_FILE        = "sessiontokenfile"
 )
 
 type VfsCacheMode string
@@ -60,12 +109,101 @@ func (mode VfsCacheMode) String() string {
 	return string(mode)
 }
 
+type S3SignatureVersion string
+
+const (
+	S3_SIGNATURE_VERSION_V2 S3SignatureVersion = "v2"
+	S3_SIGNATURE_VERSION_V4 S3SignatureVersion = "v4"
+)
+
+func (version S3SignatureVersion) String() string {
+	return string(version)
+}
+
+// KodoBackend is the type of the storage mounted by the Kodo CSI plugin,
+// the Kodo specific APIs, e.g. UC and IAM, are only called for Kodo
+type KodoBackend string
+
+const (
+	KODO_BACKEND_KODO KodoBackend = "kodo"
+	KODO_BACKEND_S3   KodoBackend = "s3"
+)
+
+func (backend KodoBackend) String() string {
+	return string(backend)
+}
+
+// KodoApiMode decides whether the Kodo volume is managed by the native Kodo APIs, e.g. UC and IAM, or only accessed by the S3 gateway
+type KodoApiMode string
+
+const (
+	// The native Kodo APIs are used if the UC endpoint is given, otherwise only the S3 gateway is
+	KODO_API_MODE_AUTO   KodoApiMode = "auto"
+	KODO_API_MODE_NATIVE KodoApiMode = "native"
+	KODO_API_MODE_S3     KodoApiMode = "s3"
+)
+
+func (mode KodoApiMode) String() string {
+	return string(mode)
+}
+
+// KodoMountCheck is how the mount point is verified by the connector once mounted, before the volume is published
+type KodoMountCheck string
+
+const (
+	KODO_MOUNT_CHECK_NONE KodoMountCheck = "none"
+	// The mount point responds to statfs, which is the default
+	KODO_MOUNT_CHECK_STATFS KodoMountCheck = "statfs"
+	// The root directory of the volume is also listed, which requires the bucket to be accessible
+	KODO_MOUNT_CHECK_LIST KodoMountCheck = "list"
+	// The head of the first file in the root directory is also read, if there's any
+	KODO_MOUNT_CHECK_READ KodoMountCheck = "read"
+)
+
+func (check KodoMountCheck) String() string {
+	return string(check)
+}
+
+// KodoIntegrityCheck is how the files of a read-only volume are verified against its integrity manifest before mounted
+type KodoIntegrityCheck string
+
+const (
+	// The MD5 saved by Kodo for every file is compared, which is the default. The files uploaded in multiple parts without MD5 fail.
+	KODO_INTEGRITY_CHECK_HASH KodoIntegrityCheck = "hash"
+	// Every file is downloaded and hashed, which also verifies the files uploaded in multiple parts, but reads the whole dataset
+	KODO_INTEGRITY_CHECK_DOWNLOAD KodoIntegrityCheck = "download"
+)
+
+func (check KodoIntegrityCheck) String() string {
+	return string(check)
+}
+
+// kodoS3Regions are the S3 regions of the public Kodo regions, whose S3 endpoints are https://s3.<S3 region>.qiniucs.com,
+// so that the volumes of these regions are accessed by the S3 gateway without asking UC
+var kodoS3Regions = map[string]string{
+	"z0":             "cn-east-1",
+	"cn-east-2":      "cn-east-2",
+	"z1":             "cn-north-1",
+	"z2":             "cn-south-1",
+	"na0":            "us-north-1",
+	"as0":            "ap-southeast-1",
+	"ap-northeast-1": "ap-northeast-1",
+}
+
+// s3Providers are the rclone providers of the S3-compatible storages by their names in lower case
+var s3Providers = map[string]string{
+	"aws":   "AWS",
+	"ceph":  "Ceph",
+	"minio": "Minio",
+	"other": "Other",
+}
+
 type kodoPvParameter struct {
 	kodoStorageClassParameter
 	bucketID, bucketName                 string
 	originalAccessKey, originalSecretKey string
-	s3Endpoint                           *url.URL
-	s3Region                             string
+	// UID of the account owning the bucket shared with the account of the volume, 0 if the bucket is owned by the account itself
+	bucketOwner uint64
 }
 
 func parseKodoPvParameter(functionName string, ctx, secrets map[string]string) (param *kodoPvParameter, err error) {
@@ -88,13 +226,11 @@ func parseKodoPvParameter(functionName string, ctx, secrets map[string]string) (
 			p.bucketID = strings.TrimSpace(value)
 		case FIELD_BUCKET_NAME:
 			p.bucketName = strings.TrimSpace(value)
-		case FIELD_S3_ENDPOINT:
-			if p.s3Endpoint, err = parseUrl(value); err != nil {
-				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_S3_ENDPOINT, value, err)
+		case FIELD_BUCKET_OWNER:
+			if p.bucketOwner, err = parseUint(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_BUCKET_OWNER, value, err)
 				return
 			}
-		case FIELD_S3_REGION:
-			p.s3Region = strings.TrimSpace(value)
 		}
 	}
 	if p.s3Endpoint == nil {
@@ -110,6 +246,14 @@ func parseKodoPvParameter(functionName string, ctx, secrets map[string]string) (
 			p.s3Region = strings.TrimSpace(value)
 		}
 	}
+	if p.s3SignatureVersion == "" {
+		if value, ok := secrets[FIELD_S3_SIGNATURE_VERSION]; ok {
+			if p.s3SignatureVersion, err = parseS3SignatureVersion(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
+		}
+	}
 	if p.bucketID == "" {
 		if value, ok := secrets[FIELD_BUCKET_ID]; ok {
 			p.bucketID = strings.TrimSpace(value)
@@ -121,14 +265,63 @@ func parseKodoPvParameter(functionName string, ctx, secrets map[string]string) (
 		}
 	}
 
-	client := qiniu.NewKodoClient(p.accessKey, p.secretKey, p.ucEndpoint, VERSION, COMMITID)
+	// The owner is verified by the bucket listed by UC
+	if p.bucketOwner != 0 && (p.apiMode == KODO_API_MODE_S3 || p.bucketName == "") {
+		err = fmt.Errorf("%s: %s requires %s and the native Kodo APIs", functionName, FIELD_BUCKET_OWNER, FIELD_BUCKET_NAME)
+		return
+	}
+
+	if p.apiMode == KODO_API_MODE_S3 {
+		// The bucket is named by the bucket name in the S3 API
+		if p.bucketID == "" {
+			p.bucketID = p.bucketName
+		} else if p.bucketName == "" {
+			p.bucketName = p.bucketID
+		}
+		if p.bucketID == "" {
+			err = fmt.Errorf("%s: both %s and %s are empty", functionName, FIELD_BUCKET_ID, FIELD_BUCKET_NAME)
+			return
+		}
+		if p.backend == KODO_BACKEND_S3 {
+			if p.s3Endpoint == nil {
+				err = fmt.Errorf("%s: %s is required by %s %s", functionName, FIELD_S3_ENDPOINT, FIELD_BACKEND, KODO_BACKEND_S3)
+				return
+			} else if p.s3Region == "" {
+				p.s3Region = "us-east-1"
+			}
+		} else if s3Region, ok := kodoS3Regions[p.region]; ok {
+			if p.s3Region == "" {
+				p.s3Region = s3Region
+			}
+			if p.s3Endpoint == nil {
+				p.s3Endpoint = &url.URL{Scheme: "https", Host: "s3." + s3Region + ".qiniucs.com"}
+			}
+		} else if p.s3Endpoint == nil || p.s3Region == "" {
+			err = fmt.Errorf("%s: %s and %s are required by %s %s for kodo region %s", functionName,
+				FIELD_S3_ENDPOINT, FIELD_S3_REGION, FIELD_API_MODE, KODO_API_MODE_S3, p.region)
+			return
+		}
+		return &p, nil
+	}
+
+	if p.accessKey == "" && (p.bucketID == "" || p.s3Endpoint == nil || p.s3Region == "") {
+		// Only temporary credentials are given, which cannot be used to look up the bucket
+		err = fmt.Errorf("%s: %s, %s and %s are required if %s and %s are not given", functionName,
+			FIELD_BUCKET_ID, FIELD_S3_ENDPOINT, FIELD_S3_REGION, FIELD_ACCESS_KEY, FIELD_SECRET_KEY)
+		return
+	}
 
-	if p.bucketID == "" {
+	client := qiniu.NewKodoClient(p.accessKey, p.secretKey, p.ucEndpoint, p.tlsConfig(), VERSION, COMMITID)
+
+	if p.bucketID == "" || p.bucketOwner != 0 {
 		if p.bucketName != "" {
 			if bucket, findError := client.FindBucketByName(context.Background(), p.bucketName, true); findError != nil {
 				err = fmt.Errorf("%s: failed to find bucket by %s: %w", functionName, p.bucketName, findError)
 				return
 			} else if bucket != nil {
+				if err = p.checkBucketOwner(functionName, bucket); err != nil {
+					return
+				}
 				p.bucketID = bucket.ID
 				p.region = bucket.KodoRegionID
 			} else {
@@ -167,8 +360,16 @@ func parseKodoPvParameter(functionName string, ctx, secrets map[string]string) (
 }
 
 type kodoStorageClassParameter struct {
+	backend                                            KodoBackend
+	apiMode                                            KodoApiMode
+	s3Provider                                         string
 	accessKey, secretKey, region                       string
 	ucEndpoint                                         *url.URL
+	s3Endpoint                                         *url.URL
+	s3InternalEndpoint                                 *url.URL
+	s3AccelerateEndpoint                               *url.URL
+	s3Region                                           string
+	s3SignatureVersion                                 S3SignatureVersion
 	storageClass                                       string
 	dirCacheDuration                                   *time.Duration
 	bufferSize                                         *uint64
@@ -184,6 +385,33 @@ type kodoStorageClassParameter struct {
 	uploadCutoff, uploadChunkSize, uploadConcurrency   *uint64
 	writeBackCache                                     bool
 	debugHttp, debugFuse                               bool
+	httpProxy, httpsProxy                              *url.URL
+	noProxy                                            string
+	caCert                                             string
+	insecureSkipVerify                                 bool
+	pvcName, pvcNamespace                              string
+	retries, lowLevelRetries                           *uint64
+	connectTimeout, timeout                            *time.Duration
+	stsEndpoint                                        *url.URL
+	stsToken                                           string
+	instanceRole                                       string
+	accessKeyFile, secretKeyFile, sessionTokenFile     string
+	writeCache                                         bool
+	writeCacheSyncInterval                             *time.Duration
+	prewarm                                            []string
+	prewarmManifest                                    string
+	syncMode, syncBack                                 bool
+	syncBackInterval                                   *time.Duration
+	mountCheck                                         KodoMountCheck
+	integrityManifest                                  string
+	integrityCheck                                     KodoIntegrityCheck
+	persistentDirCache                                 *time.Duration
+	hostAliases                                        map[string]string
+	nameservers                                        []string
+	mounterMemoryLimit                                 *uint64
+	mounterCpuLimit                                    *float64
+	mounterCpuWeight, mounterIoWeight                  *uint64
+	mountProfile                                       string
 }
 
 func parseKodoStorageClassParameter(functionName string, ctx, secrets map[string]string) (param *kodoStorageClassParameter, err error) {
@@ -192,6 +420,23 @@ func parseKodoStorageClassParameter(functionName string, ctx, secrets map[string
 	for key, value := range ctx {
 		key = strings.ToLower(key)
 		switch key {
+		case FIELD_BACKEND:
+			if p.backend, err = parseKodoBackend(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
+		case FIELD_API_MODE:
+			if p.apiMode, err = parseKodoApiMode(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
+		case FIELD_S3_PROVIDER:
+			if provider, ok := s3Providers[toLower(value)]; !ok {
+				err = fmt.Errorf("%s: unrecognized %s: %s", functionName, FIELD_S3_PROVIDER, value)
+				return
+			} else {
+				p.s3Provider = provider
+			}
 		case FIELD_ACCESS_KEY:
 			p.accessKey = strings.TrimSpace(value)
 		case FIELD_SECRET_KEY:
@@ -203,6 +448,28 @@ func parseKodoStorageClassParameter(functionName string, ctx, secrets map[string
 			}
 		case FIELD_REGION:
 			p.region = strings.TrimSpace(value)
+		case FIELD_S3_ENDPOINT:
+			if p.s3Endpoint, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_S3_ENDPOINT, value, err)
+				return
+			}
+		case FIELD_S3_INTERNAL_ENDPOINT:
+			if p.s3InternalEndpoint, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_S3_INTERNAL_ENDPOINT, value, err)
+				return
+			}
+		case FIELD_S3_ACCELERATE_ENDPOINT:
+			if p.s3AccelerateEndpoint, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_S3_ACCELERATE_ENDPOINT, value, err)
+				return
+			}
+		case FIELD_S3_REGION:
+			p.s3Region = strings.TrimSpace(value)
+		case FIELD_S3_SIGNATURE_VERSION:
+			if p.s3SignatureVersion, err = parseS3SignatureVersion(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
 		case FIELD_STORAGE_CLASS:
 			p.storageClass = strings.TrimSpace(value)
 		case FIELD_VFS_CACHE_MODE:
@@ -387,12 +654,276 @@ func parseKodoStorageClassParameter(functionName string, ctx, secrets map[string
 			} else {
 				p.debugFuse = b
 			}
+		case FIELD_HTTP_PROXY:
+			if p.httpProxy, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_HTTP_PROXY, value, err)
+				return
+			}
+		case FIELD_HTTPS_PROXY:
+			if p.httpsProxy, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_HTTPS_PROXY, value, err)
+				return
+			}
+		case FIELD_NO_PROXY:
+			p.noProxy = normalizeNoProxy(value)
+		case FIELD_CA_CERT:
+			p.caCert = strings.TrimSpace(value)
+		case FIELD_RETRIES:
+			if s, parseError := parseUint(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_RETRIES, parseError)
+				return
+			} else {
+				p.retries = &s
+			}
+		case FIELD_LOW_LEVEL_RETRIES:
+			if s, parseError := parseUint(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_LOW_LEVEL_RETRIES, parseError)
+				return
+			} else {
+				p.lowLevelRetries = &s
+			}
+		case FIELD_CONNECT_TIMEOUT:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_CONNECT_TIMEOUT, parseError)
+				return
+			} else {
+				p.connectTimeout = &d
+			}
+		case FIELD_TIMEOUT:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_TIMEOUT, parseError)
+				return
+			} else {
+				p.timeout = &d
+			}
+		case FIELD_STS_ENDPOINT:
+			if p.stsEndpoint, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_STS_ENDPOINT, value, err)
+				return
+			}
+		case FIELD_STS_TOKEN:
+			p.stsToken = strings.TrimSpace(value)
+		case FIELD_INSTANCE_ROLE:
+			p.instanceRole = strings.TrimSpace(value)
+		case FIELD_ACCESS_KEY_FILE, FIELD_SECRET_KEY_FILE, FIELD_SESSION_TOKEN_FILE:
+			// Read by the connector in the container of the plugin
+			path := strings.TrimSpace(value)
+			if !filepath.IsAbs(path) {
+				err = fmt.Errorf("%s: %s must be an absolute path: %s", functionName, key, value)
+				return
+			}
+			switch key {
+			case FIELD_ACCESS_KEY_FILE:
+				p.accessKeyFile = filepath.Clean(path)
+			case FIELD_SECRET_KEY_FILE:
+				p.secretKeyFile = filepath.Clean(path)
+			case FIELD_SESSION_TOKEN_FILE:
+				p.sessionTokenFile = filepath.Clean(path)
+			}
+		case FIELD_PVC_NAME:
+			p.pvcName = strings.TrimSpace(value)
+		case FIELD_PVC_NAMESPACE:
+			p.pvcNamespace = strings.TrimSpace(value)
+		case FIELD_INSECURE_SKIP_VERIFY:
+			if b, ok := parseBool(value); !ok {
+				err = fmt.Errorf("%s: unrecognized %s: %s", functionName, FIELD_INSECURE_SKIP_VERIFY, value)
+				return
+			} else {
+				p.insecureSkipVerify = b
+			}
+		case FIELD_WRITE_CACHE:
+			if b, ok := parseBool(value); !ok {
+				err = fmt.Errorf("%s: unrecognized %s: %s", functionName, FIELD_WRITE_CACHE, value)
+				return
+			} else {
+				p.writeCache = b
+			}
+		case FIELD_WRITE_CACHE_SYNC_INTERVAL:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_WRITE_CACHE_SYNC_INTERVAL, parseError)
+				return
+			} else {
+				p.writeCacheSyncInterval = &d
+			}
+		case FIELD_PREWARM:
+			p.prewarm = nil
+			for _, path := range strings.Split(value, ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					p.prewarm = append(p.prewarm, path)
+				}
+			}
+		case FIELD_PREWARM_MANIFEST:
+			p.prewarmManifest = strings.TrimSpace(value)
+		case FIELD_SYNC_MODE:
+			if b, ok := parseBool(value); !ok {
+				err = fmt.Errorf("%s: unrecognized %s: %s", functionName, FIELD_SYNC_MODE, value)
+				return
+			} else {
+				p.syncMode = b
+			}
+		case FIELD_SYNC_BACK:
+			if b, ok := parseBool(value); !ok {
+				err = fmt.Errorf("%s: unrecognized %s: %s", functionName, FIELD_SYNC_BACK, value)
+				return
+			} else {
+				p.syncBack = b
+			}
+		case FIELD_SYNC_BACK_INTERVAL:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_SYNC_BACK_INTERVAL, parseError)
+				return
+			} else {
+				p.syncBackInterval = &d
+			}
+		case FIELD_MOUNT_CHECK:
+			if p.mountCheck, err = parseKodoMountCheck(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
+		case FIELD_PERSISTENT_DIR_CACHE:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_PERSISTENT_DIR_CACHE, parseError)
+				return
+			} else {
+				p.persistentDirCache = &d
+			}
+		case FIELD_HOST_ALIASES:
+			if p.hostAliases, err = protocol.ParseHostAliases(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %w", functionName, FIELD_HOST_ALIASES, err)
+				return
+			}
+		case FIELD_NAMESERVERS:
+			if p.nameservers, err = protocol.ParseNameservers(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %w", functionName, FIELD_NAMESERVERS, err)
+				return
+			}
+		case FIELD_MOUNTER_MEMORY_LIMIT:
+			if s, parseError := parseUint(value); parseError != nil || s == 0 {
+				err = fmt.Errorf("%s: invalid %s: %s, expect bytes greater than 0", functionName, FIELD_MOUNTER_MEMORY_LIMIT, value)
+				return
+			} else {
+				p.mounterMemoryLimit = &s
+			}
+		case FIELD_MOUNTER_CPU_LIMIT:
+			if f, parseError := parseFloat(value); parseError != nil || f <= 0 {
+				err = fmt.Errorf("%s: invalid %s: %s, expect cores greater than 0", functionName, FIELD_MOUNTER_CPU_LIMIT, value)
+				return
+			} else {
+				p.mounterCpuLimit = &f
+			}
+		case FIELD_MOUNTER_CPU_WEIGHT:
+			if p.mounterCpuWeight, err = parseMounterWeight(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %w", functionName, FIELD_MOUNTER_CPU_WEIGHT, err)
+				return
+			}
+		case FIELD_MOUNTER_IO_WEIGHT:
+			if p.mounterIoWeight, err = parseMounterWeight(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %w", functionName, FIELD_MOUNTER_IO_WEIGHT, err)
+				return
+			}
+		case FIELD_INTEGRITY_MANIFEST:
+			p.integrityManifest = strings.TrimSpace(value)
+		case FIELD_MOUNT_PROFILE:
+			p.mountProfile = strings.TrimSpace(value)
+		case FIELD_INTEGRITY_CHECK:
+			if p.integrityCheck, err = parseKodoIntegrityCheck(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
+		}
+	}
+	// The bucket is already mounted read-only under the write cache, which would also reject the writes to the write cache
+	if p.writeCache && p.readOnly {
+		err = fmt.Errorf("%s: %s and %s are exclusive", functionName, FIELD_WRITE_CACHE, FIELD_READ_ONLY)
+		return
+	} else if p.writeCacheSyncInterval != nil && !p.writeCache {
+		err = fmt.Errorf("%s: %s requires %s", functionName, FIELD_WRITE_CACHE_SYNC_INTERVAL, FIELD_WRITE_CACHE)
+		return
+	}
+	// Only the full cache mode keeps the files read in the vfs cache
+	if (len(p.prewarm) > 0 || p.prewarmManifest != "") && p.vfsCacheMode != VFS_CACHE_MODE_FULL {
+		err = fmt.Errorf("%s: %s and %s require %s %s", functionName, FIELD_PREWARM, FIELD_PREWARM_MANIFEST, FIELD_VFS_CACHE_MODE, VFS_CACHE_MODE_FULL)
+		return
+	}
+	// The bucket is copied into the node in the sync mode, neither the vfs cache nor the write cache is involved
+	if p.syncMode && (p.writeCache || len(p.prewarm) > 0 || p.prewarmManifest != "") {
+		err = fmt.Errorf("%s: %s is exclusive with %s, %s and %s", functionName, FIELD_SYNC_MODE, FIELD_WRITE_CACHE, FIELD_PREWARM, FIELD_PREWARM_MANIFEST)
+		return
+	} else if p.syncBack && !p.syncMode {
+		err = fmt.Errorf("%s: %s requires %s", functionName, FIELD_SYNC_BACK, FIELD_SYNC_MODE)
+		return
+	} else if p.syncMode && p.persistentDirCache != nil {
+		err = fmt.Errorf("%s: %s and %s are exclusive", functionName, FIELD_SYNC_MODE, FIELD_PERSISTENT_DIR_CACHE)
+		return
+	} else if p.syncBackInterval != nil && !p.syncBack {
+		err = fmt.Errorf("%s: %s requires %s", functionName, FIELD_SYNC_BACK_INTERVAL, FIELD_SYNC_BACK)
+		return
+	} else if p.syncBack && p.readOnly {
+		err = fmt.Errorf("%s: %s and %s are exclusive", functionName, FIELD_SYNC_BACK, FIELD_READ_ONLY)
+		return
+	}
+	// The endpoints are resolved by the proxies instead
+	if (len(p.hostAliases) > 0 || len(p.nameservers) > 0) && (p.httpProxy != nil || p.httpsProxy != nil) {
+		err = fmt.Errorf("%s: %s and %s are exclusive with %s and %s", functionName, FIELD_HOST_ALIASES, FIELD_NAMESERVERS, FIELD_HTTP_PROXY, FIELD_HTTPS_PROXY)
+		return
+	}
+	// The files verified could be changed by the workload otherwise
+	if p.integrityManifest != "" && !p.readOnly {
+		err = fmt.Errorf("%s: %s requires %s", functionName, FIELD_INTEGRITY_MANIFEST, FIELD_READ_ONLY)
+		return
+	} else if p.integrityCheck != "" && p.integrityManifest == "" {
+		err = fmt.Errorf("%s: %s requires %s", functionName, FIELD_INTEGRITY_CHECK, FIELD_INTEGRITY_MANIFEST)
+		return
+	}
+	if p.backend == "" {
+		if value, ok := secrets[FIELD_BACKEND]; ok {
+			if p.backend, err = parseKodoBackend(value); err != nil {
+				err = fmt.Errorf("%s: %w", functionName, err)
+				return
+			}
+		} else {
+			p.backend = KODO_BACKEND_KODO
+		}
+	}
+	if p.backend == KODO_BACKEND_S3 && p.s3Provider == "" {
+		p.s3Provider = s3Providers["other"]
+	} else if p.backend != KODO_BACKEND_S3 && p.s3Provider != "" {
+		err = fmt.Errorf("%s: %s requires %s %s", functionName, FIELD_S3_PROVIDER, FIELD_BACKEND, KODO_BACKEND_S3)
+		return
+	}
+	if p.stsEndpoint == nil {
+		if value, ok := secrets[FIELD_STS_ENDPOINT]; ok {
+			if p.stsEndpoint, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_STS_ENDPOINT, value, err)
+				return
+			}
+		}
+	}
+	if p.stsToken == "" {
+		if value, ok := secrets[FIELD_STS_TOKEN]; ok {
+			p.stsToken = strings.TrimSpace(value)
+		}
+	}
+	if p.instanceRole == "" {
+		if value, ok := secrets[FIELD_INSTANCE_ROLE]; ok {
+			p.instanceRole = strings.TrimSpace(value)
 		}
 	}
+	if (p.accessKeyFile == "") != (p.secretKeyFile == "") {
+		err = fmt.Errorf("%s: %s and %s must be given together", functionName, FIELD_ACCESS_KEY_FILE, FIELD_SECRET_KEY_FILE)
+		return
+	} else if p.sessionTokenFile != "" && p.accessKeyFile == "" {
+		err = fmt.Errorf("%s: %s requires %s and %s", functionName, FIELD_SESSION_TOKEN_FILE, FIELD_ACCESS_KEY_FILE, FIELD_SECRET_KEY_FILE)
+		return
+	} else if p.accessKeyFile != "" && (p.stsEndpoint != nil || p.instanceRole != "") {
+		err = fmt.Errorf("%s: %s is exclusive with %s and %s", functionName, FIELD_ACCESS_KEY_FILE, FIELD_STS_ENDPOINT, FIELD_INSTANCE_ROLE)
+		return
+	}
+	// The static keys are optional if the mounter retrieves temporary credentials from the STS endpoint or the instance metadata
 	if p.accessKey == "" {
 		if value, ok := secrets[FIELD_ACCESS_KEY]; ok {
 			p.accessKey = strings.TrimSpace(value)
-		} else {
+		} else if p.credentialSource() == nil {
 			err = fmt.Errorf("%s: %s is empty", functionName, FIELD_ACCESS_KEY)
 			return
 		}
@@ -400,41 +931,194 @@ func parseKodoStorageClassParameter(functionName string, ctx, secrets map[string
 	if p.secretKey == "" {
 		if value, ok := secrets[FIELD_SECRET_KEY]; ok {
 			p.secretKey = strings.TrimSpace(value)
-		} else {
+		} else if p.credentialSource() == nil {
 			err = fmt.Errorf("%s: %s is empty", functionName, FIELD_SECRET_KEY)
 			return
 		}
 	}
-	if p.ucEndpoint == nil {
+	// Neither the UC endpoint nor the Kodo region makes sense to the S3-compatible storages
+	if p.ucEndpoint == nil && p.backend == KODO_BACKEND_KODO {
 		if value, ok := secrets[FIELD_UC_ENDPOINT]; ok {
 			if p.ucEndpoint, err = parseUrl(value); err != nil {
 				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_UC_ENDPOINT, value, err)
 				return
 			}
-		} else {
-			err = fmt.Errorf("%s: %s is empty", functionName, FIELD_UC_ENDPOINT)
+		}
+	}
+	switch {
+	case p.backend == KODO_BACKEND_S3:
+		if p.apiMode == KODO_API_MODE_NATIVE {
+			err = fmt.Errorf("%s: %s %s requires %s %s", functionName, FIELD_API_MODE, KODO_API_MODE_NATIVE, FIELD_BACKEND, KODO_BACKEND_KODO)
 			return
 		}
+		p.apiMode = KODO_API_MODE_S3
+	case p.apiMode == KODO_API_MODE_NATIVE && p.ucEndpoint == nil:
+		err = fmt.Errorf("%s: %s is empty", functionName, FIELD_UC_ENDPOINT)
+		return
+	case p.apiMode == "" || p.apiMode == KODO_API_MODE_AUTO:
+		if p.ucEndpoint != nil {
+			p.apiMode = KODO_API_MODE_NATIVE
+		} else {
+			p.apiMode = KODO_API_MODE_S3
+		}
 	}
-	if p.region == "" {
+	if p.region == "" && p.backend == KODO_BACKEND_KODO {
 		if value, ok := secrets[FIELD_REGION]; ok {
 			p.region = strings.TrimSpace(value)
 		} else {
 			p.region = "z0"
 		}
 	}
+	// The S3-compatible storages use their own default storage class if not given
 	if p.storageClass == "" {
 		if value, ok := secrets[FIELD_STORAGE_CLASS]; ok {
 			p.storageClass = strings.TrimSpace(value)
-		} else {
+		} else if p.backend == KODO_BACKEND_KODO {
 			p.storageClass = "STANDARD"
 		}
 	}
+	// Retry harder than rclone does by default, a transient network failure of a mount surfaces as EIO to applications
+	if p.retries == nil {
+		retries := uint64(5)
+		p.retries = &retries
+	}
+	if p.lowLevelRetries == nil {
+		lowLevelRetries := uint64(20)
+		p.lowLevelRetries = &lowLevelRetries
+	}
+	if p.connectTimeout == nil {
+		connectTimeout := 30 * time.Second
+		p.connectTimeout = &connectTimeout
+	}
+	if p.timeout == nil {
+		timeout := 5 * time.Minute
+		p.timeout = &timeout
+	}
+	if p.caCert == "" {
+		if value, ok := secrets[FIELD_CA_CERT]; ok {
+			p.caCert = strings.TrimSpace(value)
+		}
+	}
+	if p.caCert != "" {
+		if ok := x509.NewCertPool().AppendCertsFromPEM([]byte(p.caCert)); !ok {
+			err = fmt.Errorf("%s: invalid %s: no PEM encoded certificate found", functionName, FIELD_CA_CERT)
+			return
+		}
+	}
 
 	param = &p
 	return
 }
 
+// credentialSource returns where the mounter retrieves temporary credentials from, nil means the static keys are used
+func (p *kodoStorageClassParameter) credentialSource() *protocol.CredentialSource {
+	if p.stsEndpoint != nil {
+		return &protocol.CredentialSource{Type: protocol.CredentialSourceTypeSTS, Endpoint: p.stsEndpoint.String(), Token: p.stsToken}
+	} else if p.instanceRole != "" {
+		return &protocol.CredentialSource{Type: protocol.CredentialSourceTypeInstance, Role: p.instanceRole}
+	} else if p.accessKeyFile != "" {
+		return &protocol.CredentialSource{Type: protocol.CredentialSourceTypeFile,
+			AccessKeyFile: p.accessKeyFile, SecretKeyFile: p.secretKeyFile, SessionTokenFile: p.sessionTokenFile}
+	}
+	return nil
+}
+
+// checkBucketOwner rejects the bucket shared by an account other than the owner of the volume, or shared read-only with the writable volume
+func (p *kodoPvParameter) checkBucketOwner(functionName string, bucket *qiniu.Bucket) error {
+	if p.bucketOwner == 0 {
+		return nil
+	} else if !bucket.Shared() {
+		return fmt.Errorf("%s: bucket %s is owned by the account itself, not shared by %s %d", functionName, p.bucketName, FIELD_BUCKET_OWNER, p.bucketOwner)
+	} else if bucket.OwnerUid != p.bucketOwner {
+		return fmt.Errorf("%s: bucket %s is shared by account %d, not %s %d", functionName, p.bucketName, bucket.OwnerUid, FIELD_BUCKET_OWNER, p.bucketOwner)
+	} else if bucket.Perm == qiniu.BucketPermReadOnly && !p.readOnly {
+		return fmt.Errorf("%s: bucket %s is shared read-only by account %d, %s is required", functionName, p.bucketName, bucket.OwnerUid, FIELD_READ_ONLY)
+	}
+	return nil
+}
+
+// mounterS3Endpoint returns the S3 endpoint the volume is mounted by, which is the transfer acceleration endpoint if given
+func (p *kodoPvParameter) mounterS3Endpoint() *url.URL {
+	if p.s3AccelerateEndpoint != nil {
+		return p.s3AccelerateEndpoint
+	}
+	return p.s3Endpoint
+}
+
+// tlsConfig returns the TLS config used to connect to Kodo, nil means the system defaults
+func (p *kodoStorageClassParameter) tlsConfig() *tls.Config {
+	if p.caCert == "" && !p.insecureSkipVerify {
+		return nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.insecureSkipVerify}
+	if p.caCert != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM([]byte(p.caCert))
+	}
+	return tlsConfig
+}
+
+func parseKodoBackend(s string) (KodoBackend, error) {
+	switch toLower(s) {
+	case "kodo", "":
+		return KODO_BACKEND_KODO, nil
+	case "s3":
+		return KODO_BACKEND_S3, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s: %s", FIELD_BACKEND, s)
+	}
+}
+
+func parseKodoApiMode(s string) (KodoApiMode, error) {
+	switch toLower(s) {
+	case "auto", "":
+		return KODO_API_MODE_AUTO, nil
+	case "native":
+		return KODO_API_MODE_NATIVE, nil
+	case "s3":
+		return KODO_API_MODE_S3, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s: %s", FIELD_API_MODE, s)
+	}
+}
+
+func parseKodoMountCheck(s string) (KodoMountCheck, error) {
+	switch toLower(s) {
+	case "none", "off":
+		return KODO_MOUNT_CHECK_NONE, nil
+	case "statfs", "":
+		return KODO_MOUNT_CHECK_STATFS, nil
+	case "list":
+		return KODO_MOUNT_CHECK_LIST, nil
+	case "read":
+		return KODO_MOUNT_CHECK_READ, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s: %s", FIELD_MOUNT_CHECK, s)
+	}
+}
+
+func parseKodoIntegrityCheck(s string) (KodoIntegrityCheck, error) {
+	switch toLower(s) {
+	case "hash", "":
+		return KODO_INTEGRITY_CHECK_HASH, nil
+	case "download":
+		return KODO_INTEGRITY_CHECK_DOWNLOAD, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s: %s", FIELD_INTEGRITY_CHECK, s)
+	}
+}
+
+func parseS3SignatureVersion(s string) (S3SignatureVersion, error) {
+	switch toLower(s) {
+	case "2", "v2":
+		return S3_SIGNATURE_VERSION_V2, nil
+	case "4", "v4", "":
+		return S3_SIGNATURE_VERSION_V4, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s: %s", FIELD_S3_SIGNATURE_VERSION, s)
+	}
+}
+
 func toLower(s string) string {
 	return strings.ToLower(strings.TrimSpace(s))
 }
@@ -461,10 +1145,39 @@ func parseUint(s string) (uint64, error) {
 	return strconv.ParseUint(strings.TrimSpace(s), 10, 64)
 }
 
+// parseMounterWeight parses cpu.weight or io.weight of the cgroup of the mounter, from 1 to 10000 and 100 by default
+func parseMounterWeight(s string) (*uint64, error) {
+	weight, err := parseUint(s)
+	if err != nil {
+		return nil, err
+	} else if weight < 1 || weight > 10000 {
+		return nil, fmt.Errorf("%d is out of range from 1 to 10000", weight)
+	}
+	return &weight, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(s), 64)
+}
+
 func formatUint(i uint64) string {
 	return strconv.FormatUint(i, 10)
 }
 
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
 func formatBool(b bool) string {
 	return strconv.FormatBool(b)
 }
+
+// formatHostAliases formats the host aliases sorted by the host names, which is parsed by protocol.ParseHostAliases
+func formatHostAliases(aliases map[string]string) string {
+	pairs := make([]string, 0, len(aliases))
+	for host, ip := range aliases {
+		pairs = append(pairs, host+"="+ip)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// How often the Kodo volumes provisioned in every namespace are counted again from the PVs
+	KodoQuotaSyncInterval = time.Minute
+	// Timeout of a single round of counting the Kodo volumes
+	KodoQuotaSyncTimeout = time.Minute
+	// Key of the quota in the ConfigMap of --kodo-quota-configmap applied to the namespaces not listed
+	KodoQuotaDefaultKey = "*"
+)
+
+// kodoNamespaceQuota limits the Kodo volumes dynamically provisioned in a namespace, saved in the ConfigMap of --kodo-quota-configmap
+// by the namespace in JSON, e.g. {"capacity": "10Ti", "volumes": 20}. Unlike ResourceQuota, the volumes limit the buckets,
+// which are limited by Kodo for the whole account.
+type kodoNamespaceQuota struct {
+	// Max total capacity requested by the volumes, unlimited if not given
+	Capacity *resource.Quantity `json:"capacity,omitempty"`
+	// Max number of the volumes, unlimited if not given
+	Volumes *int64 `json:"volumes,omitempty"`
+}
+
+// kodoNamespaceUsage is the total capacity and the number of the Kodo volumes provisioned in a namespace
+type kodoNamespaceUsage struct {
+	capacity, volumes int64
+}
+
+// kodoProvisionedVolume is a volume created by the controller, which may not be saved to Kubernetes yet
+type kodoProvisionedVolume struct {
+	namespace string
+	capacity  int64
+	createdAt time.Time
+}
+
+// kodoQuotaTracker counts the Kodo volumes dynamically provisioned in every namespace,
+// from the PVs every KodoQuotaSyncInterval and from the volumes created by the controller since then
+type kodoQuotaTracker struct {
+	lock   sync.Mutex
+	usages map[string]*kodoNamespaceUsage
+	// Volumes created by the controller not found in the PVs yet, by the volume id
+	created   map[string]*kodoProvisionedVolume
+	synced    bool
+	startOnce sync.Once
+}
+
+func newKodoQuotaTracker() *kodoQuotaTracker {
+	return &kodoQuotaTracker{usages: make(map[string]*kodoNamespaceUsage), created: make(map[string]*kodoProvisionedVolume)}
+}
+
+// startQuotaTracker starts counting the volumes once the controller serves the first request, like startReconciler
+func (cs *kodoControllerServer) startQuotaTracker() {
+	cs.quota.startOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(KodoQuotaSyncInterval)
+				ctx, cancel := context.WithTimeout(context.Background(), KodoQuotaSyncTimeout)
+				if err := cs.syncQuotaUsages(ctx); err != nil {
+					log.Warnf("Quota: failed to count Kodo volumes of namespaces: %s", err)
+				}
+				cancel()
+			}
+		}()
+	})
+}
+
+// syncQuotaUsages counts the capacity and the number of the Kodo PVs provisioned by the driver by the namespaces of their PVCs.
+// The deleted volumes are no longer counted since then.
+func (cs *kodoControllerServer) syncQuotaUsages(ctx context.Context) error {
+	pvs, err := cs.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list volumes from Kubernetes error: %w", err)
+	}
+	usages := make(map[string]*kodoNamespaceUsage)
+	existing := make(map[string]bool, len(pvs.Items))
+	for _, pv := range pvs.Items {
+		// The statically provisioned volumes reuse the existing buckets
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != TypePluginKodo || pv.Annotations["pv.kubernetes.io/provisioned-by"] != TypePluginKodo || pv.Spec.ClaimRef == nil {
+			continue
+		}
+		existing[pv.Name] = true
+		usage := usages[pv.Spec.ClaimRef.Namespace]
+		if usage == nil {
+			usage = &kodoNamespaceUsage{}
+			usages[pv.Spec.ClaimRef.Namespace] = usage
+		}
+		capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+		usage.capacity += capacity.Value()
+		usage.volumes++
+	}
+
+	cs.quota.lock.Lock()
+	defer cs.quota.lock.Unlock()
+	for volumeId, volume := range cs.quota.created {
+		// The volume never saved to Kubernetes is deleted by csi-provisioner, or reconciled like its IAM user
+		if existing[volumeId] || time.Since(volume.createdAt) > KodoOrphanCredentialsGracePeriod {
+			delete(cs.quota.created, volumeId)
+		}
+	}
+	for namespace := range cs.quota.usages {
+		if usages[namespace] == nil {
+			kodoNamespaceProvisionedBytes.DeleteLabelValues(namespace)
+			kodoNamespaceVolumes.DeleteLabelValues(namespace)
+		}
+	}
+	for namespace, usage := range usages {
+		kodoNamespaceProvisionedBytes.WithLabelValues(namespace).Set(float64(usage.capacity))
+		kodoNamespaceVolumes.WithLabelValues(namespace).Set(float64(usage.volumes))
+	}
+	cs.quota.usages, cs.quota.synced = usages, true
+	return nil
+}
+
+// namespaceUsage returns the volumes provisioned in the namespace, including the ones created since the last sync
+func (cs *kodoControllerServer) namespaceUsage(ctx context.Context, namespace string) (kodoNamespaceUsage, error) {
+	cs.quota.lock.Lock()
+	synced := cs.quota.synced
+	cs.quota.lock.Unlock()
+	if !synced {
+		if err := cs.syncQuotaUsages(ctx); err != nil {
+			return kodoNamespaceUsage{}, err
+		}
+	}
+
+	cs.quota.lock.Lock()
+	defer cs.quota.lock.Unlock()
+	var usage kodoNamespaceUsage
+	if current := cs.quota.usages[namespace]; current != nil {
+		usage = *current
+	}
+	for _, volume := range cs.quota.created {
+		if volume.namespace == namespace {
+			usage.capacity += volume.capacity
+			usage.volumes++
+		}
+	}
+	return usage, nil
+}
+
+// checkQuota rejects the volume requested in the namespace beyond its quota as ResourceExhausted
+func (cs *kodoControllerServer) checkQuota(ctx context.Context, namespace string, capacity int64) error {
+	if cs.quota == nil || !featureGates.enabled(FeatureKodoNamespaceQuota) {
+		return nil
+	}
+	cs.startQuotaTracker()
+	configMap, err := cs.client.CoreV1().ConfigMaps(podNamespace()).Get(ctx, *kodoQuotaConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("CreateVolume: get %s from Kubernetes error: %w", *kodoQuotaConfigMap, err)
+	}
+	if namespace == "" {
+		return status.Errorf(codes.FailedPrecondition, "CreateVolume: namespace of the PVC is unknown to check the quota, csi-provisioner requires --extra-create-metadata")
+	}
+	value, ok := configMap.Data[namespace]
+	if !ok {
+		if value, ok = configMap.Data[KodoQuotaDefaultKey]; !ok {
+			return nil
+		}
+	}
+	var quota kodoNamespaceQuota
+	if err = json.Unmarshal([]byte(value), &quota); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "CreateVolume: invalid quota of namespace %s in %s: %s", namespace, *kodoQuotaConfigMap, err)
+	}
+
+	usage, err := cs.namespaceUsage(ctx, namespace)
+	if err != nil {
+		return fmt.Errorf("CreateVolume: count volumes of namespace %s error: %w", namespace, err)
+	}
+	if quota.Volumes != nil && usage.volumes+1 > *quota.Volumes {
+		return status.Errorf(codes.ResourceExhausted, "CreateVolume: exceeded quota of namespace %s: %d volumes are provisioned, limited to %d",
+			namespace, usage.volumes, *quota.Volumes)
+	} else if quota.Capacity != nil && usage.capacity+capacity > quota.Capacity.Value() {
+		return status.Errorf(codes.ResourceExhausted, "CreateVolume: exceeded quota of namespace %s: requested %d bytes, provisioned %d bytes, limited to %s",
+			namespace, capacity, usage.capacity, quota.Capacity.String())
+	}
+	return nil
+}
+
+// countCreatedVolume counts the new volume in the namespace until it's found in the PVs
+func (cs *kodoControllerServer) countCreatedVolume(volumeId, namespace string, capacity int64) {
+	if cs.quota == nil || namespace == "" {
+		return
+	}
+	cs.quota.lock.Lock()
+	defer cs.quota.lock.Unlock()
+	cs.quota.created[volumeId] = &kodoProvisionedVolume{namespace: namespace, capacity: capacity, createdAt: time.Now()}
+}
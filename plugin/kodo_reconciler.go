@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/qiniu/csi-driver/qiniu"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// ConfigMap recording the IAM users created for Kodo volumes, only the recorded ones could be deleted by the reconciler,
+	// so the IAM users created by other clusters or by hand with the same account are never touched
+	KodoIAMUsersConfigMapName = "kodoplugin-iam-users"
+	// IAM users younger than this are never treated as orphans, their volumes may not be saved to Kubernetes yet
+	KodoOrphanCredentialsGracePeriod = time.Hour
+	// Timeout of a single round of reconciliation
+	KodoReconcileTimeout = 10 * time.Minute
+)
+
+// kodoIAMUserRecord is saved in KodoIAMUsersConfigMapName by the volume name
+type kodoIAMUserRecord struct {
+	Account   string    `json:"account"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// kodoAccount is the account creating IAM users for volumes
+type kodoAccount struct {
+	accessKey, secretKey string
+	kodoStorageClassParameter
+}
+
+func newKodoAccount(accessKey, secretKey string, p *kodoStorageClassParameter) *kodoAccount {
+	return &kodoAccount{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		kodoStorageClassParameter: kodoStorageClassParameter{
+			ucEndpoint:         p.ucEndpoint,
+			caCert:             p.caCert,
+			insecureSkipVerify: p.insecureSkipVerify,
+		},
+	}
+}
+
+func (account *kodoAccount) key() string {
+	return account.ucEndpoint.String() + "/" + account.accessKey
+}
+
+func (account *kodoAccount) client() *qiniu.KodoClient {
+	return qiniu.NewKodoClient(account.accessKey, account.secretKey, account.ucEndpoint, account.tlsConfig(), VERSION, COMMITID)
+}
+
+// revokeKodoVolumeCredentials deletes the IAM user and the IAM policy created for the volume
+func revokeKodoVolumeCredentials(ctx context.Context, client *qiniu.KodoClient, volumeId string) error {
+	iamUserName := volumeId
+	iamPolicyName := normalizePolicyName(volumeId)
+	if err := client.RevokeIAMPolicyFromUser(ctx, iamUserName, []string{iamPolicyName}); err != nil {
+		return fmt.Errorf("revoke IAM policy %s from %s error: %w", iamPolicyName, iamUserName, err)
+	} else if err = client.DeleteIAMPolicy(ctx, iamPolicyName); err != nil {
+		return fmt.Errorf("delete IAM policy %s error: %w", iamPolicyName, err)
+	} else if err = client.DeleteIAMUser(ctx, iamUserName); err != nil {
+		return fmt.Errorf("delete IAM user %s error: %w", iamUserName, err)
+	}
+	return nil
+}
+
+func (cs *kodoControllerServer) rememberAccount(account *kodoAccount) {
+	if account.accessKey == "" || account.ucEndpoint == nil {
+		return
+	}
+	cs.accountsLock.Lock()
+	defer cs.accountsLock.Unlock()
+	cs.accounts[account.key()] = account
+}
+
+func (cs *kodoControllerServer) getAccount(key string) *kodoAccount {
+	cs.accountsLock.Lock()
+	defer cs.accountsLock.Unlock()
+	return cs.accounts[key]
+}
+
+func podNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return "kube-system"
+}
+
+// updateIAMUserRecords modifies the records of IAM users, the ConfigMap is created if not exists
+func (cs *kodoControllerServer) updateIAMUserRecords(ctx context.Context, modify func(data map[string]string)) error {
+	configMaps := cs.client.CoreV1().ConfigMaps(podNamespace())
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, KodoIAMUsersConfigMapName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: KodoIAMUsersConfigMapName}, Data: make(map[string]string)}
+			modify(configMap.Data)
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), KodoIAMUsersConfigMapName, err)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		modify(configMap.Data)
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// recordIAMUser records the IAM user before it's created, so that it could be deleted even if the volume is never saved
+func (cs *kodoControllerServer) recordIAMUser(ctx context.Context, volumeId string, account *kodoAccount) error {
+	record, err := json.Marshal(&kodoIAMUserRecord{Account: account.key(), CreatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return cs.updateIAMUserRecords(ctx, func(data map[string]string) {
+		data[volumeId] = string(record)
+	})
+}
+
+func (cs *kodoControllerServer) forgetIAMUser(ctx context.Context, volumeId string) error {
+	return cs.updateIAMUserRecords(ctx, func(data map[string]string) {
+		delete(data, volumeId)
+	})
+}
+
+// startReconciler starts reconciling once the controller serves the first request,
+// since the plugin runs on every node but only the instances behind the leader of csi-provisioner are used as the controller
+func (cs *kodoControllerServer) startReconciler() {
+	if *kodoReconcileInterval <= 0 {
+		return
+	}
+	cs.reconcileOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(*kodoReconcileInterval)
+				ctx, cancel := context.WithTimeout(context.Background(), KodoReconcileTimeout)
+				if err := cs.reconcileOrphanCredentials(ctx); err != nil {
+					log.Warnf("Reconcile: failed to delete orphan IAM users: %s", err)
+				}
+				cancel()
+			}
+		}()
+	})
+}
+
+// reconcileOrphanCredentials deletes the recorded IAM users whose volumes no longer exist,
+// which are left if the volume is never saved or deleted from Kubernetes without calling DeleteVolume successfully
+func (cs *kodoControllerServer) reconcileOrphanCredentials(ctx context.Context) error {
+	configMap, err := cs.client.CoreV1().ConfigMaps(podNamespace()).Get(ctx, KodoIAMUsersConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get %s from Kubernetes error: %w", KodoIAMUsersConfigMapName, err)
+	}
+	pvs, err := cs.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list volumes from Kubernetes error: %w", err)
+	}
+	existing := make(map[string]bool, len(pvs.Items))
+	for _, pv := range pvs.Items {
+		existing[pv.Name] = true
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != TypePluginKodo {
+			continue
+		}
+		// The accounts are recovered from the existing volumes, in case the controller is restarted
+		attributes := pv.Spec.CSI.VolumeAttributes
+		if parameter, err := parseKodoStorageClassParameter("Reconcile", attributes, nil); err == nil {
+			cs.rememberAccount(newKodoAccount(attributes[FIELD_ORIGINAL_ACCESS_KEY], attributes[FIELD_ORIGINAL_SECRET_KEY], parameter))
+		}
+	}
+
+	usersOfAccounts := make(map[string]map[string]bool)
+	for volumeId, value := range configMap.Data {
+		var record kodoIAMUserRecord
+		if err = json.Unmarshal([]byte(value), &record); err != nil {
+			log.Warnf("Reconcile: invalid record of IAM user %s: %s", volumeId, err)
+			continue
+		}
+		if existing[volumeId] || cs.isCreating(volumeId) || time.Since(record.CreatedAt) < KodoOrphanCredentialsGracePeriod {
+			continue
+		}
+		account := cs.getAccount(record.Account)
+		if account == nil {
+			log.Warnf("Reconcile: no credentials of %s to delete orphan IAM user %s", record.Account, volumeId)
+			continue
+		}
+		client := account.client()
+		users, ok := usersOfAccounts[record.Account]
+		if !ok {
+			list, err := client.ListIAMUsers(ctx)
+			if err != nil {
+				log.Warnf("Reconcile: failed to list IAM users of %s: %s", record.Account, err)
+				continue
+			}
+			users = make(map[string]bool, len(list))
+			for _, user := range list {
+				users[user.Alias] = true
+			}
+			usersOfAccounts[record.Account] = users
+		}
+		if users[volumeId] {
+			if err = revokeKodoVolumeCredentials(ctx, client, volumeId); err != nil {
+				log.Warnf("Reconcile: failed to delete orphan IAM user %s: %s", volumeId, err)
+				continue
+			}
+			log.Infof("Reconcile: orphan IAM user %s is deleted", volumeId)
+		}
+		if err = cs.forgetIAMUser(ctx, volumeId); err != nil {
+			log.Warnf("Reconcile: failed to forget IAM user %s: %s", volumeId, err)
+		}
+	}
+	return nil
+}
+
+// isCreating returns whether the volume is created by the controller but may not be saved to Kubernetes yet
+func (cs *kodoControllerServer) isCreating(volumeId string) bool {
+	cs.volumesLock.Lock()
+	defer cs.volumesLock.Unlock()
+	_, exists := cs.volumes[volumeId]
+	return exists
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/qiniu"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Timeout of a single round of exporting the storage usage
+const KodoUsageExportTimeout = 10 * time.Minute
+
+const (
+	// Annotations of the Kodo PVs with the used bytes of their buckets counted by Kodo, and the quotas of the buckets if set
+	KodoUsedBytesAnnotation  = "csi.qiniu.com/used-bytes"
+	KodoQuotaBytesAnnotation = "csi.qiniu.com/quota-bytes"
+)
+
+// kodoQuotaAlertLevels are the percentages of the bucket quotas parsed from --kodo-quota-alert-thresholds in ascending order
+var kodoQuotaAlertLevels []float64
+
+// startUsageExporter starts exporting the storage usage once the controller serves the first request, like startReconciler
+func (cs *kodoControllerServer) startUsageExporter() {
+	if *kodoUsageInterval <= 0 {
+		return
+	}
+	cs.usageExporterOnce.Do(func() {
+		go func() {
+			exported := make(map[string]prometheus.Labels)
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), KodoUsageExportTimeout)
+				if err := cs.exportUsage(ctx, exported); err != nil {
+					log.Warnf("ExportUsage: failed to export storage usage of volumes: %s", err)
+				}
+				cancel()
+				time.Sleep(*kodoUsageInterval)
+			}
+		}()
+	})
+}
+
+// exportUsage sets the storage usage of every Kodo volume to the metrics, and deletes the metrics of the volumes no longer exist.
+// The metrics of a volume are kept if its usage fails to be got, so that the dashboards are not broken by a transient error.
+// The volumes are also annotated with their estimated costs if --kodo-pricing-config is given.
+func (cs *kodoControllerServer) exportUsage(ctx context.Context, exported map[string]prometheus.Labels) error {
+	pvs, err := cs.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list volumes from Kubernetes error: %w", err)
+	}
+	var transferredBytes map[string]float64
+	if kodoPricingTable != nil && *kodoTransferPrometheusUrl != "" {
+		// Only the storage costs are estimated this time
+		if transferredBytes, err = queryKodoTransferredBytes(ctx); err != nil {
+			log.Warnf("ExportUsage: failed to query transferred bytes of volumes: %s", err)
+		}
+	}
+	existing := make(map[string]bool, len(pvs.Items))
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != TypePluginKodo {
+			continue
+		}
+		existing[pv.Name] = true
+		labels, err := cs.exportVolumeUsage(ctx, pv, transferredBytes)
+		if err != nil {
+			log.Warnf("ExportUsage: failed to get storage usage of volume %s: %s", pv.Name, err)
+			continue
+		} else if labels == nil {
+			continue
+		}
+		if previous, ok := exported[pv.Name]; ok && (previous["bucket"] != labels["bucket"] || previous["pvc"] != labels["pvc"] || previous["namespace"] != labels["namespace"]) {
+			kodoVolumeUsedBytes.Delete(previous)
+			kodoVolumeObjects.Delete(previous)
+			kodoVolumeQuotaUsageRatio.Delete(previous)
+		}
+		exported[pv.Name] = labels
+	}
+	for name, labels := range exported {
+		if !existing[name] {
+			kodoVolumeUsedBytes.Delete(labels)
+			kodoVolumeObjects.Delete(labels)
+			kodoVolumeQuotaUsageRatio.Delete(labels)
+			delete(exported, name)
+			delete(cs.quotaAlerted, name)
+		}
+	}
+	return nil
+}
+
+func (cs *kodoControllerServer) exportVolumeUsage(ctx context.Context, pv *corev1.PersistentVolume, transferredBytes map[string]float64) (prometheus.Labels, error) {
+	secrets, err := getNodePublishSecrets(ctx, cs.client, pv)
+	if err != nil {
+		return nil, err
+	}
+	parameter, err := parseKodoPvParameter("ExportUsage", pv.Spec.CSI.VolumeAttributes, secrets)
+	if err != nil {
+		return nil, err
+	} else if parameter.apiMode != KODO_API_MODE_NATIVE {
+		// The bucket statistics are only served by the native Kodo APIs, which are not used by the volume
+		return nil, nil
+	} else if parameter.bucketName == "" {
+		return nil, fmt.Errorf("%s is not given", FIELD_BUCKET_NAME)
+	}
+	// The IAM users created for the volumes are not permitted to read the statistics of the buckets
+	accessKey, secretKey := parameter.originalAccessKey, parameter.originalSecretKey
+	if accessKey == "" || secretKey == "" {
+		accessKey, secretKey = parameter.accessKey, parameter.secretKey
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("no credentials to get storage usage")
+	}
+	client := newKodoAccount(accessKey, secretKey, &parameter.kodoStorageClassParameter).client()
+	usage, err := client.GetBucketUsage(ctx, parameter.bucketName, parameter.storageClass)
+	if err != nil {
+		return nil, err
+	}
+	// The usage is still exported without the quota
+	quota, err := client.GetBucketQuota(ctx, parameter.bucketName)
+	if err != nil {
+		log.Warnf("ExportUsage: failed to get bucket quota of volume %s: %s", pv.Name, err)
+	}
+
+	labels := prometheus.Labels{"pv": pv.Name, "pvc": "", "namespace": "", "bucket": parameter.bucketName}
+	if claimRef := pv.Spec.ClaimRef; claimRef != nil {
+		labels["pvc"] = claimRef.Name
+		labels["namespace"] = claimRef.Namespace
+	}
+	kodoVolumeUsedBytes.With(labels).Set(float64(usage.Bytes))
+	kodoVolumeObjects.With(labels).Set(float64(usage.Objects))
+	if kodoPricingTable != nil {
+		if err = cs.annotateVolumeCost(ctx, pv, parameter.storageClass, usage.Bytes, transferredBytes); err != nil {
+			log.Warnf("ExportUsage: failed to annotate estimated cost of volume %s: %s", pv.Name, err)
+		}
+	}
+	if err = cs.annotateVolumeSpace(ctx, pv, usage, quota); err != nil {
+		log.Warnf("ExportUsage: failed to annotate storage usage of volume %s: %s", pv.Name, err)
+	}
+	if len(kodoQuotaAlertLevels) > 0 && quota != nil {
+		cs.alertNearQuota(pv, labels, usage, quota)
+	}
+	return labels, nil
+}
+
+// parseQuotaAlertThresholds parses the comma-separated percentages of --kodo-quota-alert-thresholds in ascending order
+func parseQuotaAlertThresholds(value string) ([]float64, error) {
+	var thresholds []float64
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		threshold, err := strconv.ParseFloat(field, 64)
+		if err != nil || threshold <= 0 || threshold > 100 {
+			return nil, fmt.Errorf("invalid threshold %s, expect a percentage in (0, 100]", field)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Float64s(thresholds)
+	return thresholds, nil
+}
+
+// alertNearQuota exports the usage of the bucket quota of the volume, and warns on its PVC once the usage crosses a higher threshold.
+// A volume is warned again by each threshold once its usage falls below, or the controller restarts or moves to another node, since
+// the warned thresholds are only kept in memory.
+func (cs *kodoControllerServer) alertNearQuota(pv *corev1.PersistentVolume, labels prometheus.Labels, usage *qiniu.BucketUsage, quota *qiniu.BucketQuota) {
+	ratio := -1.0
+	if quota.Bytes > 0 {
+		ratio = float64(usage.Bytes) / float64(quota.Bytes)
+	}
+	if quota.Objects > 0 {
+		ratio = math.Max(ratio, float64(usage.Objects)/float64(quota.Objects))
+	}
+	if ratio < 0 {
+		// No quota is set on the bucket
+		kodoVolumeQuotaUsageRatio.Delete(labels)
+		delete(cs.quotaAlerted, pv.Name)
+		return
+	}
+	kodoVolumeQuotaUsageRatio.With(labels).Set(ratio)
+
+	crossed := 0.0
+	for _, threshold := range kodoQuotaAlertLevels {
+		if ratio*100 >= threshold {
+			crossed = threshold
+		}
+	}
+	alerted := cs.quotaAlerted[pv.Name]
+	cs.quotaAlerted[pv.Name] = crossed
+	if crossed <= alerted || labels["pvc"] == "" {
+		return
+	}
+	message := fmt.Sprintf("Bucket %s has used %.1f%% of its quota, the writes are rejected by Kodo once it's exceeded", labels["bucket"], ratio*100)
+	log.Warnf("ExportUsage: volume %s crosses %g%% of bucket quota: %s", pv.Name, crossed, message)
+	go emitWarningEvent("PersistentVolumeClaim", labels["namespace"], labels["pvc"], EventReasonNearQuota, message)
+}
+
+// annotateVolumeSpace annotates the PV with the used bytes of its bucket, and with the quota of the bucket if got,
+// which are reported as the usage of the volume by the node servers, see kodoNodeServer.NodeGetVolumeStats
+func (cs *kodoControllerServer) annotateVolumeSpace(ctx context.Context, pv *corev1.PersistentVolume, usage *qiniu.BucketUsage, quota *qiniu.BucketQuota) error {
+	annotations := map[string]string{KodoUsedBytesAnnotation: strconv.FormatInt(usage.Bytes, 10)}
+	if quota != nil && quota.Bytes > 0 {
+		annotations[KodoQuotaBytesAnnotation] = strconv.FormatInt(quota.Bytes, 10)
+	} else if quota != nil {
+		annotations[KodoQuotaBytesAnnotation] = ""
+	}
+	return cs.updateVolumeAnnotations(ctx, pv, annotations)
+}
+
+// updateVolumeAnnotations sets the annotations of the PV, or removes the ones with empty values, the PV is only updated if they change
+func (cs *kodoControllerServer) updateVolumeAnnotations(ctx context.Context, pv *corev1.PersistentVolume, annotations map[string]string) error {
+	pvs := cs.client.CoreV1().PersistentVolumes()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := pvs.Get(ctx, pv.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed := false
+		for key, value := range annotations {
+			if current, ok := latest.Annotations[key]; value == "" && ok {
+				delete(latest.Annotations, key)
+				changed = true
+			} else if value != "" && current != value {
+				if latest.Annotations == nil {
+					latest.Annotations = make(map[string]string)
+				}
+				latest.Annotations[key] = value
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = pvs.Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+}
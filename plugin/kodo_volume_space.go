@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// How long the space of a Kodo volume read from its PV is kept by the node server
+const KodoVolumeSpaceCacheTTL = 5 * time.Minute
+
+// kodoVolumeSpace is the space of a Kodo volume known by its PV, which is negative if unknown
+type kodoVolumeSpace struct {
+	// Capacity requested by the PVC, only known for the dynamically provisioned volumes,
+	// since the capacity of the statically provisioned ones is usually a placeholder
+	capacity int64
+	// Quota and used bytes of the bucket annotated by the controller, see kodoControllerServer.annotateVolumeSpace
+	quota, used int64
+	fetchedAt   time.Time
+}
+
+// kodoVolumeSpaces caches the space of the Kodo volumes by the volume id
+var kodoVolumeSpaces sync.Map
+
+// total returns the size of the volume, which is the quota of the bucket if set, or the capacity requested by the PVC
+func (space *kodoVolumeSpace) total() int64 {
+	if space.quota > 0 {
+		return space.quota
+	}
+	return space.capacity
+}
+
+// apply reports the size and the used bytes of the volume instead of the ones made up by rclone,
+// which knows neither the quota nor the usage of the bucket
+func (space *kodoVolumeSpace) apply(usage *csi.VolumeUsage) {
+	if total := space.total(); total > 0 {
+		usage.Total = total
+	}
+	if space.used >= 0 {
+		usage.Used = space.used
+	}
+	if usage.Available = usage.Total - usage.Used; usage.Available < 0 {
+		usage.Available = 0
+	}
+}
+
+// getKodoVolumeSpace returns the space of the volume from its PV, or nil if the PV fails to be read.
+// The last space is returned before it's KodoVolumeSpaceCacheTTL old, or if the PV fails to be read again.
+func getKodoVolumeSpace(ctx context.Context, volumeId string) *kodoVolumeSpace {
+	var last *kodoVolumeSpace
+	if value, ok := kodoVolumeSpaces.Load(volumeId); ok {
+		if last = value.(*kodoVolumeSpace); time.Since(last.fetchedAt) < KodoVolumeSpaceCacheTTL {
+			return last
+		}
+	}
+	client := getPvcClient()
+	if client == nil {
+		return nil
+	}
+	getCtx, cancel := context.WithTimeout(ctx, PvcAnnotationsTimeout)
+	defer cancel()
+	pv, err := getPersistentVolume(getCtx, client, TypePluginKodo, volumeId)
+	if err != nil {
+		logger(ctx).Warnf("Failed to get volume %s, its space is unknown: %s", volumeId, err)
+		return last
+	} else if pv == nil {
+		return nil
+	}
+
+	space := &kodoVolumeSpace{capacity: -1, quota: -1, used: -1, fetchedAt: time.Now()}
+	if capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]; ok && pv.Annotations["pv.kubernetes.io/provisioned-by"] == TypePluginKodo {
+		space.capacity = capacity.Value()
+	}
+	if value, err := strconv.ParseInt(pv.Annotations[KodoQuotaBytesAnnotation], 10, 64); err == nil {
+		space.quota = value
+	}
+	if value, err := strconv.ParseInt(pv.Annotations[KodoUsedBytesAnnotation], 10, 64); err == nil {
+		space.used = value
+	}
+	kodoVolumeSpaces.Store(volumeId, space)
+	return space
+}
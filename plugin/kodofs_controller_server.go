@@ -18,7 +18,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 type kodofsControllerServer struct {
@@ -29,13 +28,9 @@ type kodofsControllerServer struct {
 }
 
 func newKodoFSControllerServer(d *csicommon.CSIDriver) csi.ControllerServer {
-	config, err := rest.InClusterConfig()
+	clientset, err := orchestrator.kubernetesClient()
 	if err != nil {
-		log.Fatalf("newKodoFSControllerServer: failed to create config: %v", err)
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatalf("newKodoFSControllerServer: failed to create client: %v", err)
+		log.Fatalf("newKodoFSControllerServer: %v", err)
 	}
 
 	c := &kodofsControllerServer{
@@ -47,14 +42,17 @@ func newKodoFSControllerServer(d *csicommon.CSIDriver) csi.ControllerServer {
 }
 
 func (cs *kodofsControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := requireKubernetes("CreateVolume", cs.client); err != nil {
+		return nil, err
+	}
 	pvName := req.GetName()
-	log.Infof("CreateVolume: starting creating KodoFS volume %s", pvName)
+	logger(ctx).Infof("CreateVolume: starting creating KodoFS volume %s", pvName)
 
 	cs.volumesLock.Lock()
 	defer cs.volumesLock.Unlock()
 
 	if volume, exists := cs.volumes[pvName]; exists {
-		log.Warnf("CreateVolume: volume %s already exists", pvName)
+		logger(ctx).Warnf("CreateVolume: volume %s already exists", pvName)
 		return &csi.CreateVolumeResponse{Volume: volume}, nil
 	}
 
@@ -62,7 +60,10 @@ func (cs *kodofsControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	if err != nil {
 		return nil, err
 	}
-	client := qiniu.NewKodoFSClient(parameter.accessKey, parameter.secretKey, parameter.masterServerAddress, VERSION, COMMITID)
+	client := qiniu.NewKodoFSClient(parameter.accessKey, parameter.secretKey, parameter.masterServerAddresses, VERSION, COMMITID)
+	if err = client.VerifyCredentials(ctx, pvName); err != nil {
+		return nil, verifyCredentialsError("CreateVolume", err, FIELD_MASTER_SERVER_ADDRESS)
+	}
 	gatewayId, err := client.CreateVolume(ctx, pvName, pvName, parameter.region, parameter.fsType, parameter.blockSize)
 	if err != nil {
 		return nil, fmt.Errorf("CreateVolume: create mount %s error: %w", pvName, err)
@@ -75,7 +76,7 @@ func (cs *kodofsControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	if err != nil {
 		return nil, fmt.Errorf("CreateVolume: get access token %s error: %w", accessPointId, err)
 	}
-	log.Infof("CreateVolume: KodoFS volume %s is created", pvName)
+	logger(ctx).Infof("CreateVolume: KodoFS volume %s is created", pvName)
 
 	volumeContext := map[string]string{
 		FIELD_GATEWAY_ID:            gatewayId,
@@ -83,12 +84,39 @@ func (cs *kodofsControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		FIELD_ACCESS_TOKEN:          accessToken,
 		FIELD_ACCESS_KEY:            parameter.accessKey,
 		FIELD_SECRET_KEY:            parameter.secretKey,
-		FIELD_MOUNT_SERVER_ADDRESS:  parameter.mountServerAddress.String(),
-		FIELD_MASTER_SERVER_ADDRESS: parameter.masterServerAddress.String(),
+		FIELD_MOUNT_SERVER_ADDRESS:  parameter.mountServerAddresses.String(),
+		FIELD_MASTER_SERVER_ADDRESS: parameter.masterServerAddresses.String(),
 		FIELD_REGION:                parameter.region,
 		FIELD_FS_TYPE:               strconv.FormatUint(uint64(parameter.fsType), 10),
 		FIELD_BLOCK_SIZE:            strconv.FormatUint(uint64(parameter.blockSize), 10),
 	}
+	if parameter.httpProxy != nil {
+		volumeContext[FIELD_HTTP_PROXY] = parameter.httpProxy.String()
+	}
+	if parameter.httpsProxy != nil {
+		volumeContext[FIELD_HTTPS_PROXY] = parameter.httpsProxy.String()
+	}
+	if parameter.noProxy != "" {
+		volumeContext[FIELD_NO_PROXY] = parameter.noProxy
+	}
+	if parameter.mountOptions != "" {
+		volumeContext[FIELD_MOUNT_OPTIONS] = parameter.mountOptions
+	}
+	if parameter.noRwCache {
+		volumeContext[FIELD_NO_RW_CACHE] = strconv.FormatBool(parameter.noRwCache)
+	}
+	if parameter.kodofsParams != "" {
+		volumeContext[FIELD_KODOFS_PARAMS] = parameter.kodofsParams
+	}
+	if parameter.retries != nil {
+		volumeContext[FIELD_RETRIES] = formatUint(*parameter.retries)
+	}
+	if parameter.connectTimeout != nil {
+		volumeContext[FIELD_CONNECT_TIMEOUT] = parameter.connectTimeout.String()
+	}
+	if parameter.timeout != nil {
+		volumeContext[FIELD_TIMEOUT] = parameter.timeout.String()
+	}
 	volume := &csi.Volume{
 		CapacityBytes: int64(req.GetCapacityRange().GetRequiredBytes()),
 		VolumeId:      pvName,
@@ -100,6 +128,9 @@ func (cs *kodofsControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 
 func (cs *kodofsControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeId := req.GetVolumeId()
+	if err := requireKubernetes("DeleteVolume", cs.client); err != nil {
+		return nil, err
+	}
 
 	pvInfo, err := cs.client.CoreV1().PersistentVolumes().Get(ctx, volumeId, metav1.GetOptions{})
 	if err != nil {
@@ -112,9 +143,9 @@ func (cs *kodofsControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 
 	persistentVolumeReclaimPolicy := pvInfo.Spec.PersistentVolumeReclaimPolicy
 	if persistentVolumeReclaimPolicy != "" {
-		log.Infof("DeleteVolume: starting deleting KodoFS volume %s (%s)", volumeId, persistentVolumeReclaimPolicy)
+		logger(ctx).Infof("DeleteVolume: starting deleting KodoFS volume %s (%s)", volumeId, persistentVolumeReclaimPolicy)
 	} else {
-		log.Infof("DeleteVolume: starting deleting KodoFS volume %s", volumeId)
+		logger(ctx).Infof("DeleteVolume: starting deleting KodoFS volume %s", volumeId)
 	}
 
 	cs.volumesLock.Lock()
@@ -122,14 +153,15 @@ func (cs *kodofsControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 
 	delete(cs.volumes, volumeId)
 
-	client := qiniu.NewKodoFSClient(parameter.accessKey, parameter.secretKey, parameter.masterServerAddress, VERSION, COMMITID)
+	client := qiniu.NewKodoFSClient(parameter.accessKey, parameter.secretKey, parameter.masterServerAddresses, VERSION, COMMITID)
 
 	if persistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimDelete {
 		if tempMountPath, err := ioutil.TempDir("", "temp-mnt-point-*"); err != nil {
 			return nil, fmt.Errorf("DeleteVolume: failed to create temporary mount point: %w", err)
 		} else {
 			defer os.Remove(tempMountPath)
-			if err = mountKodoFSLocally(ctx, parameter.gatewayID, tempMountPath, parameter.mountServerAddress, parameter.accessToken, "/"); err != nil {
+			if err = mountKodoFSLocally(ctx, parameter.gatewayID, tempMountPath, parameter.mountServerAddresses, parameter.accessToken, "/",
+				formatUrl(parameter.httpProxy), formatUrl(parameter.httpsProxy), parameter.noProxy); err != nil {
 				return nil, fmt.Errorf("DeleteVolume: failed to to mount kodofs to %s: %w", tempMountPath, err)
 			}
 			defer umount(tempMountPath)
@@ -150,7 +182,7 @@ func (cs *kodofsControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 			} else if err = client.RemoveVolume(ctx, volumeId); err != nil {
 				return nil, fmt.Errorf("DeleteVolume: delete volume %s error: %w", volumeId, err)
 			}
-			log.Infof("DeleteVolume: KodoFS volume %s is deleted", volumeId)
+			logger(ctx).Infof("DeleteVolume: KodoFS volume %s is deleted", volumeId)
 		}
 	} else {
 		if err = client.RemoveAccessPoint(ctx, parameter.accessPointId); err != nil {
@@ -164,18 +196,67 @@ func (cs *kodofsControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 				if err = client.RenameVolume(ctx, volumeId, newVolumeId); err != nil {
 					return nil, fmt.Errorf("DeleteVolume: rename volume %s => %s error: %w", volumeId, newVolumeId, err)
 				}
-				log.Infof("DeleteVolume: KodoFS volume %s is deleted, archive to %s", volumeId, newVolumeId)
+				logger(ctx).Infof("DeleteVolume: KodoFS volume %s is deleted, archive to %s", volumeId, newVolumeId)
+				break
 			}
 		}
 	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+func (cs *kodofsControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	return validateVolumeCapabilities(cs.Driver, req, func(*csi.VolumeCapability) string {
+		return ""
+	})
+}
+
 func (cs *kodofsControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest,
 ) (*csi.ControllerExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (cs *kodofsControllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume is called by the external-health-monitor, which emits events on the PVCs if the volumes are abnormal
+func (cs *kodofsControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := requireKubernetes("ControllerGetVolume", cs.client); err != nil {
+		return nil, err
+	}
+	return controllerGetVolume(ctx, cs.client, TypePluginKodoFS, req.GetVolumeId(), func(pv *corev1.PersistentVolume) error {
+		return cs.checkVolume(ctx, pv)
+	})
+}
+
+// ListVolumes is called by the external-health-monitor instead of ControllerGetVolume, which lists the volumes published on the nodes
+// deleted or not ready as abnormal, so the volumes left published by the failed nodes are noticed
+func (cs *kodofsControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := requireKubernetes("ListVolumes", cs.client); err != nil {
+		return nil, err
+	}
+	return listVolumes(ctx, cs.client, TypePluginKodoFS, req, func(pv *corev1.PersistentVolume) error {
+		return cs.checkVolume(ctx, pv)
+	})
+}
+
+// checkVolume checks whether the keys of the volume are still valid and the volume still exists
+func (cs *kodofsControllerServer) checkVolume(ctx context.Context, pv *corev1.PersistentVolume) error {
+	secrets, err := getNodePublishSecrets(ctx, cs.client, pv)
+	if err != nil {
+		return err
+	}
+	parameter, err := parseKodoFSPvParameter("ControllerGetVolume", pv.Spec.CSI.VolumeAttributes, secrets)
+	if err != nil {
+		return err
+	} else if parameter.accessKey == "" || len(parameter.masterServerAddresses) == 0 {
+		// Statically provisioned volumes are mounted by the access token only
+		return nil
+	}
+	volumeName := pv.Spec.CSI.VolumeHandle
+	client := qiniu.NewKodoFSClient(parameter.accessKey, parameter.secretKey, parameter.masterServerAddresses, VERSION, COMMITID)
+	if err = client.VerifyCredentials(ctx, volumeName); err != nil {
+		return fmt.Errorf("credentials of the volume are rejected: %w", err)
+	} else if exists, err := client.IsVolumeExists(ctx, volumeName); err != nil {
+		return fmt.Errorf("failed to get volume %s: %w", volumeName, err)
+	} else if !exists {
+		return fmt.Errorf("KodoFS volume %s does not exist", volumeName)
+	}
+	return nil
 }
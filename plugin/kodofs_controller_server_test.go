@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	csitesting "github.com/qiniu/csi-driver/internal/testing"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestKodoFSControllerServer returns the controller calling the mock KodoFS master and the fake Kubernetes API
+func newTestKodoFSControllerServer(t *testing.T) (*kodofsControllerServer, *csitesting.MockKodoFS) {
+	kodofs := csitesting.NewMockKodoFS()
+	t.Cleanup(kodofs.Close)
+	return &kodofsControllerServer{
+		volumes: make(map[string]*csi.Volume),
+		client:  kubefake.NewSimpleClientset(),
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(
+			csicommon.NewCSIDriver("kodofsplugin.storage.qiniu.com", "test", "controller")),
+	}, kodofs
+}
+
+func newKodoFSCreateVolumeRequest(kodofs *csitesting.MockKodoFS, name string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+		Parameters: map[string]string{FIELD_REGION: "z0"},
+		Secrets: map[string]string{
+			FIELD_ACCESS_KEY:            "access-key",
+			FIELD_SECRET_KEY:            "secret-key",
+			FIELD_MASTER_SERVER_ADDRESS: kodofs.URL(),
+			FIELD_MOUNT_SERVER_ADDRESS:  "http://10.0.0.1:8080",
+		},
+	}
+}
+
+func saveProvisionedKodoFSVolume(t *testing.T, cs *kodofsControllerServer, volume *csi.Volume, policy corev1.PersistentVolumeReclaimPolicy) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: volume.VolumeId},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: policy,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver: TypePluginKodoFS, VolumeHandle: volume.VolumeId, VolumeAttributes: volume.VolumeContext,
+			}},
+		},
+	}
+	if _, err := cs.client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to save volume %s: %s", volume.VolumeId, err)
+	}
+}
+
+func TestKodoFSControllerServerCreateVolume(t *testing.T) {
+	cs, kodofs := newTestKodoFSControllerServer(t)
+	req := newKodoFSCreateVolumeRequest(kodofs, "pv-1")
+
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	created, exists := kodofs.Volumes()["pv-1"]
+	if !exists {
+		t.Fatalf("no KodoFS volume is created")
+	} else if created.Region != "z0" {
+		t.Fatalf("KodoFS volume is created in %s, expected z0", created.Region)
+	}
+	accessPoints := kodofs.AccessPoints()
+	if len(accessPoints) != 1 {
+		t.Fatalf("%d access points are created, expected 1", len(accessPoints))
+	}
+	var accessPointId string
+	for accessPointId = range accessPoints {
+	}
+	volume := resp.GetVolume()
+	for field, expected := range map[string]string{
+		FIELD_GATEWAY_ID:            created.GatewayID,
+		FIELD_ACCESS_POINT_ID:       accessPointId,
+		FIELD_ACCESS_TOKEN:          "token-" + accessPointId,
+		FIELD_MASTER_SERVER_ADDRESS: kodofs.URL(),
+	} {
+		if actual := volume.VolumeContext[field]; actual != expected {
+			t.Fatalf("%s of the volume is %q, expected %q", field, actual, expected)
+		}
+	}
+
+	// Retried by csi-provisioner, the same volume is returned
+	if resp, err = cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to create volume again: %s", err)
+	} else if resp.GetVolume() != volume {
+		t.Fatalf("another volume %v is created", resp.GetVolume())
+	} else if accessPoints := kodofs.AccessPoints(); len(accessPoints) != 1 {
+		t.Fatalf("%d access points are created, expected 1", len(accessPoints))
+	}
+}
+
+func TestKodoFSControllerServerDeleteVolumeArchives(t *testing.T) {
+	cs, kodofs := newTestKodoFSControllerServer(t)
+	req := newKodoFSCreateVolumeRequest(kodofs, "pv-1")
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	gatewayId := resp.GetVolume().VolumeContext[FIELD_GATEWAY_ID]
+	// Archived by the volume of the same name deleted before
+	kodofs.AddVolume("deleted-0-pv-1")
+
+	saveProvisionedKodoFSVolume(t, cs, resp.GetVolume(), corev1.PersistentVolumeReclaimRetain)
+	if _, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pv-1", Secrets: req.Secrets}); err != nil {
+		t.Fatalf("failed to delete volume: %s", err)
+	}
+	volumes := kodofs.Volumes()
+	if _, exists := volumes["pv-1"]; exists {
+		t.Fatalf("deleted volume is not archived")
+	} else if archived, exists := volumes["deleted-1-pv-1"]; !exists || archived.GatewayID != gatewayId {
+		t.Fatalf("deleted volume is not archived to the first name unused: %v", volumes)
+	} else if accessPoints := kodofs.AccessPoints(); len(accessPoints) != 0 {
+		t.Fatalf("access points %v are left after the volume is deleted", accessPoints)
+	}
+}
+
+func TestKodoFSControllerServerCreateVolumeFailsByKodoFS(t *testing.T) {
+	for name, test := range map[string]struct {
+		fail func(kodofs *csitesting.MockKodoFS)
+		code codes.Code
+	}{
+		"wrong credentials":         {fail: func(kodofs *csitesting.MockKodoFS) { kodofs.FailAuth(401) }, code: codes.Unauthenticated},
+		"credentials not permitted": {fail: func(kodofs *csitesting.MockKodoFS) { kodofs.FailAuth(403) }, code: codes.PermissionDenied},
+		"master unavailable":        {fail: func(kodofs *csitesting.MockKodoFS) { kodofs.Fail("", 503, "master is down") }, code: codes.Unavailable},
+		"no access point": {fail: func(kodofs *csitesting.MockKodoFS) {
+			kodofs.Fail("/v1/kodofs-master/accessPoint/", 400, "too many access points")
+		}, code: codes.Unknown},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cs, kodofs := newTestKodoFSControllerServer(t)
+			req := newKodoFSCreateVolumeRequest(kodofs, "pv-1")
+
+			test.fail(kodofs)
+			_, err := cs.CreateVolume(context.Background(), req)
+			expectCode(t, err, test.code)
+			if _, remembered := cs.volumes["pv-1"]; remembered {
+				t.Fatalf("volume failed to be created is remembered")
+			} else if accessPoints := kodofs.AccessPoints(); len(accessPoints) != 0 {
+				t.Fatalf("access points %v are created by the failed request", accessPoints)
+			}
+		})
+	}
+}
+
+func TestKodoFSControllerServerCreateVolumeRejectsInvalidRequests(t *testing.T) {
+	for name, modify := range map[string]func(req *csi.CreateVolumeRequest){
+		"no secret key":            func(req *csi.CreateVolumeRequest) { delete(req.Secrets, FIELD_SECRET_KEY) },
+		"no master server address": func(req *csi.CreateVolumeRequest) { delete(req.Secrets, FIELD_MASTER_SERVER_ADDRESS) },
+		"invalid kodofs params": func(req *csi.CreateVolumeRequest) {
+			req.Parameters[FIELD_KODOFS_PARAMS] = "cache"
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cs, kodofs := newTestKodoFSControllerServer(t)
+			req := newKodoFSCreateVolumeRequest(kodofs, "pv-1")
+			modify(req)
+			if _, err := cs.CreateVolume(context.Background(), req); err == nil {
+				t.Fatalf("invalid request is created")
+			} else if volumes := kodofs.Volumes(); len(volumes) != 0 {
+				t.Fatalf("KodoFS volumes %v are created by the invalid request", volumes)
+			}
+		})
+	}
+}
+
+func TestKodoFSControllerServerDeleteVolumeFailsByKodoFS(t *testing.T) {
+	cs, kodofs := newTestKodoFSControllerServer(t)
+	req := newKodoFSCreateVolumeRequest(kodofs, "pv-1")
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %s", err)
+	}
+	deleteReq := &csi.DeleteVolumeRequest{VolumeId: "pv-1", Secrets: req.Secrets}
+
+	// Not saved to Kubernetes yet
+	if _, err = cs.DeleteVolume(context.Background(), deleteReq); err == nil {
+		t.Fatalf("volume unknown to Kubernetes is deleted")
+	}
+
+	saveProvisionedKodoFSVolume(t, cs, resp.GetVolume(), corev1.PersistentVolumeReclaimRetain)
+	kodofs.Fail("/v1/kodofs-master/volume/rename", 400, "volume is in use")
+	if _, err = cs.DeleteVolume(context.Background(), deleteReq); err == nil {
+		t.Fatalf("volume is deleted even though it fails to be archived")
+	} else if _, exists := kodofs.Volumes()["pv-1"]; !exists {
+		t.Fatalf("volume failed to be archived is gone")
+	}
+}
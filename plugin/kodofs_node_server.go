@@ -7,7 +7,6 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
-	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	k8smount "k8s.io/utils/mount"
@@ -15,14 +14,17 @@ import (
 
 type kodofsNodeServer struct {
 	k8smounter k8smount.Interface
+	watchdog   *remountWatchdog
 	*csicommon.DefaultNodeServer
 }
 
 func newKodoFSNodeServer(d *csicommon.CSIDriver) csi.NodeServer {
-	return &kodofsNodeServer{
+	server := &kodofsNodeServer{
 		k8smounter:        k8smount.New(""),
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 	}
+	server.watchdog = newRemountWatchdog(FuseTypeKodoFS, *remountInterval, server.mount)
+	return server
 }
 
 func (server *kodofsNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -30,20 +32,40 @@ func (server *kodofsNodeServer) NodePublishVolume(ctx context.Context, req *csi.
 	if mountPath == "" {
 		return nil, errors.New("NodePublishVolume: mountPath is empty")
 	}
-	log.Infof("NodePublishVolume: starting mount kodofs volume %s to path: %s", req.GetVolumeId(), mountPath)
+	logger(ctx).Infof("NodePublishVolume: starting mount kodofs volume %s to path: %s", req.GetVolumeId(), mountPath)
+	if err := acquirePublishedNode(ctx, TypePluginKodoFS, req.GetVolumeId(), req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+	if err := server.mount(ctx, req); err != nil {
+		releasePublishedNode(ctx, TypePluginKodoFS, req.GetVolumeId(), mountPath)
+		return nil, err
+	}
+	server.watchdog.publish(req)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
 
+// mount mounts the volume on the target path, it's also called by the watchdog to re-mount the disconnected volume
+func (server *kodofsNodeServer) mount(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+	mountPath := req.GetTargetPath()
 	parameter, err := parseKodoFSPvParameter("NodePublishVolume", req.GetVolumeContext(), req.GetSecrets())
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if err = ensureDirectoryCreated(mountPath); err != nil {
-		return nil, fmt.Errorf("NodePublishVolume: create mount path %s error: %w", mountPath, err)
+		return fmt.Errorf("NodePublishVolume: create mount path %s error: %w", mountPath, err)
 	}
-	if err = mountKodoFS(parameter.gatewayID, mountPath, parameter.mountServerAddress, parameter.accessToken, "/"); err != nil {
-		return nil, fmt.Errorf("NodePublishVolume: failed to to mount kodofs to %s: %w", mountPath, err)
+	if err = mountKodoFS(ctx, parameter.gatewayID, mountPath, parameter.mountServerAddresses, parameter.accessToken, parameter.subDir,
+		formatUrl(parameter.httpProxy), formatUrl(parameter.httpsProxy), parameter.noProxy,
+		parameter.mountOptions, parameter.noRwCache, parameter.modifyParams()); err != nil {
+		return fmt.Errorf("NodePublishVolume: failed to to mount kodofs to %s: %w", mountPath, err)
 	}
-	log.Infof("NodePublishVolume: kodofs volume %s is mounted on %s", req.GetVolumeId(), mountPath)
-	return &csi.NodePublishVolumeResponse{}, nil
+	if err = checkRemoteMounted(ctx, req.GetVolumeId(), mountPath, isKodoFSMounted, func(ctx context.Context, volumeId, mountPath string) error {
+		return requestUmount(ctx, volumeId, mountPath, false)
+	}); err != nil {
+		return fmt.Errorf("NodePublishVolume: kodofs volume mounted by the remote connector can't be used: %w", err)
+	}
+	logger(ctx).Infof("NodePublishVolume: kodofs volume %s is mounted on %s", req.GetVolumeId(), mountPath)
+	return nil
 }
 
 func (server *kodofsNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
@@ -51,20 +73,31 @@ func (server *kodofsNodeServer) NodeUnpublishVolume(ctx context.Context, req *cs
 	if mountPath == "" {
 		return nil, errors.New("NodeUnpublishVolume: mountPath is empty")
 	}
-	log.Infof("NodeUnpublishVolume: starting umount kodofs volume from path: %s", mountPath)
+	logger(ctx).Infof("NodeUnpublishVolume: starting umount kodofs volume from path: %s", mountPath)
+	server.watchdog.unpublish(mountPath)
 	mounted, err := isKodoFSMounted(mountPath)
 	if err != nil {
-		log.Warnf("NodeUnpublishVolume: failed to detect mount point: %s", err)
+		logger(ctx).Warnf("NodeUnpublishVolume: failed to detect mount point: %s", err)
 	} else if !mounted {
-		log.Warnf("NodeUnpublishVolume: mountPath is not mounted by kodofs")
-	} else if err = umount(mountPath); err != nil {
+		logger(ctx).Warnf("NodeUnpublishVolume: mountPath is not mounted by kodofs")
+	} else if err = unmountVolume(ctx, req.VolumeId, mountPath, false); err != nil {
 		return nil, fmt.Errorf("NodeUnpublishVolume: failed to unmount kodofs: %w", err)
 	} else {
-		log.Infof("NodeUnpublishVolume: umounted kodofs volume from path: %s", mountPath)
+		logger(ctx).Infof("NodeUnpublishVolume: umounted kodofs volume from path: %s", mountPath)
 	}
+	releasePublishedNode(ctx, TypePluginKodoFS, req.VolumeId, mountPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+func (server *kodofsNodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: nodeCapabilities}, nil
+}
+
+// NodeGetVolumeStats is called by kubelet, which emits events on the Pods if the mount points are abnormal
+func (server *kodofsNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nodeGetVolumeStats(ctx, req, FuseTypeKodoFS)
+}
+
 func (server *kodofsNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	return &csi.NodeStageVolumeResponse{}, nil
 }
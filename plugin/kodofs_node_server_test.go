@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/qiniu/csi-driver/protocol"
+)
+
+func newTestKodoFSNodeServer(t *testing.T) *kodofsNodeServer {
+	interval := *remountInterval
+	*remountInterval = 0
+	t.Cleanup(func() {
+		*remountInterval = interval
+	})
+	return newKodoFSNodeServer(csicommon.NewCSIDriver("kodofsplugin.storage.qiniu.com", "test", "node")).(*kodofsNodeServer)
+}
+
+func newKodoFSPublishRequest(t *testing.T) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   "pv-kodofs",
+		TargetPath: filepath.Join(t.TempDir(), "pods", "6f2b", "volumes", "kubernetes.io~csi", "pv-kodofs", "mount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{FIELD_SUB_DIR: "data"},
+		Secrets: map[string]string{
+			FIELD_GATEWAY_ID:           "gateway",
+			FIELD_MOUNT_SERVER_ADDRESS: "http://10.0.0.1:8080",
+			FIELD_ACCESS_TOKEN:         "token",
+		},
+	}
+}
+
+func TestKodoFSNodeServerPublishAndUnpublish(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoFSNodeServer(t)
+	req := newKodoFSPublishRequest(t)
+
+	if _, err := server.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to publish volume: %s", err)
+	}
+	if gatewayId := connector.Mounts()[req.TargetPath]; gatewayId != "gateway" {
+		t.Fatalf("gateway mounted on %s is %q, expected gateway", req.TargetPath, gatewayId)
+	}
+	payloads := requestsOf(connector, protocol.InitKodoFsMountCmdName)
+	if len(payloads) != 1 {
+		t.Fatalf("%d mount requests are sent, expected 1", len(payloads))
+	}
+	var cmd protocol.InitKodoFSMountCmd
+	if err := json.Unmarshal(payloads[0], &cmd); err != nil {
+		t.Fatalf("failed to parse mount request: %s", err)
+	} else if cmd.GatewayID != "gateway" || cmd.MountPath != req.TargetPath || cmd.SubDir != "/data" {
+		t.Fatalf("unexpected mount request: %s", payloads[0])
+	}
+	if _, published := server.watchdog.published[req.TargetPath]; !published {
+		t.Fatalf("published volume is not watched")
+	}
+
+	// Nothing is mounted by the fake connector, so nothing is unmounted either
+	if _, err := server.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId: req.VolumeId, TargetPath: req.TargetPath,
+	}); err != nil {
+		t.Fatalf("failed to unpublish volume: %s", err)
+	}
+	if payloads := requestsOf(connector, protocol.UmountCmdName); len(payloads) != 0 {
+		t.Fatalf("target path not mounted is unmounted: %s", payloads)
+	} else if _, published := server.watchdog.published[req.TargetPath]; published {
+		t.Fatalf("unpublished volume is still watched")
+	}
+}
+
+func TestKodoFSNodeServerPublishFailsByConnector(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoFSNodeServer(t)
+	req := newKodoFSPublishRequest(t)
+
+	connector.Fail(protocol.InitKodoFsMountCmdName, 1)
+	if _, err := server.NodePublishVolume(context.Background(), req); err == nil {
+		t.Fatalf("volume is published even though the connector fails to mount it")
+	}
+	if mounts := connector.Mounts(); len(mounts) != 0 {
+		t.Fatalf("%v are mounted by the failed request", mounts)
+	} else if _, published := server.watchdog.published[req.TargetPath]; published {
+		t.Fatalf("volume failed to be published is watched")
+	}
+
+	connector.Fail(protocol.InitKodoFsMountCmdName, 0)
+	if _, err := server.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("failed to publish volume once the connector recovers: %s", err)
+	}
+}
+
+func TestKodoFSNodeServerPublishRejectsInvalidRequests(t *testing.T) {
+	connector := startFakeConnector(t)
+	server := newTestKodoFSNodeServer(t)
+
+	for name, modify := range map[string]func(req *csi.NodePublishVolumeRequest){
+		"no target path":          func(req *csi.NodePublishVolumeRequest) { req.TargetPath = "" },
+		"no gateway id":           func(req *csi.NodePublishVolumeRequest) { delete(req.Secrets, FIELD_GATEWAY_ID) },
+		"no mount server address": func(req *csi.NodePublishVolumeRequest) { delete(req.Secrets, FIELD_MOUNT_SERVER_ADDRESS) },
+		"sub directory escaping the file system": func(req *csi.NodePublishVolumeRequest) {
+			req.VolumeContext[FIELD_SUB_DIR] = "../data"
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := newKodoFSPublishRequest(t)
+			modify(req)
+			if _, err := server.NodePublishVolume(context.Background(), req); err == nil {
+				t.Fatalf("invalid request is published")
+			}
+		})
+	}
+	if payloads := requestsOf(connector, protocol.InitKodoFsMountCmdName); len(payloads) != 0 {
+		t.Fatalf("invalid requests are sent to the connector: %s", payloads)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"path"
 	"strings"
+	"time"
 )
 
 const (
@@ -17,6 +20,18 @@ const (
 	FIELD_REGION                = "region"
 	FIELD_FS_TYPE               = "fstype"
 	FIELD_BLOCK_SIZE            = "blocksize"
+	FIELD_MOUNT_OPTIONS         = "mountoptions"
+	FIELD_NO_RW_CACHE           = "norwcache"
+	FIELD_KODOFS_PARAMS         = "kodofsparams"
+	FIELD_SUB_DIR               = "subdir"
+)
+
+// Keys of the kodofs configuration parameters written by modifyParams, which are the fields of the configuration of kodofs v2.4.18
+// bundled in the image, see kodofs modify --help. Both timeouts are in milliseconds.
+const (
+	KODOFS_PARAM_RETRY_COUNT     = "retry_count"
+	KODOFS_PARAM_DIAL_TIMEOUT    = "timeoutdialms"
+	KODOFS_PARAM_REQUEST_TIMEOUT = "client_timeout_ms"
 )
 
 type kodofsPvParameter struct {
@@ -24,6 +39,7 @@ type kodofsPvParameter struct {
 	gatewayID     string
 	accessToken   string
 	accessPointId string
+	subDir        string
 }
 
 func parseKodoFSPvParameter(functionName string, ctx, secrets map[string]string) (param *kodofsPvParameter, err error) {
@@ -42,6 +58,11 @@ func parseKodoFSPvParameter(functionName string, ctx, secrets map[string]string)
 			p.accessPointId = strings.TrimSpace(value)
 		case FIELD_ACCESS_TOKEN:
 			p.accessToken = strings.TrimSpace(value)
+		case FIELD_SUB_DIR:
+			if p.subDir, err = normalizeSubDir(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_SUB_DIR, value, err)
+				return
+			}
 		case FIELD_MOUNT_SERVER_ADDRESS:
 			// Don't have to handle it here
 		}
@@ -54,9 +75,9 @@ func parseKodoFSPvParameter(functionName string, ctx, secrets map[string]string)
 			return
 		}
 	}
-	if p.mountServerAddress == nil {
+	if p.mountServerAddresses == nil {
 		if value, ok := secrets[FIELD_MOUNT_SERVER_ADDRESS]; ok {
-			if p.mountServerAddress, err = parseUrl(value); err != nil {
+			if p.mountServerAddresses, err = parseUrlList(value); err != nil {
 				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_MOUNT_SERVER_ADDRESS, value, err)
 				return
 			}
@@ -78,11 +99,18 @@ func parseKodoFSPvParameter(functionName string, ctx, secrets map[string]string)
 }
 
 type kodofsStorageClassParameter struct {
-	accessKey, secretKey                    string
-	mountServerAddress, masterServerAddress *url.URL
-	region                                  string
-	fsType                                  uint8
-	blockSize                               uint32
+	accessKey, secretKey                        string
+	mountServerAddresses, masterServerAddresses urlList
+	region                                      string
+	fsType                                      uint8
+	blockSize                                   uint32
+	httpProxy, httpsProxy                       *url.URL
+	noProxy                                     string
+	mountOptions                                string
+	noRwCache                                   bool
+	kodofsParams                                string
+	retries                                     *uint64
+	connectTimeout, timeout                     *time.Duration
 }
 
 func parseKodoFSStorageClassParameter(functionName string, ctx, secrets map[string]string, ignoreSecrets bool) (param *kodofsStorageClassParameter, err error) {
@@ -99,12 +127,12 @@ func parseKodoFSStorageClassParameter(functionName string, ctx, secrets map[stri
 		case FIELD_SECRET_KEY:
 			p.secretKey = strings.TrimSpace(value)
 		case FIELD_MOUNT_SERVER_ADDRESS:
-			if p.mountServerAddress, err = parseUrl(value); err != nil {
+			if p.mountServerAddresses, err = parseUrlList(value); err != nil {
 				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_MOUNT_SERVER_ADDRESS, value, err)
 				return
 			}
 		case FIELD_MASTER_SERVER_ADDRESS:
-			if p.masterServerAddress, err = parseUrl(value); err != nil {
+			if p.masterServerAddresses, err = parseUrlList(value); err != nil {
 				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_MASTER_SERVER_ADDRESS, value, err)
 				return
 			}
@@ -124,6 +152,64 @@ func parseKodoFSStorageClassParameter(functionName string, ctx, secrets map[stri
 				err = fmt.Errorf("%s: invalid %s: %s", functionName, FIELD_BLOCK_SIZE, value)
 				return
 			}
+		case FIELD_HTTP_PROXY:
+			if p.httpProxy, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_HTTP_PROXY, value, err)
+				return
+			}
+		case FIELD_HTTPS_PROXY:
+			if p.httpsProxy, err = parseUrl(value); err != nil {
+				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_HTTPS_PROXY, value, err)
+				return
+			}
+		case FIELD_NO_PROXY:
+			p.noProxy = normalizeNoProxy(value)
+		case FIELD_MOUNT_OPTIONS:
+			p.mountOptions = normalizeList(value)
+		case FIELD_NO_RW_CACHE:
+			if b, ok := parseBool(value); !ok {
+				err = fmt.Errorf("%s: unrecognized %s: %s", functionName, FIELD_NO_RW_CACHE, value)
+				return
+			} else {
+				p.noRwCache = b
+			}
+		case FIELD_KODOFS_PARAMS:
+			p.kodofsParams = normalizeList(value)
+			for _, kv := range strings.Split(p.kodofsParams, ",") {
+				if kv != "" && !strings.Contains(kv, "=") {
+					err = fmt.Errorf("%s: invalid %s: %s: expect key=value", functionName, FIELD_KODOFS_PARAMS, kv)
+					return
+				}
+			}
+		case FIELD_RETRIES:
+			if s, parseError := parseUint(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_RETRIES, parseError)
+				return
+			} else {
+				p.retries = &s
+			}
+		case FIELD_CONNECT_TIMEOUT:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_CONNECT_TIMEOUT, parseError)
+				return
+			} else if d < time.Millisecond {
+				// Written to kodofs in milliseconds, a shorter one would be 0
+				err = fmt.Errorf("%s: invalid %s: %s: must be at least 1ms", functionName, FIELD_CONNECT_TIMEOUT, value)
+				return
+			} else {
+				p.connectTimeout = &d
+			}
+		case FIELD_TIMEOUT:
+			if d, parseError := parseDuration(value); parseError != nil {
+				err = fmt.Errorf("%s: failed to parse %s: %w", functionName, FIELD_TIMEOUT, parseError)
+				return
+			} else if d < time.Millisecond {
+				// Written to kodofs in milliseconds, a shorter one would be 0
+				err = fmt.Errorf("%s: invalid %s: %s: must be at least 1ms", functionName, FIELD_TIMEOUT, value)
+				return
+			} else {
+				p.timeout = &d
+			}
 		}
 	}
 	if p.accessKey == "" {
@@ -142,9 +228,9 @@ func parseKodoFSStorageClassParameter(functionName string, ctx, secrets map[stri
 			return
 		}
 	}
-	if p.mountServerAddress == nil {
+	if p.mountServerAddresses == nil {
 		if value, ok := secrets[FIELD_MOUNT_SERVER_ADDRESS]; ok {
-			if p.mountServerAddress, err = parseUrl(value); err != nil {
+			if p.mountServerAddresses, err = parseUrlList(value); err != nil {
 				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_MOUNT_SERVER_ADDRESS, value, err)
 				return
 			}
@@ -153,9 +239,9 @@ func parseKodoFSStorageClassParameter(functionName string, ctx, secrets map[stri
 			return
 		}
 	}
-	if p.masterServerAddress == nil {
+	if p.masterServerAddresses == nil {
 		if value, ok := secrets[FIELD_MASTER_SERVER_ADDRESS]; ok {
-			if p.masterServerAddress, err = parseUrl(value); err != nil {
+			if p.masterServerAddresses, err = parseUrlList(value); err != nil {
 				err = fmt.Errorf("%s: invalid %s: %s: %w", functionName, FIELD_MASTER_SERVER_ADDRESS, value, err)
 				return
 			}
@@ -179,6 +265,96 @@ func parseKodoFSStorageClassParameter(functionName string, ctx, secrets map[stri
 	return
 }
 
+// modifyParams returns the kodofs configuration parameters applied before mount,
+// the retry and timeout options are translated into kodofs keys, which are left out if kodofsparams gives the same keys
+func (p *kodofsStorageClassParameter) modifyParams() string {
+	given := make(map[string]bool)
+	for _, kv := range strings.Split(p.kodofsParams, ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			given[strings.TrimSpace(kv[:i])] = true
+		}
+	}
+	var params []string
+	if p.retries != nil && !given[KODOFS_PARAM_RETRY_COUNT] {
+		params = append(params, KODOFS_PARAM_RETRY_COUNT+"="+formatUint(*p.retries))
+	}
+	if p.connectTimeout != nil && !given[KODOFS_PARAM_DIAL_TIMEOUT] {
+		params = append(params, KODOFS_PARAM_DIAL_TIMEOUT+"="+formatUint(uint64(p.connectTimeout.Milliseconds())))
+	}
+	if p.timeout != nil && !given[KODOFS_PARAM_REQUEST_TIMEOUT] {
+		params = append(params, KODOFS_PARAM_REQUEST_TIMEOUT+"="+formatUint(uint64(p.timeout.Milliseconds())))
+	}
+	if p.kodofsParams != "" {
+		params = append(params, p.kodofsParams)
+	}
+	return strings.Join(params, ",")
+}
+
+// normalizeSubDir returns the absolute path of the sub directory in the volume, which must not escape from the volume root
+func normalizeSubDir(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "/", nil
+	}
+	for _, segment := range strings.Split(s, "/") {
+		if segment == ".." {
+			return "", errors.New("must not contain ..")
+		}
+	}
+	return path.Join("/", s), nil
+}
+
 func parseUrl(s string) (*url.URL, error) {
 	return url.Parse(strings.TrimSpace(s))
 }
+
+// urlList is a list of addresses of the same service, the service is still available if any of them is alive
+type urlList []*url.URL
+
+// String returns the addresses separated by commas, which is also accepted by kodofs
+func (l urlList) String() string {
+	addresses := make([]string, 0, len(l))
+	for _, u := range l {
+		addresses = append(addresses, u.String())
+	}
+	return strings.Join(addresses, ",")
+}
+
+// parseUrlList accepts addresses separated by commas, semicolons or spaces
+func parseUrlList(s string) (urlList, error) {
+	var list urlList
+	for _, item := range strings.Split(normalizeList(s), ",") {
+		if item == "" {
+			continue
+		}
+		if u, err := parseUrl(item); err != nil {
+			return nil, err
+		} else {
+			list = append(list, u)
+		}
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no address is given")
+	}
+	return list, nil
+}
+
+// normalizeNoProxy accepts hosts separated by commas, semicolons or spaces and returns them in NO_PROXY format
+func normalizeNoProxy(s string) string {
+	return normalizeList(s)
+}
+
+// normalizeList accepts items separated by commas, semicolons or spaces and returns them separated by commas
+func normalizeList(s string) string {
+	items := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n'
+	})
+	return strings.Join(items, ",")
+}
+
+func formatUrl(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestKodoFSModifyParams(t *testing.T) {
+	secrets := map[string]string{
+		FIELD_ACCESS_KEY:            "access-key",
+		FIELD_SECRET_KEY:            "secret-key",
+		FIELD_MASTER_SERVER_ADDRESS: "http://10.0.0.1:8080",
+		FIELD_MOUNT_SERVER_ADDRESS:  "http://10.0.0.1:8080",
+		FIELD_REGION:                "z0",
+	}
+	for name, test := range map[string]struct {
+		parameters map[string]string
+		params     string
+	}{
+		"nothing": {parameters: map[string]string{}, params: ""},
+		"retries and timeouts": {
+			parameters: map[string]string{FIELD_RETRIES: "10", FIELD_CONNECT_TIMEOUT: "10s", FIELD_TIMEOUT: "2m"},
+			params:     "retry_count=10,timeoutdialms=10000,client_timeout_ms=120000",
+		},
+		"kodofs params only": {
+			parameters: map[string]string{FIELD_KODOFS_PARAMS: "connect_pool_size=32"},
+			params:     "connect_pool_size=32",
+		},
+		"same keys of kodofs params": {
+			parameters: map[string]string{FIELD_RETRIES: "10", FIELD_TIMEOUT: "2m", FIELD_KODOFS_PARAMS: "client_timeout_ms=5000, connect_pool_size=32"},
+			params:     "retry_count=10,client_timeout_ms=5000,connect_pool_size=32",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, err := parseKodoFSStorageClassParameter("Test", test.parameters, secrets, false)
+			if err != nil {
+				t.Fatalf("failed to parse parameters: %s", err)
+			} else if params := p.modifyParams(); params != test.params {
+				t.Fatalf("kodofs params are %q, expected %q", params, test.params)
+			}
+		})
+	}
+}
+
+func TestKodoFSTimeoutsInMilliseconds(t *testing.T) {
+	for _, field := range []string{FIELD_CONNECT_TIMEOUT, FIELD_TIMEOUT} {
+		if _, err := parseKodoFSStorageClassParameter("Test", map[string]string{field: "500us"}, nil, true); err == nil {
+			t.Fatalf("%s shorter than 1ms is accepted", field)
+		}
+	}
+}
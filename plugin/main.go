@@ -8,9 +8,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/qiniu/csi-driver/qiniu"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -30,11 +33,49 @@ var (
 	COMMITID = ""
 
 	// BUILDTIME is CSI Driver Buildtime
-	BUILDTIME  = ""
-	endpoint   = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	nodeID     = flag.String("nodeid", "", "Node id")
-	driverName = flag.String("driver", "", "Driver Name")
-	healthPort = flag.Int("health-port", 11260, "Health Port")
+	BUILDTIME       = ""
+	endpoint        = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	nodeID          = flag.String("nodeid", "", "Node id")
+	driverName      = flag.String("driver", "", "Driver Name")
+	pluginMode      = flag.String("mode", ModeAll, "Services to serve, controller for the controller Deployment, node for the node DaemonSet, or all")
+	healthPort      = flag.Int("health-port", 11260, "Health Port")
+	kubeconfig      = flag.String("kubeconfig", "", "Path of the kubeconfig to access Kubernetes from outside of the cluster, the in-cluster config is used if empty")
+	coName          = flag.String("co", OrchestratorKubernetes, "Container orchestrator calling the driver, kubernetes or nomad, which only supports statically provisioned volumes")
+	publishDir      = flag.String("publish-dir", "", "Directory the target paths of the volumes are under, KUBELET_ROOT_DIR by default for kubernetes and required for nomad")
+	logFormat       = flag.String("log-format", "text", "Format of the logs, text or json")
+	logLevel        = flag.String("log-level", "info", "Minimum level of the logs, one of debug, info, warning and error")
+	featureGates    = newFeatureGatesFlag()
+	configConfigMap = flag.String("config-configmap", "", "Name of the ConfigMap in the namespace of the plugin with the flags changed without restarting the plugin, disabled if empty")
+
+	connectorSocket  = flag.String("connector-socket", SocketPath, "Path of the unix socket of the connector")
+	connectorAddress = flag.String("connector-address", "", "TCP address of the remote connector, e.g. storage-gateway-0:9443, dialed with mutual TLS instead of --connector-socket if given")
+	connectorTlsCert = flag.String("connector-tls-cert", "", "Path of the PEM encoded client certificate presented to the remote connector")
+	connectorTlsKey  = flag.String("connector-tls-key", "", "Path of the PEM encoded private key of --connector-tls-cert")
+	connectorTlsCa   = flag.String("connector-tls-ca", "", "Path of the PEM encoded CA bundle verifying the server certificate of the remote connector")
+	unprivileged     = flag.Bool("unprivileged", false, "The plugin runs without privilege, so the volumes are unmounted by the connector on the node instead, which must be installed beforehand")
+
+	metricsAddress = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. :9811, disabled if empty")
+	otlpEndpoint   = flag.String("otlp-endpoint", "", "OTLP gRPC endpoint to export traces to, e.g. otel-collector:4317, disabled if empty")
+	otlpInsecure   = flag.Bool("otlp-insecure", false, "Export traces to the OTLP endpoint without TLS")
+
+	slowRPCThreshold       = newReloadableDuration("slow-rpc-threshold", 30*time.Second, "CSI RPCs taking longer are logged and counted as slow operations with the slowest stage, 0 to disable")
+	slowConnectorThreshold = newReloadableDuration("slow-connector-threshold", 20*time.Second, "Requests to the connector taking longer are logged and counted as slow operations, 0 to disable")
+	connectorPoolSize      = flag.Int("connector-pool-size", 4, "Idle connections kept to the connector for the next requests, 0 to dial the connector for every request")
+	remountInterval        = flag.Duration("remount-interval", 30*time.Second, "How often to check the volumes published on the node and re-mount the disconnected ones, e.g. after the connector restarts, 0 to disable")
+	startupTaint           = flag.String("startup-taint", "", "Key of the taint of the node removed once the connector replies the ping, e.g. kodoplugin.storage.qiniu.com/agent-not-ready, so the pods using the volumes are not scheduled onto the node until then, disabled if empty")
+
+	kodoReconcileInterval      = flag.Duration("kodo-reconcile-interval", time.Hour, "How often to delete the IAM users created for Kodo volumes which no longer exist, 0 to disable")
+	kodoUsageInterval          = flag.Duration("kodo-usage-interval", 0, "How often to export the storage usage of Kodo volumes as metrics by the controller, 0 to disable")
+	kodoPricingConfig          = flag.String("kodo-pricing-config", "", "Path of the JSON pricing table to annotate Kodo volumes with their estimated monthly costs once their usage is exported, disabled if empty")
+	kodoTransferPrometheusUrl  = flag.String("kodo-transfer-prometheus-url", "", "URL of the Prometheus scraping the connectors, to estimate the transfer costs of Kodo volumes by their traffic in the last 30 days, only the storage costs are estimated if empty")
+	kodoQuotaAlertThresholds   = flag.String("kodo-quota-alert-thresholds", "80,90,95", "Percentages of the bucket quotas of Kodo volumes to warn on their PVCs once the storage usage exported by --kodo-usage-interval crosses each of them, disabled if empty")
+	kodoQuotaConfigMap         = flag.String("kodo-quota-configmap", "", "Name of the ConfigMap in the namespace of the plugin with the quotas of Kodo volumes dynamically provisioned in every namespace, disabled if empty")
+	kodoMountProfilesConfigMap = flag.String("kodo-mount-profiles-configmap", "kodoplugin-mount-profiles", "Name of the ConfigMap in the namespace of the plugin with the mount profiles referenced by Kodo volumes, disabled if empty")
+	kodoApiRateLimit           = flag.Float64("kodo-api-rate-limit", 20, "Max requests per second to Kodo APIs of the same account, 0 for unlimited")
+	kodoApiBurst               = flag.Int("kodo-api-burst", 20, "Max requests sent at once to Kodo APIs of the same account")
+	kodoApiCacheTTL            = flag.Duration("kodo-api-cache-ttl", 30*time.Second, "How long the bucket lists and the verified credentials are cached to provision Kodo volumes, 0 to disable")
+	kodoFlushTimeout           = newReloadableDuration("kodo-flush-timeout", 5*time.Minute, "How long to wait for the write-back cache to be uploaded before unmounting a Kodo volume, 0 to disable")
+	kodoLazyUnmount            = newReloadableBool("kodo-lazy-unmount", false, "Unmount Kodo volumes lazily and let the connector upload the write-back cache in background, so that Pods are deleted without waiting for the upload")
 )
 
 func init() {
@@ -45,8 +86,30 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == GenPvCommand {
+		// Run by the users to write the manifests of static provisioning, it never starts the driver
+		os.Exit(runGenPv(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == InstallCommand {
+		os.Exit(runInstall(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == MigrateCommand {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == WebhookCommand {
+		os.Exit(runWebhook(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == MountLogsCommand {
+		// Run in the CSI plugin on the node by kubectl exec, it only asks the connector for the logs
+		os.Exit(runMountLogs(os.Args[2:]))
+	}
 	flag.Parse()
 
+	if err := setLogFormat(*logFormat, *logLevel); err != nil {
+		log.Errorf("Invalid log settings: %s", err)
+		os.Exit(1)
+	}
+
 	if driverName == nil {
 		log.Errorf("-driver must be specified")
 		os.Exit(1)
@@ -60,17 +123,51 @@ func main() {
 		}
 	}
 
-	if nodeID == nil {
-		log.Errorf("-nodeid must be specified")
+	if err := validateMode(); err != nil {
+		log.Errorf("%s", err)
 		os.Exit(1)
 	}
-	if err := ensureCommandExists("umount"); err != nil {
-		log.Errorf("Please make sure umount is installed in PATH: %s", err)
+
+	if co, err := newContainerOrchestrator(*coName, *publishDir); err != nil {
+		log.Errorf("%s", err)
 		os.Exit(1)
+	} else {
+		orchestrator = co
+	}
+
+	if *nodeID == "" {
+		if servesNode() {
+			log.Errorf("-nodeid must be specified")
+			os.Exit(1)
+		}
+		*nodeID = defaultControllerNodeID()
+	}
+	qiniu.BucketsCacheTTL = *kodoApiCacheTTL
+	qiniu.KodoApiRateLimit, qiniu.KodoApiBurst = rate.Limit(*kodoApiRateLimit), *kodoApiBurst
+	qiniu.ObserveRequest = observeKodoApiRequest
+	if *kodoPricingConfig != "" {
+		if pricing, err := loadKodoPricing(*kodoPricingConfig); err != nil {
+			log.Errorf("Invalid pricing table: %s", err)
+			os.Exit(1)
+		} else {
+			kodoPricingTable = pricing
+		}
 	}
-	if err := ensureCommandExists("findmnt"); err != nil {
-		log.Errorf("Please make sure findmnt is installed in PATH: %s", err)
+	if thresholds, err := parseQuotaAlertThresholds(*kodoQuotaAlertThresholds); err != nil {
+		log.Errorf("Invalid --kodo-quota-alert-thresholds: %s", err)
 		os.Exit(1)
+	} else {
+		kodoQuotaAlertLevels = thresholds
+	}
+	if servesNode() {
+		if err := ensureCommandExists("umount"); err != nil {
+			log.Errorf("Please make sure umount is installed in PATH: %s", err)
+			os.Exit(1)
+		}
+		if err := ensureCommandExists("findmnt"); err != nil {
+			log.Errorf("Please make sure findmnt is installed in PATH: %s", err)
+			os.Exit(1)
+		}
 	}
 	if proto, addr, err := csicommon.ParseEndpoint(*endpoint); err != nil {
 		log.Errorf("Invalid endpoint: %s", err)
@@ -83,7 +180,7 @@ func main() {
 		}
 	}
 
-	log.Infof("CSI Driver Name: %s, nodeID: %s, endPoints: %s", *driverName, *nodeID, *endpoint)
+	log.Infof("CSI Driver Name: %s, mode: %s, nodeID: %s, endPoints: %s, CO: %s", *driverName, *pluginMode, *nodeID, *endpoint, orchestrator.name())
 	log.Infof("CSI Driver Version: %s, CommitID: %s, Build time: %s", VERSION, COMMITID, BUILDTIME)
 
 	var wg sync.WaitGroup
@@ -100,6 +197,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *metricsAddress != "" {
+		fsType := FuseTypeKodo
+		if *driverName == KodoFSDriverName {
+			fsType = FuseTypeKodoFS
+		}
+		serveMetrics(*metricsAddress, *driverName, fsType)
+	}
+
+	if *otlpEndpoint != "" {
+		if err := initTracing(*otlpEndpoint, *otlpInsecure, *driverName); err != nil {
+			log.Errorf("Failed to export traces to %s: %s", *otlpEndpoint, err)
+			os.Exit(1)
+		}
+	}
+
+	startConfigReloader(getPvcClient())
+	if servesNode() {
+		startStartupTaintRemover(getPvcClient())
+	}
+
 	go func() {
 		defer wg.Done()
 		driver.Run()
@@ -114,6 +231,9 @@ func main() {
 	log.Infof("CSI will listen on port %d.", servicePort)
 	server := &http.Server{Addr: fmt.Sprintf(":%d", servicePort)}
 	http.HandleFunc("/health", healthHandler)
+	if servesNode() {
+		http.HandleFunc("/healthz", readinessHandler)
+	}
 	if err = server.ListenAndServe(); err != nil {
 		log.Fatalf("Service port listen and serve err: %s", err.Error())
 	}
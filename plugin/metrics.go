@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Namespace of all metrics exported by the plugin
+	MetricsNamespace = "qiniu_csi_plugin"
+	// Path of the metrics endpoint
+	MetricsPath = "/metrics"
+)
+
+var (
+	csiOperationTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "csi",
+		Name:      "operations_total",
+		Help:      "Total number of CSI RPCs by method and gRPC code",
+	}, []string{"method", "code"})
+	csiOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "csi",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of CSI RPCs by method and gRPC code, which covers provisioning by CreateVolume and mounting by NodePublishVolume",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"method", "code"})
+	connectorRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "connector",
+		Name:      "request_duration_seconds",
+		Help:      "Round-trip time of requests to the connector by command and result",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"command", "result"})
+	csiKodoApiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "csi",
+		Name:      "kodo_api_duration_seconds",
+		Help:      "Time spent by CSI RPCs waiting for the responses of Qiniu APIs by method, only for the RPCs sending requests, the rest of operation_duration_seconds is spent by the driver",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"method"})
+	kodoApiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of the requests to Qiniu APIs by API and status code, every retry is observed on its own",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"api", "code"})
+	kodoApiErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "api_errors_total",
+		Help:      "Total number of the requests to Qiniu APIs failed by API and status code, which is error if no response is received",
+	}, []string{"api", "code"})
+	kodoVolumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "volume_used_bytes",
+		Help:      "Bytes stored in the bucket of the Kodo volume, counted by Kodo once a day",
+	}, []string{"pv", "pvc", "namespace", "bucket"})
+	kodoVolumeObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "volume_objects",
+		Help:      "Number of objects in the bucket of the Kodo volume, counted by Kodo once a day",
+	}, []string{"pv", "pvc", "namespace", "bucket"})
+	kodoVolumeQuotaUsageRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "volume_quota_usage_ratio",
+		Help:      "Storage usage of the bucket of the Kodo volume to its quota, the higher one of the bytes and the objects, only for the buckets with quotas",
+	}, []string{"pv", "pvc", "namespace", "bucket"})
+	kodoNamespaceProvisionedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "namespace_provisioned_bytes",
+		Help:      "Total capacity of the Kodo volumes dynamically provisioned in the namespace, counted if --kodo-quota-configmap is given",
+	}, []string{"namespace"})
+	kodoNamespaceVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "kodo",
+		Name:      "namespace_volumes",
+		Help:      "Number of the Kodo volumes dynamically provisioned in the namespace, counted if --kodo-quota-configmap is given",
+	}, []string{"namespace"})
+)
+
+type kodoApiTimeContextKey struct{}
+
+// observeGRPC records the duration and the result of every CSI RPC, along with the time spent waiting for Qiniu APIs
+func observeGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	kodoApiTime := new(int64)
+	ctx = context.WithValue(ctx, kodoApiTimeContextKey{}, kodoApiTime)
+	begin := time.Now()
+	resp, err := handler(ctx, req)
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	code := status.Code(err).String()
+	csiOperationTotal.WithLabelValues(method, code).Inc()
+	csiOperationDuration.WithLabelValues(method, code).Observe(time.Since(begin).Seconds())
+	if duration := time.Duration(atomic.LoadInt64(kodoApiTime)); duration > 0 {
+		csiKodoApiDuration.WithLabelValues(method).Observe(duration.Seconds())
+	}
+	return resp, err
+}
+
+// observeKodoApiRequest records every attempt of the requests to Qiniu APIs, also as a stage of the CSI RPC sending it,
+// set as qiniu.ObserveRequest
+func observeKodoApiRequest(ctx context.Context, api string, statusCode int, duration time.Duration, err error) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	kodoApiRequestDuration.WithLabelValues(api, code).Observe(duration.Seconds())
+	if err != nil || statusCode >= http.StatusBadRequest {
+		kodoApiErrorsTotal.WithLabelValues(api, code).Inc()
+	}
+	if kodoApiTime, ok := ctx.Value(kodoApiTimeContextKey{}).(*int64); ok {
+		atomic.AddInt64(kodoApiTime, int64(duration))
+	}
+	recordStage(ctx, "kodo "+api, time.Now().Add(-duration))
+}
+
+// observeConnectorRequest records the round-trip time of a request to the connector as a stage of the CSI RPC,
+// called by defer with the named error
+func observeConnectorRequest(ctx context.Context, command string, begin time.Time, err *error) {
+	result := "success"
+	if *err != nil {
+		result = "failure"
+	}
+	duration := time.Since(begin)
+	connectorRequestDuration.WithLabelValues(command, result).Observe(duration.Seconds())
+	recordStage(ctx, "connector "+command, begin)
+	detectSlowConnectorRequest(ctx, command, duration)
+}
+
+// publishedVolumesCollector counts the volumes of the driver mounted under the publish directory of the CO on every scrape,
+// so that the number is still right after the plugin is restarted
+type publishedVolumesCollector struct {
+	fsType string
+	desc   *prometheus.Desc
+}
+
+func newPublishedVolumesCollector(fsType string) *publishedVolumesCollector {
+	return &publishedVolumesCollector{
+		fsType: fsType,
+		desc:   prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "node", "published_volumes"), "Number of volumes published on the node", nil, nil),
+	}
+}
+
+func (c *publishedVolumesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *publishedVolumesCollector) Collect(ch chan<- prometheus.Metric) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		log.Warnf("Failed to read mounts for metrics: %s", err)
+		return
+	}
+	defer file.Close()
+
+	prefix := filepath.Clean(orchestrator.publishDir()) + "/"
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 2 && fields[2] == c.fsType && strings.HasPrefix(fields[1], prefix) {
+			count++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		log.Warnf("Failed to read mounts for metrics: %s", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+// serveMetrics serves the metrics endpoint in background, the plugin keeps working even if it fails
+func serveMetrics(address, driverName, fsType string) {
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"driver": driverName}, registry)
+	registerer.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		csiOperationTotal, csiOperationDuration, csiKodoApiDuration, connectorRequestDuration, kodoApiRequestDuration, kodoApiErrorsTotal,
+		kodoVolumeUsedBytes, kodoVolumeObjects, kodoVolumeQuotaUsageRatio, kodoNamespaceProvisionedBytes, kodoNamespaceVolumes, slowOperationTotal,
+		newPublishedVolumesCollector(fsType),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: log.StandardLogger()}))
+	go func() {
+		log.Infof("Serving metrics on %s%s", address, MetricsPath)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Errorf("Failed to serve metrics on %s: %s", address, err)
+		}
+	}()
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// MigrateCommand is the subcommand converting the PVs of other S3 drivers into Kodo volumes
+	MigrateCommand = "migrate"
+	// Annotation of the migrated PVs recording the driver they were created by
+	MigratedFromAnnotation = TypePluginKodo + "/migrated-from"
+	migratePollInterval    = time.Second
+)
+
+// Drivers whose volumes are not configured by the bucket, endpoint and region options as the others
+var (
+	csiS3Drivers        = []string{"ch.ctrox.csi.s3-driver", "ru.yandex.s3.csi"}
+	mountpointS3Drivers = []string{"s3.csi.aws.com"}
+)
+
+// migrationSource is where the volume of another driver stores its files
+type migrationSource struct {
+	driver           string
+	bucket, prefix   string
+	endpoint, region string
+	secretRef        *corev1.SecretReference
+}
+
+// migrateReport prints what's done, or what would be done in a dry run, and remembers whether any step failed
+type migrateReport struct {
+	dryRun bool
+	failed bool
+}
+
+func (report *migrateReport) done(format string, args ...interface{}) {
+	if report.dryRun {
+		format = "would " + format
+	}
+	fmt.Printf("  "+format+"\n", args...)
+}
+
+func (report *migrateReport) fail(format string, args ...interface{}) {
+	report.failed = true
+	fmt.Printf("  failed to "+format+"\n", args...)
+}
+
+// migrateOptions are the flags of migrate shared by all the PVs
+type migrateOptions struct {
+	secret           string
+	endpoint, region string
+	backupDir        string
+	timeout          time.Duration
+}
+
+// runMigrate converts the PVs of s3fs or rclone FlexVolume and other S3 CSI drivers into Kodo volumes in place, returns the exit code
+func runMigrate(args []string) int {
+	var options migrateOptions
+	flagSet := flag.NewFlagSet(MigrateCommand, flag.ContinueOnError)
+	flagSet.StringVar(kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "Path of the kubeconfig, the in-cluster config is used if empty")
+	all := flagSet.Bool("all", false, "Migrate all the PVs of the recognized drivers instead of the given ones")
+	flagSet.StringVar(&options.secret, "secret", "", "Secret with accesskey, secretkey and ucendpoint to mount the migrated volumes, as <namespace>/<name> or <name> in the namespace of each PVC, the secret of each PV is kept if empty")
+	flagSet.StringVar(&options.endpoint, "s3-endpoint", "", "S3 endpoint of the buckets, used if a PV doesn't record it")
+	flagSet.StringVar(&options.region, "s3-region", "", "S3 region of the buckets, used if a PV doesn't record it")
+	flagSet.StringVar(&options.backupDir, "backup-dir", "pv-backup", "Directory to save the original PVs into before they are deleted")
+	flagSet.DurationVar(&options.timeout, "timeout", time.Minute, "How long to wait for each PV to be deleted and for its PVC to be bound again")
+	apply := flagSet.Bool("apply", false, "Migrate the PVs, otherwise only report what would be done")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] -all | <pv>...\n", filepath.Base(os.Args[0]), MigrateCommand)
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	} else if *all == (flagSet.NArg() > 0) {
+		fmt.Fprintf(os.Stderr, "Either -all or the names of the PVs is required\n")
+		flagSet.Usage()
+		return 2
+	}
+
+	config, err := kubeConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load kubeconfig: %s\n", err)
+		return 1
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create Kubernetes client: %s\n", err)
+		return 1
+	}
+	ctx := context.Background()
+	var pvs []corev1.PersistentVolume
+	if *all {
+		list, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list PVs: %s\n", err)
+			return 1
+		}
+		pvs = list.Items
+	} else {
+		for _, name := range flagSet.Args() {
+			pv, err := client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to get PV %s: %s\n", name, err)
+				return 1
+			}
+			pvs = append(pvs, *pv)
+		}
+	}
+
+	report := &migrateReport{dryRun: !*apply}
+	migrated := 0
+	for i := range pvs {
+		pv := &pvs[i]
+		source, err := parseMigrationSource(ctx, client, pv, &options)
+		if source == nil && err == nil {
+			if !*all {
+				fmt.Printf("Skipping PV %s, which is not created by a recognized S3 driver\n", pv.Name)
+			}
+			continue
+		}
+		fmt.Printf("Migrating PV %s\n", pv.Name)
+		if err != nil {
+			report.fail("parse PV: %s", err)
+			continue
+		}
+		migratePersistentVolume(ctx, client, report, pv, source, &options)
+		migrated++
+	}
+	if migrated == 0 {
+		fmt.Printf("No PV to migrate\n")
+	}
+	if report.failed {
+		return 1
+	}
+	return 0
+}
+
+// parseMigrationSource returns nil without error if the PV is not created by a S3 driver
+func parseMigrationSource(ctx context.Context, client kubernetes.Interface, pv *corev1.PersistentVolume, options *migrateOptions) (*migrationSource, error) {
+	source := &migrationSource{}
+	var attributes map[string]string
+	switch {
+	case pv.Spec.FlexVolume != nil:
+		source.driver = pv.Spec.FlexVolume.Driver
+		attributes = pv.Spec.FlexVolume.Options
+		source.secretRef = pv.Spec.FlexVolume.SecretRef
+		if _, remote, ok := strings.Cut(lookupOption(attributes, "remote"), ":"); ok {
+			// The remote of rclone is <remote>:<bucket>[/<prefix>]
+			source.bucket, source.prefix, _ = strings.Cut(remote, "/")
+		}
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver != TypePluginKodo && pv.Spec.CSI.Driver != TypePluginKodoFS:
+		source.driver = pv.Spec.CSI.Driver
+		attributes = pv.Spec.CSI.VolumeAttributes
+		source.secretRef = pv.Spec.CSI.NodePublishSecretRef
+		if containsString(csiS3Drivers, source.driver) && lookupOption(attributes, "bucket") == "" {
+			// The volume handle is <bucket>[/<prefix>] unless the bucket is given explicitly
+			source.bucket, source.prefix, _ = strings.Cut(pv.Spec.CSI.VolumeHandle, "/")
+		}
+	default:
+		return nil, nil
+	}
+	if !isS3DriverName(source.driver) {
+		return nil, nil
+	}
+	if source.bucket == "" {
+		source.bucket = lookupOption(attributes, "bucket", "bucketname")
+	}
+	if source.prefix == "" {
+		source.prefix = lookupOption(attributes, "prefix", "path", "subpath")
+	}
+	source.endpoint = lookupOption(attributes, "endpoint", "s3endpoint", "url", "endpointurl")
+	source.region = lookupOption(attributes, "region", "s3region")
+	if containsString(mountpointS3Drivers, source.driver) {
+		// Mountpoint for Amazon S3 is configured by its mount options
+		mountOptions := parseMountOptions(pv.Spec.MountOptions)
+		if source.endpoint == "" {
+			source.endpoint = mountOptions["endpointurl"]
+		}
+		if source.region == "" {
+			source.region = mountOptions["region"]
+		}
+		if source.prefix == "" {
+			source.prefix = mountOptions["prefix"]
+		}
+	}
+	if source.bucket == "" {
+		return nil, fmt.Errorf("bucket of driver %s is not found", source.driver)
+	}
+
+	if source.secretRef != nil && source.secretRef.Namespace == "" && pv.Spec.ClaimRef != nil {
+		source.secretRef = &corev1.SecretReference{Name: source.secretRef.Name, Namespace: pv.Spec.ClaimRef.Namespace}
+	}
+	if (source.endpoint == "" || source.region == "") && containsString(csiS3Drivers, source.driver) && source.secretRef != nil {
+		// csi-s3 reads the endpoint and the region from the secret
+		secret, err := client.CoreV1().Secrets(source.secretRef.Namespace).Get(ctx, source.secretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret %s/%s of driver %s: %w", source.secretRef.Namespace, source.secretRef.Name, source.driver, err)
+		}
+		if source.endpoint == "" {
+			source.endpoint = lookupOption(secretData(secret), "endpoint")
+		}
+		if source.region == "" {
+			source.region = lookupOption(secretData(secret), "region")
+		}
+	}
+	if source.endpoint == "" {
+		source.endpoint = options.endpoint
+	}
+	if source.region == "" {
+		source.region = options.region
+	}
+	return source, nil
+}
+
+// migratePersistentVolume replaces the PV by a Kodo volume of the same name, which is bound to the same PVC
+func migratePersistentVolume(ctx context.Context, client kubernetes.Interface, report *migrateReport, pv *corev1.PersistentVolume, source *migrationSource, options *migrateOptions) {
+	report.done("convert %s volume on bucket %s at %s in region %s", source.driver, source.bucket, source.endpoint, source.region)
+	migrated, err := newMigratedVolume(pv, source, options)
+	if err != nil {
+		report.fail("convert PV: %s", err)
+		return
+	}
+	secretRef := migrated.Spec.CSI.NodePublishSecretRef
+	if missing, err := missingSecretKeys(ctx, client, secretRef); err != nil {
+		report.fail("get secret %s/%s: %s", secretRef.Namespace, secretRef.Name, err)
+		return
+	} else if len(missing) > 0 {
+		report.fail("use secret %s/%s without %s, create a secret for the driver and pass it by -secret",
+			secretRef.Namespace, secretRef.Name, strings.Join(missing, ", "))
+		return
+	}
+	if len(pv.Spec.MountOptions) > 0 {
+		report.done("drop mount options %s of %s", strings.Join(pv.Spec.MountOptions, ","), source.driver)
+	}
+
+	claim := pv.Spec.ClaimRef
+	if claim != nil {
+		if pods, err := podsUsingClaim(ctx, client, claim.Namespace, claim.Name); err != nil {
+			report.fail("list pods using PVC %s/%s: %s", claim.Namespace, claim.Name, err)
+			return
+		} else if len(pods) > 0 {
+			report.fail("migrate PV used by pods %s, stop them first", strings.Join(pods, ", "))
+			return
+		}
+	}
+	if report.dryRun {
+		report.done("save PV into %s", filepath.Join(options.backupDir, pv.Name+".yaml"))
+		if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+			report.done("change reclaim policy from %s to Retain", pv.Spec.PersistentVolumeReclaimPolicy)
+		}
+		report.done("delete PV and recreate it with driver %s", TypePluginKodo)
+		if claim != nil {
+			report.done("keep PV bound to PVC %s/%s", claim.Namespace, claim.Name)
+		}
+		return
+	}
+
+	backup, err := savePersistentVolume(options.backupDir, pv)
+	if err != nil {
+		report.fail("save PV: %s", err)
+		return
+	}
+	report.done("saved PV into %s", backup)
+	// The bucket must outlive the PV even if it's deleted by mistake in the middle of the migration
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		patch := []byte(`{"spec":{"persistentVolumeReclaimPolicy":"Retain"}}`)
+		if _, err = client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			report.fail("change reclaim policy to Retain: %s", err)
+			return
+		}
+		report.done("changed reclaim policy from %s to Retain", pv.Spec.PersistentVolumeReclaimPolicy)
+	}
+	// pv-protection never removes the finalizer of a bound PV
+	patch := []byte(`{"metadata":{"finalizers":null}}`)
+	if _, err = client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		report.fail("remove finalizers: %s", err)
+		return
+	}
+	preconditions := metav1.NewUIDPreconditions(string(pv.UID))
+	if err = client.CoreV1().PersistentVolumes().Delete(ctx, pv.Name, metav1.DeleteOptions{Preconditions: preconditions}); err != nil {
+		report.fail("delete PV: %s", err)
+		return
+	}
+	if err = wait.PollImmediate(migratePollInterval, options.timeout, func() (bool, error) {
+		_, err := client.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}); err != nil {
+		report.fail("wait for PV to be deleted, recreate it from %s if it's gone: %s", backup, err)
+		return
+	}
+	report.done("deleted PV")
+	if _, err = client.CoreV1().PersistentVolumes().Create(ctx, migrated, metav1.CreateOptions{}); err != nil {
+		report.fail("create migrated PV, restore it from %s: %s", backup, err)
+		return
+	}
+	report.done("created PV with driver %s", TypePluginKodo)
+
+	if claim == nil {
+		return
+	}
+	if err = wait.PollImmediate(migratePollInterval, options.timeout, func() (bool, error) {
+		pvc, err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pvc.Status.Phase == corev1.ClaimBound && pvc.Spec.VolumeName == pv.Name, nil
+	}); err != nil {
+		report.fail("wait for PVC %s/%s to be bound again: %s", claim.Namespace, claim.Name, err)
+		return
+	}
+	report.done("PVC %s/%s is bound again", claim.Namespace, claim.Name)
+}
+
+// newMigratedVolume returns the Kodo volume replacing the PV, which keeps its name, capacity, storage class and claim
+func newMigratedVolume(pv *corev1.PersistentVolume, source *migrationSource, options *migrateOptions) (*corev1.PersistentVolume, error) {
+	if source.prefix = strings.Trim(source.prefix, "/"); source.prefix != "" {
+		return nil, fmt.Errorf("prefix %s of bucket %s is not supported by Kodo volumes, which always mount the whole bucket", source.prefix, source.bucket)
+	} else if source.endpoint == "" || source.region == "" {
+		return nil, fmt.Errorf("S3 endpoint or region of bucket %s is unknown, pass it by -s3-endpoint and -s3-region", source.bucket)
+	}
+
+	secretRef := source.secretRef
+	if options.secret != "" {
+		secretRef = &corev1.SecretReference{Name: options.secret}
+		if pv.Spec.ClaimRef != nil {
+			secretRef.Namespace = pv.Spec.ClaimRef.Namespace
+		}
+		if namespace, name, ok := strings.Cut(options.secret, "/"); ok {
+			secretRef.Namespace, secretRef.Name = namespace, name
+		}
+	}
+	if secretRef == nil || secretRef.Namespace == "" {
+		return nil, fmt.Errorf("secret of the PV is unknown, pass it by -secret as <namespace>/<name>")
+	}
+
+	volumeAttributes := map[string]string{
+		FIELD_BUCKET_ID:   source.bucket,
+		FIELD_S3_ENDPOINT: source.endpoint,
+		FIELD_S3_REGION:   source.region,
+	}
+	readOnly := pv.Spec.CSI != nil && pv.Spec.CSI.ReadOnly || pv.Spec.FlexVolume != nil && pv.Spec.FlexVolume.ReadOnly
+	if readOnly {
+		volumeAttributes[FIELD_READ_ONLY] = "true"
+	}
+	if _, err := parseKodoStorageClassParameter(MigrateCommand, volumeAttributes, placeholderSecrets); err != nil {
+		return nil, err
+	}
+
+	annotations := make(map[string]string, len(pv.Annotations)+1)
+	for key, value := range pv.Annotations {
+		annotations[key] = value
+	}
+	// Otherwise the provisioner of the original driver would still think it owns the PV
+	delete(annotations, "pv.kubernetes.io/provisioned-by")
+	annotations[MigratedFromAnnotation] = source.driver
+
+	migrated := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pv.Name, Labels: pv.Labels, Annotations: annotations},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      pv.Spec.Capacity,
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              pv.Spec.StorageClassName,
+			VolumeMode:                    pv.Spec.VolumeMode,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver: TypePluginKodo,
+				// The volume id is joined into the paths of the caches and logs on the nodes, which is safe for the names of the PVs
+				VolumeHandle:         pv.Name,
+				ReadOnly:             readOnly,
+				VolumeAttributes:     volumeAttributes,
+				NodePublishSecretRef: secretRef,
+			}},
+		},
+	}
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		// The UID binds the PV to the same PVC again, which is lost only until the PV is created
+		migrated.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind: claim.Kind, APIVersion: claim.APIVersion, Namespace: claim.Namespace, Name: claim.Name, UID: claim.UID,
+		}
+	}
+	return migrated, nil
+}
+
+// savePersistentVolume writes the manifest of the PV into the directory and returns its path
+func savePersistentVolume(dir string, pv *corev1.PersistentVolume) (string, error) {
+	backup := pv.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	backup.ResourceVersion, backup.UID, backup.ManagedFields = "", "", nil
+	manifest, err := marshalManifest(backup)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, pv.Name+".yaml")
+	return path, os.WriteFile(path, manifest, 0644)
+}
+
+// missingSecretKeys returns the keys required by Kodo volumes which are not in the secret
+func missingSecretKeys(ctx context.Context, client kubernetes.Interface, secretRef *corev1.SecretReference) ([]string, error) {
+	secret, err := client.CoreV1().Secrets(secretRef.Namespace).Get(ctx, secretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data := secretData(secret)
+	var missing []string
+	for _, key := range []string{FIELD_ACCESS_KEY, FIELD_SECRET_KEY, FIELD_UC_ENDPOINT} {
+		if _, ok := data[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// podsUsingClaim returns the pods not terminated yet which use the PVC
+func podsUsingClaim(ctx context.Context, client kubernetes.Interface, namespace, claimName string) ([]string, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimName {
+				names = append(names, pod.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+func secretData(secret *corev1.Secret) map[string]string {
+	data := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data
+}
+
+// lookupOption returns the first non-empty option of the names, which are compared case-insensitively and ignoring - and _
+func lookupOption(options map[string]string, names ...string) string {
+	for _, name := range names {
+		for key, value := range options {
+			if normalizeOptionName(key) == name && strings.TrimSpace(value) != "" {
+				return strings.TrimSpace(value)
+			}
+		}
+	}
+	return ""
+}
+
+func normalizeOptionName(name string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// parseMountOptions parses the mount options as --<name>=<value>, <name>=<value> or <name> <value>
+func parseMountOptions(mountOptions []string) map[string]string {
+	options := make(map[string]string, len(mountOptions))
+	for _, option := range mountOptions {
+		option = strings.TrimLeft(strings.TrimSpace(option), "-")
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			name, value, _ = strings.Cut(option, " ")
+		}
+		options[normalizeOptionName(name)] = strings.TrimSpace(value)
+	}
+	return options
+}
+
+// isS3DriverName reports whether the FlexVolume or CSI driver is likely to mount S3 buckets by its name
+func isS3DriverName(driver string) bool {
+	driver = strings.ToLower(driver)
+	for _, keyword := range []string{"s3", "rclone", "goofys"} {
+		if strings.Contains(driver, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+const (
+	// Only the controller service is served, by the Deployment with csi-provisioner
+	ModeController = "controller"
+	// Only the node service is served, by the DaemonSet with csi-node-driver-registrar on every node
+	ModeNode = "node"
+	// Both services are served by the same plugin, e.g. for csi-sanity or Nomad
+	ModeAll = "all"
+)
+
+// controllerOnlyFlags are only read by the controller service, so they're rejected by --mode=node
+var controllerOnlyFlags = []string{
+	"kodo-reconcile-interval",
+	"kodo-usage-interval",
+	"kodo-pricing-config",
+	"kodo-transfer-prometheus-url",
+	"kodo-quota-alert-thresholds",
+	"kodo-quota-configmap",
+}
+
+// nodeOnlyFlags are only read by the node service, which is the only one sending requests to the connector,
+// so they're rejected by --mode=controller
+var nodeOnlyFlags = []string{
+	"connector-socket",
+	"connector-address",
+	"connector-tls-cert",
+	"connector-tls-key",
+	"connector-tls-ca",
+	"connector-pool-size",
+	"slow-connector-threshold",
+	"unprivileged",
+	"remount-interval",
+	"startup-taint",
+	"kodo-flush-timeout",
+	"kodo-lazy-unmount",
+}
+
+// servesController returns true if the controller service is served in the mode of --mode
+func servesController() bool {
+	return *pluginMode != ModeNode
+}
+
+// servesNode returns true if the node service is served in the mode of --mode
+func servesNode() bool {
+	return *pluginMode != ModeController
+}
+
+// validateMode checks --mode, and rejects the flags given on the command line which are never read in the mode,
+// so a flag of the other service is never silently ignored
+func validateMode() error {
+	var rejected []string
+	switch *pluginMode {
+	case ModeAll:
+		return nil
+	case ModeController:
+		rejected = nodeOnlyFlags
+	case ModeNode:
+		rejected = controllerOnlyFlags
+	default:
+		return fmt.Errorf("--mode must be one of %s, %s and %s", ModeController, ModeNode, ModeAll)
+	}
+	var given []string
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range rejected {
+			if f.Name == name {
+				given = append(given, "--"+name)
+			}
+		}
+	})
+	if len(given) > 0 {
+		sort.Strings(given)
+		return fmt.Errorf("%s can't be given with --mode=%s", strings.Join(given, ", "), *pluginMode)
+	}
+	return nil
+}
+
+// defaultControllerNodeID returns the node id of the controller, which is never used by the controller RPCs but required by csi-common
+func defaultControllerNodeID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return ModeController
+}
+
+// identityServer advertises the controller service only if it's served in the mode of --mode, which csi-common always advertises
+type identityServer struct {
+	*csicommon.DefaultIdentityServer
+}
+
+func newIdentityServer(d *csicommon.CSIDriver) csi.IdentityServer {
+	return &identityServer{DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d)}
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	if servesController() {
+		return ids.DefaultIdentityServer.GetPluginCapabilities(ctx, req)
+	}
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
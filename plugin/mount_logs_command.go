@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// MountLogsCommand is the subcommand printing the logs of the mounters of a Kodo volume on the node, read from the connector
+const MountLogsCommand = "mount-logs"
+
+// runMountLogs prints the last lines of the logs of the mounters of the volume, and the new lines until interrupted if following, returns the exit code
+func runMountLogs(args []string) int {
+	flagSet := flag.NewFlagSet(MountLogsCommand, flag.ContinueOnError)
+	flagSet.StringVar(connectorSocket, "connector-socket", SocketPath, "Path of the unix socket of the connector")
+	flagSet.StringVar(connectorAddress, "connector-address", "", "TCP address of the remote connector, dialed with mutual TLS instead of --connector-socket if given")
+	flagSet.StringVar(connectorTlsCert, "connector-tls-cert", "", "Path of the PEM encoded client certificate presented to the remote connector")
+	flagSet.StringVar(connectorTlsKey, "connector-tls-key", "", "Path of the PEM encoded private key of --connector-tls-cert")
+	flagSet.StringVar(connectorTlsCa, "connector-tls-ca", "", "Path of the PEM encoded CA bundle verifying the server certificate of the remote connector")
+	lines := flagSet.Int("n", 100, "Lines shown from the end of the log of each mounter")
+	follow := flagSet.Bool("f", false, "Keep printing the new lines until interrupted")
+	mountPath := flagSet.String("mount-path", "", "Only show the log of the mounter serving the mount path, e.g. the target path of a Pod, which is required for the shared mounts")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] <volume id>\n", filepath.Base(os.Args[0]), MountLogsCommand)
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	} else if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := requestKodoMountLogs(ctx, flagSet.Arg(0), *mountPath, *lines, *follow, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read logs of %s: %s\n", flagSet.Arg(0), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Annotation of the PVCs naming the mount profile of their volumes, which replaces the one of the StorageClass
+	PvcMountProfileAnnotation = "mount-profile"
+	// Timeout to get the ConfigMap of the mount profiles
+	MountProfilesTimeout = 10 * time.Second
+)
+
+// getMountProfile returns the fields of the volume context set by the named mount profile, saved in the ConfigMap of
+// --kodo-mount-profiles-configmap by the name in JSON with the same keys as the PVC annotations, e.g. {"vfs-cache-mode": "full", "transfers": 16}.
+// It fails with FailedPrecondition if the profile doesn't exist or is invalid, so the volume is never mounted with the options unexpected.
+func getMountProfile(ctx context.Context, client kubernetes.Interface, functionName, name string) (map[string]string, error) {
+	if *kodoMountProfilesConfigMap == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s: mount profile %s is given, but --kodo-mount-profiles-configmap is empty", functionName, name)
+	} else if client == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s: mount profiles are not supported with -co %s", functionName, orchestrator.name())
+	}
+	getCtx, cancel := context.WithTimeout(ctx, MountProfilesTimeout)
+	defer cancel()
+	configMap, err := client.CoreV1().ConfigMaps(podNamespace()).Get(getCtx, *kodoMountProfilesConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s: mount profile %s doesn't exist, ConfigMap %s is not found", functionName, name, *kodoMountProfilesConfigMap)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: get %s from Kubernetes error: %w", functionName, *kodoMountProfilesConfigMap, err)
+	}
+	value, ok := configMap.Data[name]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s: mount profile %s doesn't exist in %s", functionName, name, *kodoMountProfilesConfigMap)
+	}
+	fields, err := parseMountProfile(value)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s: invalid mount profile %s in %s: %s", functionName, name, *kodoMountProfilesConfigMap, err)
+	}
+	return fields, nil
+}
+
+// parseMountProfile returns the fields of the volume context by the options of the profile, which only tune the mounter like the PVC annotations,
+// the numbers and the booleans are accepted as well as the strings
+func parseMountProfile(value string) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.UseNumber()
+	var options map[string]interface{}
+	if err := decoder.Decode(&options); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(options))
+	var unsupported []string
+	for option, value := range options {
+		field, ok := pvcAnnotationFields[option]
+		if !ok || field == FIELD_MOUNT_PROFILE {
+			unsupported = append(unsupported, option)
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			fields[field] = v
+		case json.Number, bool:
+			fields[field] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("option %s is neither a string, a number nor a boolean", option)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return nil, fmt.Errorf("unsupported options %s", strings.Join(unsupported, ","))
+	}
+	return fields, nil
+}
+
+// applyMountProfile returns a copy of the volume context filled in by the mount profile it names, the fields already given
+// by the StorageClass, the PV or the PVC annotations are kept, so the profile only gives the defaults of the volume
+func applyMountProfile(ctx context.Context, volumeContext map[string]string) (map[string]string, error) {
+	var name string
+	for key, value := range volumeContext {
+		if strings.ToLower(key) == FIELD_MOUNT_PROFILE {
+			name = strings.TrimSpace(value)
+		}
+	}
+	if name == "" {
+		return volumeContext, nil
+	} else if !featureGates.enabled(FeatureKodoMountProfiles) {
+		logger(ctx).Warnf("NodePublishVolume: mount profile %s is ignored, feature gate %s is disabled", name, FeatureKodoMountProfiles)
+		return volumeContext, nil
+	}
+	fields, err := getMountProfile(ctx, getPvcClient(), "NodePublishVolume", name)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]string, len(volumeContext)+len(fields))
+	for field, value := range fields {
+		applied[field] = value
+	}
+	for key, value := range volumeContext {
+		// The fields are case-insensitive, see parseKodoStorageClassParameter
+		delete(applied, strings.ToLower(key))
+		applied[key] = value
+	}
+	return applied, nil
+}
+
+// checkMountProfile rejects the volume whose mount profile doesn't exist, or whose parameters are invalid with the profile applied.
+// The profile is only recorded in the volume context, so the changes of the profile take effect once the volume is published again.
+func (cs *kodoControllerServer) checkMountProfile(ctx context.Context, name string, parameters, secrets map[string]string) error {
+	if name == "" || !featureGates.enabled(FeatureKodoMountProfiles) {
+		return nil
+	}
+	fields, err := getMountProfile(ctx, cs.client, "CreateVolume", name)
+	if err != nil {
+		return err
+	}
+	for key, value := range parameters {
+		delete(fields, strings.ToLower(key))
+		fields[key] = value
+	}
+	_, err = parseKodoStorageClassParameter("CreateVolume", fields, secrets)
+	return err
+}
+
+// hasField returns true if the field is given in the parameters, whose keys are case-insensitive
+func hasField(parameters map[string]string, field string) bool {
+	for key := range parameters {
+		if strings.ToLower(key) == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	OrchestratorKubernetes = "kubernetes"
+	OrchestratorNomad      = "nomad"
+)
+
+// containerOrchestrator hides what the driver assumes about the CO calling it, e.g. kubelet,
+// so that the same driver also works with the other COs implementing CSI
+type containerOrchestrator interface {
+	name() string
+	// publishDir is the directory the target paths of the published volumes are under
+	publishDir() string
+	// workload returns the namespace and the name of the workload the volume is published for, empty if not given by the CO
+	workload(volumeContext map[string]string) (namespace, name string)
+	// controllerCapabilities are advertised by the controller servers
+	controllerCapabilities() []csi.ControllerServiceCapability_RPC_Type
+	// kubernetesClient returns the client to read the PVs and their secrets, nil if the CO is not Kubernetes
+	kubernetesClient() (kubernetes.Interface, error)
+}
+
+// orchestrator is the CO the driver is running with, chosen by -co
+var orchestrator containerOrchestrator = &kubernetesOrchestrator{}
+
+func newContainerOrchestrator(name, publishDir string) (containerOrchestrator, error) {
+	switch name {
+	case OrchestratorKubernetes:
+		return &kubernetesOrchestrator{dir: publishDir}, nil
+	case OrchestratorNomad:
+		// The connector mounts on the node by the target paths inside the plugin container,
+		// so stage_publish_base_dir of csi_plugin must be the same directory on the node it's mounted from
+		if publishDir == "" {
+			return nil, fmt.Errorf("-publish-dir is required with -co %s, which must be stage_publish_base_dir of csi_plugin", OrchestratorNomad)
+		}
+		return &nomadOrchestrator{dir: publishDir}, nil
+	}
+	return nil, fmt.Errorf("-co must be either %s or %s", OrchestratorKubernetes, OrchestratorNomad)
+}
+
+// kubernetesOrchestrator is kubelet with the sidecars, the PVs are read from the API server
+type kubernetesOrchestrator struct {
+	dir string
+}
+
+func (*kubernetesOrchestrator) name() string {
+	return OrchestratorKubernetes
+}
+
+func (o *kubernetesOrchestrator) publishDir() string {
+	if o.dir != "" {
+		return o.dir
+	}
+	return KubeletRootDir
+}
+
+// workload is given by kubelet with podInfoOnMount of CSIDriver
+func (*kubernetesOrchestrator) workload(volumeContext map[string]string) (string, string) {
+	return strings.TrimSpace(volumeContext[FIELD_POD_NAMESPACE]), strings.TrimSpace(volumeContext[FIELD_POD_NAME])
+}
+
+func (*kubernetesOrchestrator) controllerCapabilities() []csi.ControllerServiceCapability_RPC_Type {
+	return []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+	}
+}
+
+func (*kubernetesOrchestrator) kubernetesClient() (kubernetes.Interface, error) {
+	config, err := kubeConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return clientset, nil
+}
+
+// nomadOrchestrator is the Nomad client, which registers the volumes by nomad volume register.
+// There is no PV to read the attributes and the reclaim policy from when a volume is deleted,
+// so the volumes are only statically provisioned. No controller RPC is advertised either,
+// otherwise Nomad would call ControllerPublishVolume, which is never needed by the driver and unimplemented.
+type nomadOrchestrator struct {
+	dir string
+}
+
+func (*nomadOrchestrator) name() string {
+	return OrchestratorNomad
+}
+
+func (o *nomadOrchestrator) publishDir() string {
+	return o.dir
+}
+
+// workload is never given by Nomad, the pod info keys are only accepted as any other volume context
+func (*nomadOrchestrator) workload(map[string]string) (string, string) {
+	return "", ""
+}
+
+func (*nomadOrchestrator) controllerCapabilities() []csi.ControllerServiceCapability_RPC_Type {
+	return nil
+}
+
+func (*nomadOrchestrator) kubernetesClient() (kubernetes.Interface, error) {
+	return nil, nil
+}
+
+// requireKubernetes returns the error of the controller RPCs which read the PVs if the CO is not Kubernetes
+func requireKubernetes(functionName string, client kubernetes.Interface) error {
+	if client == nil {
+		return status.Errorf(codes.Unimplemented, "%s: not supported with -co %s, only statically provisioned volumes are", functionName, orchestrator.name())
+	}
+	return nil
+}
+
+// validateVolumeCapabilities confirms the capabilities if all of them are supported by the driver and by the mounter of the volume,
+// which is required by the COs registering the volumes, e.g. nomad volume register.
+// checkCapability returns why the capability is not supported by the volume, or empty if it is.
+func validateVolumeCapabilities(d *csicommon.CSIDriver, req *csi.ValidateVolumeCapabilitiesRequest,
+	checkCapability func(capability *csi.VolumeCapability) string) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities: volume id is empty")
+	} else if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities: volume capabilities are empty")
+	}
+	for _, capability := range req.GetVolumeCapabilities() {
+		if capability.GetBlock() != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: "block volumes are not supported"}, nil
+		} else if capability.GetAccessMode() == nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: "access mode is not given"}, nil
+		}
+		supported := false
+		for _, mode := range d.GetVolumeCapabilityAccessModes() {
+			if mode.GetMode() == capability.GetAccessMode().GetMode() {
+				supported = true
+			}
+		}
+		if !supported {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: fmt.Sprintf("access mode %s is not supported", capability.GetAccessMode().GetMode())}, nil
+		}
+		if flags := capability.GetMount().GetMountFlags(); len(flags) > 0 {
+			// The mounters are only configured by the parameters, the mount flags are never passed to them
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: fmt.Sprintf("mount flags %s are not supported, give the options of the mounter by the parameters instead", strings.Join(flags, ","))}, nil
+		}
+		if message := checkCapability(capability); message != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: message}, nil
+		}
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+		VolumeContext:      req.GetVolumeContext(),
+		VolumeCapabilities: req.GetVolumeCapabilities(),
+		Parameters:         req.GetParameters(),
+	}}, nil
+}
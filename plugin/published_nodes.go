@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	k8smount "k8s.io/utils/mount"
+)
+
+// Annotation of the PVs with the comma-separated ids of the nodes the volume is published on, maintained by the node servers
+const PublishedNodesAnnotation = "csi.qiniu.com/published-nodes"
+
+// isSingleNodeAccessMode returns true if the volume of the access mode must not be published on more than one node
+func isSingleNodeAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// parsePublishedNodes returns the sorted ids of the nodes in the annotation of the PV
+func parsePublishedNodes(pv *corev1.PersistentVolume) []string {
+	var nodes []string
+	for _, node := range strings.Split(pv.Annotations[PublishedNodesAnnotation], ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// acquirePublishedNode records the node in the PV of the volume before the volume is published on it,
+// the volume of a single node access mode already published on another node is rejected with FailedPrecondition,
+// since nothing stops the buckets from being mounted by the mounters on different nodes, which overwrite each other.
+// Nothing is recorded if the plugin is not running in Kubernetes, or the volume has no PV, e.g. it's ephemeral.
+func acquirePublishedNode(ctx context.Context, driverName, volumeId string, capability *csi.VolumeCapability) error {
+	client := getPvcClient()
+	if client == nil || *nodeID == "" {
+		return nil
+	}
+	singleNode := isSingleNodeAccessMode(capability.GetAccessMode().GetMode())
+	pv, err := getPersistentVolume(ctx, client, driverName, volumeId)
+	if err != nil {
+		if singleNode {
+			return status.Errorf(codes.Unavailable, "NodePublishVolume: failed to get pv of volume %s to check the nodes it's published on: %s", volumeId, err)
+		}
+		logger(ctx).Warnf("NodePublishVolume: failed to get pv of volume %s to record the node it's published on: %s", volumeId, err)
+		return nil
+	} else if pv == nil {
+		return nil
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := client.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		nodes := parsePublishedNodes(latest)
+		published := make([]string, 0, len(nodes)+1)
+		for _, node := range nodes {
+			if node == *nodeID {
+				continue
+			} else if exists, err := nodeExists(ctx, client, node); err == nil && !exists {
+				// The node is deleted without unpublishing the volume, e.g. it's gone with the instance
+				logger(ctx).Warnf("NodePublishVolume: node %s of volume %s no longer exists, forget it", node, volumeId)
+				continue
+			}
+			published = append(published, node)
+		}
+		if singleNode && len(published) > 0 && featureGates.enabled(FeatureSingleNodeAccess) {
+			return status.Errorf(codes.FailedPrecondition,
+				"NodePublishVolume: volume %s of access mode %s is already published on node %s, remove annotation %s of pv %s if the node will never unpublish it",
+				volumeId, capability.GetAccessMode().GetMode(), strings.Join(published, ","), PublishedNodesAnnotation, latest.Name)
+		}
+		published = append(published, *nodeID)
+		sort.Strings(published)
+		if strings.Join(published, ",") == strings.Join(nodes, ",") {
+			return nil
+		}
+		if latest.Annotations == nil {
+			latest.Annotations = make(map[string]string)
+		}
+		latest.Annotations[PublishedNodesAnnotation] = strings.Join(published, ",")
+		_, err = client.CoreV1().PersistentVolumes().Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if _, ok := status.FromError(err); ok {
+		// Either nil or rejected
+		return err
+	} else if !singleNode {
+		logger(ctx).Warnf("NodePublishVolume: failed to record node of volume %s in pv %s: %s", volumeId, pv.Name, err)
+		return nil
+	}
+	return status.Errorf(codes.Unavailable, "NodePublishVolume: failed to record node of volume %s in pv %s: %s", volumeId, pv.Name, err)
+}
+
+// releasePublishedNode removes the node from the PV of the volume once none of the target paths of the volume is mounted on the node,
+// it's called once the target path is unmounted, or the volume fails to be published on it
+func releasePublishedNode(ctx context.Context, driverName, volumeId, targetPath string) {
+	client := getPvcClient()
+	if client == nil || *nodeID == "" {
+		return
+	}
+	pv, err := getPersistentVolume(ctx, client, driverName, volumeId)
+	if err != nil {
+		logger(ctx).Warnf("Failed to get pv of volume %s to forget the node it's published on: %s", volumeId, err)
+		return
+	} else if pv == nil {
+		return
+	}
+	if published, err := isPublishedElsewhere(pv.Name, targetPath); err != nil {
+		logger(ctx).Warnf("Failed to list mount points to forget the node volume %s is published on: %s", volumeId, err)
+		return
+	} else if published {
+		return
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := client.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		nodes := parsePublishedNodes(latest)
+		remaining := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			if node != *nodeID {
+				remaining = append(remaining, node)
+			}
+		}
+		if len(remaining) == len(nodes) {
+			return nil
+		} else if len(remaining) == 0 {
+			delete(latest.Annotations, PublishedNodesAnnotation)
+		} else {
+			latest.Annotations[PublishedNodesAnnotation] = strings.Join(remaining, ",")
+		}
+		_, err = client.CoreV1().PersistentVolumes().Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		logger(ctx).Warnf("Failed to forget the node volume %s is published on: %s", volumeId, err)
+	}
+}
+
+// isPublishedElsewhere returns true if any target path of the PV other than the given one is still mounted on the node,
+// the target paths given by kubelet are <kubelet root dir>/pods/<pod uid>/volumes/kubernetes.io~csi/<pv name>/mount
+func isPublishedElsewhere(pvName, targetPath string) (bool, error) {
+	mountPoints, err := k8smount.New("").List()
+	if err != nil {
+		return false, err
+	}
+	for _, mountPoint := range mountPoints {
+		path := filepath.Clean(mountPoint.Path)
+		if path == filepath.Clean(targetPath) || filepath.Base(path) != "mount" {
+			continue
+		}
+		volumeDir := filepath.Dir(path)
+		if filepath.Base(volumeDir) == pvName && filepath.Base(filepath.Dir(volumeDir)) == "kubernetes.io~csi" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func nodeExists(ctx context.Context, client kubernetes.Interface, name string) (bool, error) {
+	if _, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("get node %s error: %w", name, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Prefix of the annotations of the PVCs overriding the mount options of their volumes
+	PvcAnnotationPrefix = "csi.qiniu.com/"
+	// Timeout to get the PVC of the volume being published
+	PvcAnnotationsTimeout = 10 * time.Second
+)
+
+// pvcAnnotationFields maps the annotations of the PVCs to the fields of the volume context they override.
+// Only the options tuning the mounter are allowed, the bucket, the credentials, the endpoints and read-only are still decided by the StorageClass or the PV.
+var pvcAnnotationFields = map[string]string{
+	"vfs-cache-mode":            FIELD_VFS_CACHE_MODE,
+	"dir-cache-duration":        FIELD_DIR_CACHE_DURATION,
+	"buffer-size":               FIELD_BUFFER_SIZE,
+	"vfs-cache-max-age":         FIELD_VFS_CACHE_MAX_AGE,
+	"vfs-cache-poll-interval":   FIELD_VFS_CACHE_POLL_INTERVAL,
+	"vfs-write-back":            FIELD_VFS_WRITE_BACK,
+	"vfs-cache-max-size":        FIELD_VFS_CACHE_MAX_SIZE,
+	"vfs-read-ahead":            FIELD_VFS_READ_AHEAD,
+	"vfs-fast-fingerprint":      FIELD_VFS_FAST_FINGER_PRINT,
+	"vfs-read-chunk-size":       FIELD_VFS_READ_CHUNK_SIZE,
+	"vfs-read-chunk-size-limit": FIELD_VFS_READ_CHUNK_SIZE_LIMIT,
+	"vfs-read-wait":             FIELD_VFS_READ_WAIT,
+	"vfs-write-wait":            FIELD_VFS_WRITE_WAIT,
+	"no-checksum":               FIELD_NO_CHECKSUM,
+	"no-mod-time":               FIELD_NO_MOD_TIME,
+	"no-seek":                   FIELD_NO_SEEK,
+	"transfers":                 FIELD_TRANSFERS,
+	"write-back-cache":          FIELD_WRITE_BACK_CACHE,
+	"upload-cutoff":             FIELD_UPLOAD_CUTOFF,
+	"upload-chunk-size":         FIELD_UPLOAD_CHUNK_SIZE,
+	"upload-concurrency":        FIELD_UPLOAD_CONCURRENCY,
+	"retries":                   FIELD_RETRIES,
+	"low-level-retries":         FIELD_LOW_LEVEL_RETRIES,
+	"connect-timeout":           FIELD_CONNECT_TIMEOUT,
+	"timeout":                   FIELD_TIMEOUT,
+	"prewarm":                   FIELD_PREWARM,
+	"prewarm-manifest":          FIELD_PREWARM_MANIFEST,
+	"mount-check":               FIELD_MOUNT_CHECK,
+	"persistent-dir-cache":      FIELD_PERSISTENT_DIR_CACHE,
+	PvcMountProfileAnnotation:   FIELD_MOUNT_PROFILE,
+}
+
+var (
+	pvcClientOnce sync.Once
+	pvcClient     kubernetes.Interface
+)
+
+// getPvcClient creates the client to read the PVCs on first use, returns nil if the plugin is not running in Kubernetes
+func getPvcClient() kubernetes.Interface {
+	pvcClientOnce.Do(func() {
+		client, err := orchestrator.kubernetesClient()
+		if err != nil {
+			log.Warnf("PVC annotations are ignored: failed to create client: %s", err)
+			return
+		}
+		pvcClient = client
+	})
+	return pvcClient
+}
+
+// overrideByPvcAnnotations returns a copy of the volume context overridden by the annotations of its PVC,
+// which is known by the volume context if the volume is provisioned by csi-provisioner with --extra-create-metadata.
+// The volume context is returned as is if the PVC is unknown or fails to be read, so that the volume is still mounted with the defaults.
+func overrideByPvcAnnotations(ctx context.Context, volumeContext map[string]string) map[string]string {
+	name, namespace := strings.TrimSpace(volumeContext[FIELD_PVC_NAME]), strings.TrimSpace(volumeContext[FIELD_PVC_NAMESPACE])
+	if name == "" || namespace == "" {
+		return volumeContext
+	}
+	client := getPvcClient()
+	if client == nil {
+		return volumeContext
+	}
+	getCtx, cancel := context.WithTimeout(ctx, PvcAnnotationsTimeout)
+	defer cancel()
+	pvc, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(getCtx, name, metav1.GetOptions{})
+	if err != nil {
+		logger(ctx).Warnf("Failed to get PVC %s/%s, its annotations are ignored: %s", namespace, name, err)
+		return volumeContext
+	}
+
+	overridden, unsupported := applyPvcAnnotations(volumeContext, pvc.GetAnnotations())
+	for _, annotation := range unsupported {
+		logger(ctx).Warnf("Unsupported annotation %s of PVC %s/%s is ignored", annotation, namespace, name)
+	}
+	return overridden
+}
+
+// applyPvcAnnotations returns a copy of the volume context overridden by the annotations prefixed by PvcAnnotationPrefix,
+// and the ones with the prefix which are not supported
+func applyPvcAnnotations(volumeContext, annotations map[string]string) (map[string]string, []string) {
+	overrides := make(map[string]string)
+	var unsupported []string
+	for annotation, value := range annotations {
+		if !strings.HasPrefix(annotation, PvcAnnotationPrefix) {
+			continue
+		}
+		if field, ok := pvcAnnotationFields[strings.TrimPrefix(annotation, PvcAnnotationPrefix)]; ok {
+			overrides[field] = value
+		} else {
+			unsupported = append(unsupported, annotation)
+		}
+	}
+	sort.Strings(unsupported)
+	if len(overrides) == 0 {
+		return volumeContext, unsupported
+	}
+	overridden := overrides
+	for key, value := range volumeContext {
+		// The fields are case-insensitive, see parseKodoStorageClassParameter
+		if _, ok := overrides[strings.ToLower(key)]; !ok {
+			overridden[key] = value
+		}
+	}
+	return overridden, unsupported
+}
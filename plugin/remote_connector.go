@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Timeout to dial the remote connector of --connector-address including the TLS handshake
+const remoteConnectorDialTimeout = 10 * time.Second
+
+var (
+	remoteConnectorTLSOnce   sync.Once
+	remoteConnectorTLSConfig *tls.Config
+	remoteConnectorTLSErr    error
+)
+
+// connectorEndpoint returns the address of the remote connector if given, otherwise the unix socket of the connector on the node
+func connectorEndpoint() string {
+	if *connectorAddress != "" {
+		return *connectorAddress
+	}
+	return *connectorSocket
+}
+
+// isRemoteConnector reports whether the volumes are mounted by the remote connector of --connector-address on its own node
+func isRemoteConnector() bool {
+	return *connectorAddress != ""
+}
+
+// checkRemoteMounted fails if the target path mounted by the remote connector isn't a mount point on this node,
+// e.g. the FUSE mount point on the gateway node never propagates through a directory exported by it, so the Pod would write to
+// the local directory instead. The mount point on the gateway node is unmounted by unmount then.
+func checkRemoteMounted(ctx context.Context, volumeId, mountPath string, isMounted func(string) (bool, error),
+	unmount func(ctx context.Context, volumeId, mountPath string) error) error {
+	if !isRemoteConnector() {
+		return nil
+	}
+	mounted, err := isMounted(mountPath)
+	if err == nil && !mounted {
+		err = fmt.Errorf("%s is mounted on the node of connector %s, but it's not a mount point on this node", mountPath, *connectorAddress)
+	}
+	if err != nil {
+		if unmountErr := unmount(ctx, volumeId, mountPath); unmountErr != nil {
+			logger(ctx).Warnf("Failed to unmount %s on the node of connector %s: %s", mountPath, *connectorAddress, unmountErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// dialConnectorEndpoint dials the connector on the node by the unix socket, or the remote connector by TCP with mutual TLS,
+// which verifies the connector by the CA of --connector-tls-ca, and presents the client certificate of --connector-tls-cert
+func dialConnectorEndpoint() (net.Conn, error) {
+	if *connectorAddress == "" {
+		conn, err := net.Dial("unix", *connectorSocket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial unix socket %s: %w", *connectorSocket, err)
+		}
+		return conn, nil
+	}
+	remoteConnectorTLSOnce.Do(func() {
+		remoteConnectorTLSConfig, remoteConnectorTLSErr = loadRemoteConnectorTLSConfig(*connectorTlsCert, *connectorTlsKey, *connectorTlsCa)
+	})
+	if remoteConnectorTLSErr != nil {
+		return nil, fmt.Errorf("invalid TLS of connector %s: %w", *connectorAddress, remoteConnectorTLSErr)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: remoteConnectorDialTimeout}, "tcp", *connectorAddress, remoteConnectorTLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial connector %s: %w", *connectorAddress, err)
+	}
+	return conn, nil
+}
+
+func loadRemoteConnectorTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("--connector-tls-cert, --connector-tls-key and --connector-tls-ca are all required")
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificate is found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      rootCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
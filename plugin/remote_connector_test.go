@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckRemoteMounted(t *testing.T) {
+	address := *connectorAddress
+	t.Cleanup(func() {
+		*connectorAddress = address
+	})
+	const mountPath = "/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount"
+
+	for name, test := range map[string]struct {
+		address   string
+		mounted   bool
+		err       error
+		fails     bool
+		unmounted bool
+	}{
+		"local connector":                {address: ""},
+		"remote mount point seen":        {address: "gateway:9443", mounted: true},
+		"remote mount point not seen":    {address: "gateway:9443", fails: true, unmounted: true},
+		"remote mount point not checked": {address: "gateway:9443", err: errors.New("findmnt failed"), fails: true, unmounted: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			*connectorAddress = test.address
+			unmounted := false
+			err := checkRemoteMounted(context.Background(), "pv-1", mountPath, func(path string) (bool, error) {
+				if path != mountPath {
+					t.Fatalf("%s is checked, expected %s", path, mountPath)
+				}
+				return test.mounted, test.err
+			}, func(ctx context.Context, volumeId, path string) error {
+				unmounted = volumeId == "pv-1" && path == mountPath
+				return nil
+			})
+			if (err != nil) != test.fails {
+				t.Fatalf("checkRemoteMounted = %v, expected failure %v", err, test.fails)
+			} else if unmounted != test.unmounted {
+				t.Fatalf("volume is unmounted: %v, expected %v", unmounted, test.unmounted)
+			}
+		})
+	}
+}
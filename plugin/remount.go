@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+)
+
+// The mount point is re-mounted only if it's found disconnected by so many checks in a row,
+// so that the mounter being restarted by the connector is not raced
+const RemountDisconnectedChecks = 2
+
+// remountWatchdog re-mounts the volumes published on the node whose mount points are disconnected,
+// which happens if the connector is restarted and its mounters are killed together with it.
+// The containers see the new mount points only if the volumes are mounted with mountPropagation HostToContainer.
+type remountWatchdog struct {
+	fsType string
+	mount  func(ctx context.Context, req *csi.NodePublishVolumeRequest) error
+	// probe tells whether the target path is mounted by fsType and disconnected, unmount unmounts it like unmountVolume
+	probe   func(targetPath string) (mounted, disconnected bool)
+	unmount func(ctx context.Context, volumeId, targetPath string, lazy bool) error
+
+	lock sync.Mutex
+	// Requests by the target paths published and not unpublished yet, which are forgotten once the plugin restarts
+	published map[string]*csi.NodePublishVolumeRequest
+	// How many checks in a row found the target paths disconnected
+	disconnected map[string]int
+}
+
+// newRemountWatchdog checks the published volumes every interval in background, never if interval is 0
+func newRemountWatchdog(fsType string, interval time.Duration, mount func(ctx context.Context, req *csi.NodePublishVolumeRequest) error) *remountWatchdog {
+	watchdog := &remountWatchdog{
+		fsType:       fsType,
+		mount:        mount,
+		unmount:      unmountVolume,
+		published:    make(map[string]*csi.NodePublishVolumeRequest),
+		disconnected: make(map[string]int),
+	}
+	watchdog.probe = func(targetPath string) (bool, bool) {
+		return probeMountPoint(targetPath, fsType)
+	}
+	if interval > 0 {
+		go watchdog.run(interval)
+	}
+	return watchdog
+}
+
+func (watchdog *remountWatchdog) publish(req *csi.NodePublishVolumeRequest) {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+
+	watchdog.published[req.GetTargetPath()] = req
+	delete(watchdog.disconnected, req.GetTargetPath())
+}
+
+// unpublish forgets the target path, waits for it to be re-mounted if it's being re-mounted
+func (watchdog *remountWatchdog) unpublish(targetPath string) {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+
+	delete(watchdog.published, targetPath)
+	delete(watchdog.disconnected, targetPath)
+}
+
+func (watchdog *remountWatchdog) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		watchdog.lock.Lock()
+		targetPaths := make([]string, 0, len(watchdog.published))
+		for targetPath := range watchdog.published {
+			targetPaths = append(targetPaths, targetPath)
+		}
+		watchdog.lock.Unlock()
+
+		for _, targetPath := range targetPaths {
+			watchdog.check(targetPath)
+		}
+	}
+}
+
+// check re-mounts the target path if it's disconnected, the lock is held so that the target path is not unpublished meanwhile
+func (watchdog *remountWatchdog) check(targetPath string) {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+
+	req, ok := watchdog.published[targetPath]
+	if !ok {
+		return
+	}
+	entry := log.WithField("volume_id", req.GetVolumeId())
+	mounted, disconnected := watchdog.probe(targetPath)
+	if !mounted {
+		// Being restarted by the connector or unmounted on purpose, never mounted again over the files written to the directory meanwhile
+		delete(watchdog.disconnected, targetPath)
+		return
+	} else if !disconnected {
+		// A stuck mount point may still recover, re-mounting it loses the data not uploaded yet
+		delete(watchdog.disconnected, targetPath)
+		return
+	}
+	if watchdog.disconnected[targetPath]++; watchdog.disconnected[targetPath] < RemountDisconnectedChecks {
+		entry.Warnf("Mount point %s is disconnected, re-mount it if it's still disconnected in the next check", targetPath)
+		return
+	}
+	delete(watchdog.disconnected, targetPath)
+
+	entry.Warnf("Mount point %s is still disconnected, re-mount it", targetPath)
+	if err := watchdog.remount(req); err != nil {
+		entry.Errorf("Failed to re-mount %s: %s", targetPath, err)
+		if namespace, name := orchestrator.workload(req.GetVolumeContext()); name != "" && namespace != "" {
+			go emitFailureEvent("Pod", namespace, name, EventReasonRemountFailed, err)
+		}
+		return
+	}
+	entry.Infof("Mount point %s is re-mounted", targetPath)
+}
+
+// remount unmounts the disconnected mount point lazily, then mounts the volume on it again just like NodePublishVolume
+func (watchdog *remountWatchdog) remount(req *csi.NodePublishVolumeRequest) error {
+	if err := watchdog.unmount(context.Background(), req.GetVolumeId(), req.GetTargetPath(), true); err != nil {
+		return fmt.Errorf("failed to unmount disconnected mount point lazily: %w", err)
+	}
+	return watchdog.mount(context.Background(), req)
+}
+
+// probeMountPoint tells whether the target path is mounted by the fs type, and whether the mount point is disconnected,
+// i.e. its mounter is gone, rather than stuck
+func probeMountPoint(targetPath, fsType string) (mounted, disconnected bool) {
+	if mounted, err := isMounted(targetPath, fsType); err != nil || !mounted {
+		return false, false
+	}
+	_, err := statMountPoint(context.Background(), targetPath)
+	return true, errors.Is(err, errMountPointDisconnected)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const testTargetPath = "/var/lib/kubelet/pods/6f2b/volumes/kubernetes.io~csi/pv-1/mount"
+
+// fakeMountPoints records how the watchdog unmounts and mounts the target paths probed as given
+type fakeMountPoints struct {
+	lock         sync.Mutex
+	mounted      bool
+	disconnected bool
+	unmountErr   error
+	unmounts     []string
+	mounts       []string
+}
+
+func (points *fakeMountPoints) set(mounted, disconnected bool) {
+	points.lock.Lock()
+	defer points.lock.Unlock()
+
+	points.mounted, points.disconnected = mounted, disconnected
+}
+
+func (points *fakeMountPoints) counts() (int, int) {
+	points.lock.Lock()
+	defer points.lock.Unlock()
+
+	return len(points.unmounts), len(points.mounts)
+}
+
+func newTestRemountWatchdog(points *fakeMountPoints, interval time.Duration) *remountWatchdog {
+	watchdog := newRemountWatchdog(FuseTypeKodo, 0, func(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+		points.lock.Lock()
+		defer points.lock.Unlock()
+
+		points.mounts = append(points.mounts, req.GetTargetPath())
+		points.disconnected = false
+		return nil
+	})
+	watchdog.probe = func(targetPath string) (bool, bool) {
+		points.lock.Lock()
+		defer points.lock.Unlock()
+
+		return points.mounted, points.disconnected
+	}
+	watchdog.unmount = func(ctx context.Context, volumeId, targetPath string, lazy bool) error {
+		points.lock.Lock()
+		defer points.lock.Unlock()
+
+		if !lazy {
+			return errors.New("disconnected mount point is unmounted forcibly")
+		} else if points.unmountErr != nil {
+			return points.unmountErr
+		}
+		points.unmounts = append(points.unmounts, targetPath)
+		return nil
+	}
+	if interval > 0 {
+		go watchdog.run(interval)
+	}
+	return watchdog
+}
+
+func expectRemounts(t *testing.T, points *fakeMountPoints, unmounts, mounts int) {
+	t.Helper()
+	if actualUnmounts, actualMounts := points.counts(); actualUnmounts != unmounts || actualMounts != mounts {
+		t.Fatalf("unmounted %d times and mounted %d times, expected %d and %d", actualUnmounts, actualMounts, unmounts, mounts)
+	}
+}
+
+func TestRemountWatchdogRemountsIfDisconnectedTwice(t *testing.T) {
+	points := &fakeMountPoints{mounted: true}
+	watchdog := newTestRemountWatchdog(points, 0)
+	watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: testTargetPath})
+
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 0, 0)
+
+	points.set(true, true)
+	watchdog.check(testTargetPath)
+	// The mounter may be being restarted by the connector
+	expectRemounts(t, points, 0, 0)
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 1, 1)
+
+	// Connected again once re-mounted
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 1, 1)
+}
+
+func TestRemountWatchdogCountsDisconnectedChecksInARow(t *testing.T) {
+	for name, between := range map[string]func(*fakeMountPoints){
+		"connected": func(points *fakeMountPoints) { points.set(true, false) },
+		"unmounted": func(points *fakeMountPoints) { points.set(false, false) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			points := &fakeMountPoints{mounted: true, disconnected: true}
+			watchdog := newTestRemountWatchdog(points, 0)
+			watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: testTargetPath})
+
+			watchdog.check(testTargetPath)
+			between(points)
+			watchdog.check(testTargetPath)
+			points.set(true, true)
+			watchdog.check(testTargetPath)
+			expectRemounts(t, points, 0, 0)
+			watchdog.check(testTargetPath)
+			expectRemounts(t, points, 1, 1)
+		})
+	}
+}
+
+func TestRemountWatchdogNeverRemountsUnpublished(t *testing.T) {
+	points := &fakeMountPoints{mounted: true, disconnected: true}
+	watchdog := newTestRemountWatchdog(points, 0)
+	watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: testTargetPath})
+
+	watchdog.check(testTargetPath)
+	watchdog.unpublish(testTargetPath)
+	watchdog.check(testTargetPath)
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 0, 0)
+
+	// Published again, the checks before are forgotten
+	watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: testTargetPath})
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 0, 0)
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 1, 1)
+}
+
+func TestRemountWatchdogNeverMountsIfUnmountFails(t *testing.T) {
+	points := &fakeMountPoints{mounted: true, disconnected: true, unmountErr: errors.New("device or resource busy")}
+	watchdog := newTestRemountWatchdog(points, 0)
+	// Without the workload, no event is emitted
+	watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: testTargetPath})
+
+	watchdog.check(testTargetPath)
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 0, 0)
+
+	// Tried again after another two checks
+	points.lock.Lock()
+	points.unmountErr = nil
+	points.lock.Unlock()
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 0, 0)
+	watchdog.check(testTargetPath)
+	expectRemounts(t, points, 1, 1)
+}
+
+func TestRemountWatchdogRunStopsCheckingOnceUnpublished(t *testing.T) {
+	points := &fakeMountPoints{mounted: true}
+	watchdog := newTestRemountWatchdog(points, 10*time.Millisecond)
+	const otherTargetPath = "/var/lib/kubelet/pods/9a1c/volumes/kubernetes.io~csi/pv-1/mount"
+	watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: testTargetPath})
+	watchdog.publish(&csi.NodePublishVolumeRequest{VolumeId: "pv-1", TargetPath: otherTargetPath})
+	watchdog.unpublish(otherTargetPath)
+
+	points.set(true, true)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, mounts := points.counts(); mounts > 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("disconnected mount point is not re-mounted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Disconnected again, but unpublished
+	watchdog.unpublish(testTargetPath)
+	points.set(true, true)
+	// Far more checks than RemountDisconnectedChecks
+	time.Sleep(100 * time.Millisecond)
+
+	points.lock.Lock()
+	defer points.lock.Unlock()
+	for _, targetPath := range points.mounts {
+		if targetPath != testTargetPath {
+			t.Fatalf("unpublished %s is re-mounted", targetPath)
+		}
+	}
+	if len(points.mounts) != 1 {
+		t.Fatalf("re-mounted %d times, expected once", len(points.mounts))
+	}
+}
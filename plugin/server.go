@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// serveGRPC serves the CSI services on the endpoint until the server stops, the controller or the node service is not served if nil, see --mode.
+// It replaces the server of csi-common, whose interceptors cannot be extended to observe the RPCs.
+func serveGRPC(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		log.Fatalf("Invalid endpoint: %s", err)
+	}
+	if proto == "unix" {
+		addr = "/" + addr
+		if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to remove %s: %s", addr, err)
+		}
+	}
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %s", err)
+	}
+
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(traceGRPC, logGRPC, observeGRPC, detectSlowGRPC, reportGRPCFailure))
+	csi.RegisterIdentityServer(server, ids)
+	if cs != nil {
+		csi.RegisterControllerServer(server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(server, ns)
+	}
+
+	log.Infof("Listening for connections on address: %s", listener.Addr())
+	if err = server.Serve(listener); err != nil {
+		log.Errorf("Failed to serve gRPC: %s", err)
+	}
+}
+
+type (
+	loggerContextKey    struct{}
+	requestIdContextKey struct{}
+)
+
+// quietMethods are called periodically by the sidecars, so they're only logged on failure or at debug level
+var quietMethods = map[string]bool{
+	"Probe":                     true,
+	"GetPluginInfo":             true,
+	"GetPluginCapabilities":     true,
+	"ControllerGetCapabilities": true,
+	"NodeGetCapabilities":       true,
+	"NodeGetInfo":               true,
+}
+
+// logger returns the logger of the CSI RPC, which logs with the method, the request id and the volume id of the RPC
+func logger(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(loggerContextKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// requestIdFromContext returns the id of the CSI RPC, or empty if not called by a CSI RPC
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	requestId := randomChoices("0123456789abcdef", 16)
+	fields := log.Fields{"method": method, "requestID": requestId}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		fields["volumeID"] = r.GetVolumeId()
+	}
+	entry := log.WithFields(fields)
+	ctx = context.WithValue(ctx, loggerContextKey{}, entry)
+	ctx = context.WithValue(ctx, requestIdContextKey{}, requestId)
+
+	entry.Debugf("GRPC request: %s", protosanitizer.StripSecrets(req))
+	begin := time.Now()
+	resp, err := handler(ctx, req)
+	entry = entry.WithField("duration", time.Since(begin).Seconds())
+	if err != nil {
+		entry.Errorf("GRPC error: %s", err)
+	} else if quietMethods[method] {
+		entry.Debugf("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	} else {
+		entry.Infof("GRPC call succeeded")
+		entry.Debugf("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/csi-driver/protocol"
+	"google.golang.org/grpc"
+)
+
+// Stage of the time spent by the plugin itself, outside of the requests to the connector
+const StagePlugin = "plugin"
+
+var slowOperationTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: MetricsNamespace,
+	Name:      "slow_operations_total",
+	Help:      "Total number of CSI RPCs and connector requests exceeding the thresholds by operation and the slowest stage",
+}, []string{"operation", "stage"})
+
+// slowExemptCommands wait by design, so they're never reported as slow
+var slowExemptCommands = map[string]bool{
+	protocol.KodoFlushCmdName: true,
+}
+
+type stagesContextKey struct{}
+
+// operationStages records the time spent in each stage of a CSI RPC
+type operationStages struct {
+	lock      sync.Mutex
+	durations map[string]time.Duration
+}
+
+// recordStage adds the time spent in the stage since begin to the CSI RPC of the context
+func recordStage(ctx context.Context, stage string, begin time.Time) {
+	if stages, ok := ctx.Value(stagesContextKey{}).(*operationStages); ok {
+		stages.lock.Lock()
+		defer stages.lock.Unlock()
+		stages.durations[stage] += time.Since(begin)
+	}
+}
+
+// slowest returns the slowest stage, along with the durations of all stages in descending order for logging
+func (stages *operationStages) slowest(total time.Duration) (string, string) {
+	stages.lock.Lock()
+	defer stages.lock.Unlock()
+
+	durations := make(map[string]time.Duration, len(stages.durations)+1)
+	others := total
+	for stage, duration := range stages.durations {
+		durations[stage] = duration
+		others -= duration
+	}
+	if others > 0 {
+		durations[StagePlugin] += others
+	}
+	names := make([]string, 0, len(durations))
+	for stage := range durations {
+		names = append(names, stage)
+	}
+	sort.Slice(names, func(i, j int) bool { return durations[names[i]] > durations[names[j]] })
+	details := make([]string, 0, len(names))
+	for _, stage := range names {
+		details = append(details, fmt.Sprintf("%s=%s", stage, durations[stage].Round(time.Millisecond)))
+	}
+	if len(names) == 0 {
+		return StagePlugin, ""
+	}
+	return names[0], strings.Join(details, ", ")
+}
+
+// detectSlowGRPC warns about the CSI RPCs exceeding --slow-rpc-threshold with the slowest stage
+func detectSlowGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if slowRPCThreshold.get() <= 0 {
+		return handler(ctx, req)
+	}
+	stages := &operationStages{durations: make(map[string]time.Duration)}
+	ctx = context.WithValue(ctx, stagesContextKey{}, stages)
+	begin := time.Now()
+	resp, err := handler(ctx, req)
+	if total := time.Since(begin); total > slowRPCThreshold.get() {
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		stage, details := stages.slowest(total)
+		slowOperationTotal.WithLabelValues(method, stage).Inc()
+		logger(ctx).WithField("duration", total.Seconds()).
+			Warnf("Slow CSI RPC: %s takes %s, exceeding %s, the slowest stage is %s (%s)", method, total.Round(time.Millisecond), slowRPCThreshold.get(), stage, details)
+	}
+	return resp, err
+}
+
+// detectSlowConnectorRequest warns about the requests to the connector exceeding --slow-connector-threshold,
+// the stages of the request are logged by the connector with the same request id
+func detectSlowConnectorRequest(ctx context.Context, command string, duration time.Duration) {
+	if slowConnectorThreshold.get() <= 0 || duration <= slowConnectorThreshold.get() || slowExemptCommands[command] {
+		return
+	}
+	slowOperationTotal.WithLabelValues("connector "+command, "connector").Inc()
+	logger(ctx).WithField("duration", duration.Seconds()).
+		Warnf("Slow connector request: %s takes %s, exceeding %s, see the logs of the connector for the slow stage", command, duration.Round(time.Millisecond), slowConnectorThreshold.get())
+}
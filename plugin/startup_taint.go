@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// How often the connector is pinged again until the startup taint is removed
+	StartupTaintRetryInterval = 5 * time.Second
+	// Timeout to remove the startup taint from the node
+	StartupTaintTimeout = 10 * time.Second
+)
+
+// startStartupTaintRemover removes the taint of --startup-taint from the node once the connector replies the ping,
+// the preflight checks of the node service have passed already as the plugin starts.
+// The nodes are tainted by the cluster as they join, e.g. by --register-with-taints of kubelet, so the pods using the volumes
+// are never scheduled onto a node before its node plugin could mount them, and the taint is never added back by the plugin.
+func startStartupTaintRemover(client kubernetes.Interface) {
+	if *startupTaint == "" {
+		return
+	} else if client == nil {
+		log.Warnf("Startup taint: --startup-taint is ignored, the plugin is not running in Kubernetes")
+		return
+	}
+
+	go func() {
+		var failed bool
+		for {
+			if err := pingConnector(context.Background()); err != nil {
+				if !failed {
+					log.Warnf("Startup taint: %s is kept on node %s, connector is not ready: %s", *startupTaint, *nodeID, err)
+					failed = true
+				}
+			} else if err = removeStartupTaint(client); err != nil {
+				log.Warnf("Startup taint: failed to remove %s from node %s: %s", *startupTaint, *nodeID, err)
+			} else {
+				return
+			}
+			time.Sleep(StartupTaintRetryInterval)
+		}
+	}()
+}
+
+// removeStartupTaint removes the taint of --startup-taint of any effect from the node, nothing is changed if the node isn't tainted
+func removeStartupTaint(client kubernetes.Interface) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StartupTaintTimeout)
+	defer cancel()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := client.CoreV1().Nodes().Get(ctx, *nodeID, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		taints := make([]corev1.Taint, 0, len(node.Spec.Taints))
+		for _, taint := range node.Spec.Taints {
+			if taint.Key != *startupTaint {
+				taints = append(taints, taint)
+			}
+		}
+		if len(taints) == len(node.Spec.Taints) {
+			log.Infof("Startup taint: connector is ready, node %s is not tainted by %s", *nodeID, *startupTaint)
+			return nil
+		}
+		node.Spec.Taints = taints
+		if _, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Infof("Startup taint: connector is ready, removed %s from node %s", *startupTaint, *nodeID)
+		return nil
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// tracer creates the spans of the plugin, which are dropped unless initTracing is called
+var tracer = otel.Tracer("github.com/qiniu/csi-driver/plugin")
+
+// initTracing exports the spans to the OTLP gRPC endpoint, and propagates the trace context to the connector
+func initTracing(endpoint string, insecure bool, driverName string) error {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("qiniu-csi-plugin"),
+			semconv.ServiceVersionKey.String(VERSION),
+			attribute.String("csi.driver", driverName),
+			attribute.String("csi.node_id", *nodeID),
+		)),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("Tracing error: %s", err)
+	}))
+	log.Infof("Exporting traces to %s", endpoint)
+	return nil
+}
+
+// traceGRPC starts a span for every CSI RPC
+func traceGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, span := tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer))
+	defer endSpan(span, &err)
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		span.SetAttributes(attribute.String("csi.volume_id", r.GetVolumeId()))
+	}
+	return handler(ctx, req)
+}
+
+// endSpan ends the span with the error, called by defer with the named error
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
@@ -8,17 +8,22 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/qiniu/csi-driver/protocol"
+	"github.com/qiniu/csi-driver/qiniu"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const LOG_DIR_PATH = "/var/log/qiniu/storage/csi-plugin/"
@@ -62,6 +67,38 @@ func setLogAttribute(driverName string) {
 	}
 }
 
+// setLogFormat sets the format and the minimum level of the logs
+func setLogFormat(format, level string) error {
+	switch strings.ToLower(format) {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format %q, expect text or json", format)
+	}
+	if err := setConfiguredLogLevel(level); err != nil {
+		return err
+	}
+	go toggleDebugLogOnSignal()
+	return nil
+}
+
+// toggleDebugLogOnSignal switches the level of the logs between debug and the configured level on every SIGUSR1,
+// so that the debug logs of a reproduction could be captured without restarting and losing the broken state
+func toggleDebugLogOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		if level := getConfiguredLogLevel(); log.GetLevel() == log.DebugLevel && level != log.DebugLevel {
+			log.SetLevel(level)
+		} else {
+			log.SetLevel(log.DebugLevel)
+		}
+		log.Warnf("Log level is changed to %s by SIGUSR1", log.GetLevel())
+	}
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	time := time.Now()
@@ -69,6 +106,18 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(message))
 }
 
+// readinessHandler serves /healthz of the node plugin, which is ready only if the connector replies the ping,
+// so the node plugin with its connector dead is marked not ready
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if err := pingConnector(r.Context()); err != nil {
+		log.Warnf("Readiness probe failed: %s", err)
+		http.Error(w, "Connector is not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Readiness probe is OK, connector " + connectorEndpoint() + " is reachable"))
+}
+
 func ensureCommandExists(name string) error {
 	_, err := exec.LookPath(name)
 	if err != nil {
@@ -97,6 +146,14 @@ const (
 	SocketPath = "/var/lib/qiniu/storage/csi-plugin/connector.sock"
 )
 
+// kubeConfig returns the config to access Kubernetes by --kubeconfig, or the in-cluster config if it's not given
+func kubeConfig() (*rest.Config, error) {
+	if *kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
 func redirectToLog(logPrefix string, reader io.Reader) {
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
@@ -123,14 +180,22 @@ func redirectToChan(logPrefix string, reader io.Reader, c chan<- string) {
 	}
 }
 
-func mountKodoFSLocally(ctx context.Context, gatewayID, mountPath string, mountServerAddress *url.URL, accessToken, subDir string) error {
+func mountKodoFSLocally(ctx context.Context, gatewayID, mountPath string, mountServerAddresses urlList, accessToken, subDir string,
+	httpProxy, httpsProxy, noProxy string) error {
+	// Unlike the connector on the node, the container of the plugin may be given no /dev/fuse
+	if err := protocol.CheckFuse(); err != nil {
+		return err
+	}
 	outputChan := make(chan string)
 	defer close(outputChan)
 
 	cmd := protocol.InitKodoFSMountCmd{
-		GatewayID: gatewayID,
-		MountPath: mountPath,
-		SubDir:    subDir,
+		GatewayID:  gatewayID,
+		MountPath:  mountPath,
+		SubDir:     subDir,
+		HttpProxy:  httpProxy,
+		HttpsProxy: httpsProxy,
+		NoProxy:    noProxy,
 	}
 	execCmd := cmd.ExecCommand(ctx)
 	stdin, err := execCmd.StdinPipe()
@@ -154,7 +219,7 @@ func mountKodoFSLocally(ctx context.Context, gatewayID, mountPath string, mountS
 	go func(ctx context.Context, input io.Writer, output <-chan string) {
 		for text := range output {
 			if strings.Contains(text, "please enter the master address(separate multiple addresses with commas):") {
-				io.WriteString(input, mountServerAddress.String()+"\n")
+				io.WriteString(input, mountServerAddresses.String()+"\n")
 			} else if strings.Contains(text, "please enter the AccessToken:") {
 				io.WriteString(input, accessToken+"\n")
 			} else {
@@ -166,10 +231,16 @@ func mountKodoFSLocally(ctx context.Context, gatewayID, mountPath string, mountS
 	return execCmd.Run()
 }
 
-func mountKodoFS(gatewayID, mountPath string, mountServerAddress *url.URL, accessToken, subDir string) error {
-	conn, err := net.Dial("unix", SocketPath)
+func mountKodoFS(ctx context.Context, gatewayID, mountPath string, mountServerAddresses urlList, accessToken, subDir string,
+	httpProxy, httpsProxy, noProxy string, mountOptions string, noRwCache bool, kodofsParams string) (err error) {
+	defer observeConnectorRequest(ctx, protocol.InitKodoFsMountCmdName, time.Now(), &err)
+	ctx, span := tracer.Start(ctx, "connector "+protocol.InitKodoFsMountCmdName)
+	defer endSpan(span, &err)
+
+	// The outputs of kodofs may arrive after it exits, so the connection is never reused
+	conn, err := dialConnector(false)
 	if err != nil {
-		return fmt.Errorf("failed to dial unix socket %s: %w", SocketPath, err)
+		return err
 	}
 	defer conn.Close()
 
@@ -179,38 +250,45 @@ func mountKodoFS(gatewayID, mountPath string, mountServerAddress *url.URL, acces
 		subDir = filepath.Join("/", subDir)
 	}
 
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+	encoder := conn.encoder
 
-	writeCmdToConn := func(encoder *json.Encoder, cmd protocol.Cmd) error {
+	writeCmdToConn := func(encoder *frameEncoder, cmd protocol.Cmd) error {
 		buf, err := json.Marshal(cmd)
 		if err != nil {
 			return fmt.Errorf("failed to marshal json payload: %w", err)
 		}
 		switch cmd.(type) {
 		case *protocol.InitKodoFSMountCmd:
-			if err = encoder.Encode(makeRequest(protocol.InitKodoFsMountCmdName, buf)); err != nil {
-				return fmt.Errorf("failed to write command to unix socket %s: %w", SocketPath, err)
+			if err = encoder.Encode(conn.makeRequest(ctx, protocol.InitKodoFsMountCmdName, buf)); err != nil {
+				return fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
 			}
 		case *protocol.RequestDataCmd:
-			if err = encoder.Encode(makeRequest(protocol.RequestDataCmdName, buf)); err != nil {
-				return fmt.Errorf("failed to write command to unix socket %s: %w", SocketPath, err)
+			if err = conn.sendData(ctx, buf); err != nil {
+				return err
 			}
 		}
 		return nil
 	}
 
 	if err = writeCmdToConn(encoder, &protocol.InitKodoFSMountCmd{
-		GatewayID: gatewayID,
-		MountPath: mountPath,
-		SubDir:    subDir,
+		GatewayID:    gatewayID,
+		MountPath:    mountPath,
+		SubDir:       subDir,
+		HttpProxy:    httpProxy,
+		HttpsProxy:   httpsProxy,
+		NoProxy:      noProxy,
+		MountOptions: mountOptions,
+		NoRwCache:    noRwCache,
+		Params:       kodofsParams,
 	}); err != nil {
 		return err
 	}
 
-	for decoder.More() {
+	// The last error replied, which is the reason of the failure
+	var lastError string
+	for conn.more() {
 		var request protocol.Request
-		if err = decoder.Decode(&request); err != nil {
+		if err = conn.decode(&request); err != nil {
 			return fmt.Errorf("failed to decode json request: %w", err)
 		}
 		if request.Version != protocol.Version {
@@ -223,10 +301,11 @@ func mountKodoFS(gatewayID, mountPath string, mountServerAddress *url.URL, acces
 				return fmt.Errorf("failed to marshal json payload: %w", err)
 			}
 			if cmd.IsError {
-				log.Warnf("kodofs mount stderr prompt: %s", cmd.Data)
+				lastError = cmd.Data
+				logger(ctx).Warnf("kodofs mount stderr prompt: %s", cmd.Data)
 			} else if strings.Contains(cmd.Data, "please enter the master address(separate multiple addresses with commas):") {
 				if err = writeCmdToConn(encoder, &protocol.RequestDataCmd{
-					Data: mountServerAddress.String() + "\n",
+					Data: mountServerAddresses.String() + "\n",
 				}); err != nil {
 					return fmt.Errorf("failed to enter the master address: %w", err)
 				}
@@ -237,7 +316,7 @@ func mountKodoFS(gatewayID, mountPath string, mountServerAddress *url.URL, acces
 					return fmt.Errorf("failed to enter the AccessToken: %w", err)
 				}
 			} else {
-				log.Infof("kodofs mount stdout prompt: %s", cmd.Data)
+				logger(ctx).Infof("kodofs mount stdout prompt: %s", cmd.Data)
 			}
 		case protocol.TerminateCmdName:
 			var cmd protocol.TerminateCmd
@@ -246,6 +325,9 @@ func mountKodoFS(gatewayID, mountPath string, mountServerAddress *url.URL, acces
 			}
 			if cmd.Code == 0 {
 				return nil
+			} else if lastError != "" {
+				// e.g. FUSE is not usable on the node
+				return fmt.Errorf("unexpected command returns code: %d: %s", cmd.Code, lastError)
 			} else {
 				return fmt.Errorf("unexpected command returns code: %d", cmd.Code)
 			}
@@ -255,32 +337,44 @@ func mountKodoFS(gatewayID, mountPath string, mountServerAddress *url.URL, acces
 	return nil
 }
 
-func mountKodo(volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Region, s3Endpoint, storageClass string,
+func mountKodo(ctx context.Context, volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Region, s3Endpoint string,
+	s3SignatureVersion S3SignatureVersion, s3Provider, storageClass string,
 	vfsCacheMode VfsCacheMode, dirCacheDuration *time.Duration, bufferSize *uint64,
 	vfsCacheMaxAge, vfsCachePollInterval, vfsWriteBack *time.Duration, vfsCacheMaxSize, vfsReadAhead *uint64,
 	vfsFastFingerPrint bool, vfsReadChunkSize, vfsReadChunkSizeLimit *uint64,
 	noCheckSum, noModTime, noSeek, readOnly bool, vfsReadWait, vfsWriteWait *time.Duration,
 	transfers, vfsDiskSpaceTotalSize *uint64, writeBackCache bool,
-	uploadCutoff, uploadChunkSize, uploadConcurrency *uint64, debugHttp, debugFuse bool) error {
+	uploadCutoff, uploadChunkSize, uploadConcurrency *uint64, debugHttp, debugFuse bool,
+	httpProxy, httpsProxy, noProxy string, caCert string, insecureSkipVerify bool,
+	pvcNamespace, pvcName, podNamespace, podName string,
+	retries, lowLevelRetries *uint64, connectTimeout, timeout *time.Duration,
+	credentialSource *protocol.CredentialSource, writeCache bool, writeCacheSyncInterval *time.Duration,
+	prewarm []string, prewarmManifest string, syncMode, syncBack bool, syncBackInterval *time.Duration,
+	mountCheck KodoMountCheck, integrityManifest string, integrityCheck KodoIntegrityCheck, persistentDirCache *time.Duration,
+	hostAliases map[string]string, nameservers []string, s3InternalEndpoint string,
+	mounterMemoryLimit *uint64, mounterCpuLimit *float64, mounterCpuWeight, mounterIoWeight *uint64) (err error) {
+	defer observeConnectorRequest(ctx, protocol.InitKodoMountCmdName, time.Now(), &err)
+	ctx, span := tracer.Start(ctx, "connector "+protocol.InitKodoMountCmdName)
+	defer endSpan(span, &err)
 
-	conn, err := net.Dial("unix", SocketPath)
+	conn, err := dialConnector(true)
 	if err != nil {
-		return fmt.Errorf("failed to dial unix socket %s: %w", SocketPath, err)
+		return err
 	}
 	defer conn.Close()
 
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+	encoder := conn.encoder
+	decoder := conn.decoder
 
-	writeCmdToConn := func(encoder *json.Encoder, cmd protocol.Cmd) error {
+	writeCmdToConn := func(encoder *frameEncoder, cmd protocol.Cmd) error {
 		buf, err := json.Marshal(cmd)
 		if err != nil {
 			return fmt.Errorf("failed to marshal json payload: %w", err)
 		}
 		switch cmd.(type) {
 		case *protocol.InitKodoMountCmd:
-			if err = encoder.Encode(makeRequest(protocol.InitKodoMountCmdName, buf)); err != nil {
-				return fmt.Errorf("failed to write command to unix socket %s: %w", SocketPath, err)
+			if err = encoder.Encode(conn.makeRequest(ctx, protocol.InitKodoMountCmdName, buf)); err != nil {
+				return fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
 			}
 		}
 		return nil
@@ -295,6 +389,9 @@ func mountKodo(volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Re
 		BucketId:           bucketId,
 		S3Region:           s3Region,
 		S3Endpoint:         s3Endpoint,
+		S3InternalEndpoint: s3InternalEndpoint,
+		S3SignatureVersion: s3SignatureVersion.String(),
+		S3Provider:         s3Provider,
 		StorageClass:       storageClass,
 		VfsCacheMode:       vfsCacheMode.String(),
 		VfsFastFingerPrint: vfsFastFingerPrint,
@@ -305,6 +402,24 @@ func mountKodo(volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Re
 		WriteBackCache:     writeBackCache,
 		DebugHttp:          debugHttp,
 		DebugFuse:          debugFuse,
+		HttpProxy:          httpProxy,
+		HttpsProxy:         httpsProxy,
+		NoProxy:            noProxy,
+		CaCert:             caCert,
+		InsecureSkipVerify: insecureSkipVerify,
+		PvcNamespace:       pvcNamespace,
+		PvcName:            pvcName,
+		PodNamespace:       podNamespace,
+		PodName:            podName,
+		CredentialSource:   credentialSource,
+		LocalWriteCache:    writeCache,
+		Prewarm:            prewarm,
+		PrewarmManifest:    prewarmManifest,
+		SyncMode:           syncMode,
+		SyncBack:           syncBack,
+		IntegrityManifest:  integrityManifest,
+		HostAliases:        hostAliases,
+		Nameservers:        nameservers,
 	}
 	if dirCacheDuration != nil {
 		cmd.DirCacheDuration = dirCacheDuration.String()
@@ -354,14 +469,55 @@ func mountKodo(volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Re
 	if uploadConcurrency != nil {
 		cmd.UploadConcurrency = uploadConcurrency
 	}
+	if retries != nil {
+		cmd.Retries = retries
+	}
+	if lowLevelRetries != nil {
+		cmd.LowLevelRetries = lowLevelRetries
+	}
+	if connectTimeout != nil {
+		cmd.ConnectTimeout = connectTimeout.String()
+	}
+	if timeout != nil {
+		cmd.Timeout = timeout.String()
+	}
+	if writeCacheSyncInterval != nil {
+		cmd.WriteCacheSyncInterval = writeCacheSyncInterval.String()
+	}
+	if syncBackInterval != nil {
+		cmd.SyncBackInterval = syncBackInterval.String()
+	}
+	if mountCheck != "" {
+		cmd.MountCheck = mountCheck.String()
+	}
+	if integrityCheck != "" {
+		cmd.IntegrityCheck = integrityCheck.String()
+	}
+	if persistentDirCache != nil {
+		cmd.PersistentDirCache = persistentDirCache.String()
+	}
+	if mounterMemoryLimit != nil {
+		cmd.MounterMemoryLimit = *mounterMemoryLimit
+	}
+	if mounterCpuLimit != nil {
+		cmd.MounterCpuLimit = *mounterCpuLimit
+	}
+	if mounterCpuWeight != nil {
+		cmd.MounterCpuWeight = *mounterCpuWeight
+	}
+	if mounterIoWeight != nil {
+		cmd.MounterIoWeight = *mounterIoWeight
+	}
 
 	if err = writeCmdToConn(encoder, &cmd); err != nil {
 		return err
 	}
 
+	// The last error replied, which is the reason of the failure
+	var lastError string
 	for decoder.More() {
 		var request protocol.Request
-		if err = decoder.Decode(&request); err != nil {
+		if err = conn.decode(&request); err != nil {
 			return fmt.Errorf("failed to decode json request: %w", err)
 		}
 		if request.Version != protocol.Version {
@@ -374,9 +530,10 @@ func mountKodo(volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Re
 				return fmt.Errorf("failed to marshal json payload: %w", err)
 			}
 			if cmd.IsError {
-				log.Warnf("kodo mount stderr prompt: %s", cmd.Data)
+				lastError = cmd.Data
+				logger(ctx).Warnf("kodo mount stderr prompt: %s", cmd.Data)
 			} else {
-				log.Infof("kodo mount stdout prompt: %s", cmd.Data)
+				logger(ctx).Infof("kodo mount stdout prompt: %s", cmd.Data)
 			}
 		case protocol.TerminateCmdName:
 			var cmd protocol.TerminateCmd
@@ -385,6 +542,9 @@ func mountKodo(volumeId, mountPath, subDir, accessKey, secretKey, bucketId, s3Re
 			}
 			if cmd.Code == 0 {
 				return nil
+			} else if lastError != "" {
+				// e.g. FUSE is not usable on the node
+				return fmt.Errorf("unexpected command returns code: %d: %s", cmd.Code, lastError)
 			} else {
 				return fmt.Errorf("unexpected command returns code: %d", cmd.Code)
 			}
@@ -399,24 +559,133 @@ func umount(mountPath string) error {
 	return err
 }
 
-func cleanAfterKodoUmount(volumeId, mountPath string) error {
-	conn, err := net.Dial("unix", SocketPath)
+// unmountVolume unmounts the volume published on the node forcibly, or lazily if it's disconnected.
+// With --unprivileged, the plugin can't unmount in its own mount namespace, so the connector unmounts it on the node.
+func unmountVolume(ctx context.Context, volumeId, mountPath string, lazy bool) error {
+	if *unprivileged {
+		return requestUmount(ctx, volumeId, mountPath, lazy)
+	} else if !lazy {
+		return umount(mountPath)
+	}
+	if output, err := exec.Command("umount", "-l", mountPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func requestUmount(ctx context.Context, volumeId, mountPath string, lazy bool) (err error) {
+	defer observeConnectorRequest(ctx, protocol.UmountCmdName, time.Now(), &err)
+	ctx, span := tracer.Start(ctx, "connector "+protocol.UmountCmdName)
+	defer endSpan(span, &err)
+
+	conn, err := dialConnector(true)
 	if err != nil {
-		return fmt.Errorf("failed to dial unix socket %s: %w", SocketPath, err)
+		return
 	}
 	defer conn.Close()
 
-	encoder := json.NewEncoder(conn)
+	buf, err := json.Marshal(&protocol.UmountCmd{
+		VolumeId:  volumeId,
+		MountPath: mountPath,
+		Lazy:      lazy,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal json payload: %w", err)
+		return
+	}
+	if err = conn.encoder.Encode(conn.makeRequest(ctx, protocol.UmountCmdName, buf)); err != nil {
+		err = fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
+		return
+	}
 
-	writeCmdToConn := func(encoder *json.Encoder, cmd protocol.Cmd) error {
+	var reason string
+	for conn.decoder.More() {
+		var request protocol.Request
+		if err = conn.decode(&request); err != nil {
+			err = fmt.Errorf("failed to decode json request: %w", err)
+			return
+		}
+		if request.Version != protocol.Version {
+			err = fmt.Errorf("unrecognized protocol version: %s", request.Version)
+			return
+		}
+		switch request.Cmd {
+		case protocol.ResponseDataCmdName:
+			var cmd protocol.ResponseDataCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			reason = cmd.Data
+		case protocol.TerminateCmdName:
+			var cmd protocol.TerminateCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			if cmd.Code != 0 {
+				err = fmt.Errorf("connector failed to unmount %s: %s", mountPath, reason)
+			}
+			return
+		}
+	}
+	err = errors.New("connector closed the connection before umount is done")
+	return
+}
+
+// pingConnector dials a new connection to the connector and sends PingCmd, which is replied within connectorPingTimeout
+func pingConnector(ctx context.Context) error {
+	conn, err := dialConnector(false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connectorPingTimeout))
+
+	buf, err := json.Marshal(&protocol.PingCmd{})
+	if err != nil {
+		return fmt.Errorf("failed to marshal json payload: %w", err)
+	}
+	if err = conn.encoder.Encode(conn.makeRequest(ctx, protocol.PingCmdName, buf)); err != nil {
+		return fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
+	}
+	// Decoded until it fails rather than by More, so the timeout is returned instead of being taken as closed
+	for {
+		var request protocol.Request
+		if err = conn.decode(&request); errors.Is(err, io.EOF) {
+			return errors.New("connector closed the connection before ping is replied, it may not support ping")
+		} else if err != nil {
+			return fmt.Errorf("failed to decode json request: %w", err)
+		} else if request.Version != protocol.Version {
+			return fmt.Errorf("unrecognized protocol version: %s", request.Version)
+		} else if conn.terminated {
+			return nil
+		}
+	}
+}
+
+func cleanAfterKodoUmount(ctx context.Context, volumeId, mountPath string) (err error) {
+	defer observeConnectorRequest(ctx, protocol.KodoUmountCmdName, time.Now(), &err)
+	ctx, span := tracer.Start(ctx, "connector "+protocol.KodoUmountCmdName)
+	defer endSpan(span, &err)
+
+	conn, err := dialConnector(true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	encoder := conn.encoder
+
+	writeCmdToConn := func(encoder *frameEncoder, cmd protocol.Cmd) error {
 		buf, err := json.Marshal(cmd)
 		if err != nil {
 			return fmt.Errorf("failed to marshal json payload: %w", err)
 		}
 		switch cmd.(type) {
 		case *protocol.KodoUmountCmd:
-			if err = encoder.Encode(makeRequest(protocol.KodoUmountCmdName, buf)); err != nil {
-				return fmt.Errorf("failed to write command to unix socket %s: %w", SocketPath, err)
+			if err = encoder.Encode(conn.makeRequest(ctx, protocol.KodoUmountCmdName, buf)); err != nil {
+				return fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
 			}
 		}
 		return nil
@@ -426,15 +695,264 @@ func cleanAfterKodoUmount(volumeId, mountPath string) error {
 		VolumeId:  volumeId,
 		MountPath: mountPath,
 	}
-	return writeCmdToConn(encoder, &cmd)
+	if err = writeCmdToConn(encoder, &cmd); err != nil || !conn.keepAlive {
+		return err
+	}
+	// The connector replies only if the connection is kept alive, which is reused once the reply is received
+	conn.SetReadDeadline(time.Now().Add(connectorReplyTimeout))
+	for conn.decoder.More() {
+		var request protocol.Request
+		if err = conn.decode(&request); err != nil {
+			return fmt.Errorf("failed to decode json request: %w", err)
+		} else if conn.terminated {
+			return nil
+		}
+	}
+	return errors.New("connector closed the connection before umount is done")
+}
+
+const (
+	// Longest time the connector waits for the dirty files in a single flush cmd, must be shorter than the connection deadline of the connector
+	kodoFlushWaitInterval = 20 * time.Second
+)
+
+// flushKodo waits until all files modified in the write-back cache of the mount are uploaded, or returns error if timeout
+func flushKodo(ctx context.Context, volumeId, mountPath string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wait := time.Until(deadline)
+		if wait > kodoFlushWaitInterval {
+			wait = kodoFlushWaitInterval
+		} else if wait < 0 {
+			wait = 0
+		}
+		flushed, reason, err := requestKodoFlush(ctx, volumeId, mountPath, wait)
+		if err != nil {
+			return err
+		} else if flushed {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("write-back cache is not flushed in %s: %s", timeout, reason)
+		}
+		logger(ctx).Infof("kodo flush: waiting for write-back cache of %s: %s", mountPath, reason)
+	}
+}
+
+func requestKodoFlush(ctx context.Context, volumeId, mountPath string, wait time.Duration) (flushed bool, reason string, err error) {
+	defer observeConnectorRequest(ctx, protocol.KodoFlushCmdName, time.Now(), &err)
+	ctx, span := tracer.Start(ctx, "connector "+protocol.KodoFlushCmdName)
+	defer endSpan(span, &err)
+
+	conn, err := dialConnector(true)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	encoder := conn.encoder
+	decoder := conn.decoder
+
+	buf, err := json.Marshal(&protocol.KodoFlushCmd{
+		VolumeId:  volumeId,
+		MountPath: mountPath,
+		Wait:      wait.String(),
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal json payload: %w", err)
+		return
+	}
+	if err = encoder.Encode(conn.makeRequest(ctx, protocol.KodoFlushCmdName, buf)); err != nil {
+		err = fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
+		return
+	}
+
+	for decoder.More() {
+		var request protocol.Request
+		if err = conn.decode(&request); err != nil {
+			err = fmt.Errorf("failed to decode json request: %w", err)
+			return
+		}
+		if request.Version != protocol.Version {
+			err = fmt.Errorf("unrecognized protocol version: %s", request.Version)
+			return
+		}
+		switch request.Cmd {
+		case protocol.ResponseDataCmdName:
+			var cmd protocol.ResponseDataCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			reason = cmd.Data
+		case protocol.TerminateCmdName:
+			var cmd protocol.TerminateCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			flushed = cmd.Code == 0
+			return
+		}
+	}
+	err = errors.New("connector closed the connection before flush is done")
+	return
+}
+
+// detachKodo asks the connector to unmount the volume lazily, the write-back cache is uploaded by the connector in background
+func detachKodo(ctx context.Context, volumeId, mountPath string, wait time.Duration) (err error) {
+	defer observeConnectorRequest(ctx, protocol.KodoDetachCmdName, time.Now(), &err)
+	ctx, span := tracer.Start(ctx, "connector "+protocol.KodoDetachCmdName)
+	defer endSpan(span, &err)
+
+	conn, err := dialConnector(true)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	encoder := conn.encoder
+	decoder := conn.decoder
+
+	buf, err := json.Marshal(&protocol.KodoDetachCmd{
+		VolumeId:  volumeId,
+		MountPath: mountPath,
+		Wait:      wait.String(),
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal json payload: %w", err)
+		return
+	}
+	if err = encoder.Encode(conn.makeRequest(ctx, protocol.KodoDetachCmdName, buf)); err != nil {
+		err = fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
+		return
+	}
+
+	var reason string
+	for decoder.More() {
+		var request protocol.Request
+		if err = conn.decode(&request); err != nil {
+			err = fmt.Errorf("failed to decode json request: %w", err)
+			return
+		}
+		if request.Version != protocol.Version {
+			err = fmt.Errorf("unrecognized protocol version: %s", request.Version)
+			return
+		}
+		switch request.Cmd {
+		case protocol.ResponseDataCmdName:
+			var cmd protocol.ResponseDataCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			reason = cmd.Data
+		case protocol.TerminateCmdName:
+			var cmd protocol.TerminateCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			if cmd.Code != 0 {
+				err = fmt.Errorf("connector failed to detach %s: %s", mountPath, reason)
+			}
+			return
+		}
+	}
+	err = errors.New("connector closed the connection before detach is done")
+	return
 }
 
-func makeRequest(cmdName string, buf []byte) *protocol.Request {
-	return &protocol.Request{
+// requestKodoMountLogs writes the last lines of the logs of the mounters of the volume into w, or of the mounter serving the mount path if given.
+// If follow is set, the new lines are written until ctx is done, e.g. interrupted by the user.
+func requestKodoMountLogs(ctx context.Context, volumeId, mountPath string, lines int, follow bool, w io.Writer) (err error) {
+	// Never reused since it's closed to stop following
+	conn, err := dialConnector(false)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	buf, err := json.Marshal(&protocol.KodoMountLogsCmd{
+		VolumeId:  volumeId,
+		MountPath: mountPath,
+		Lines:     lines,
+		Follow:    follow,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal json payload: %w", err)
+		return
+	}
+	if err = conn.encoder.Encode(conn.makeRequest(ctx, protocol.KodoMountLogsCmdName, buf)); err != nil {
+		err = fmt.Errorf("failed to write command to connector %s: %w", connectorEndpoint(), err)
+		return
+	}
+
+	var reason string
+	for conn.decoder.More() {
+		var request protocol.Request
+		if err = conn.decode(&request); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			err = fmt.Errorf("failed to decode json request: %w", err)
+			return
+		}
+		if request.Version != protocol.Version {
+			err = fmt.Errorf("unrecognized protocol version: %s", request.Version)
+			return
+		}
+		switch request.Cmd {
+		case protocol.ResponseDataCmdName:
+			var cmd protocol.ResponseDataCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			if cmd.IsError {
+				reason = cmd.Data
+			} else if _, err = io.WriteString(w, cmd.Data); err != nil {
+				return
+			}
+		case protocol.TerminateCmdName:
+			var cmd protocol.TerminateCmd
+			if err = json.Unmarshal([]byte(request.Payload), &cmd); err != nil {
+				err = fmt.Errorf("failed to marshal json payload: %w", err)
+				return
+			}
+			if cmd.Code != 0 {
+				err = fmt.Errorf("connector failed to read logs of %s: %s", volumeId, reason)
+			}
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	err = fmt.Errorf("connector closed the connection before logs of %s are read, it may not support %s, please upgrade it", volumeId, protocol.KodoMountLogsCmdName)
+	return
+}
+
+func makeRequest(ctx context.Context, cmdName string, buf []byte) *protocol.Request {
+	request := &protocol.Request{
 		Version: protocol.Version,
 		Cmd:     cmdName,
 		Payload: json.RawMessage(buf),
 	}
+	request.RequestId = requestIdFromContext(ctx)
+	protocol.InjectTraceContext(ctx, request)
+	return request
 }
 
 const (
@@ -447,7 +965,36 @@ func isKodoFSMounted(mountPath string) (bool, error) {
 }
 
 func isKodoMounted(mountPath string) (bool, error) {
-	return isMounted(mountPath, FuseTypeKodo)
+	if mounted, err := isMounted(mountPath, FuseTypeKodo); err != nil || mounted {
+		return mounted, err
+	}
+	return isSyncedKodoMounted(mountPath)
+}
+
+// isSyncedKodoMounted returns true if the mount path is bound from the directory of a Kodo volume in the sync mode,
+// whose filesystem is the one of the node instead of FUSE
+func isSyncedKodoMounted(mountPath string) (bool, error) {
+	type (
+		FileSystem struct {
+			Target string `json:"target"`
+			FsRoot string `json:"fsroot"`
+		}
+		FindMntOutput struct {
+			FileSystems []*FileSystem `json:"filesystems"`
+		}
+	)
+	var body FindMntOutput
+	if output, err := exec.Command("findmnt", "-J", "-o", "TARGET,FSROOT", mountPath).Output(); err != nil {
+		return false, fmt.Errorf("failed to find the mount point via `findmnt`: %w", err)
+	} else if err = json.Unmarshal(output, &body); err != nil {
+		return false, fmt.Errorf("unexpected output from `findmnt`: %w", err)
+	}
+	for _, fs := range body.FileSystems {
+		if fs.Target == mountPath && protocol.IsSyncedKodoRoot(fs.FsRoot) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func isMounted(mountPath, fsType string) (bool, error) {
@@ -469,7 +1016,7 @@ func isMounted(mountPath, fsType string) (bool, error) {
 	log.Infof("Found %d fileSystems on %s", len(body.FileSystems), mountPath)
 	for _, fs := range body.FileSystems {
 		log.Infof("Found fileSystem `%#v` on %s", fs, mountPath)
-		if fs.Target == mountPath && fs.FsType == fsType {
+		if fs.Target == mountPath && (fsType == "" || fs.FsType == fsType) {
 			return true, nil
 		}
 	}
@@ -500,3 +1047,15 @@ func randomChoices(choices string, n int) string {
 func normalizePolicyName(s string) string {
 	return strings.ReplaceAll(s, "-", "")
 }
+
+// verifyCredentialsError maps the failure of verifying credentials to gRPC status, naming the fields to be fixed in the secret
+func verifyCredentialsError(functionName string, err error, endpointField string) error {
+	var authErr *qiniu.AuthError
+	if errors.As(err, &authErr) {
+		if authErr.Unauthenticated() {
+			return status.Errorf(codes.Unauthenticated, "%s: %s or %s is wrong: %s", functionName, FIELD_ACCESS_KEY, FIELD_SECRET_KEY, authErr)
+		}
+		return status.Errorf(codes.PermissionDenied, "%s: the user of %s is not permitted: %s", functionName, FIELD_ACCESS_KEY, authErr)
+	}
+	return status.Errorf(codes.Unavailable, "%s: failed to verify %s and %s, please check %s: %s", functionName, FIELD_ACCESS_KEY, FIELD_SECRET_KEY, endpointField, err)
+}
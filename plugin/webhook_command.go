@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// WebhookCommand is the subcommand serving the validating admission webhook of the StorageClasses and the PVCs
+	WebhookCommand = "webhook"
+	// Path the AdmissionReviews are posted to by the API server
+	WebhookValidatePath = "/validate"
+	// Largest AdmissionReview accepted, the objects validated are far smaller
+	WebhookMaxRequestBytes = 1 << 20
+	// Timeout to read the Secrets and the StorageClasses referenced by the object being validated
+	WebhookLookupTimeout = 5 * time.Second
+	// Prefix of the parameters of the StorageClasses interpreted by csi-provisioner instead of the driver
+	csiParameterPrefix = "csi.storage.k8s.io/"
+)
+
+// storageClassFields are the parameters of the StorageClasses recognized by each driver, except the ones of csi-provisioner
+var storageClassFields = map[string][]string{
+	KodoDriverName: {
+		FIELD_BACKEND, FIELD_S3_PROVIDER, FIELD_API_MODE, FIELD_ACCESS_KEY, FIELD_SECRET_KEY, FIELD_ACCESS_KEY_FILE, FIELD_SECRET_KEY_FILE,
+		FIELD_SESSION_TOKEN_FILE, FIELD_UC_ENDPOINT, FIELD_REGION,
+		FIELD_S3_REGION, FIELD_S3_ENDPOINT, FIELD_S3_INTERNAL_ENDPOINT, FIELD_S3_ACCELERATE_ENDPOINT,
+		FIELD_S3_SIGNATURE_VERSION, FIELD_STORAGE_CLASS,
+		FIELD_VFS_CACHE_MODE, FIELD_DIR_CACHE_DURATION, FIELD_BUFFER_SIZE, FIELD_VFS_CACHE_MAX_AGE, FIELD_VFS_CACHE_POLL_INTERVAL,
+		FIELD_VFS_WRITE_BACK, FIELD_VFS_CACHE_MAX_SIZE, FIELD_VFS_READ_AHEAD, FIELD_VFS_FAST_FINGER_PRINT,
+		FIELD_VFS_READ_CHUNK_SIZE, FIELD_VFS_READ_CHUNK_SIZE_LIMIT, FIELD_NO_CHECKSUM, FIELD_NO_MOD_TIME, FIELD_NO_SEEK, FIELD_READ_ONLY,
+		FIELD_VFS_READ_WAIT, FIELD_VFS_WRITE_WAIT, FIELD_TRANSFERS, FIELD_VFS_DISK_SPACE_TOTAL_SIZE, FIELD_WRITE_BACK_CACHE,
+		FIELD_UPLOAD_CUTOFF, FIELD_UPLOAD_CHUNK_SIZE, FIELD_UPLOAD_CONCURRENCY, FIELD_DEBUG_HTTP, FIELD_DEBUG_FUSE,
+		FIELD_HTTP_PROXY, FIELD_HTTPS_PROXY, FIELD_NO_PROXY, FIELD_CA_CERT, FIELD_INSECURE_SKIP_VERIFY,
+		FIELD_RETRIES, FIELD_LOW_LEVEL_RETRIES, FIELD_CONNECT_TIMEOUT, FIELD_TIMEOUT,
+		FIELD_STS_ENDPOINT, FIELD_STS_TOKEN, FIELD_INSTANCE_ROLE,
+		FIELD_WRITE_CACHE, FIELD_WRITE_CACHE_SYNC_INTERVAL, FIELD_PREWARM, FIELD_PREWARM_MANIFEST,
+		FIELD_SYNC_MODE, FIELD_SYNC_BACK, FIELD_SYNC_BACK_INTERVAL, FIELD_MOUNT_CHECK,
+		FIELD_INTEGRITY_MANIFEST, FIELD_INTEGRITY_CHECK, FIELD_PERSISTENT_DIR_CACHE,
+		FIELD_HOST_ALIASES, FIELD_NAMESERVERS, FIELD_MOUNTER_MEMORY_LIMIT, FIELD_MOUNTER_CPU_LIMIT,
+		FIELD_MOUNTER_CPU_WEIGHT, FIELD_MOUNTER_IO_WEIGHT, FIELD_MOUNT_PROFILE,
+	},
+	KodoFSDriverName: {
+		FIELD_ACCESS_KEY, FIELD_SECRET_KEY, FIELD_MOUNT_SERVER_ADDRESS, FIELD_MASTER_SERVER_ADDRESS, FIELD_REGION,
+		FIELD_FS_TYPE, FIELD_BLOCK_SIZE, FIELD_HTTP_PROXY, FIELD_HTTPS_PROXY, FIELD_NO_PROXY,
+		FIELD_MOUNT_OPTIONS, FIELD_NO_RW_CACHE, FIELD_KODOFS_PARAMS, FIELD_RETRIES, FIELD_CONNECT_TIMEOUT, FIELD_TIMEOUT,
+	},
+}
+
+// placeholderKodoSecrets stand for the provisioner secret which is only known once a PVC is provisioned, e.g. in the namespace of each PVC,
+// so that the values of the parameters are still validated
+var placeholderKodoSecrets = map[string]string{
+	FIELD_ACCESS_KEY:  "placeholder",
+	FIELD_SECRET_KEY:  "placeholder",
+	FIELD_UC_ENDPOINT: "https://uc.example.com",
+}
+
+// admissionValidator validates the objects of a driver, the objects of the other drivers are always allowed
+type admissionValidator struct {
+	driver, csiDriverName string
+	client                kubernetes.Interface
+}
+
+// runWebhook serves the validating admission webhook over TLS until it fails, returns the exit code
+func runWebhook(args []string) int {
+	flagSet := flag.NewFlagSet(WebhookCommand, flag.ContinueOnError)
+	flagSet.StringVar(kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "Path of the kubeconfig, the in-cluster config is used if empty")
+	driver := flagSet.String("driver", KodoDriverName, "Driver whose StorageClasses and PVCs are validated, kodo or kodofs")
+	address := flagSet.String("address", ":9443", "Address to serve the webhook on")
+	certFile := flagSet.String("tls-cert-file", "/etc/webhook/certs/tls.crt", "Path of the TLS certificate of the webhook")
+	keyFile := flagSet.String("tls-private-key-file", "/etc/webhook/certs/tls.key", "Path of the TLS private key of the webhook")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags]\n", filepath.Base(os.Args[0]), WebhookCommand)
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	validator := &admissionValidator{driver: *driver}
+	switch *driver {
+	case KodoDriverName:
+		validator.csiDriverName = TypePluginKodo
+	case KodoFSDriverName:
+		validator.csiDriverName = TypePluginKodoFS
+	default:
+		fmt.Fprintf(os.Stderr, "-driver must be either kodo or kodofs\n")
+		return 2
+	}
+
+	config, err := kubeConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load kubeconfig: %s\n", err)
+		return 1
+	}
+	if validator.client, err = kubernetes.NewForConfig(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create Kubernetes client: %s\n", err)
+		return 1
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(WebhookValidatePath, validator)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	log.Infof("Serving admission webhook of %s on %s%s", validator.csiDriverName, *address, WebhookValidatePath)
+	if err = http.ListenAndServeTLS(*address, *certFile, *keyFile, mux); err != nil {
+		log.Errorf("Failed to serve admission webhook on %s: %s", *address, err)
+		return 1
+	}
+	return 0
+}
+
+func (v *admissionValidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review admissionv1.AdmissionReview
+	if body, err := io.ReadAll(io.LimitReader(r.Body, WebhookMaxRequestBytes)); err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request: %s", err), http.StatusBadRequest)
+		return
+	} else if err = json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	ctx, cancel := context.WithTimeout(r.Context(), WebhookLookupTimeout)
+	defer cancel()
+	reasons, warnings := v.validate(ctx, review.Request)
+	response.Warnings = warnings
+	if len(reasons) > 0 {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusUnprocessableEntity,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: strings.Join(reasons, "; "),
+		}
+		log.Infof("Rejected %s %s/%s: %s", review.Request.Kind.Kind, review.Request.Namespace, review.Request.Name, response.Result.Message)
+	}
+	review.Response, review.Request = response, nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		log.Warnf("Failed to write AdmissionReview: %s", err)
+	}
+}
+
+// validate returns why the object is rejected, and the warnings of what fails to be validated, e.g. the Secrets fail to be read
+func (v *admissionValidator) validate(ctx context.Context, request *admissionv1.AdmissionRequest) (reasons, warnings []string) {
+	switch request.Kind.Kind {
+	case "StorageClass":
+		var sc storagev1.StorageClass
+		if err := json.Unmarshal(request.Object.Raw, &sc); err != nil {
+			return []string{fmt.Sprintf("invalid StorageClass: %s", err)}, nil
+		}
+		if sc.Provisioner == v.csiDriverName {
+			return v.validateStorageClass(ctx, &sc)
+		}
+	case "PersistentVolumeClaim":
+		var pvc corev1.PersistentVolumeClaim
+		if err := json.Unmarshal(request.Object.Raw, &pvc); err != nil {
+			return []string{fmt.Sprintf("invalid PersistentVolumeClaim: %s", err)}, nil
+		}
+		// The annotations are only honored by Kodo volumes, see overrideByPvcAnnotations
+		if v.driver == KodoDriverName {
+			return v.validatePvc(ctx, &pvc)
+		}
+	}
+	return nil, nil
+}
+
+func (v *admissionValidator) validateStorageClass(ctx context.Context, sc *storagev1.StorageClass) (reasons, warnings []string) {
+	known := make(map[string]bool)
+	for _, field := range storageClassFields[v.driver] {
+		known[field] = true
+	}
+	for key := range sc.Parameters {
+		if lower := strings.ToLower(key); !known[lower] && !strings.HasPrefix(lower, csiParameterPrefix) {
+			reasons = append(reasons, fmt.Sprintf("unknown parameter %s", key))
+		}
+	}
+
+	// Only the provisioner secret is read by CreateVolume, the others are just required to exist.
+	// Without it, the credentials must be given by the parameters themselves.
+	secrets, unknownSecrets := make(map[string]string), false
+	for key, name := range sc.Parameters {
+		if !strings.HasPrefix(key, csiParameterPrefix) || !strings.HasSuffix(key, "-secret-name") {
+			continue
+		}
+		namespace := sc.Parameters[strings.TrimSuffix(key, "-name")+"-namespace"]
+		if namespace == "" {
+			reasons = append(reasons, fmt.Sprintf("%s requires %s", key, strings.TrimSuffix(key, "-name")+"-namespace"))
+			continue
+		} else if strings.Contains(name, "${") || strings.Contains(namespace, "${") {
+			// Templated by the PVC, e.g. ${pvc.namespace}, which is only resolved by csi-provisioner
+			unknownSecrets = unknownSecrets || key == csiParameterPrefix+"provisioner-secret-name"
+			continue
+		}
+		secret, err := v.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			reasons = append(reasons, fmt.Sprintf("secret %s/%s of %s is not found", namespace, name, key))
+			continue
+		} else if err != nil {
+			warnings = append(warnings, fmt.Sprintf("secret %s/%s of %s is not validated: %s", namespace, name, key, err))
+			unknownSecrets = unknownSecrets || key == csiParameterPrefix+"provisioner-secret-name"
+			continue
+		}
+		if key == csiParameterPrefix+"provisioner-secret-name" {
+			for k, value := range secret.Data {
+				secrets[k] = string(value)
+			}
+		}
+	}
+
+	var err error
+	switch v.driver {
+	case KodoDriverName:
+		if unknownSecrets {
+			secrets = placeholderKodoSecrets
+		}
+		var parameter *kodoStorageClassParameter
+		// Rejected by CreateVolume, see kodoControllerServer.CreateVolume
+		if parameter, err = parseKodoStorageClassParameter("StorageClass", sc.Parameters, secrets); err == nil && parameter.backend != KODO_BACKEND_KODO {
+			err = fmt.Errorf("StorageClass: volumes of %s %s can't be provisioned dynamically", FIELD_BACKEND, parameter.backend)
+		} else if err == nil && parameter.apiMode != KODO_API_MODE_NATIVE {
+			err = fmt.Errorf("StorageClass: buckets can only be created by the native Kodo APIs, but %s is %s", FIELD_API_MODE, parameter.apiMode)
+		}
+	case KodoFSDriverName:
+		_, err = parseKodoFSStorageClassParameter("StorageClass", sc.Parameters, secrets, unknownSecrets)
+	}
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	return reasons, warnings
+}
+
+func (v *admissionValidator) validatePvc(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (reasons, warnings []string) {
+	annotated := false
+	for annotation := range pvc.Annotations {
+		if strings.HasPrefix(annotation, PvcAnnotationPrefix) {
+			annotated = true
+		}
+	}
+	if !annotated {
+		return nil, nil
+	}
+
+	// The annotations are validated together with the parameters they override
+	var parameters map[string]string
+	if name := pvc.Spec.StorageClassName; name != nil && *name != "" {
+		sc, err := v.client.StorageV1().StorageClasses().Get(ctx, *name, metav1.GetOptions{})
+		if err == nil && sc.Provisioner != v.csiDriverName {
+			return nil, nil
+		} else if err == nil {
+			parameters = sc.Parameters
+		} else if !apierrors.IsNotFound(err) {
+			warnings = append(warnings, fmt.Sprintf("StorageClass %s is not read, the annotations are validated without its parameters: %s", *name, err))
+		}
+	}
+	overridden, unsupported := applyPvcAnnotations(parameters, pvc.Annotations)
+	for _, annotation := range unsupported {
+		reasons = append(reasons, fmt.Sprintf("unsupported annotation %s", annotation))
+	}
+	if _, err := parseKodoStorageClassParameter("PersistentVolumeClaim", overridden, placeholderKodoSecrets); err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	return reasons, warnings
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DecodeCmd decodes the payload of the request into the command named by it, and rejects the commands whose ids
+// could escape the directories of the connector, since the ids are joined into the paths of the caches and logs.
+func DecodeCmd(request *Request) (Cmd, error) {
+	var cmd Cmd
+	switch request.Cmd {
+	case InitKodoFsMountCmdName:
+		cmd = new(InitKodoFSMountCmd)
+	case InitKodoMountCmdName:
+		cmd = new(InitKodoMountCmd)
+	case KodoUmountCmdName:
+		cmd = new(KodoUmountCmd)
+	case KodoFlushCmdName:
+		cmd = new(KodoFlushCmd)
+	case KodoDetachCmdName:
+		cmd = new(KodoDetachCmd)
+	case KodoVfsStatsCmdName:
+		cmd = new(KodoVfsStatsCmd)
+	case KodoVfsForgetCmdName:
+		cmd = new(KodoVfsForgetCmd)
+	case KodoMountLogsCmdName:
+		cmd = new(KodoMountLogsCmd)
+	case UmountCmdName:
+		cmd = new(UmountCmd)
+	case RequestDataCmdName:
+		cmd = new(RequestDataCmd)
+	case AckDataCmdName:
+		cmd = new(AckDataCmd)
+	case DebugStateCmdName:
+		// No payload at all
+		return new(DebugStateCmd), nil
+	case PingCmdName:
+		return new(PingCmd), nil
+	case HeartbeatCmdName:
+		return new(HeartbeatCmd), nil
+	default:
+		return nil, fmt.Errorf("unrecognized request cmd: %s", request.Cmd)
+	}
+	if err := json.Unmarshal([]byte(request.Payload), cmd); err != nil {
+		return nil, fmt.Errorf("%s payload parse error: %w", request.Cmd, err)
+	}
+
+	var err error
+	switch c := cmd.(type) {
+	case *InitKodoFSMountCmd:
+		err = checkIdAndPath("gateway_id", c.GatewayID, c.MountPath)
+	case *InitKodoMountCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *KodoUmountCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *KodoFlushCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *KodoDetachCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *KodoVfsStatsCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *KodoVfsForgetCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *KodoMountLogsCmd:
+		// The mount path is optional
+		if c.MountPath == "" {
+			err = checkId("volume_id", c.VolumeId)
+		} else {
+			err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+		}
+	case *UmountCmd:
+		err = checkIdAndPath("volume_id", c.VolumeId, c.MountPath)
+	case *AckDataCmd:
+		// More credits than the window can't be granted, since no more data is sent before it's acknowledged
+		if c.Credits <= 0 || c.Credits > DataWindow {
+			err = fmt.Errorf("credits %d is not in [1, %d]", c.Credits, DataWindow)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", request.Cmd, err)
+	}
+	return cmd, nil
+}
+
+// checkIdAndPath checks the id is a single path element which can't be taken as an option by kodofs,
+// and the mount path is an absolute path other than the root, which is always hashed before joined into other paths
+func checkIdAndPath(idName, id, mountPath string) error {
+	if err := checkId(idName, id); err != nil {
+		return err
+	}
+	if !filepath.IsAbs(mountPath) || filepath.Clean(mountPath) == "/" || strings.ContainsRune(mountPath, 0) {
+		return fmt.Errorf("mount_path %q is not an absolute path", mountPath)
+	}
+	return nil
+}
+
+// checkId checks the id is a single path element which can't be taken as an option by kodofs
+func checkId(idName, id string) error {
+	if id == "" || id == "." || id == ".." || strings.HasPrefix(id, "-") || strings.ContainsAny(id, "/\x00") {
+		return fmt.Errorf("%s %q is not a valid file name", idName, id)
+	}
+	return nil
+}
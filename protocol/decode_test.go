@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// decodeSeeds are the valid and invalid payloads of every command
+var decodeSeeds = map[string]struct{ valid, invalid []string }{
+	InitKodoMountCmdName: {
+		valid: []string{`{"volume_id":"pv-1","mount_path":"/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/pv-1/mount","bucket_id":"bucket","s3_endpoint":"https://s3.example.com","buffer_size":16777216}`},
+		invalid: []string{
+			`{"volume_id":"../pv-1","mount_path":"/mnt"}`,
+			`{"volume_id":"-o","mount_path":"/mnt"}`,
+			`{"volume_id":"pv-1","mount_path":"mnt"}`,
+			`{"volume_id":"pv-1","mount_path":"/"}`,
+			`{"volume_id":"pv-1","mount_path":"/mnt","buffer_size":-1}`,
+		},
+	},
+	InitKodoFsMountCmdName: {
+		valid: []string{`{"gateway_id":"gw-1","mount_path":"/mnt/kodofs","sub_dir":"data","params":"a=b"}`},
+		invalid: []string{
+			`{"gateway_id":"","mount_path":"/mnt/kodofs"}`,
+			`{"gateway_id":"gw/1","mount_path":"/mnt/kodofs"}`,
+			`{"gateway_id":"gw-1","mount_path":"/mnt/\u0000"}`,
+		},
+	},
+	KodoUmountCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo"}`},
+		invalid: []string{`{"volume_id":".","mount_path":"/mnt/kodo"}`, `{"volume_id":"pv-1","mount_path":"/.."}`},
+	},
+	KodoFlushCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo","wait":"30s"}`},
+		invalid: []string{`{"volume_id":"pv-1","mount_path":"","wait":"30s"}`},
+	},
+	KodoDetachCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo","wait":"1m"}`},
+		invalid: []string{`{"volume_id":"pv\u00001","mount_path":"/mnt/kodo"}`},
+	},
+	KodoVfsStatsCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo"}`},
+		invalid: []string{`{"volume_id":"pv-1"}`},
+	},
+	KodoVfsForgetCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo","paths":["a","b/c"]}`},
+		invalid: []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo","paths":"a"}`},
+	},
+	KodoMountLogsCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","lines":100,"follow":true}`, `{"volume_id":"pv-1","mount_path":"/mnt/kodo"}`},
+		invalid: []string{`{"volume_id":"pv-1","mount_path":"relative"}`, `{"volume_id":"..","lines":100}`},
+	},
+	UmountCmdName: {
+		valid:   []string{`{"volume_id":"pv-1","mount_path":"/mnt/kodo","lazy":true}`},
+		invalid: []string{`{"volume_id":"pv-1","mount_path":"/"}`, `{"volume_id":"pv-1","mount_path":"/mnt/kodo","lazy":"yes"}`},
+	},
+	// The payloads are never parsed
+	DebugStateCmdName: {valid: []string{``, `null`, `[]`}},
+	PingCmdName:       {valid: []string{``, `{}`}},
+	HeartbeatCmdName:  {valid: []string{``, `{}`}},
+	RequestDataCmdName: {
+		valid:   []string{`{"data":"y\n"}`},
+		invalid: []string{`{"data":1}`},
+	},
+	AckDataCmdName: {
+		valid:   []string{`{"credits":1}`, `{"credits":16}`},
+		invalid: []string{`{"credits":0}`, `{"credits":17}`, `{"credits":-1}`},
+	},
+	// Only sent by the connector, so they are never decoded by it
+	ResponseDataCmdName: {invalid: []string{`{"is_error":true,"data":"failed"}`}},
+	TerminateCmdName:    {invalid: []string{`{"code":0}`}},
+	"unknown":           {invalid: []string{`{}`}},
+}
+
+func FuzzDecodeCmd(f *testing.F) {
+	for cmdName, seeds := range decodeSeeds {
+		for _, payload := range append(seeds.valid, seeds.invalid...) {
+			f.Add(cmdName, []byte(payload))
+		}
+		// Not even JSON
+		f.Add(cmdName, []byte(`{"volume_id":`))
+		f.Add(cmdName, []byte(`[]`))
+	}
+	f.Fuzz(func(t *testing.T, cmdName string, payload []byte) {
+		cmd, err := DecodeCmd(&Request{Version: Version, Cmd: cmdName, Payload: payload})
+		if err != nil {
+			if cmd != nil {
+				t.Fatalf("%s is decoded with error %s", cmdName, err)
+			}
+			return
+		}
+		checkDecodedCmd(t, cmdName, cmd)
+
+		// The decoded command is decoded again the same way once it's encoded, as the plugin sends it
+		buf, err := json.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("failed to marshal %s: %s", cmdName, err)
+		}
+		if _, err = DecodeCmd(&Request{Version: Version, Cmd: cmdName, Payload: buf}); err != nil {
+			t.Fatalf("failed to decode %s encoded from %s: %s", buf, payload, err)
+		}
+	})
+}
+
+func TestDecodeCmdSeeds(t *testing.T) {
+	for cmdName, seeds := range decodeSeeds {
+		for _, payload := range seeds.valid {
+			if cmd, err := DecodeCmd(&Request{Version: Version, Cmd: cmdName, Payload: json.RawMessage(payload)}); err != nil {
+				t.Errorf("failed to decode %s %s: %s", cmdName, payload, err)
+			} else {
+				checkDecodedCmd(t, cmdName, cmd)
+			}
+		}
+		for _, payload := range seeds.invalid {
+			if _, err := DecodeCmd(&Request{Version: Version, Cmd: cmdName, Payload: json.RawMessage(payload)}); err == nil {
+				t.Errorf("%s %s is expected to be rejected", cmdName, payload)
+			}
+		}
+	}
+}
+
+// checkDecodedCmd checks the ids and the mount paths of the decoded command could be joined into the paths of the connector
+func checkDecodedCmd(t *testing.T, cmdName string, cmd Cmd) {
+	t.Helper()
+
+	var ids, mountPaths []string
+	switch c := cmd.(type) {
+	case *InitKodoFSMountCmd:
+		ids, mountPaths = []string{c.GatewayID}, []string{c.MountPath}
+	case *InitKodoMountCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *KodoUmountCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *KodoFlushCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *KodoDetachCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *KodoVfsStatsCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *KodoVfsForgetCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *KodoMountLogsCmd:
+		ids = []string{c.VolumeId}
+		if c.MountPath != "" {
+			mountPaths = []string{c.MountPath}
+		}
+	case *UmountCmd:
+		ids, mountPaths = []string{c.VolumeId}, []string{c.MountPath}
+	case *AckDataCmd:
+		if c.Credits <= 0 || c.Credits > DataWindow {
+			t.Fatalf("%s is decoded with %d credits", cmdName, c.Credits)
+		}
+	case *RequestDataCmd, *DebugStateCmd, *PingCmd, *HeartbeatCmd:
+	default:
+		t.Fatalf("%s is decoded into %T", cmdName, cmd)
+	}
+	for _, id := range ids {
+		if id == "" || id == "." || id == ".." || strings.HasPrefix(id, "-") || filepath.Base(id) != id || strings.ContainsRune(id, 0) {
+			t.Fatalf("%s is decoded with id %q", cmdName, id)
+		}
+	}
+	for _, mountPath := range mountPaths {
+		if !filepath.IsAbs(mountPath) || filepath.Clean(mountPath) == "/" || strings.ContainsRune(mountPath, 0) {
+			t.Fatalf("%s is decoded with mount path %q", cmdName, mountPath)
+		}
+	}
+}
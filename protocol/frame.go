@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// FrameSequence numbers the frames sent through a connection one by one from 1, or checks the frames received from it are numbered so.
+// The frames received are only checked if the first one is numbered, so the peers of the older versions are still accepted.
+// A frame lost, duplicated or corrupted, e.g. two lines of JSON are mixed up by a broken writer, is detected by the next frame,
+// instead of misparsed as another command.
+type FrameSequence struct {
+	last     uint64
+	unsealed bool
+}
+
+// Seal numbers the frame as the next one, and sets its checksum
+func (f *FrameSequence) Seal(request *Request) {
+	f.last++
+	request.Seq = f.last
+	var compact bytes.Buffer
+	if json.Compact(&compact, request.Payload) == nil {
+		// The payload is written compact and HTML escaped by the encoders anyway, so the receiver checks the same bytes
+		var payload bytes.Buffer
+		json.HTMLEscape(&payload, compact.Bytes())
+		request.Payload = payload.Bytes()
+	}
+	request.Checksum = frameChecksum(request)
+}
+
+// Check returns an error if the frame is not the next one, or its checksum mismatches
+func (f *FrameSequence) Check(request *Request) error {
+	if f.last == 0 && request.Seq == 0 {
+		f.unsealed = true
+	}
+	if f.unsealed {
+		return nil
+	}
+	f.last++
+	if request.Seq != f.last {
+		return fmt.Errorf("frame %d is received, but frame %d is expected", request.Seq, f.last)
+	} else if checksum := frameChecksum(request); request.Checksum != checksum {
+		return fmt.Errorf("checksum of frame %d is %s, but %s is expected", request.Seq, request.Checksum, checksum)
+	}
+	return nil
+}
+
+// frameChecksum returns CRC-32C of the sequence number, the command and the payload of the frame,
+// the other fields are not covered, since the older peers may drop the fields unknown to them
+func frameChecksum(request *Request) string {
+	hash := crc32.New(castagnoli)
+	hash.Write([]byte(strconv.FormatUint(request.Seq, 10)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(request.Cmd))
+	hash.Write([]byte{0})
+	hash.Write(request.Payload)
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	// FuseDevice is opened by the mounters to serve the mount points
+	FuseDevice = "/dev/fuse"
+	// Filesystems supported by the kernel, which includes fuse once the module is loaded or built in
+	procFilesystems = "/proc/filesystems"
+)
+
+// CheckFuse checks the FUSE device exists and is usable, and the kernel supports FUSE,
+// so that the mount fails with what to do on the node instead of the generic error of the mounter.
+// It's called by the connector when it starts and before each mount, and by the plugin before mounting in its container.
+func CheckFuse() error {
+	info, err := os.Stat(FuseDevice)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist, load the fuse module by modprobe fuse on the node, or add the device to the container if running in one", FuseDevice)
+	} else if err != nil {
+		return fmt.Errorf("failed to access %s: %w", FuseDevice, err)
+	} else if info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device, add the device of the node to the container instead of a directory or a file", FuseDevice)
+	}
+	// Opening the device loads the module on demand, and is denied by the device cgroup of the containers without it
+	file, err := os.OpenFile(FuseDevice, os.O_RDWR, 0)
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("%s is not allowed to open: %w, add the device to the container, e.g. by --device %s or a FUSE device plugin", FuseDevice, err, FuseDevice)
+	} else if errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("%s is not backed by the kernel: %w, load the fuse module by modprobe fuse on the node", FuseDevice, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to open %s: %w", FuseDevice, err)
+	}
+	file.Close()
+
+	if supported, err := kernelSupportsFuse(); err != nil {
+		// Not mounted in some containers, the device is already opened anyway
+		return nil
+	} else if !supported {
+		return fmt.Errorf("fuse is not supported by the kernel, load the fuse module by modprobe fuse on the node")
+	}
+	return nil
+}
+
+func kernelSupportsFuse() (bool, error) {
+	file, err := os.Open(procFilesystems)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// e.g. "nodev	fuse"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "fuse" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
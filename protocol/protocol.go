@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
+	"path"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -13,8 +16,18 @@ const (
 	InitKodoMountCmdName   = "init_kodo_mount"
 	InitKodoFsMountCmdName = "init_kodofs_mount"
 	KodoUmountCmdName      = "umount_kodo"
+	KodoFlushCmdName       = "flush_kodo"
+	KodoDetachCmdName      = "detach_kodo"
+	KodoVfsStatsCmdName    = "vfs_stats_kodo"
+	KodoVfsForgetCmdName   = "vfs_forget_kodo"
+	KodoMountLogsCmdName   = "mount_logs_kodo"
+	UmountCmdName          = "umount"
+	DebugStateCmdName      = "debug_state"
+	PingCmdName            = "ping"
+	HeartbeatCmdName       = "heartbeat"
 	RequestDataCmdName     = "request_data"
 	ResponseDataCmdName    = "response_data"
+	AckDataCmdName         = "ack_data"
 	TerminateCmdName       = "terminate"
 )
 
@@ -23,12 +36,34 @@ type (
 		Version string          `json:"version"`
 		Cmd     string          `json:"cmd"`
 		Payload json.RawMessage `json:"payload"`
+		// ID of the CSI RPC sending the request, logged by the connector to correlate with the logs of the plugin
+		RequestId string `json:"request_id,omitempty"`
+		// W3C trace context of the caller, so that the spans of the connector and the mounter join the trace of the CSI RPC
+		TraceContext map[string]string `json:"trace_context,omitempty"`
+		// Asks the connector to keep the connection open for the next command once the command terminates,
+		// so that the plugin sends the commands through a few long-lived connections instead of dialing for each
+		KeepAlive bool `json:"keep_alive,omitempty"`
+		// Asks the connector to send heartbeats while the command runs, which the plugin answers by heartbeats,
+		// so that the connection is closed once either side stops responding instead of by the deadline of the command
+		Heartbeat bool `json:"heartbeat,omitempty"`
+		// Asks the connector to flow control the data of the command in both directions, each side sends no more than the credits
+		// granted by the other by AckDataCmd, which starts from DataWindow, so that a fast producer never overruns a slow consumer
+		FlowControl bool `json:"flow_control,omitempty"`
+		// Sequence number and checksum of the frame, see FrameSequence
+		Seq      uint64 `json:"seq,omitempty"`
+		Checksum string `json:"checksum,omitempty"`
 	}
 
 	InitKodoFSMountCmd struct {
-		GatewayID string `json:"gateway_id"`
-		MountPath string `json:"mount_path"`
-		SubDir    string `json:"sub_dir"`
+		GatewayID    string `json:"gateway_id"`
+		MountPath    string `json:"mount_path"`
+		SubDir       string `json:"sub_dir"`
+		HttpProxy    string `json:"http_proxy,omitempty"`
+		HttpsProxy   string `json:"https_proxy,omitempty"`
+		NoProxy      string `json:"no_proxy,omitempty"`
+		MountOptions string `json:"mount_options,omitempty"`
+		NoRwCache    bool   `json:"no_rw_cache,omitempty"`
+		Params       string `json:"params,omitempty"`
 	}
 
 	InitKodoMountCmd struct {
@@ -40,6 +75,8 @@ type (
 		BucketId              string  `json:"bucket_id"`
 		S3Region              string  `json:"s3_region"`
 		S3Endpoint            string  `json:"s3_endpoint"`
+		S3SignatureVersion    string  `json:"s3_signature_version,omitempty"`
+		S3Provider            string  `json:"s3_provider,omitempty"`
 		StorageClass          string  `json:"storage_class"`
 		VfsCacheMode          string  `json:"vfs_cache_mode,omitempty"`
 		DirCacheDuration      string  `json:"dir_cache_duration,omitempty"`
@@ -66,6 +103,66 @@ type (
 		WriteBackCache        bool    `json:"write_back_cache,omitempty"`
 		DebugHttp             bool    `json:"debug_http,omitempty"`
 		DebugFuse             bool    `json:"debug_fuse,omitempty"`
+		HttpProxy             string  `json:"http_proxy,omitempty"`
+		HttpsProxy            string  `json:"https_proxy,omitempty"`
+		NoProxy               string  `json:"no_proxy,omitempty"`
+		CaCert                string  `json:"ca_cert,omitempty"`
+		InsecureSkipVerify    bool    `json:"insecure_skip_verify,omitempty"`
+		PvcNamespace          string  `json:"pvc_namespace,omitempty"`
+		PvcName               string  `json:"pvc_name,omitempty"`
+		PodNamespace          string  `json:"pod_namespace,omitempty"`
+		PodName               string  `json:"pod_name,omitempty"`
+		Retries               *uint64 `json:"retries,omitempty"`
+		LowLevelRetries       *uint64 `json:"low_level_retries,omitempty"`
+		ConnectTimeout        string  `json:"connect_timeout,omitempty"`
+		Timeout               string  `json:"timeout,omitempty"`
+		// Retrieve temporary credentials from the source instead of using AccessKey and SecretKey
+		CredentialSource *CredentialSource `json:"credential_source,omitempty"`
+		// Overlay a directory on the node taking all writes on top of the bucket mounted read-only,
+		// the changed files are copied back to the bucket every WriteCacheSyncInterval if given, and once unmounted
+		LocalWriteCache        bool   `json:"local_write_cache,omitempty"`
+		WriteCacheSyncInterval string `json:"write_cache_sync_interval,omitempty"`
+		// Paths in the volume, whose files are read into the vfs cache in background once mounted,
+		// PrewarmManifest is a file in the volume listing more of them, one per line
+		Prewarm         []string `json:"prewarm,omitempty"`
+		PrewarmManifest string   `json:"prewarm_manifest,omitempty"`
+		// Copy the bucket into a directory on the node bound to the mount path instead of mounting it by FUSE,
+		// the changes are copied back every SyncBackInterval if given, and once unmounted if SyncBack
+		SyncMode         bool   `json:"sync_mode,omitempty"`
+		SyncBack         bool   `json:"sync_back,omitempty"`
+		SyncBackInterval string `json:"sync_back_interval,omitempty"`
+		// How the mount point is verified once mounted before the mount is replied, one of none, statfs, list and read,
+		// statfs if not given
+		MountCheck string `json:"mount_check,omitempty"`
+		// File in the volume listing the MD5 of the files in the format of md5sum, which are verified against the bucket before mounted,
+		// by the hashes saved by Kodo, or by downloading the files if IntegrityCheck is download
+		IntegrityManifest string `json:"integrity_manifest,omitempty"`
+		IntegrityCheck    string `json:"integrity_check,omitempty"`
+		// Keep the listings of the directories on the node across the remounts of the volume for the duration,
+		// by the rclone cache backend wrapping the bucket, see DirCacheRemote
+		PersistentDirCache string `json:"persistent_dir_cache,omitempty"`
+		// Resolve the Kodo endpoints by the IP addresses of the host names, then by the DNS servers instead of the DNS of the node,
+		// in addition to the ones given to the connector
+		HostAliases map[string]string `json:"host_aliases,omitempty"`
+		Nameservers []string          `json:"nameservers,omitempty"`
+		// Internal endpoint of the S3 gateway reachable in the network of the node, which replaces S3Endpoint once mounted if it's reachable
+		S3InternalEndpoint string `json:"s3_internal_endpoint,omitempty"`
+		// Memory limit in bytes and CPU limit in cores of the cgroup of the mounter, overriding the ones of the connector if not 0
+		MounterMemoryLimit uint64  `json:"mounter_memory_limit,omitempty"`
+		MounterCpuLimit    float64 `json:"mounter_cpu_limit,omitempty"`
+		// cpu.weight and io.weight of the cgroup of the mounter from 1 to 10000, 100 by the kernel if 0
+		MounterCpuWeight uint64 `json:"mounter_cpu_weight,omitempty"`
+		MounterIoWeight  uint64 `json:"mounter_io_weight,omitempty"`
+	}
+
+	CredentialSource struct {
+		Type             string `json:"type"`
+		Endpoint         string `json:"endpoint,omitempty"`
+		Token            string `json:"token,omitempty"`
+		Role             string `json:"role,omitempty"`
+		AccessKeyFile    string `json:"access_key_file,omitempty"`
+		SecretKeyFile    string `json:"secret_key_file,omitempty"`
+		SessionTokenFile string `json:"session_token_file,omitempty"`
 	}
 
 	KodoUmountCmd struct {
@@ -73,6 +170,59 @@ type (
 		MountPath string `json:"mount_path"`
 	}
 
+	KodoFlushCmd struct {
+		VolumeId  string `json:"volume_id"`
+		MountPath string `json:"mount_path"`
+		Wait      string `json:"wait"`
+	}
+
+	// KodoDetachCmd unmounts the volume lazily, the connector uploads the write-back cache in background before stopping the mounter.
+	// Wait is how long the connector waits for the cache to be uploaded each time before warning.
+	KodoDetachCmd struct {
+		VolumeId  string `json:"volume_id"`
+		MountPath string `json:"mount_path"`
+		Wait      string `json:"wait"`
+	}
+
+	KodoVfsStatsCmd struct {
+		VolumeId  string `json:"volume_id"`
+		MountPath string `json:"mount_path"`
+	}
+
+	KodoVfsForgetCmd struct {
+		VolumeId  string   `json:"volume_id"`
+		MountPath string   `json:"mount_path"`
+		Paths     []string `json:"paths,omitempty"`
+	}
+
+	// KodoMountLogsCmd asks the connector for the last lines of the logs of the mounters of the volume, with the secrets masked.
+	// The logs of all the mount points of the volume are replied if MountPath is empty. Lines is 100 by default.
+	// If Follow is set, the new lines are replied as they are written, until the connection is closed.
+	KodoMountLogsCmd struct {
+		VolumeId  string `json:"volume_id"`
+		MountPath string `json:"mount_path,omitempty"`
+		Lines     int    `json:"lines,omitempty"`
+		Follow    bool   `json:"follow,omitempty"`
+	}
+
+	// UmountCmd asks the connector to unmount the mount point on the node, for the plugin running without privilege,
+	// which can't unmount in its own mount namespace. Lazy unmounts a disconnected mount point by umount -l.
+	// Only the mount points of the mounters on the target paths of the volumes are unmounted, others are rejected.
+	UmountCmd struct {
+		VolumeId  string `json:"volume_id"`
+		MountPath string `json:"mount_path"`
+		Lazy      bool   `json:"lazy,omitempty"`
+	}
+
+	// DebugStateCmd asks the connector for its state to collect the debug bundle, which is replied in JSON without any secret
+	DebugStateCmd struct{}
+
+	// PingCmd checks the connector accepts the connections and serves the commands, which is replied by TerminateCmd at once
+	PingCmd struct{}
+
+	// HeartbeatCmd is sent by the connector periodically while the command runs, and by the plugin to answer it
+	HeartbeatCmd struct{}
+
 	RequestDataCmd struct {
 		Data string `json:"data"`
 	}
@@ -82,6 +232,12 @@ type (
 		Data    string `json:"data"`
 	}
 
+	// AckDataCmd acknowledges the data consumed by the receiver, i.e. the ResponseDataCmds read by the plugin,
+	// or the RequestDataCmds written into the stdin of the command by the connector, and grants the sender as many credits to send more
+	AckDataCmd struct {
+		Credits int `json:"credits"`
+	}
+
 	TerminateCmd struct {
 		Code int `json:"code"`
 	}
@@ -99,8 +255,18 @@ type (
 func (*InitKodoFSMountCmd) Command() {}
 func (*InitKodoMountCmd) Command()   {}
 func (*KodoUmountCmd) Command()      {}
+func (*KodoFlushCmd) Command()       {}
+func (*KodoDetachCmd) Command()      {}
+func (*KodoVfsStatsCmd) Command()    {}
+func (*KodoVfsForgetCmd) Command()   {}
+func (*KodoMountLogsCmd) Command()   {}
+func (*UmountCmd) Command()          {}
+func (*DebugStateCmd) Command()      {}
+func (*PingCmd) Command()            {}
+func (*HeartbeatCmd) Command()       {}
 func (*RequestDataCmd) Command()     {}
 func (*ResponseDataCmd) Command()    {}
+func (*AckDataCmd) Command()         {}
 func (*TerminateCmd) Command()       {}
 
 type contextKey string
@@ -110,39 +276,78 @@ const (
 	KodoFSCmd = "kodofs"
 	// Rclone executable name
 	RcloneCmd = "rclone"
+	// Number of the data frames either side may send through a connection under flow control before it's acknowledged
+	DataWindow = 16
+	// Directory of the directories on the node which the Kodo volumes in the sync mode are copied into, and bound to the mount paths from
+	SyncedKodoDir = "/var/lib/qiniu/storage/csi-plugin/synced"
 
 	ContextKeyConfigFilePath contextKey = "config_file_path"
+	ContextKeyConfigPassword contextKey = "config_password"
 	ContextKeyUserAgent      contextKey = "user_agent"
 	ContextKeyLogFilePath    contextKey = "log_file_path"
 	ContextKeyCacheDirPath   contextKey = "cache_dir_path"
+	ContextKeyCaCertFilePath contextKey = "ca_cert_file_path"
+	ContextKeyRcAddr         contextKey = "rc_addr"
+	ContextKeyRcUser         contextKey = "rc_user"
+	ContextKeyRcPassword     contextKey = "rc_password"
+	// URI and token of the loopback endpoint serving the temporary credentials
+	ContextKeyCredentialsUri   contextKey = "credentials_uri"
+	ContextKeyCredentialsToken contextKey = "credentials_token"
+	// URL of the loopback proxy resolving the Kodo endpoints by HostAliases and Nameservers, including its credentials
+	ContextKeyResolverProxyUrl contextKey = "resolver_proxy_url"
+
+	// Temporary credentials are retrieved from an STS endpoint
+	CredentialSourceTypeSTS = "sts"
+	// Temporary credentials of the instance role are retrieved from the instance metadata service of the node
+	CredentialSourceTypeInstance = "instance"
+	// Keys are read from the files in the container of the Kodo CSI plugin, and read again once they change
+	CredentialSourceTypeFile = "file"
 )
 
 func (c *InitKodoFSMountCmd) ExecCommand(ctx context.Context) *exec.Cmd {
 	var args = []string{"mount", c.GatewayID, c.MountPath, "-s", c.SubDir, "--force_reinit"}
-	return exec.CommandContext(ctx, KodoFSCmd, args...)
+	if c.NoRwCache {
+		args = append(args, "--no_rw_cache")
+	}
+	if c.MountOptions != "" {
+		args = append(args, []string{"-o", c.MountOptions}...)
+	}
+	execCmd := exec.CommandContext(ctx, KodoFSCmd, args...)
+	execCmd.Env = proxyEnviron(c.HttpProxy, c.HttpsProxy, c.NoProxy)
+	return execCmd
+}
+
+// PrepareCommands returns the commands to run before ExecCommand, which apply the kodofs parameters to the config of the volume.
+// kodofs mount doesn't accept the parameters directly, so the config is initialized first if not exists, then modified.
+// The init command prompts for the master address and the AccessToken just like the mount command.
+func (c *InitKodoFSMountCmd) PrepareCommands(ctx context.Context, configExists bool) []*exec.Cmd {
+	if c.Params == "" {
+		return nil
+	}
+	var execCmds []*exec.Cmd
+	if !configExists {
+		var args = []string{"init", c.GatewayID}
+		if c.NoRwCache {
+			args = append(args, "--no_rw_cache")
+		}
+		execCmds = append(execCmds, exec.CommandContext(ctx, KodoFSCmd, args...))
+	}
+	execCmds = append(execCmds, exec.CommandContext(ctx, KodoFSCmd, "modify", c.GatewayID, "-p", c.Params))
+	for _, execCmd := range execCmds {
+		execCmd.Env = proxyEnviron(c.HttpProxy, c.HttpsProxy, c.NoProxy)
+	}
+	return execCmds
 }
 
 func (c *InitKodoMountCmd) ExecCommand(ctx context.Context) *exec.Cmd {
-	rcloneConfigFilePath := ctx.Value(ContextKeyConfigFilePath).(string)
-	userAgent := ctx.Value(ContextKeyUserAgent).(string)
-	rcloneLogFilePath := ctx.Value(ContextKeyLogFilePath).(string)
 	rcloneCacheDirPath := ctx.Value(ContextKeyCacheDirPath).(string)
+	rcAddr, _ := ctx.Value(ContextKeyRcAddr).(string)
 
-	var cmdFlags = []string{
-		"--auto-confirm",
-		"--config", rcloneConfigFilePath,
-		"--user-agent", fmt.Sprintf("%s/%s", userAgent, c.VolumeId),
-		"--log-file", rcloneLogFilePath}
-	if c.BufferSize != nil {
-		cmdFlags = append(cmdFlags, []string{"--buffer-size", formatByteSize(*c.BufferSize)}...)
-	}
-	if c.Transfers != nil {
-		cmdFlags = append(cmdFlags, []string{"--transfers", formatUint(*c.Transfers)}...)
-	}
-	if c.DebugHttp {
-		cmdFlags = append(cmdFlags, []string{"--verbose", "--dump", "headers"}...)
+	cmdFlags := c.globalFlags(ctx)
+	var mountFlags = []string{"--cache-dir", rcloneCacheDirPath}
+	if rcAddr != "" {
+		mountFlags = append(mountFlags, []string{"--rc", "--rc-addr", rcAddr}...)
 	}
-	var mountFlags = []string{"--daemon", "--cache-dir", rcloneCacheDirPath}
 	if c.DirCacheDuration != "" {
 		mountFlags = append(mountFlags, []string{"--dir-cache-time", c.DirCacheDuration}...)
 	}
@@ -200,11 +405,228 @@ func (c *InitKodoMountCmd) ExecCommand(ctx context.Context) *exec.Cmd {
 	if c.DebugFuse {
 		mountFlags = append(mountFlags, []string{"--debug-fuse"}...)
 	}
+	remote := c.BucketRemote()
+	if c.LocalWriteCache {
+		remote = c.WriteCacheRemote()
+	}
 	var args = append(
 		append(
 			append(cmdFlags, "mount"), mountFlags...),
-		[]string{fmt.Sprintf("%s:%s/%s", c.VolumeId, c.BucketId, c.SubDir), c.MountPath}...)
-	return exec.CommandContext(ctx, RcloneCmd, args...)
+		[]string{remote, c.MountPath}...)
+	execCmd := exec.CommandContext(ctx, RcloneCmd, args...)
+	execCmd.Env = c.environ(ctx)
+	return execCmd
+}
+
+// TransferCommand returns the command copying src to dst out of the mount, either of them is Remote() and the other is a directory on the node.
+// The files not in src are also deleted from dst if deleteExtraneous, just like rclone sync.
+func (c *InitKodoMountCmd) TransferCommand(ctx context.Context, src, dst string, deleteExtraneous bool) *exec.Cmd {
+	command := "copy"
+	if deleteExtraneous {
+		command = "sync"
+	}
+	args := append(c.globalFlags(ctx), command, src, dst)
+	execCmd := exec.CommandContext(ctx, RcloneCmd, args...)
+	execCmd.Env = c.environ(ctx)
+	return execCmd
+}
+
+// ChecksumCommand returns the command verifying the files of Remote() listed in IntegrityManifest, the files not listed are ignored
+func (c *InitKodoMountCmd) ChecksumCommand(ctx context.Context) *exec.Cmd {
+	remote := strings.TrimSuffix(c.Remote(), "/")
+	args := append(c.globalFlags(ctx), "checksum", "md5", remote+"/"+strings.TrimPrefix(c.IntegrityManifest, "/"), remote, "--one-way")
+	if c.IntegrityCheck == "download" {
+		args = append(args, "--download")
+	}
+	execCmd := exec.CommandContext(ctx, RcloneCmd, args...)
+	execCmd.Env = c.environ(ctx)
+	return execCmd
+}
+
+// globalFlags returns the flags of rclone shared by all its commands
+func (c *InitKodoMountCmd) globalFlags(ctx context.Context) []string {
+	rcloneConfigFilePath := ctx.Value(ContextKeyConfigFilePath).(string)
+	userAgent := ctx.Value(ContextKeyUserAgent).(string)
+	rcloneLogFilePath := ctx.Value(ContextKeyLogFilePath).(string)
+	caCertFilePath, _ := ctx.Value(ContextKeyCaCertFilePath).(string)
+
+	var cmdFlags = []string{
+		"--auto-confirm",
+		"--config", rcloneConfigFilePath,
+		"--user-agent", c.userAgent(userAgent),
+		"--log-file", rcloneLogFilePath}
+	if c.BufferSize != nil {
+		cmdFlags = append(cmdFlags, []string{"--buffer-size", formatByteSize(*c.BufferSize)}...)
+	}
+	if c.Transfers != nil {
+		cmdFlags = append(cmdFlags, []string{"--transfers", formatUint(*c.Transfers)}...)
+	}
+	if c.Retries != nil {
+		cmdFlags = append(cmdFlags, []string{"--retries", formatUint(*c.Retries)}...)
+	}
+	if c.LowLevelRetries != nil {
+		cmdFlags = append(cmdFlags, []string{"--low-level-retries", formatUint(*c.LowLevelRetries)}...)
+	}
+	if c.ConnectTimeout != "" {
+		cmdFlags = append(cmdFlags, []string{"--contimeout", c.ConnectTimeout}...)
+	}
+	if c.Timeout != "" {
+		cmdFlags = append(cmdFlags, []string{"--timeout", c.Timeout}...)
+	}
+	if c.DebugHttp {
+		cmdFlags = append(cmdFlags, []string{"--verbose", "--dump", "headers"}...)
+	}
+	if caCertFilePath != "" {
+		cmdFlags = append(cmdFlags, []string{"--ca-cert", caCertFilePath}...)
+	}
+	if c.InsecureSkipVerify {
+		cmdFlags = append(cmdFlags, []string{"--no-check-certificate"}...)
+	}
+	return cmdFlags
+}
+
+// environ returns the environment of rclone, which carries the secrets never passed by the command line
+func (c *InitKodoMountCmd) environ(ctx context.Context) []string {
+	environ := proxyEnviron(c.HttpProxy, c.HttpsProxy, c.NoProxy)
+	if resolverProxyUrl, _ := ctx.Value(ContextKeyResolverProxyUrl).(string); resolverProxyUrl != "" {
+		// The volume has no proxy of its own, otherwise the endpoints are resolved by that proxy
+		environ = proxyEnviron(resolverProxyUrl, resolverProxyUrl, c.NoProxy)
+	}
+	if rcloneConfigPassword, _ := ctx.Value(ContextKeyConfigPassword).(string); rcloneConfigPassword != "" {
+		// The config file is encrypted since it contains the keys, the password is never written to the disk
+		if environ == nil {
+			environ = os.Environ()
+		}
+		environ = append(environ, "RCLONE_CONFIG_PASS="+rcloneConfigPassword)
+	}
+	if rcAddr, _ := ctx.Value(ContextKeyRcAddr).(string); rcAddr != "" {
+		// Pass the credentials of remote control by environment to hide them from the process list
+		rcUser, _ := ctx.Value(ContextKeyRcUser).(string)
+		rcPassword, _ := ctx.Value(ContextKeyRcPassword).(string)
+		if environ == nil {
+			environ = os.Environ()
+		}
+		environ = append(environ, "RCLONE_RC_USER="+rcUser, "RCLONE_RC_PASS="+rcPassword)
+	}
+	if credentialsUri, _ := ctx.Value(ContextKeyCredentialsUri).(string); credentialsUri != "" {
+		// rclone picks up the temporary credentials from the endpoint like an ECS container by env_auth
+		credentialsToken, _ := ctx.Value(ContextKeyCredentialsToken).(string)
+		if environ == nil {
+			environ = os.Environ()
+		}
+		environ = append(environ, "AWS_CONTAINER_CREDENTIALS_FULL_URI="+credentialsUri, "AWS_CONTAINER_AUTHORIZATION_TOKEN="+credentialsToken)
+	}
+	return environ
+}
+
+// Remote returns the path of the bucket mounted in the rclone config
+func (c *InitKodoMountCmd) Remote() string {
+	return fmt.Sprintf("%s:%s/%s", c.VolumeId, c.BucketId, c.SubDir)
+}
+
+// DirCacheRemote returns the rclone cache backend wrapping Remote() with PersistentDirCache, whose database of the listings is kept on the node
+func (c *InitKodoMountCmd) DirCacheRemote() string {
+	return c.VolumeId + "-dircache:"
+}
+
+// BucketRemote returns the remote of the bucket read by the mounter, which is DirCacheRemote() with PersistentDirCache, otherwise Remote()
+func (c *InitKodoMountCmd) BucketRemote() string {
+	if c.PersistentDirCache != "" {
+		return c.DirCacheRemote()
+	}
+	return c.Remote()
+}
+
+// WriteCacheRemote returns the rclone union of the write cache directory and the read-only bucket mounted with LocalWriteCache
+func (c *InitKodoMountCmd) WriteCacheRemote() string {
+	return c.VolumeId + "-writecache:"
+}
+
+// IsSyncedKodoRoot returns true if the root of the mount point within its filesystem, e.g. FSROOT of findmnt,
+// is a directory under SyncedKodoDir, which is <SyncedKodoDir>/<volume id>/<id of mount path>.
+// The filesystem may be mounted on any parent directory of SyncedKodoDir, so only the suffix is checked.
+func IsSyncedKodoRoot(root string) bool {
+	parent := path.Dir(path.Dir(path.Clean(root)))
+	return parent != "/" && parent != "." && strings.HasSuffix(SyncedKodoDir, parent)
+}
+
+// Secrets returns the secrets carried by the command, which must only reach the mounter by the encrypted config or the environment
+func (c *InitKodoMountCmd) Secrets() []string {
+	secrets := []string{c.AccessKey, c.SecretKey}
+	if c.CredentialSource != nil {
+		secrets = append(secrets, c.CredentialSource.Token)
+	}
+	return secrets
+}
+
+// CheckArgs returns error if any of the secrets appears in the command line of the command,
+// which is readable by any user on the host from /proc/<pid>/cmdline, unlike the environment
+func CheckArgs(execCmd *exec.Cmd, secrets ...string) error {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		for _, arg := range execCmd.Args {
+			if strings.Contains(arg, secret) {
+				return fmt.Errorf("refuse to pass secrets to %s by the command line", execCmd.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// userAgent appends the volume and the workload identity to the user agent of the connector,
+// so that Kodo access logs could be traced back to the PVC and the pod generating the traffic
+func (c *InitKodoMountCmd) userAgent(userAgent string) string {
+	userAgent = fmt.Sprintf("%s/%s", userAgent, c.VolumeId)
+	if c.PvcName != "" {
+		userAgent = fmt.Sprintf("%s/pvc/%s/%s", userAgent, c.PvcNamespace, c.PvcName)
+	}
+	if c.PodName != "" {
+		userAgent = fmt.Sprintf("%s/pod/%s/%s", userAgent, c.PodNamespace, c.PodName)
+	}
+	return userAgent
+}
+
+// proxyEnviron returns the environment of the mounter with the proxy settings of the volume applied,
+// or nil if there is nothing to override so that the mounter simply inherits the environment of the connector.
+// Hosts in noProxy are appended to the NO_PROXY inherited from the connector rather than replacing it,
+// so that connector-wide exclusions for internal endpoints always take effect.
+func proxyEnviron(httpProxy, httpsProxy, noProxy string) []string {
+	if httpProxy == "" && httpsProxy == "" && noProxy == "" {
+		return nil
+	}
+	environ := os.Environ()
+	setEnv := func(key, value string) {
+		for _, k := range []string{strings.ToUpper(key), strings.ToLower(key)} {
+			prefix := k + "="
+			found := false
+			for i, kv := range environ {
+				if strings.HasPrefix(kv, prefix) {
+					environ[i] = prefix + value
+					found = true
+				}
+			}
+			if !found {
+				environ = append(environ, prefix+value)
+			}
+		}
+	}
+	if httpProxy != "" {
+		setEnv("HTTP_PROXY", httpProxy)
+	}
+	if httpsProxy != "" {
+		setEnv("HTTPS_PROXY", httpsProxy)
+	}
+	if noProxy != "" {
+		if inherited := os.Getenv("NO_PROXY"); inherited != "" {
+			noProxy = inherited + "," + noProxy
+		} else if inherited = os.Getenv("no_proxy"); inherited != "" {
+			noProxy = inherited + "," + noProxy
+		}
+		setEnv("NO_PROXY", noProxy)
+	}
+	return environ
 }
 
 func formatUint(i uint64) string {
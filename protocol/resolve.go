@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseHostAliases parses the comma-separated pairs of the host names and their IP addresses, e.g. s3.example.com=10.0.0.1,
+// shared by the parameters of the volumes and the flag of the connector
+func ParseHostAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		host, ip, ok := strings.Cut(pair, "=")
+		host, ip = strings.ToLower(strings.TrimSpace(host)), strings.TrimSpace(ip)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid host alias %q, expected <host>=<ip>", pair)
+		} else if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address %q of host alias %s", ip, host)
+		}
+		aliases[host] = ip
+	}
+	return aliases, nil
+}
+
+// ParseNameservers parses the comma-separated addresses of the DNS servers, whose port is 53 if not given
+func ParseNameservers(s string) ([]string, error) {
+	var nameservers []string
+	for _, address := range strings.Split(s, ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		if net.ParseIP(strings.Trim(address, "[]")) != nil {
+			address = net.JoinHostPort(strings.Trim(address, "[]"), "53")
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nameserver %q: %w", address, err)
+		} else if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid nameserver %q, expected an IP address", address)
+		}
+		nameservers = append(nameservers, address)
+	}
+	return nameservers, nil
+}
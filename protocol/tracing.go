@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// InjectTraceContext saves the trace context of ctx into the request, nothing is saved if tracing is disabled
+func InjectTraceContext(ctx context.Context, request *Request) {
+	carrier := make(propagation.MapCarrier)
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		request.TraceContext = carrier
+	}
+}
+
+// ExtractTraceContext returns ctx with the trace context saved in the request
+func ExtractTraceContext(ctx context.Context, request *Request) context.Context {
+	if len(request.TraceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(request.TraceContext))
+}
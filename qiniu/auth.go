@@ -230,3 +230,30 @@ func (headers xQiniuHeaders) Less(i, j int) bool {
 func (headers xQiniuHeaders) Swap(i, j int) {
 	headers[i], headers[j] = headers[j], headers[i]
 }
+
+// AuthError is returned if a request is rejected by the authentication or the authorization of the server
+type AuthError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *AuthError) Error() string {
+	if err.Message == "" {
+		return http.StatusText(err.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(err.StatusCode), err.Message)
+}
+
+// Unauthenticated returns whether the credential itself is wrong, otherwise it's valid but not permitted to do the request
+func (err *AuthError) Unauthenticated() bool {
+	return err.StatusCode == http.StatusUnauthorized
+}
+
+func newAuthErrorFromResponse(resp *http.Response, message string) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{StatusCode: resp.StatusCode, Message: message}
+	default:
+		return nil
+	}
+}
@@ -3,6 +3,7 @@ package qiniu
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -21,6 +22,10 @@ import (
 var (
 	cacheMap          sync.Map
 	singleflightGroup singleflight.Group
+
+	// BucketsCacheTTL is how long the bucket lists and the verified credentials are cached for the same credentials,
+	// so that a burst of provisioning with the same credentials is served by a few queries
+	BucketsCacheTTL = time.Second
 )
 
 type KodoClient struct {
@@ -46,12 +51,28 @@ type Bucket struct {
 	ID           string `json:"id"`
 	Name         string `json:"tbl"`
 	KodoRegionID string `json:"region"`
+	// Account owning the bucket and the permission granted to the account listing it, only given for the buckets shared by others
+	OwnerUid uint64 `json:"ouid,omitempty"`
+	Perm     int    `json:"perm,omitempty"`
 }
 
-func NewKodoClient(accessKey, secretKey string, ucUrl *url.URL, version, commitId string) *KodoClient {
-	httpClient := new(http.Client)
+const (
+	// Permissions of the buckets shared by other accounts
+	BucketPermReadOnly  = 1
+	BucketPermReadWrite = 2
+)
+
+// Shared returns true if the bucket is owned by another account, and shared with the account listing it
+func (bucket *Bucket) Shared() bool {
+	return bucket.OwnerUid != 0
+}
+
+func NewKodoClient(accessKey, secretKey string, ucUrl *url.URL, tlsConfig *tls.Config, version, commitId string) *KodoClient {
+	httpClient := &http.Client{Transport: newBaseTransport(tlsConfig)}
 	transport := NewUserAgentTransport(fmt.Sprintf("QiniuCSIDriver/%s/%s/kodo", version, commitId), httpClient.Transport)
 	transport = NewQiniuAuthTransport(accessKey, secretKey, transport, false)
+	transport = NewObserveTransport(transport)
+	transport = NewThrottleTransport(accessKey, transport)
 	httpClient.Transport = transport
 	return &KodoClient{httpClient: httpClient, ucUrl: ucUrl, accessKey: accessKey, secretKey: secretKey}
 }
@@ -67,6 +88,7 @@ func (client *KodoClient) CreateBucket(ctx context.Context, bucketName, regionID
 		if bytes, err := ioutil.ReadAll(resp.Body); err != nil {
 			return fmt.Errorf("KodoClient.CreateBucket: read response err: %w", err)
 		} else if resp.StatusCode == http.StatusOK {
+			client.invalidateBuckets(bucketName)
 			return nil
 		} else if errBody, err := parseKodoErrorFromResponseBody(bytes); err != nil {
 			return err
@@ -282,6 +304,60 @@ func (client *KodoClient) DeleteIAMUser(ctx context.Context, userName string) er
 	}
 }
 
+type IAMUser struct {
+	Alias string `json:"alias"`
+	// RFC3339 formatted creation time, kept as string since it's only informative
+	CreatedAt string `json:"created_at"`
+}
+
+// ListIAMUsers lists all IAM users of the account page by page
+func (client *KodoClient) ListIAMUsers(ctx context.Context) ([]*IAMUser, error) {
+	type ResponseBody struct {
+		Data struct {
+			Count int        `json:"count"`
+			List  []*IAMUser `json:"list"`
+		} `json:"data"`
+	}
+	const pageSize = 100
+
+	apiEndpoint, err := client.GetCentralApiEndpoint(ctx)
+	if err != nil {
+		return nil, err
+	} else if apiEndpoint == nil {
+		return nil, fmt.Errorf("KodoClient.ListIAMUsers: cannot get api endpoint of central region")
+	}
+	var users []*IAMUser
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/iam/v1/users?page=%d&page_size=%d", apiEndpoint, page, pageSize)
+		if request, err := http.NewRequest(http.MethodGet, url, http.NoBody); err != nil {
+			return nil, fmt.Errorf("KodoClient.ListIAMUsers: create request err: %w", err)
+		} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+			return nil, fmt.Errorf("KodoClient.ListIAMUsers: send request err: %w", err)
+		} else {
+			bytes, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("KodoClient.ListIAMUsers: read response err: %w", err)
+			} else if resp.StatusCode == http.StatusOK {
+				var responseBody ResponseBody
+				if err = json.Unmarshal(bytes, &responseBody); err != nil {
+					return nil, fmt.Errorf("KodoClient.ListIAMUsers: parse response body err: %w", err)
+				}
+				users = append(users, responseBody.Data.List...)
+				if len(responseBody.Data.List) < pageSize || len(users) >= responseBody.Data.Count {
+					return users, nil
+				}
+			} else if errBody, err := parseKodoErrorFromResponseBody(bytes); err != nil {
+				return nil, err
+			} else if errBody != nil {
+				return nil, errBody
+			} else {
+				return nil, fmt.Errorf("KodoClient.ListIAMUsers: invalid status code: %s", resp.Status)
+			}
+		}
+	}
+}
+
 func (client *KodoClient) CreateIAMPolicy(ctx context.Context, name, bucketName string) error {
 	type Statement struct {
 		Action   []string `json:"action"`
@@ -678,6 +754,7 @@ func (client *KodoClient) DeleteBucket(ctx context.Context, bucketName string) e
 		if bytes, err := ioutil.ReadAll(resp.Body); err != nil {
 			return fmt.Errorf("KodoClient.DeleteBucket: read response err: %w", err)
 		} else if resp.StatusCode == http.StatusOK {
+			client.invalidateBuckets(bucketName)
 			return nil
 		} else if errBody, err := parseKodoErrorFromResponseBody(bytes); err != nil {
 			return err
@@ -904,6 +981,10 @@ func (client *KodoClient) FindBucketByName(ctx context.Context, bucketName strin
 		}); err != nil {
 			return nil, err
 		} else {
+			if value.(*Bucket) == nil {
+				// Only the region of the existing bucket is cached for long, the missing one may be created soon
+				cacheMap.Delete(cacheKey)
+			}
 			return value.(*Bucket), nil
 		}
 	} else if value, err := client.findBucketByName(ctx, bucketName, false); err != nil {
@@ -939,7 +1020,7 @@ func (client *KodoClient) findBucketByName(ctx context.Context, bucketName strin
 
 func (client *KodoClient) GetBuckets(ctx context.Context) ([]*Bucket, error) {
 	cacheKey := fmt.Sprintf("cacheKey-%s-%s-%s-buckets", client.accessKey, client.secretKey, client.ucUrl)
-	if value, err := getCacheValueByKey(cacheKey, 1*time.Second, func() (interface{}, error) {
+	if value, err := getCacheValueByKey(cacheKey, BucketsCacheTTL, func() (interface{}, error) {
 		return client.getBuckets(ctx)
 	}); err != nil {
 		return nil, err
@@ -948,6 +1029,12 @@ func (client *KodoClient) GetBuckets(ctx context.Context) ([]*Bucket, error) {
 	}
 }
 
+// invalidateBuckets removes the cached bucket list and the cached bucket once the bucket is created or deleted
+func (client *KodoClient) invalidateBuckets(bucketName string) {
+	cacheMap.Delete(fmt.Sprintf("cacheKey-%s-%s-%s-buckets", client.accessKey, client.secretKey, client.ucUrl))
+	cacheMap.Delete(fmt.Sprintf("cacheKey-%s-%s-%s-bucketName-%s", client.accessKey, client.secretKey, client.ucUrl, bucketName))
+}
+
 func (client *KodoClient) getBuckets(ctx context.Context) ([]*Bucket, error) {
 	var response []*Bucket
 	url := client.ucUrl.String() + "/v2/buckets?shared=rd"
@@ -975,6 +1062,154 @@ func (client *KodoClient) getBuckets(ctx context.Context) ([]*Bucket, error) {
 	}
 }
 
+// VerifyCredentials performs a cheap authenticated call to check the keys, *AuthError is returned if they're rejected.
+// Only the verified credentials are cached for BucketsCacheTTL.
+func (client *KodoClient) VerifyCredentials(ctx context.Context) error {
+	cacheKey := fmt.Sprintf("cacheKey-%s-%s-%s-verified", client.accessKey, client.secretKey, client.ucUrl)
+	_, err := getCacheValueByKey(cacheKey, BucketsCacheTTL, func() (interface{}, error) {
+		return struct{}{}, client.verifyCredentials(ctx)
+	})
+	return err
+}
+
+func (client *KodoClient) verifyCredentials(ctx context.Context) error {
+	url := client.ucUrl.String() + "/v2/buckets?shared=rd"
+	if request, err := http.NewRequest(http.MethodGet, url, http.NoBody); err != nil {
+		return fmt.Errorf("KodoClient.VerifyCredentials: create request err: %w", err)
+	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+		return fmt.Errorf("KodoClient.VerifyCredentials: send request err: %w", err)
+	} else {
+		defer resp.Body.Close()
+		if bytes, err := ioutil.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("KodoClient.VerifyCredentials: read response err: %w", err)
+		} else if resp.StatusCode == http.StatusOK {
+			return nil
+		} else {
+			var message string
+			if errBody, _ := parseKodoErrorFromResponseBody(bytes); errBody != nil {
+				message = errBody.Message
+			}
+			if authErr := newAuthErrorFromResponse(resp, message); authErr != nil {
+				return authErr
+			} else if message != "" {
+				return fmt.Errorf("KodoClient.VerifyCredentials: %s", message)
+			}
+			return fmt.Errorf("KodoClient.VerifyCredentials: invalid status code: %s", resp.Status)
+		}
+	}
+}
+
+// BucketUsage is the storage usage of a bucket in the given storage class, which is counted by Kodo once a day
+type BucketUsage struct {
+	Bytes   int64
+	Objects int64
+}
+
+// statisticsSuffixes are the suffixes of the statistics APIs by the storage class of the objects
+var statisticsSuffixes = map[string]string{
+	"":             "",
+	"STANDARD":     "",
+	"LINE":         "_line",
+	"GLACIER":      "_archive",
+	"DEEP_ARCHIVE": "_deep",
+}
+
+// GetBucketUsage gets the latest storage usage of the bucket in the storage class from the statistics APIs
+func (client *KodoClient) GetBucketUsage(ctx context.Context, bucketName, storageClass string) (*BucketUsage, error) {
+	suffix, ok := statisticsSuffixes[strings.ToUpper(storageClass)]
+	if !ok {
+		return nil, fmt.Errorf("KodoClient.GetBucketUsage: unsupported storage class %s", storageClass)
+	}
+	apiEndpoint, err := client.GetCentralApiEndpoint(ctx)
+	if err != nil {
+		return nil, err
+	} else if apiEndpoint == nil {
+		return nil, fmt.Errorf("KodoClient.GetBucketUsage: cannot get api endpoint of central region")
+	}
+	var usage BucketUsage
+	if usage.Bytes, err = client.getLatestStatistics(ctx, apiEndpoint, "space"+suffix, bucketName); err != nil {
+		return nil, err
+	} else if usage.Objects, err = client.getLatestStatistics(ctx, apiEndpoint, "count"+suffix, bucketName); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// BucketQuota is the quota of a bucket set on Kodo, either is unlimited if not positive
+type BucketQuota struct {
+	Bytes   int64 `json:"size"`
+	Objects int64 `json:"count"`
+}
+
+// GetBucketQuota gets the quota of the storage usage of the bucket, beyond which the writes to the bucket are rejected
+func (client *KodoClient) GetBucketQuota(ctx context.Context, bucketName string) (*BucketQuota, error) {
+	url := client.ucUrl.String() + "/getbucketquota/" + bucketName
+	if request, err := http.NewRequest(http.MethodPost, url, http.NoBody); err != nil {
+		return nil, fmt.Errorf("KodoClient.GetBucketQuota: create request err: %w", err)
+	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+		return nil, fmt.Errorf("KodoClient.GetBucketQuota: send request err: %w", err)
+	} else {
+		defer resp.Body.Close()
+		if bytes, err := ioutil.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("KodoClient.GetBucketQuota: read response err: %w", err)
+		} else if resp.StatusCode == http.StatusOK {
+			var quota BucketQuota
+			if err = json.Unmarshal(bytes, &quota); err != nil {
+				return nil, fmt.Errorf("KodoClient.GetBucketQuota: parse response body err: %w", err)
+			}
+			return &quota, nil
+		} else if errBody, err := parseKodoErrorFromResponseBody(bytes); err != nil {
+			return nil, err
+		} else if errBody != nil {
+			return nil, errBody
+		} else {
+			return nil, fmt.Errorf("KodoClient.GetBucketQuota: invalid status code: %s", resp.Status)
+		}
+	}
+}
+
+// getLatestStatistics gets the daily statistics of the bucket in the last two days and returns the latest one,
+// since the statistics of today may not be counted yet
+func (client *KodoClient) getLatestStatistics(ctx context.Context, apiEndpoint *url.URL, name, bucketName string) (int64, error) {
+	type ResponseBody struct {
+		Times []int64 `json:"times"`
+		Datas []int64 `json:"datas"`
+	}
+	const timeLayout = "20060102150405"
+
+	now := time.Now()
+	query := make(url.Values)
+	query.Set("bucket", bucketName)
+	query.Set("begin", now.Add(-48*time.Hour).Format(timeLayout))
+	query.Set("end", now.Format(timeLayout))
+	query.Set("g", "day")
+	url := apiEndpoint.String() + "/v6/" + name + "?" + query.Encode()
+	if request, err := http.NewRequest(http.MethodGet, url, http.NoBody); err != nil {
+		return 0, fmt.Errorf("KodoClient.getLatestStatistics: create request err: %w", err)
+	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+		return 0, fmt.Errorf("KodoClient.getLatestStatistics: send request err: %w", err)
+	} else {
+		defer resp.Body.Close()
+		if bytes, err := ioutil.ReadAll(resp.Body); err != nil {
+			return 0, fmt.Errorf("KodoClient.getLatestStatistics: read response err: %w", err)
+		} else if resp.StatusCode == http.StatusOK {
+			var responseBody ResponseBody
+			if err = json.Unmarshal(bytes, &responseBody); err != nil {
+				return 0, fmt.Errorf("KodoClient.getLatestStatistics: parse response body err: %w", err)
+			} else if len(responseBody.Datas) == 0 {
+				return 0, nil
+			}
+			return responseBody.Datas[len(responseBody.Datas)-1], nil
+		} else if errBody, err := parseKodoErrorFromResponseBody(bytes); err != nil {
+			return 0, err
+		} else if errBody != nil {
+			return 0, errBody
+		} else {
+			return 0, fmt.Errorf("KodoClient.getLatestStatistics: invalid status code: %s", resp.Status)
+		}
+	}
+}
+
 func getCacheValueByKey(cacheKey string, cacheTtl time.Duration, fn func() (interface{}, error)) (interface{}, error) {
 	type CacheValue struct {
 		value    interface{}
@@ -4,23 +4,81 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type KodoFSClient struct {
 	httpClient *http.Client
-	masterUrl  *url.URL
+	masterUrls []*url.URL
+	// index of the master which responds last time
+	current uint32
 }
 
-func NewKodoFSClient(accessKey, secretKey string, masterUrl *url.URL, version, commitId string) *KodoFSClient {
+func NewKodoFSClient(accessKey, secretKey string, masterUrls []*url.URL, version, commitId string) *KodoFSClient {
 	httpClient := new(http.Client)
 	transport := NewUserAgentTransport(fmt.Sprintf("QiniuCSIDriver/%s/%s/kodofs", version, commitId), httpClient.Transport)
 	transport = NewQiniuAuthTransport(accessKey, secretKey, transport, true)
+	transport = NewObserveTransport(transport)
 	httpClient.Transport = transport
-	return &KodoFSClient{httpClient: httpClient, masterUrl: masterUrl}
+	return &KodoFSClient{httpClient: httpClient, masterUrls: masterUrls}
+}
+
+// do sends the request to the masters one by one until one of them responds without server error,
+// so that the outage of a single master doesn't fail the request. Only GET is sent again to the next master once it's sent,
+// since the other requests may still be done by the master failing them, e.g. the volume is created,
+// while those which can't be sent at all, e.g. the master can't be dialed, are always sent to the next master.
+// The response of the server error is returned as is if it's not sent to the next master, which has the error of KodoFS.
+func (client *KodoFSClient) do(ctx context.Context, method, pathAndQuery string, body []byte, contentType string) (*http.Response, error) {
+	if len(client.masterUrls) == 0 {
+		return nil, errors.New("no kodofs master address")
+	}
+	start := int(atomic.LoadUint32(&client.current))
+	for i := 0; ; i++ {
+		index := (start + i) % len(client.masterUrls)
+		last := i+1 == len(client.masterUrls)
+		bodyReader := io.Reader(http.NoBody)
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		request, err := http.NewRequest(method, client.masterUrls[index].String()+pathAndQuery, bodyReader)
+		if err != nil {
+			return nil, fmt.Errorf("create request err: %w", err)
+		}
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		resp, err := client.httpClient.Do(request.WithContext(ctx))
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			atomic.StoreUint32(&client.current, uint32(index))
+			return resp, nil
+		} else if err == nil && (last || method != http.MethodGet) {
+			return resp, nil
+		} else if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s responds status code %d", client.masterUrls[index].Host, resp.StatusCode)
+		} else if last || method != http.MethodGet && !isUnsentRequestError(err) {
+			return nil, err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, err
+		}
+		log.Warnf("KodoFSClient: request to kodofs master %s failed, try the next one: %s", client.masterUrls[index].Host, err)
+	}
+}
+
+// isUnsentRequestError returns true if the request fails before it's sent, since the server or the proxy can't be connected
+func isUnsentRequestError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
 }
 
 func (client *KodoFSClient) CreateVolume(ctx context.Context, volumeName, description, region string, fsType uint8, blockSize uint32) (string, error) {
@@ -44,14 +102,8 @@ func (client *KodoFSClient) CreateVolume(ctx context.Context, volumeName, descri
 	if err != nil {
 		return "", fmt.Errorf("KodoFSClient.CreateVolume: marshal json request body err: %w", err)
 	}
-	url := client.masterUrl.String() + "/v1/kodofs-master/volume/create"
-	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-	if err != nil {
-		return "", fmt.Errorf("KodoFSClient.CreateVolume: create request err: %w", err)
-	}
-	request.Header.Set("Content-Type", "application/json")
 	var response Response
-	if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodPost, "/v1/kodofs-master/volume/create", body, "application/json"); err != nil {
 		return "", fmt.Errorf("KodoFSClient.CreateVolume: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
@@ -88,14 +140,8 @@ func (client *KodoFSClient) CreateAccessPoint(ctx context.Context, volumeName, d
 	if err != nil {
 		return "", fmt.Errorf("KodoFSClient.CreateAccessPoint: marshal json request body err: %w", err)
 	}
-	url := client.masterUrl.String() + "/v1/kodofs-master/accessPoint/create"
-	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-	if err != nil {
-		return "", fmt.Errorf("KodoFSClient.CreateAccessPoint: create request err: %w", err)
-	}
-	request.Header.Set("Content-Type", "application/json")
 	var response Response
-	if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodPost, "/v1/kodofs-master/accessPoint/create", body, "application/json"); err != nil {
 		return "", fmt.Errorf("KodoFSClient.CreateAccessPoint: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
@@ -120,10 +166,7 @@ func (client *KodoFSClient) GetAccessToken(ctx context.Context, accessPointId st
 	var response Response
 	queryPairs := make(url.Values)
 	queryPairs.Add("accessId", accessPointId)
-	url := client.masterUrl.String() + "/v1/kodofs-master/accessPoint/info?" + queryPairs.Encode()
-	if request, err := http.NewRequest(http.MethodGet, url, http.NoBody); err != nil {
-		return "", fmt.Errorf("KodoFSClient.GetAccessToken: create request err: %w", err)
-	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodGet, "/v1/kodofs-master/accessPoint/info?"+queryPairs.Encode(), nil, ""); err != nil {
 		return "", fmt.Errorf("KodoFSClient.GetAccessToken: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
@@ -151,10 +194,7 @@ func (client *KodoFSClient) RemoveAccessPoint(ctx context.Context, accessPointId
 	if err != nil {
 		return fmt.Errorf("KodoFSClient.RemoveAccessPoint: marshal json request body err: %w", err)
 	}
-	url := client.masterUrl.String() + "/v1/kodofs-master/accessPoint/remove"
-	if request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body)); err != nil {
-		return fmt.Errorf("KodoFSClient.RemoveAccessPoint: create request err: %w", err)
-	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodPost, "/v1/kodofs-master/accessPoint/remove", body, ""); err != nil {
 		return fmt.Errorf("KodoFSClient.RemoveAccessPoint: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
@@ -173,10 +213,7 @@ func (client *KodoFSClient) RemoveAccessPoint(ctx context.Context, accessPointId
 func (client *KodoFSClient) IsVolumeExists(ctx context.Context, volumeName string) (bool, error) {
 	queryPairs := make(url.Values)
 	queryPairs.Add("volume", volumeName)
-	url := client.masterUrl.String() + "/v1/kodofs-master/volume/info?" + queryPairs.Encode()
-	if request, err := http.NewRequest(http.MethodGet, url, http.NoBody); err != nil {
-		return false, fmt.Errorf("KodoFSClient.IsVolumeExists: create request err: %w", err)
-	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodGet, "/v1/kodofs-master/volume/info?"+queryPairs.Encode(), nil, ""); err != nil {
 		return false, fmt.Errorf("KodoFSClient.IsVolumeExists: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
@@ -196,6 +233,32 @@ func (client *KodoFSClient) IsVolumeExists(ctx context.Context, volumeName strin
 	}
 }
 
+// VerifyCredentials performs a cheap authenticated call to check the keys, *AuthError is returned if they're rejected
+func (client *KodoFSClient) VerifyCredentials(ctx context.Context, volumeName string) error {
+	queryPairs := make(url.Values)
+	queryPairs.Add("volume", volumeName)
+	if resp, err := client.do(ctx, http.MethodGet, "/v1/kodofs-master/volume/info?"+queryPairs.Encode(), nil, ""); err != nil {
+		return fmt.Errorf("KodoFSClient.VerifyCredentials: send request err: %w", err)
+	} else {
+		defer resp.Body.Close()
+		if bytes, err := ioutil.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("KodoFSClient.VerifyCredentials: read response err: %w", err)
+		} else {
+			var message string
+			if errBody, _ := parseKodoFSErrorFromResponseBody(bytes); errBody != nil {
+				message = errBody.Message
+			}
+			// The volume doesn't need to exist, any response other than the rejection means the keys are accepted
+			if authErr := newAuthErrorFromResponse(resp, message); authErr != nil {
+				return authErr
+			} else if resp.StatusCode >= http.StatusInternalServerError {
+				return fmt.Errorf("KodoFSClient.VerifyCredentials: kodofs master responds status code %d: %s", resp.StatusCode, bytes)
+			}
+			return nil
+		}
+	}
+}
+
 func (client *KodoFSClient) RenameVolume(ctx context.Context, oldVolumeName, newVolumeName string) error {
 	type Request struct {
 		OldVolumeName string `json:"oldVolumeName"`
@@ -208,10 +271,7 @@ func (client *KodoFSClient) RenameVolume(ctx context.Context, oldVolumeName, new
 	if err != nil {
 		return fmt.Errorf("KodoFSClient.RenameVolume: marshal json request body err: %w", err)
 	}
-	url := client.masterUrl.String() + "/v1/kodofs-master/volume/rename"
-	if request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body)); err != nil {
-		return fmt.Errorf("KodoFSClient.RenameVolume: create request err: %w", err)
-	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodPost, "/v1/kodofs-master/volume/rename", body, ""); err != nil {
 		return fmt.Errorf("KodoFSClient.RenameVolume: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
@@ -237,10 +297,7 @@ func (client *KodoFSClient) RemoveVolume(ctx context.Context, volumeName string)
 	if err != nil {
 		return fmt.Errorf("KodoFSClient.RemoveVolume: marshal json request body err: %w", err)
 	}
-	url := client.masterUrl.String() + "/v1/kodofs-master/volume/remove"
-	if request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body)); err != nil {
-		return fmt.Errorf("KodoFSClient.RemoveVolume: create request err: %w", err)
-	} else if resp, err := client.httpClient.Do(request.WithContext(ctx)); err != nil {
+	if resp, err := client.do(ctx, http.MethodPost, "/v1/kodofs-master/volume/remove", body, ""); err != nil {
 		return fmt.Errorf("KodoFSClient.RemoveVolume: send request err: %w", err)
 	} else {
 		defer resp.Body.Close()
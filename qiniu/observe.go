@@ -0,0 +1,62 @@
+package qiniu
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ObserveRequest is called once the response of every attempt of the requests to Qiniu APIs is received, or the attempt fails,
+// with the API named by ApiName and the status code, which is 0 if no response is received. Nothing is observed if it's nil.
+var ObserveRequest func(ctx context.Context, api string, statusCode int, duration time.Duration, err error)
+
+// ObserveTransport times every attempt sent to Qiniu APIs, so it's wrapped by ThrottleTransport to see its retries
+type ObserveTransport struct {
+	transport http.RoundTripper
+}
+
+func NewObserveTransport(transport http.RoundTripper) http.RoundTripper {
+	return &ObserveTransport{transport: transport}
+}
+
+func (t *ObserveTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	innerTransport := t.transport
+	if innerTransport == nil {
+		innerTransport = http.DefaultTransport
+	}
+	observe := ObserveRequest
+	if observe == nil {
+		return innerTransport.RoundTrip(request)
+	}
+	begin := time.Now()
+	resp, err := innerTransport.RoundTrip(request)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	observe(request.Context(), ApiName(request.Method, request.URL.Path), statusCode, time.Since(begin), err)
+	return resp, err
+}
+
+// ApiName returns the method and the path of the API without the bucket names, the user names and the other arguments,
+// e.g. POST /mkbucketv3 or GET /iam/v1/users/{}/keypairs, so the number of the names is bounded
+func ApiName(method, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case segments[0] == "iam" && len(segments) > 2:
+		// /iam/v1/<resource>/<name>/<sub resource>
+		for i := 3; i < len(segments); i += 2 {
+			segments[i] = "{}"
+		}
+	case segments[0] == "v1" || segments[0] == "v2":
+		// /v1/kodofs-master/volume/create, /v2/buckets and /v2/list have no arguments in the path
+	case segments[0] == "v6" && len(segments) > 1:
+		// /v6/<statistics name>
+		segments = segments[:2]
+	default:
+		// /<command>/<bucket name>/<argument name>/<argument>...
+		segments = segments[:1]
+	}
+	return method + " /" + strings.Join(segments, "/")
+}
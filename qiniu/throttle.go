@@ -0,0 +1,218 @@
+package qiniu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Retries of a throttled or failed request, besides the first attempt
+	KodoApiMaxRetries = 3
+	// Backoff before the first retry if the server doesn't say when, doubled every time
+	KodoApiMinRetryBackoff = time.Second
+	// Longest time to wait before a retry, even if the server asks for longer
+	KodoApiMaxRetryBackoff = 30 * time.Second
+	// The circuit of an account opens after so many requests fail in a row
+	KodoApiCircuitFailures = 5
+	// How long the open circuit rejects requests before a single request is allowed to probe the server again
+	KodoApiCircuitCooldown = 30 * time.Second
+	// Status code of Qiniu APIs for exceeding the rate limit, besides http.StatusTooManyRequests
+	statusQiniuRateLimited = 573
+)
+
+var (
+	// KodoApiRateLimit is the max requests per second to Kodo APIs of the same account from this process, 0 means unlimited
+	KodoApiRateLimit rate.Limit = 20
+	// KodoApiBurst is the max requests sent at once to Kodo APIs of the same account
+	KodoApiBurst = 20
+
+	// ErrCircuitOpen is returned without sending the request if the recent requests of the account keep failing
+	ErrCircuitOpen = errors.New("too many failures of Kodo API in a row, requests are suspended for a while")
+
+	// throttles saves *throttle by access key, shared by all clients of the same account
+	throttles sync.Map
+)
+
+// throttle limits the rate of the requests of an account, and breaks the circuit if they keep failing
+type throttle struct {
+	limiter *rate.Limiter
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func getThrottle(accessKey string) *throttle {
+	if value, ok := throttles.Load(accessKey); ok {
+		return value.(*throttle)
+	}
+	value, _ := throttles.LoadOrStore(accessKey, &throttle{limiter: rate.NewLimiter(KodoApiRateLimit, KodoApiBurst)})
+	return value.(*throttle)
+}
+
+// allow returns ErrCircuitOpen if the circuit is open, otherwise the request may be sent
+func (t *throttle) allow() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.failures < KodoApiCircuitFailures {
+		return nil
+	} else if time.Since(t.openedAt) < KodoApiCircuitCooldown || t.probing {
+		return ErrCircuitOpen
+	}
+	// Half open, only one request probes the server
+	t.probing = true
+	return nil
+}
+
+// release gives up the probe without knowing whether the server recovers, e.g. the request is canceled
+func (t *throttle) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.probing = false
+}
+
+func (t *throttle) record(success bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.probing = false
+	if success {
+		t.failures = 0
+		return
+	}
+	t.failures += 1
+	if t.failures >= KodoApiCircuitFailures {
+		t.openedAt = time.Now()
+	}
+}
+
+// ThrottleTransport limits the rate of the requests to Kodo APIs, retries the throttled requests, or the failed ones
+// other than POST, as the Retry-After header says, and stops sending requests for a while if they keep failing
+type ThrottleTransport struct {
+	transport http.RoundTripper
+	throttle  *throttle
+}
+
+func NewThrottleTransport(accessKey string, transport http.RoundTripper) http.RoundTripper {
+	return &ThrottleTransport{transport: transport, throttle: getThrottle(accessKey)}
+}
+
+func (t *ThrottleTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	innerTransport := t.transport
+	if innerTransport == nil {
+		innerTransport = http.DefaultTransport
+	}
+	ctx := request.Context()
+	// The body is sent again by every retry, so it must be rewindable
+	retryable := request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+	// A POST which fails by the transport or the gateway may still be done by the server, e.g. the bucket is created,
+	// so it's only retried if it's throttled, which the server never processes
+	idempotent := request.Method != http.MethodPost && request.Method != http.MethodPatch
+
+	backoff := KodoApiMinRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := t.throttle.allow(); err != nil {
+			return nil, fmt.Errorf("ThrottleTransport.RoundTrip: %s %s: %w", request.Method, request.URL.Path, err)
+		}
+		if KodoApiRateLimit > 0 {
+			if err := t.throttle.limiter.Wait(ctx); err != nil {
+				t.throttle.release()
+				return nil, fmt.Errorf("ThrottleTransport.RoundTrip: wait for rate limit err: %w", err)
+			}
+		}
+
+		attemptRequest := request
+		if attempt > 0 {
+			attemptRequest = request.Clone(ctx)
+			if request.GetBody != nil {
+				body, err := request.GetBody()
+				if err != nil {
+					t.throttle.release()
+					return nil, fmt.Errorf("ThrottleTransport.RoundTrip: rewind request body err: %w", err)
+				}
+				attemptRequest.Body = body
+			}
+		} else if retryable {
+			// The auth transport sets the headers of the request, which are signed again by every retry
+			attemptRequest = request.Clone(ctx)
+		}
+		resp, err := innerTransport.RoundTrip(attemptRequest)
+		failed := err != nil || isRetryableStatus(resp.StatusCode)
+		if err != nil && ctx.Err() != nil {
+			t.throttle.release()
+		} else {
+			t.throttle.record(!failed)
+		}
+		retry := failed && (idempotent || err == nil && isThrottledStatus(resp.StatusCode))
+		if !retry || !retryable || attempt >= KodoApiMaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+
+		wait := backoff
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if wait > KodoApiMaxRetryBackoff {
+			wait = KodoApiMaxRetryBackoff
+		}
+		if err != nil {
+			log.Warnf("ThrottleTransport: %s %s failed: %s, retry in %s", request.Method, request.URL.Path, err, wait)
+		} else {
+			log.Warnf("ThrottleTransport: %s %s responded %s, retry in %s", request.Method, request.URL.Path, resp.Status, wait)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > KodoApiMaxRetryBackoff {
+			backoff = KodoApiMaxRetryBackoff
+		}
+	}
+}
+
+// isRetryableStatus returns true if the request is throttled or the server fails temporarily
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return isThrottledStatus(statusCode)
+	}
+}
+
+// isThrottledStatus returns true if the request is rejected by the rate limit before it's processed
+func isThrottledStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == statusQiniuRateLimited
+}
+
+// parseRetryAfter parses the Retry-After header in either seconds or HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	} else if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	} else if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
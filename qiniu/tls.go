@@ -0,0 +1,16 @@
+package qiniu
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// newBaseTransport returns the innermost transport of the client, nil means http.DefaultTransport
+func newBaseTransport(tlsConfig *tls.Config) http.RoundTripper {
+	if tlsConfig == nil {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
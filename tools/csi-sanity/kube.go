@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	csitesting "github.com/qiniu/csi-driver/internal/testing"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeKube serves the Kubernetes APIs called by the controller in memory.
+// The PVs are never created by csi-sanity, so they're made up from the buckets of the mock Kodo API as csi-provisioner would do.
+type fakeKube struct {
+	server *httptest.Server
+	kodo   *csitesting.MockKodo
+	// Secret of csi-sanity, which is the secret of the StorageClass
+	secrets map[string]string
+
+	lock sync.Mutex
+	// Objects created by the controller by path, e.g. the ConfigMap recording the IAM users
+	objects map[string][]byte
+}
+
+func newFakeKube(kodo *csitesting.MockKodo, secrets map[string]string) *fakeKube {
+	kube := &fakeKube{kodo: kodo, secrets: secrets, objects: make(map[string][]byte)}
+	kube.server = httptest.NewServer(http.HandlerFunc(kube.serveHTTP))
+	return kube
+}
+
+func (kube *fakeKube) close() {
+	kube.server.Close()
+}
+
+// writeKubeconfig writes the kubeconfig to access the fake Kubernetes API by --kubeconfig of the plugin
+func (kube *fakeKube) writeKubeconfig(path string) error {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: sanity
+  cluster:
+    server: %s
+contexts:
+- name: sanity
+  context:
+    cluster: sanity
+current-context: sanity
+`, kube.server.URL)
+	return os.WriteFile(path, []byte(kubeconfig), 0600)
+}
+
+func (kube *fakeKube) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(segments) == 4 && segments[2] == "persistentvolumes":
+		if pv := kube.persistentVolume(segments[3]); pv != nil {
+			csitesting.WriteJSON(w, http.StatusOK, pv)
+		} else {
+			writeNotFound(w, "persistentvolumes", segments[3])
+		}
+	case r.Method == http.MethodGet && len(segments) == 3 && segments[2] == "persistentvolumes":
+		csitesting.WriteJSON(w, http.StatusOK, &corev1.PersistentVolumeList{TypeMeta: metav1.TypeMeta{Kind: "PersistentVolumeList", APIVersion: "v1"}})
+	case r.Method == http.MethodGet:
+		kube.lock.Lock()
+		object, exists := kube.objects[r.URL.Path]
+		kube.lock.Unlock()
+		if !exists {
+			writeNotFound(w, segments[len(segments)-2], segments[len(segments)-1])
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(object)
+	case r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			csitesting.WriteJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		path := r.URL.Path
+		if r.Method == http.MethodPost {
+			var object metav1.ObjectMeta
+			var meta struct {
+				Metadata *metav1.ObjectMeta `json:"metadata"`
+			}
+			meta.Metadata = &object
+			if err = json.Unmarshal(body, &meta); err != nil {
+				csitesting.WriteJSON(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			path += "/" + object.Name
+		}
+		kube.lock.Lock()
+		kube.objects[path] = body
+		kube.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	default:
+		writeNotFound(w, segments[len(segments)-2], segments[len(segments)-1])
+	}
+}
+
+// persistentVolume makes up the PV of the volume provisioned by the controller, nil if the bucket doesn't exist
+func (kube *fakeKube) persistentVolume(volumeId string) *corev1.PersistentVolume {
+	bucket := kube.kodo.FindBucket(volumeId)
+	if bucket == nil {
+		return nil
+	}
+	return &corev1.PersistentVolume{
+		TypeMeta:   metav1.TypeMeta{Kind: "PersistentVolume", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: volumeId},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver:       kodoDriverName,
+				VolumeHandle: volumeId,
+				VolumeAttributes: map[string]string{
+					"bucketid":          bucket.ID,
+					"bucketname":        bucket.Name,
+					"region":            bucket.Region,
+					"ucendpoint":        kube.kodo.URL(),
+					"s3endpoint":        kube.kodo.URL(),
+					"s3region":          csitesting.MockKodoS3Region,
+					"originalaccesskey": kube.secrets["accesskey"],
+					"originalsecretkey": kube.secrets["secretkey"],
+				},
+			}},
+		},
+	}
+}
+
+func writeNotFound(w http.ResponseWriter, resource, name string) {
+	csitesting.WriteJSON(w, http.StatusNotFound, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   metav1.StatusReasonNotFound,
+		Code:     http.StatusNotFound,
+		Message:  fmt.Sprintf("%s %q not found", resource, name),
+		Details:  &metav1.StatusDetails{Name: name, Kind: resource},
+	})
+}
@@ -0,0 +1,182 @@
+// Command csi-sanity runs the CSI sanity suite against the Kodo driver of the plugin,
+// with a fake connector, a fake Kubernetes API and a mocked Kodo API, so that no node, cluster or bucket is needed.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	csitesting "github.com/qiniu/csi-driver/internal/testing"
+)
+
+const (
+	kodoDriverName = "kodoplugin.storage.qiniu.com"
+	// Access key and secret key of the StorageClass, never verified by the mock Kodo API
+	sanityAccessKey = "sanity-access-key"
+	sanitySecretKey = "sanity-secret-key"
+)
+
+var (
+	pluginPath    = flag.String("plugin", "plugin/plugin.storage.qiniu.com", "Path of the plugin executable to test")
+	csiSanityPath = flag.String("csi-sanity", "csi-sanity", "Path of the csi-sanity executable, the arguments after -- are passed to it")
+	keepWorkDir   = flag.Bool("keep-work-dir", false, "Keep the working directory with the logs and sockets after the suite exits")
+	co            = flag.String("co", "kubernetes", "Container orchestrator the plugin runs with, with nomad only the identity service is tested")
+)
+
+func main() {
+	flag.Parse()
+	if code, err := run(flag.Args()); err != nil {
+		log.Printf("csi-sanity: %s", err)
+		os.Exit(1)
+	} else {
+		os.Exit(code)
+	}
+}
+
+func run(sanityArgs []string) (int, error) {
+	workDir, err := os.MkdirTemp("", "csi-sanity-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	if *keepWorkDir {
+		log.Printf("csi-sanity: working directory is %s", workDir)
+	} else {
+		defer os.RemoveAll(workDir)
+	}
+
+	kodo := csitesting.NewMockKodo()
+	defer kodo.Close()
+
+	secrets := map[string]string{"accesskey": sanityAccessKey, "secretkey": sanitySecretKey}
+	kube := newFakeKube(kodo, secrets)
+	defer kube.close()
+	kubeconfigPath := filepath.Join(workDir, "kubeconfig")
+	if err = kube.writeKubeconfig(kubeconfigPath); err != nil {
+		return 0, fmt.Errorf("failed to write kubeconfig: %w", err)
+	}
+
+	connectorSocketPath := filepath.Join(workDir, "connector.sock")
+	connector, err := csitesting.NewFakeConnector(connectorSocketPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen on %s: %w", connectorSocketPath, err)
+	}
+	defer connector.Close()
+
+	parametersPath := filepath.Join(workDir, "parameters.yaml")
+	if err = writeYAML(parametersPath, map[string]string{"ucendpoint": kodo.URL(), "region": csitesting.MockKodoRegion}); err != nil {
+		return 0, fmt.Errorf("failed to write volume parameters: %w", err)
+	}
+	secretsPath := filepath.Join(workDir, "secrets.yaml")
+	if err = writeSecrets(secretsPath, secrets); err != nil {
+		return 0, fmt.Errorf("failed to write secrets: %w", err)
+	}
+
+	servicePort, err := freePort()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port for the plugin: %w", err)
+	}
+	endpointPath := filepath.Join(workDir, "csi.sock")
+	plugin := exec.Command(*pluginPath,
+		"-driver", "kodo", "-endpoint", "unix://"+endpointPath, "-nodeid", "sanity",
+		"-kubeconfig", kubeconfigPath, "-connector-socket", connectorSocketPath,
+		"-kodo-reconcile-interval", "0", "-remount-interval", "0",
+		"-co", *co, "-publish-dir", workDir)
+	plugin.Env = append(os.Environ(), "KUBELET_ROOT_DIR="+filepath.Join(workDir, "kubelet"), "SERVICE_PORT="+strconv.Itoa(servicePort))
+	pluginLog, err := os.Create(filepath.Join(workDir, "plugin.log"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create plugin log: %w", err)
+	}
+	defer pluginLog.Close()
+	plugin.Stdout, plugin.Stderr = pluginLog, pluginLog
+	if err = plugin.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start plugin %s: %w", *pluginPath, err)
+	}
+	defer func() {
+		plugin.Process.Kill()
+		plugin.Wait()
+	}()
+	if err = waitForSocket(endpointPath, 30*time.Second); err != nil {
+		return 0, fmt.Errorf("plugin is not serving on %s, see %s: %w", endpointPath, pluginLog.Name(), err)
+	}
+
+	args := []string{
+		"--csi.endpoint", endpointPath,
+		"--csi.testvolumeparameters", parametersPath,
+		"--csi.secrets", secretsPath,
+		"--csi.mountdir", filepath.Join(workDir, "mount"),
+		"--csi.stagingdir", filepath.Join(workDir, "staging"),
+	}
+	if *co != "kubernetes" {
+		// No controller RPC is advertised without Kubernetes, while both the controller suite and the node suite
+		// expect at least one, so only the identity suite is run
+		args = append(args, "--ginkgo.focus", "Identity Service")
+	}
+	sanity := exec.Command(*csiSanityPath, append(args, sanityArgs...)...)
+	sanity.Stdout, sanity.Stderr = os.Stdout, os.Stderr
+	if err = sanity.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			log.Printf("csi-sanity: suite failed, logs of the plugin are in %s", pluginLog.Name())
+			return exitErr.ExitCode(), nil
+		}
+		return 0, fmt.Errorf("failed to run %s: %w", *csiSanityPath, err)
+	}
+	return 0, nil
+}
+
+// writeSecrets writes the secrets file of csi-sanity, which passes the same secrets to every RPC
+func writeSecrets(path string, secrets map[string]string) error {
+	var builder strings.Builder
+	for _, name := range []string{
+		"CreateVolumeSecret", "DeleteVolumeSecret", "ControllerPublishVolumeSecret", "ControllerUnpublishVolumeSecret",
+		"ControllerValidateVolumeCapabilitiesSecret", "NodeStageVolumeSecret", "NodePublishVolumeSecret",
+		"CreateSnapshotSecret", "DeleteSnapshotSecret", "ControllerExpandVolumeSecret", "NodeExpandVolumeSecret",
+		"ListSnapshotsSecret",
+	} {
+		builder.WriteString(name + ":\n")
+		for key, value := range secrets {
+			fmt.Fprintf(&builder, "  %s: %q\n", key, value)
+		}
+	}
+	return os.WriteFile(path, []byte(builder.String()), 0600)
+}
+
+func writeYAML(path string, values map[string]string) error {
+	var builder strings.Builder
+	for key, value := range values {
+		fmt.Fprintf(&builder, "%s: %q\n", key, value)
+	}
+	return os.WriteFile(path, []byte(builder.String()), 0600)
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitForSocket(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil
+		} else if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
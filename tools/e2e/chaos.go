@@ -0,0 +1,154 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/test/e2e/framework"
+	e2eskipper "k8s.io/kubernetes/test/e2e/framework/skipper"
+	admissionapi "k8s.io/pod-security-admission/api"
+)
+
+const (
+	chaosPodName   = "chaos"
+	fuseTypeRclone = "fuse.rclone"
+	// Name of the systemd service of the connector installed on the nodes by the plugin
+	connectorService = "csiplugin-connector"
+	// Longest time a single IO check in the chaos pod may take, it never returns on a stuck mount point
+	chaosIOTimeout = 30 * time.Second
+)
+
+// chaosFaults are injected on the node of the chaos pod one after another, each of them must be recovered by the driver
+var chaosFaults = []struct {
+	name string
+	args []string
+}{
+	// The mount point is disconnected, the connector restarts the mounter on it
+	{"kill rclone", []string{"pkill", "-KILL", "-x", "rclone"}},
+	// The mounters are killed together with the connector, the plugin mounts the disconnected mount points again
+	{"restart connector", []string{"systemctl", "restart", connectorService}},
+}
+
+// mountedScript succeeds only if the volume is mounted in the pod, the writes in between the unmount and the mount of a restarting mounter
+// go to the directory on the node, which makes the mounter refuse to mount on it
+var mountedScript = fmt.Sprintf(`[ "$(awk -v d=%s '$2 == d { fs = $3 } END { print fs }' /proc/mounts)" = %s ]`, volumeMountDir, fuseTypeRclone)
+
+var _ = framework.Describe("Kodo CSI driver chaos", framework.WithDisruptive(), func() {
+	f := framework.NewDefaultFramework("kodo-chaos")
+	f.NamespacePodSecurityLevel = admissionapi.LevelPrivileged
+
+	ginkgo.BeforeEach(func() {
+		if !*chaos {
+			e2eskipper.Skipf("Chaos is enabled by -chaos")
+		}
+	})
+
+	ginkgo.It("should recover the IO from the mounter killed and the connector restarted", func(ctx context.Context) {
+		_, v := newKodoVolumeResource(ctx, f)
+		framework.ExpectNoError(runChaos(ctx, v, *podImage, *stepTimeout))
+		framework.ExpectNoError(checkUnmounted(ctx, e2eCluster))
+	})
+})
+
+// runChaos injects the faults on the node while a pod keeps writing to the volume,
+// and checks the IO recovers after every fault without restarting the pod
+func runChaos(ctx context.Context, v *volume, image string, timeout time.Duration) error {
+	pod, err := v.startChaosPod(ctx, image, timeout)
+	if err != nil {
+		return err
+	}
+	if err = v.waitForIO(ctx, pod, "before chaos", timeout); err != nil {
+		return err
+	}
+	for _, fault := range chaosFaults {
+		ginkgo.By(fmt.Sprintf("Chaos: %s on node %s", fault.name, pod.Spec.NodeName))
+		if _, err = v.cluster.execOnNode(ctx, pod.Spec.NodeName, fault.args...); err != nil {
+			return fmt.Errorf("failed to %s: %w", fault.name, err)
+		}
+		if err = v.waitForIO(ctx, pod, "after "+fault.name, timeout); err != nil {
+			return err
+		}
+	}
+
+	current, err := v.cluster.clientset.CoreV1().Pods(v.namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get pod %s: %w", pod.Name, err)
+	} else if current.UID != pod.UID {
+		return fmt.Errorf("pod %s is recreated during chaos", pod.Name)
+	}
+	for _, status := range current.Status.ContainerStatuses {
+		if status.RestartCount > 0 {
+			return fmt.Errorf("container %s of pod %s is restarted %d times during chaos", status.Name, pod.Name, status.RestartCount)
+		}
+	}
+	return v.deletePod(ctx, pod.Name, timeout)
+}
+
+// startChaosPod starts the pod writing to the volume in a loop, which sees the mount points re-mounted on the node
+// since the volume is mounted with mountPropagation HostToContainer
+func (v *volume) startChaosPod(ctx context.Context, image string, timeout time.Duration) (*corev1.Pod, error) {
+	propagation := corev1.MountPropagationHostToContainer
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: chaosPodName, Namespace: v.namespace},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyAlways,
+			Containers: []corev1.Container{{
+				Name:  chaosPodName,
+				Image: image,
+				Command: []string{"sh", "-c", fmt.Sprintf(
+					"while true; do %s && dd if=/dev/urandom of=%s/chaos.bin bs=65536 count=16 2>/dev/null; sleep 1; done", mountedScript, volumeMountDir)},
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: volumeMountDir, MountPropagation: &propagation}},
+			}},
+			Volumes: []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: v.name},
+			}}},
+		},
+	}
+	if _, err := v.cluster.clientset.CoreV1().Pods(v.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create pod %s: %w", chaosPodName, err)
+	}
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		var err error
+		if pod, err = v.cluster.clientset.CoreV1().Pods(v.namespace).Get(ctx, chaosPodName, metav1.GetOptions{}); err != nil {
+			return false, err
+		}
+		return pod.Status.Phase == corev1.PodRunning, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pod %s is not running: %w", chaosPodName, err)
+	}
+	return pod, nil
+}
+
+// waitForIO waits until a file written through the volume in the pod is read back
+func (v *volume) waitForIO(ctx context.Context, pod *corev1.Pod, step string, timeout time.Duration) error {
+	token := strconv.FormatInt(time.Now().UnixNano(), 10)
+	script := fmt.Sprintf("%s && echo %s > %s/chaos-io && cat %s/chaos-io", mountedScript, token, volumeMountDir, volumeMountDir)
+	var lastErr error
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		execCtx, cancel := context.WithTimeout(ctx, chaosIOTimeout)
+		defer cancel()
+		output, err := run(execCtx, nil, "kubectl", "--kubeconfig", v.cluster.kubeconfigPath, "-n", pod.Namespace,
+			"exec", pod.Name, "--", "sh", "-c", script)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		} else if strings.TrimSpace(output) != token {
+			lastErr = fmt.Errorf("read %q, expected %q", output, token)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("IO on the volume is not recovered %s in %s: %v", step, timeout, lastErr)
+	}
+	framework.Logf("Chaos: IO on the volume succeeds %s", step)
+	return nil
+}
@@ -0,0 +1,134 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	pluginNamespace = "kube-system"
+	pluginDaemonSet = "kodo-csi-plugin"
+)
+
+// kindCluster is the kind cluster which the driver is deployed into
+type kindCluster struct {
+	name           string
+	kubeconfigPath string
+	clientset      *kubernetes.Clientset
+}
+
+// createKindCluster creates the kind cluster unless it exists already, writes its kubeconfig to the path,
+// and loads the image of the driver into its nodes
+func createKindCluster(ctx context.Context, name, image, kubeconfigPath string) (*kindCluster, error) {
+	output, err := run(ctx, nil, "kind", "get", "clusters")
+	if err != nil {
+		return nil, err
+	}
+	exists := false
+	for _, cluster := range strings.Fields(output) {
+		exists = exists || cluster == name
+	}
+	if exists {
+		framework.Logf("Reuse kind cluster %s", name)
+	} else if _, err = run(ctx, nil, "kind", "create", "cluster", "--name", name, "--wait", "5m"); err != nil {
+		return nil, err
+	}
+
+	cluster := &kindCluster{name: name, kubeconfigPath: kubeconfigPath}
+	if output, err = run(ctx, nil, "kind", "get", "kubeconfig", "--name", name); err != nil {
+		return nil, err
+	} else if err = os.WriteFile(cluster.kubeconfigPath, []byte(output), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write kubeconfig: %w", err)
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", cluster.kubeconfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig of kind cluster %s: %w", name, err)
+	}
+	if cluster.clientset, err = kubernetes.NewForConfig(config); err != nil {
+		return nil, err
+	}
+	if _, err = run(ctx, nil, "kind", "load", "docker-image", image, "--name", name); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+func (cluster *kindCluster) delete(ctx context.Context) error {
+	_, err := run(ctx, nil, "kind", "delete", "cluster", "--name", cluster.name)
+	return err
+}
+
+// nodes returns the names of the kind nodes, which are also the names of their docker containers
+func (cluster *kindCluster) nodes(ctx context.Context) ([]string, error) {
+	output, err := run(ctx, nil, "kind", "get", "nodes", "--name", cluster.name)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(output), nil
+}
+
+// execOnNode runs the command on the kind node, which is the host of the connector and the mounters
+func (cluster *kindCluster) execOnNode(ctx context.Context, node string, args ...string) (string, error) {
+	return run(ctx, nil, "docker", append([]string{"exec", node}, args...)...)
+}
+
+// deployDriver applies the manifests of the Kodo driver rendered by the plugin binary with the image loaded into the nodes,
+// and waits for the plugin to be ready
+func (cluster *kindCluster) deployDriver(ctx context.Context, pluginBinary, image, workDir string, timeout time.Duration) error {
+	manifestsDir := filepath.Join(workDir, "manifests")
+	// The provisioner isn't deployed since the volume is provisioned statically
+	if _, err := run(ctx, nil, pluginBinary, "install", "render", "-driver", "kodo", "-namespace", pluginNamespace,
+		"-image", image, "-image-pull-policy", "IfNotPresent", "-output-dir", manifestsDir); err != nil {
+		return fmt.Errorf("failed to render manifests: %w", err)
+	}
+	for _, manifest := range []string{"kodo-rbac.yaml", "kodo-plugin.yaml"} {
+		if _, err := run(ctx, nil, "kubectl", "--kubeconfig", cluster.kubeconfigPath, "apply", "-f", filepath.Join(manifestsDir, "kodo", manifest)); err != nil {
+			return err
+		}
+	}
+	// The plugin restarts with the new image if it's deployed already
+	if _, err := run(ctx, nil, "kubectl", "--kubeconfig", cluster.kubeconfigPath, "-n", pluginNamespace,
+		"rollout", "restart", "daemonset/"+pluginDaemonSet); err != nil {
+		return err
+	}
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		daemonSet, err := cluster.clientset.AppsV1().DaemonSets(pluginNamespace).Get(ctx, pluginDaemonSet, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return daemonSetReady(daemonSet), nil
+	})
+}
+
+func daemonSetReady(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+	return status.ObservedGeneration >= daemonSet.Generation && status.DesiredNumberScheduled > 0 &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled && status.NumberReady == status.DesiredNumberScheduled
+}
+
+// run runs the command with the stdin, and returns its stdout, or an error with its stderr if it fails
+func run(ctx context.Context, stdin []byte, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,124 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/onsi/ginkgo/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/kubernetes/test/e2e/framework"
+	e2evolume "k8s.io/kubernetes/test/e2e/framework/volume"
+	storageframework "k8s.io/kubernetes/test/e2e/storage/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testsuites"
+	admissionapi "k8s.io/pod-security-admission/api"
+)
+
+const kodoDriverName = "kodoplugin.storage.qiniu.com"
+
+// kodoTestSuites are run against the Kodo driver, the suites of the features it doesn't support skip themselves by its capabilities
+var kodoTestSuites = []func() storageframework.TestSuite{
+	testsuites.InitVolumesTestSuite,
+	testsuites.InitVolumeIOTestSuite,
+}
+
+// kodoDriver is the storage framework test driver of the Kodo driver, whose volumes are pre-provisioned on the buckets of minio,
+// since dynamic provisioning needs the UC and IAM APIs of Kodo
+type kodoDriver struct {
+	driverInfo storageframework.DriverInfo
+	// Deployed by BeforeSuite
+	minio *minio
+	// Number of the volumes created so far, which makes the names of their buckets unique
+	volumes atomic.Int64
+}
+
+// kodoVolume is the bucket of a pre-provisioned volume, which is removed once the PV is deleted
+type kodoVolume struct {
+	minio  *minio
+	bucket string
+}
+
+var kodo = &kodoDriver{driverInfo: storageframework.DriverInfo{
+	Name:        kodoDriverName,
+	MaxFileSize: storageframework.FileSizeMedium,
+	// The capacity of the PV is never enforced on the bucket
+	SupportedSizeRange: e2evolume.SizeRange{Min: "1Gi"},
+	SupportedFsType:    sets.NewString(""),
+	Capabilities: map[storageframework.Capability]bool{
+		storageframework.CapPersistence: true,
+		storageframework.CapRWX:         true,
+		storageframework.CapMultiPODs:   true,
+		// rclone mounts the files without the executable bit
+		storageframework.CapExec: false,
+	},
+}}
+
+var _ storageframework.PreprovisionedPVTestDriver = kodo
+
+func (d *kodoDriver) GetDriverInfo() *storageframework.DriverInfo {
+	return &d.driverInfo
+}
+
+func (d *kodoDriver) SkipUnsupportedTest(pattern storageframework.TestPattern) {}
+
+func (d *kodoDriver) PrepareTest(ctx context.Context, f *framework.Framework) *storageframework.PerTestConfig {
+	return &storageframework.PerTestConfig{Driver: d, Prefix: "kodo", Framework: f}
+}
+
+func (d *kodoDriver) CreateVolume(ctx context.Context, config *storageframework.PerTestConfig, volumeType storageframework.TestVolType) storageframework.TestVolume {
+	bucket := fmt.Sprintf("%s-%d", config.Framework.Namespace.Name, d.volumes.Add(1))
+	framework.ExpectNoError(d.minio.createBucket(ctx, bucket, *stepTimeout), "failed to create bucket %s", bucket)
+	return &kodoVolume{minio: d.minio, bucket: bucket}
+}
+
+func (d *kodoDriver) GetPersistentVolumeSource(readOnly bool, fsType string, testVolume storageframework.TestVolume) (*corev1.PersistentVolumeSource, *corev1.VolumeNodeAffinity) {
+	v := testVolume.(*kodoVolume)
+	return &corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+		Driver:       kodoDriverName,
+		VolumeHandle: v.bucket,
+		ReadOnly:     readOnly,
+		VolumeAttributes: map[string]string{
+			"bucketid":   v.bucket,
+			"s3endpoint": v.minio.endpoint,
+			"s3region":   minioRegion,
+		},
+		NodePublishSecretRef: &corev1.SecretReference{Namespace: v.minio.namespace, Name: v.minio.secretName},
+	}}, nil
+}
+
+func (v *kodoVolume) DeleteVolume(ctx context.Context) {
+	framework.ExpectNoError(v.minio.removeBucket(ctx, v.bucket, *stepTimeout), "failed to remove bucket %s", v.bucket)
+}
+
+// newKodoVolumeResource creates the PV on a new bucket and the PVC bound to it, which are deleted after the test
+func newKodoVolumeResource(ctx context.Context, f *framework.Framework) (*storageframework.VolumeResource, *volume) {
+	resource := storageframework.CreateVolumeResource(ctx, kodo, kodo.PrepareTest(ctx, f), storageframework.DefaultFsPreprovisionedPV, e2evolume.SizeRange{})
+	ginkgo.DeferCleanup(resource.CleanupResource)
+	return resource, &volume{cluster: e2eCluster, namespace: f.Namespace.Name, name: resource.Pvc.Name}
+}
+
+var _ = ginkgo.Describe("Kodo CSI driver", func() {
+	storageframework.DefineTestSuites(kodo, kodoTestSuites)
+
+	ginkgo.Context("bucket", func() {
+		f := framework.NewDefaultFramework("kodo-bucket")
+		f.NamespacePodSecurityLevel = admissionapi.LevelPrivileged
+
+		ginkgo.It("should upload the files written through the volume to the bucket", func(ctx context.Context) {
+			resource, v := newKodoVolumeResource(ctx, f)
+			const message = "hello from qiniu csi e2e"
+			_, err := v.runPod(ctx, "writer", *podImage, fmt.Sprintf("echo '%s' > %s/hello.txt", message, volumeMountDir), *stepTimeout)
+			framework.ExpectNoError(err, "failed to write files")
+			framework.ExpectNoError(checkUnmounted(ctx, e2eCluster))
+
+			bucket := resource.Volume.(*kodoVolume).bucket
+			output, err := kodo.minio.object(ctx, bucket, "hello.txt", *stepTimeout)
+			framework.ExpectNoError(err)
+			if strings.TrimSpace(output) != message {
+				framework.Failf("unexpected object hello.txt in bucket %s: %q", bucket, output)
+			}
+		})
+	})
+})
@@ -0,0 +1,37 @@
+package e2e
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+func TestMain(m *testing.M) {
+	framework.RegisterCommonFlags(flag.CommandLine)
+	framework.RegisterClusterFlags(flag.CommandLine)
+	flag.Parse()
+
+	// The framework falls back to a default host after reading the flags unless the kubeconfig is given,
+	// so the kubeconfig of the kind cluster created by BeforeSuite is written to the path decided beforehand
+	kubeconfigDir, err := os.MkdirTemp("", "qiniu-csi-e2e-kubeconfig-")
+	if err != nil {
+		log.Fatalf("e2e: failed to create directory of kubeconfig: %s", err)
+	}
+	framework.TestContext.KubeConfig = filepath.Join(kubeconfigDir, "kubeconfig")
+	framework.AfterReadingAllFlags(&framework.TestContext)
+
+	code := m.Run()
+	os.RemoveAll(kubeconfigDir)
+	os.Exit(code)
+}
+
+func TestE2E(t *testing.T) {
+	gomega.RegisterFailHandler(framework.Fail)
+	ginkgo.RunSpecs(t, "Qiniu CSI e2e suite")
+}
@@ -0,0 +1,143 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	minioName      = "minio"
+	minioAccessKey = "e2e-access-key"
+	minioSecretKey = "e2e-secret-key"
+	minioRegion    = "us-east-1"
+	minioPort      = 9000
+)
+
+// minio is the S3-compatible backend of the volumes, which stands in for Kodo
+type minio struct {
+	cluster   *kindCluster
+	namespace string
+	mcImage   string
+	// Reachable from the pods and from the mounters running on the nodes, which don't resolve the cluster DNS
+	endpoint string
+	// Secret of the credentials of minio in the namespace, which is the node publish secret of the volumes
+	secretName string
+}
+
+func deployMinio(ctx context.Context, cluster *kindCluster, namespace, image, mcImage string, timeout time.Duration) (*minio, error) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: minioName, Namespace: namespace},
+		StringData: map[string]string{"accesskey": minioAccessKey, "secretkey": minioSecretKey},
+	}
+	if _, err := cluster.clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create minio secret: %w", err)
+	}
+	labels := map[string]string{"app": minioName}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: minioName, Namespace: namespace},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name:  minioName,
+					Image: image,
+					Args:  []string{"server", "/data"},
+					Env: []corev1.EnvVar{
+						{Name: "MINIO_ROOT_USER", Value: minioAccessKey},
+						{Name: "MINIO_ROOT_PASSWORD", Value: minioSecretKey},
+						{Name: "MINIO_REGION", Value: minioRegion},
+					},
+					Ports: []corev1.ContainerPort{{ContainerPort: minioPort}},
+					ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+						Path: "/minio/health/ready", Port: intstr.FromInt(minioPort),
+					}}},
+				}}},
+			},
+		},
+	}
+	if _, err := cluster.clientset.AppsV1().Deployments(namespace).Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create minio deployment: %w", err)
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: minioName, Namespace: namespace},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports:    []corev1.ServicePort{{Port: minioPort, TargetPort: intstr.FromInt(minioPort)}},
+		},
+	}
+	service, err := cluster.clientset.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create minio service: %w", err)
+	}
+	if err = wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		deployment, err := cluster.clientset.AppsV1().Deployments(namespace).Get(ctx, minioName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return deployment.Status.ReadyReplicas > 0, nil
+	}); err != nil {
+		return nil, fmt.Errorf("minio is not ready: %w", err)
+	}
+	return &minio{
+		cluster:    cluster,
+		namespace:  namespace,
+		mcImage:    mcImage,
+		endpoint:   fmt.Sprintf("http://%s:%d", service.Spec.ClusterIP, minioPort),
+		secretName: secret.Name,
+	}, nil
+}
+
+// mc runs the mc commands in a job with the alias e2e of minio configured, and returns the logs of the job.
+// The name of the job must be unique in the suite.
+func (m *minio) mc(ctx context.Context, name, script string, timeout time.Duration) (string, error) {
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: m.namespace},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    "mc",
+						Image:   m.mcImage,
+						Command: []string{"sh", "-c", fmt.Sprintf("mc alias set e2e %s %s %s >/dev/null && %s", m.endpoint, minioAccessKey, minioSecretKey, script)},
+					}},
+				},
+			},
+		},
+	}
+	if _, err := m.cluster.clientset.BatchV1().Jobs(m.namespace).Create(ctx, job, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create job %s: %w", name, err)
+	}
+	pod, err := waitForPodOf(ctx, m.cluster, m.namespace, "job-name="+name, timeout)
+	if err != nil {
+		return "", fmt.Errorf("job %s failed: %w", name, err)
+	}
+	return podLogs(ctx, m.cluster, pod)
+}
+
+func (m *minio) createBucket(ctx context.Context, bucket string, timeout time.Duration) error {
+	_, err := m.mc(ctx, "mb-"+bucket, "mc mb e2e/"+bucket, timeout)
+	return err
+}
+
+// removeBucket removes the bucket with the objects in it
+func (m *minio) removeBucket(ctx context.Context, bucket string, timeout time.Duration) error {
+	_, err := m.mc(ctx, "rb-"+bucket, "mc rb --force e2e/"+bucket, timeout)
+	return err
+}
+
+// object returns the content of the object, which is written through the volume
+func (m *minio) object(ctx context.Context, bucket, key string, timeout time.Duration) (string, error) {
+	return m.mc(ctx, "cat-"+bucket, fmt.Sprintf("mc cat e2e/%s/%s", bucket, key), timeout)
+}
@@ -0,0 +1,90 @@
+// Package e2e runs the storage test suites of the Kubernetes e2e framework against the Kodo driver,
+// which is deployed into a kind cluster with minio as the S3-compatible backend.
+// With -chaos, it also checks the volume recovers from the mounter killed and the connector restarted during IO.
+package e2e
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const pollInterval = 2 * time.Second
+
+var (
+	image        = flag.String("image", "kodoproduct/csi-plugin.storage.qiniu.com:e2e", "Image of the driver built locally, which is loaded into the kind nodes")
+	clusterName  = flag.String("cluster-name", "qiniu-csi-e2e", "Name of the kind cluster, which is reused if exists")
+	keepCluster  = flag.Bool("keep-cluster", false, "Keep the kind cluster and the namespaces of the suite after it exits")
+	pluginBinary = flag.String("plugin", "../../plugin/plugin.storage.qiniu.com", "Plugin binary built locally, which renders the manifests of the Kodo driver")
+	minioImage   = flag.String("minio-image", "minio/minio:RELEASE.2022-10-24T18-35-07Z", "Image of minio")
+	mcImage      = flag.String("mc-image", "minio/mc:RELEASE.2022-10-22T03-39-29Z", "Image of minio client")
+	podImage     = flag.String("pod-image", "busybox:1.35", "Image of the pods doing IO on the volume outside of the storage test suites")
+	stepTimeout  = flag.Duration("step-timeout", 5*time.Minute, "How long to wait for each step outside of the storage test suites")
+	chaos        = flag.Bool("chaos", false, "Also kill the mounter and restart the connector while a pod is writing to the volume, and check the IO recovers without restarting the pod")
+)
+
+// e2eCluster is created by BeforeSuite, with its kubeconfig written to the path the framework loads
+var e2eCluster *kindCluster
+
+var _ = ginkgo.BeforeSuite(func(ctx context.Context) {
+	workDir, err := os.MkdirTemp("", "qiniu-csi-e2e-")
+	framework.ExpectNoError(err, "failed to create working directory")
+	ginkgo.DeferCleanup(os.RemoveAll, workDir)
+
+	ginkgo.By(fmt.Sprintf("Creating kind cluster %s and loading image %s", *clusterName, *image))
+	cluster, err := createKindCluster(ctx, *clusterName, *image, framework.TestContext.KubeConfig)
+	framework.ExpectNoError(err)
+	if !*keepCluster {
+		ginkgo.DeferCleanup(func(ctx context.Context) error {
+			return cluster.delete(ctx)
+		})
+	}
+	e2eCluster = cluster
+
+	ginkgo.By("Deploying driver rendered by " + *pluginBinary)
+	framework.ExpectNoError(cluster.deployDriver(ctx, *pluginBinary, *image, workDir, *stepTimeout), "failed to deploy driver")
+
+	// Outlives the namespaces of the tests, since the PVs of all of them refer to the secret of minio
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "qiniu-csi-e2e-minio-"}}
+	namespace, err = cluster.clientset.CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{})
+	framework.ExpectNoError(err, "failed to create namespace of minio")
+	if !*keepCluster {
+		ginkgo.DeferCleanup(func(ctx context.Context) error {
+			return cluster.clientset.CoreV1().Namespaces().Delete(ctx, namespace.Name, metav1.DeleteOptions{})
+		})
+	}
+	ginkgo.By("Deploying minio in namespace " + namespace.Name)
+	kodo.minio, err = deployMinio(ctx, cluster, namespace.Name, *minioImage, *mcImage, *stepTimeout)
+	framework.ExpectNoError(err)
+})
+
+var _ = ginkgo.AfterSuite(func(ctx context.Context) {
+	if e2eCluster != nil {
+		framework.ExpectNoError(checkUnmounted(ctx, e2eCluster))
+	}
+})
+
+// checkUnmounted checks no rclone mount point is left on the nodes once the pods are deleted
+func checkUnmounted(ctx context.Context, cluster *kindCluster) error {
+	nodes, err := cluster.nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		output, err := cluster.execOnNode(ctx, node, "sh", "-c", "findmnt -n -t "+fuseTypeRclone+" -o TARGET || true")
+		if err != nil {
+			return err
+		} else if mounts := strings.TrimSpace(output); mounts != "" {
+			return fmt.Errorf("volume is still mounted on node %s after the pod is deleted: %s", node, mounts)
+		}
+	}
+	return nil
+}
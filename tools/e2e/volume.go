@@ -0,0 +1,121 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Where the pods of the suite mount the volume
+const volumeMountDir = "/data"
+
+// volume is the PVC of a Kodo volume, which the pods of the suite mount
+type volume struct {
+	cluster   *kindCluster
+	namespace string
+	name      string
+}
+
+// runPod runs the script in a pod mounting the volume on /data until it succeeds, then deletes the pod to unmount the volume.
+// The logs of the pod are returned.
+func (v *volume) runPod(ctx context.Context, name, image, script string, timeout time.Duration) (string, error) {
+	labels := map[string]string{"e2e-pod": name}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: v.namespace, Labels: labels},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:         name,
+				Image:        image,
+				Command:      []string{"sh", "-c", script},
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: volumeMountDir}},
+			}},
+			Volumes: []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: v.name},
+			}}},
+		},
+	}
+	if _, err := v.cluster.clientset.CoreV1().Pods(v.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create pod %s: %w", name, err)
+	}
+	pod, err := waitForPodOf(ctx, v.cluster, v.namespace, "e2e-pod="+name, timeout)
+	if err != nil {
+		return "", err
+	}
+	logs, err := podLogs(ctx, v.cluster, pod)
+	if err != nil {
+		return "", err
+	}
+	if err = v.deletePod(ctx, name, timeout); err != nil {
+		return "", err
+	}
+	return logs, nil
+}
+
+// deletePod deletes the pod and waits until it's gone, so that the volume is unmounted
+func (v *volume) deletePod(ctx context.Context, name string, timeout time.Duration) error {
+	if err := deleteAndWait(ctx, timeout, func() error {
+		return v.cluster.clientset.CoreV1().Pods(v.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	}, func() error {
+		_, err := v.cluster.clientset.CoreV1().Pods(v.namespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	}); err != nil {
+		return fmt.Errorf("pod %s is not deleted: %w", name, err)
+	}
+	return nil
+}
+
+// waitForPodOf waits for the pod selected by the label selector to succeed
+func waitForPodOf(ctx context.Context, cluster *kindCluster, namespace, selector string, timeout time.Duration) (*corev1.Pod, error) {
+	var succeeded *corev1.Pod
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		pods, err := cluster.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		for i := range pods.Items {
+			switch pod := &pods.Items[i]; pod.Status.Phase {
+			case corev1.PodSucceeded:
+				succeeded = pod
+				return true, nil
+			case corev1.PodFailed:
+				logs, _ := podLogs(ctx, cluster, pod)
+				return false, fmt.Errorf("pod %s failed: %s", pod.Name, strings.TrimSpace(logs))
+			}
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		err = fmt.Errorf("no pod of %s succeeded in %s, see kubectl describe pods -n %s -l %s", selector, timeout, namespace, selector)
+	}
+	return succeeded, err
+}
+
+func podLogs(ctx context.Context, cluster *kindCluster, pod *corev1.Pod) (string, error) {
+	logs, err := cluster.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get logs of pod %s: %w", pod.Name, err)
+	}
+	return string(logs), nil
+}
+
+// deleteAndWait deletes the object and waits until get returns not found
+func deleteAndWait(ctx context.Context, timeout time.Duration, delete, get func() error) error {
+	if err := delete(); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		if err := get(); apierrors.IsNotFound(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		return false, nil
+	})
+}